@@ -2,7 +2,9 @@ package chatauth
 
 import (
   crand "crypto/rand"
+  "fmt"
   "math/rand"
+  "sync"
   "golang.org/x/crypto/bcrypt"
 )
 // This file provides helper functions for handling user authentication.
@@ -13,7 +15,9 @@ import (
 //  creating and invalidating session tokens, etc.)
 
 // For brcypt, controls how "difficult" it is to brute force the hash.
-const HASH_COST = 14
+// This is the default, callers can pick any cost ValidateHashCost accepts
+// (e.g. a low one to keep tests fast).
+const DEFAULT_HASH_COST = 14
 
 // Returns a random string of the given length in bytes.
 func generateRandomBytes(numBytes int) []byte {
@@ -32,13 +36,26 @@ func GenerateSalt(numBytes int) []byte {
   return generateRandomBytes(numBytes)
 }
 
-// Given a salt and a password, generate the hash.
-func HashPasswordWithSalt(password string) ([]byte, error) {
-  hash, err := bcrypt.GenerateFromPassword([]byte(password), HASH_COST)
+// Returns an error if bcrypt doesn't support the given cost.
+func ValidateHashCost(cost int) error {
+  if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+    return fmt.Errorf("hash cost should be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+  }
+  return nil
+}
+
+// Given a password and bcrypt cost, generate the hash.
+// bcrypt generates a random salt and embeds it in the returned hash, so the
+// hash is the only thing that needs to be stored to authenticate later.
+func HashPasswordWithSalt(password string, cost int) ([]byte, error) {
+  if err := ValidateHashCost(cost); err != nil {
+    return nil, err
+  }
+  hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
   return hash, err
 }
 
-// Given a password, salt and hash, return token if correct, otherwise error.
+// Given a password and hash, return token if correct, otherwise error.
 // This token can be used to validate future requests from this user for the
 // remainder of their session (although that is not implemented in this project).
 func Authenticate(password string, hash []byte) ([]byte, error) {
@@ -48,3 +65,25 @@ func Authenticate(password string, hash []byte) ([]byte, error) {
   // Password is good, return a token (256 bits).
   return generateRandomBytes(32), nil
 }
+
+// Hashes of a random password, by cost, for AuthenticateDummy.
+var dummyHashes = make(map[int][]byte)
+var dummyHashesMutex sync.Mutex
+
+// Compares the password against a hash no password matches, taking about as
+// long as Authenticate does for a hash of the given cost. Call it when the
+// user doesn't exist, so response times don't reveal which usernames do.
+func AuthenticateDummy(password string, cost int) {
+  dummyHashesMutex.Lock()
+  hash, ok := dummyHashes[cost]
+  if !ok {
+    var err error
+    if hash, err = HashPasswordWithSalt(string(generateRandomBytes(16)), cost); err != nil {
+      dummyHashesMutex.Unlock()
+      return
+    }
+    dummyHashes[cost] = hash
+  }
+  dummyHashesMutex.Unlock()
+  bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
@@ -0,0 +1,79 @@
+package chatauth
+
+import (
+  "testing"
+  "golang.org/x/crypto/bcrypt"
+)
+
+// The lowest cost bcrypt allows, to keep tests fast.
+const TEST_HASH_COST = bcrypt.MinCost
+
+func TestHashPasswordWithSaltRoundTrip(t *testing.T) {
+  hash, err := HashPasswordWithSalt("super-secret", TEST_HASH_COST)
+  if err != nil {
+    t.Fatalf("HashPasswordWithSalt: %s", err.Error())
+  }
+  token, err := Authenticate("super-secret", hash)
+  if err != nil {
+    t.Fatalf("Authenticate with the right password: %s", err.Error())
+  }
+  if len(token) != 32 {
+    t.Errorf("got a %d byte token, want 32", len(token))
+  }
+  if _, err := Authenticate("wrong-password", hash); err == nil {
+    t.Errorf("Authenticate with the wrong password succeeded")
+  }
+}
+
+func TestHashPasswordWithSaltUsesFreshSalt(t *testing.T) {
+  first, err := HashPasswordWithSalt("super-secret", TEST_HASH_COST)
+  if err != nil {
+    t.Fatalf("HashPasswordWithSalt: %s", err.Error())
+  }
+  second, err := HashPasswordWithSalt("super-secret", TEST_HASH_COST)
+  if err != nil {
+    t.Fatalf("HashPasswordWithSalt: %s", err.Error())
+  }
+  if string(first) == string(second) {
+    t.Errorf("hashing the same password twice gave the same hash")
+  }
+}
+
+func TestHashPasswordWithSaltRejectsBadCost(t *testing.T) {
+  for _, cost := range []int{bcrypt.MinCost - 1, bcrypt.MaxCost + 1} {
+    if _, err := HashPasswordWithSalt("super-secret", cost); err == nil {
+      t.Errorf("cost %d: got no error", cost)
+    }
+  }
+}
+
+func TestAuthenticateDummyNeverPanics(t *testing.T) {
+  // Called once to fill the cache and once to use it.
+  AuthenticateDummy("super-secret", TEST_HASH_COST)
+  AuthenticateDummy("super-secret", TEST_HASH_COST)
+  // An invalid cost is ignored rather than hashing.
+  AuthenticateDummy("super-secret", bcrypt.MaxCost + 1)
+}
+
+func TestValidateHashCost(t *testing.T) {
+  for _, cost := range []int{bcrypt.MinCost, DEFAULT_HASH_COST, bcrypt.MaxCost} {
+    if err := ValidateHashCost(cost); err != nil {
+      t.Errorf("cost %d: %s", cost, err.Error())
+    }
+  }
+  for _, cost := range []int{0, bcrypt.MinCost - 1, bcrypt.MaxCost + 1} {
+    if err := ValidateHashCost(cost); err == nil {
+      t.Errorf("cost %d: got no error", cost)
+    }
+  }
+}
+
+func TestHashPasswordWithSaltUsesCost(t *testing.T) {
+  hash, err := HashPasswordWithSalt("super-secret", TEST_HASH_COST + 1)
+  if err != nil {
+    t.Fatalf("HashPasswordWithSalt: %s", err.Error())
+  }
+  if cost, err := bcrypt.Cost(hash); err != nil || cost != TEST_HASH_COST + 1 {
+    t.Errorf("got cost %d (%v), want %d", cost, err, TEST_HASH_COST + 1)
+  }
+}
@@ -0,0 +1,78 @@
+package chatauth
+
+import (
+  "errors"
+  "fmt"
+  "unicode"
+)
+
+// bcrypt only looks at the first 72 bytes of a password, so longer ones
+// would give a false sense of security.
+const MAX_PASSWORD_LENGTH = 72
+
+// Default password requirements.
+const DEFAULT_MIN_PASSWORD_LENGTH = 8
+const DEFAULT_REQUIRE_MIXED_CLASSES = true
+
+// PasswordPolicy describes what makes a password acceptable.
+type PasswordPolicy struct {
+  // Minimum length in bytes, at least 1.
+  MinLength int
+  // Whether passwords need characters from at least two of letters, digits
+  // and symbols, which rules out e.g. all-numeric passwords.
+  RequireMixedClasses bool
+}
+
+// Factory for a policy with the default requirements.
+func DefaultPasswordPolicy() *PasswordPolicy {
+  return &PasswordPolicy{
+    MinLength: DEFAULT_MIN_PASSWORD_LENGTH,
+    RequireMixedClasses: DEFAULT_REQUIRE_MIXED_CLASSES,
+  }
+}
+
+// Returns an error if the policy's settings don't make sense.
+func (policy *PasswordPolicy) Check() error {
+  if policy.MinLength < 1 || policy.MinLength > MAX_PASSWORD_LENGTH {
+    return fmt.Errorf("minimum password length should be between 1 and %d", MAX_PASSWORD_LENGTH)
+  }
+  return nil
+}
+
+// Returns an error saying why the password doesn't meet the policy.
+func (policy *PasswordPolicy) Validate(password string) error {
+  if len(password) < policy.MinLength {
+    return fmt.Errorf("password should be at least %d characters", policy.MinLength)
+  }
+  if len(password) > MAX_PASSWORD_LENGTH {
+    return fmt.Errorf("password should be at most %d characters", MAX_PASSWORD_LENGTH)
+  }
+  if policy.RequireMixedClasses {
+    var hasLetter, hasDigit, hasSymbol bool
+    for _, c := range password {
+      switch {
+      case unicode.IsLetter(c):
+        hasLetter = true
+      case unicode.IsDigit(c):
+        hasDigit = true
+      default:
+        hasSymbol = true
+      }
+    }
+    classes := 0
+    for _, has := range []bool{hasLetter, hasDigit, hasSymbol} {
+      if has {
+        classes++
+      }
+    }
+    if classes < 2 {
+      return errors.New("password should mix at least two of letters, digits and symbols")
+    }
+  }
+  return nil
+}
+
+// Returns an error saying why the password doesn't meet the default policy.
+func ValidatePassword(password string) error {
+  return DefaultPasswordPolicy().Validate(password)
+}
@@ -0,0 +1,55 @@
+package chatauth
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestValidatePassword(t *testing.T) {
+  tests := []struct {
+    name string
+    password string
+    ok bool
+  }{
+    {"too short", "abc123", false},
+    {"all numeric", "1234567890", false},
+    {"all letters", "passwordpassword", false},
+    {"letters and digits", "super-secret1", true},
+    {"letters and symbols", "super-secret", true},
+    {"exactly the minimum", "abcdefg1", true},
+    {"exactly the maximum", strings.Repeat("a1", MAX_PASSWORD_LENGTH / 2), true},
+    {"too long", strings.Repeat("a1", MAX_PASSWORD_LENGTH / 2) + "a", false},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      err := ValidatePassword(test.password)
+      if test.ok && err != nil {
+        t.Errorf("got error %s, want none", err.Error())
+      }
+      if !test.ok && err == nil {
+        t.Errorf("got no error")
+      }
+    })
+  }
+}
+
+func TestPasswordPolicyWithoutMixedClasses(t *testing.T) {
+  policy := &PasswordPolicy{MinLength: 4}
+  if err := policy.Validate("1234"); err != nil {
+    t.Errorf("all numeric password rejected: %s", err.Error())
+  }
+  if err := policy.Validate("123"); err == nil {
+    t.Errorf("too short password accepted")
+  }
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+  if err := DefaultPasswordPolicy().Check(); err != nil {
+    t.Errorf("default policy: %s", err.Error())
+  }
+  for _, minLength := range []int{0, MAX_PASSWORD_LENGTH + 1} {
+    if err := (&PasswordPolicy{MinLength: minLength}).Check(); err == nil {
+      t.Errorf("minimum length %d: got no error", minLength)
+    }
+  }
+}
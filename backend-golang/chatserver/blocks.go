@@ -0,0 +1,155 @@
+package chatserver
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+)
+
+// Struct for decoding JSON body for POST and DELETE requests at /users/block.
+type blockStruct struct {
+  Blocker string
+  Blocked string
+}
+
+// Request handler for /users/block.
+func (server *ChatServer) handleBlocks(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodPost:
+    server.blockUser(w, r)
+  case http.MethodDelete:
+    server.unblockUser(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at /users/block, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only POST and DELETE requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Request handler for /users/blocked.
+func (server *ChatServer) handleBlocked(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodGet:
+    server.fetchBlockedUsers(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at /users/blocked, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only GET requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Blocks a user from sending direct messages to another. Messages they
+// already sent stay, and both can still fetch them. Rooms they share aren't
+// affected.
+// Expects a POST to /users/block with the following parameters in the body:
+// - blocker: username of the user doing the blocking
+// - blocked: username of the user to block
+// Blocking someone twice has no further effect. Messages from the blocked
+// user to the blocker get a 403 with code blocked.
+//
+// Sample curl request:
+// curl -d '{"blocker":"user1", "blocked":"user2"}' -H "Content-Type: application/json" -X POST localhost:18000/users/block
+func (server *ChatServer) blockUser(w http.ResponseWriter, r *http.Request) {
+  body, err := parseBlock(r)
+  if err != nil {
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf("bad POST request at /users/block, %s", err.Error()), code)
+    return
+  }
+  server.logger.Debugf("Received POST at /users/block for %s blocking %s", body.Blocker, body.Blocked)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  if err := server.db.BlockUser(ctx, body.Blocker, body.Blocked); err != nil {
+    server.logger.Errorf("Error blocking user in db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't block user: %s", err.Error()), codeForError(err))
+    return
+  }
+  server.writeBlockResponse(w, body)
+}
+
+// Unblocks a user, so they can send direct messages to the blocker again.
+// Expects a DELETE to /users/block with the same body as blockUser.
+// Unblocking someone who isn't blocked has no effect.
+//
+// Sample curl request:
+// curl -d '{"blocker":"user1", "blocked":"user2"}' -H "Content-Type: application/json" -X DELETE localhost:18000/users/block
+func (server *ChatServer) unblockUser(w http.ResponseWriter, r *http.Request) {
+  body, err := parseBlock(r)
+  if err != nil {
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf("bad DELETE request at /users/block, %s", err.Error()), code)
+    return
+  }
+  server.logger.Debugf("Received DELETE at /users/block for %s unblocking %s", body.Blocker, body.Blocked)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  if err := server.db.UnblockUser(ctx, body.Blocker, body.Blocked); err != nil {
+    server.logger.Errorf("Error unblocking user in db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't unblock user: %s", err.Error()), codeForError(err))
+    return
+  }
+  server.writeBlockResponse(w, body)
+}
+
+// Helper function to parse requests to /users/block.
+func parseBlock(r *http.Request) (*blockStruct, error) {
+  var body blockStruct
+  if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+    return nil, bodyReadError(err, errors.New("couldn't decode JSON"))
+  }
+  if len(body.Blocker) < 1 || len(body.Blocked) < 1 {
+    return nil, errors.New("blocker and blocked are required")
+  }
+  if body.Blocker == body.Blocked {
+    return nil, errors.New("users can't block themselves")
+  }
+  return &body, nil
+}
+
+// Responds to a successful block or unblock with the two usernames.
+func (server *ChatServer) writeBlockResponse(w http.ResponseWriter, body *blockStruct) {
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(map[string]string{
+    "blocker": body.Blocker,
+    "blocked": body.Blocked,
+  }); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Lists the users a user has blocked, in alphabetical order.
+// Expects a GET to /users/blocked with the following query parameters:
+// - user: username of the blocker
+//
+// Sample curl request:
+// curl "localhost:18000/users/blocked?user=user1"
+func (server *ChatServer) fetchBlockedUsers(w http.ResponseWriter, r *http.Request) {
+  params := r.URL.Query()
+  if len(params["user"]) != 1 || len(params.Get("user")) < 1 {
+    errorResponse(w, http.StatusBadRequest, "bad GET request at /users/blocked, expected exactly one user", ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  username := params.Get("user")
+  server.logger.Debugf("Received GET at /users/blocked for %s", username)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  usernames, err := server.db.FetchBlockedUsers(ctx, username)
+  if err != nil {
+    server.logger.Errorf("Error fetching blocked users from db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't fetch blocked users: %s", err.Error()), codeForError(err))
+    return
+  }
+  // Always respond with an array, even if no one is blocked.
+  if usernames == nil {
+    usernames = []string{}
+  }
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(usernames); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
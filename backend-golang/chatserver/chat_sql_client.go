@@ -1,229 +1,1702 @@
 package chatserver
 
 import (
+  "context"
   "database/sql"
   "errors"
   "fmt"
-  "log"
-  _ "github.com/go-sql-driver/mysql"
+  "strings"
+  "sync"
+  "time"
+  "github.com/go-sql-driver/mysql"
+  "github.com/prometheus/client_golang/prometheus"
 )
 
+// Range of values a MySQL DATETIME column supports.
+var MIN_DATETIME = time.Date(1000, time.January, 1, 0, 0, 0, 0, time.UTC)
+var MAX_DATETIME = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
+
+// MySQL error number for a duplicate key in a UNIQUE index.
+const MYSQL_ERR_DUP_ENTRY = 1062
+// MySQL error number for a foreign key pointing at a missing row, e.g. a
+// user deleted since their id was cached.
+const MYSQL_ERR_NO_REFERENCED_ROW = 1452
+// MySQL error numbers for transient errors, after which the transaction was
+// rolled back and can be retried.
+const MYSQL_ERR_LOCK_WAIT_TIMEOUT = 1205
+const MYSQL_ERR_LOCK_DEADLOCK = 1213
+
 // MySQL queries and statements.
 const INSERT_USER = "INSERT INTO users(username, hash) VALUES(?, ?)"
-const INSERT_MESSAGE = "INSERT INTO messages(sender_id, recipient_id, message_type, message_content, message_metadata_id) VALUES (?, ?, ?, ?, ?)"
-const INSERT_MESSAGE_WITH_NO_METADATA = "INSERT INTO messages(sender_id, recipient_id, message_type, message_content) VALUES (?, ?, ?, ?)"
+// Messages have either a recipient_id or a recipient_room_id, the other is NULL.
+const INSERT_MESSAGE = "INSERT INTO messages(sender_id, recipient_id, recipient_room_id, parent_message_id, message_type, message_content, message_metadata_id) VALUES (?, ?, ?, ?, ?, ?, ?)"
+const INSERT_MESSAGE_WITH_NO_METADATA = "INSERT INTO messages(sender_id, recipient_id, recipient_room_id, parent_message_id, message_type, message_content) VALUES (?, ?, ?, ?, ?, ?)"
 const INSERT_MESSAGES_IMAGE_METADATA = "INSERT INTO messages_metadata(width, height) VALUES(?, ?)"
 const INSERT_MESSAGES_VIDEO_METADATA = "INSERT INTO messages_metadata(length, source) VALUES(?, ?)"
+const INSERT_MESSAGES_FILE_METADATA = "INSERT INTO messages_metadata(filename, size_bytes) VALUES(?, ?)"
 
 const SELECT_ID_FROM_USERNAME = "SELECT id FROM users WHERE username=?"
 const SELECT_USERNAME_FROM_ID = "SELECT username FROM users WHERE id=?"
 const SELECT_IMAGE_METADATA = "SELECT width, height FROM messages_metadata WHERE id=?"
 const SELECT_VIDEO_METADATA = "SELECT length, source FROM messages_metadata WHERE id=?"
 // Selects from messages and joins on the metadata_id if possible.
-const SELECT_MESSAGES_BETWEEN_USERS = `SELECT messages.sender_id, messages.recipient_id, messages.message_type, messages.message_content, ` +
-                                        `messages_metadata.width, messages_metadata.height, messages_metadata.length, messages_metadata.source ` +
-                                      `FROM messages ` +
-                                      `LEFT JOIN messages_metadata ON messages_metadata.id=messages.message_metadata_id ` +
-                                      `WHERE (messages.sender_id=? AND messages.recipient_id=?) OR (messages.sender_id=? AND messages.recipient_id=?) ` +
+// Ids are assigned in insertion order, so ordering by id also orders by created_at.
+const SELECT_MESSAGES_FROM = `SELECT messages.id, messages.sender_id, messages.recipient_id, messages.message_type, messages.message_content, messages.created_at, messages.edited_at, messages.read_at, messages.parent_message_id, messages.status, ` +
+                               `messages_metadata.width, messages_metadata.height, messages_metadata.length, messages_metadata.source, ` +
+                               `messages_metadata.filename, messages_metadata.size_bytes ` +
+                             `FROM messages ` +
+                             `LEFT JOIN messages_metadata ON messages_metadata.id=messages.message_metadata_id `
+const MESSAGES_BETWEEN_USERS = `((messages.sender_id=? AND messages.recipient_id=?) OR (messages.sender_id=? AND messages.recipient_id=?)) `
+// Both bounds are inclusive, see createdAtBounds for unbounded fetches.
+const MESSAGES_CREATED_BETWEEN = `messages.created_at BETWEEN ? AND ? `
+const SELECT_MESSAGES_BETWEEN_USERS = SELECT_MESSAGES_FROM +
+                                      `WHERE ` + MESSAGES_BETWEEN_USERS + `AND ` + MESSAGES_CREATED_BETWEEN +
                                       `ORDER BY messages.id `
 const SELECT_MESSAGES_BETWEEN_USERS_WITH_LIMIT = SELECT_MESSAGES_BETWEEN_USERS +
                                                  `LIMIT ?, ?`
+// Selects the latest messages older than a message id, newest first.
+const SELECT_MESSAGES_BEFORE_ID = SELECT_MESSAGES_FROM +
+                                  `WHERE ` + MESSAGES_BETWEEN_USERS + `AND ` + MESSAGES_CREATED_BETWEEN + `AND messages.id<? ` +
+                                  `ORDER BY messages.id DESC LIMIT ?`
+// Selects the earliest messages newer than a message id, oldest first.
+const SELECT_MESSAGES_AFTER_ID = SELECT_MESSAGES_FROM +
+                                 `WHERE ` + MESSAGES_BETWEEN_USERS + `AND ` + MESSAGES_CREATED_BETWEEN + `AND messages.id>? ` +
+                                 `ORDER BY messages.id LIMIT ?`
+// Selects a room's messages, joining on users for the sender's name.
+const SELECT_ROOM_MESSAGES_FROM = `SELECT messages.id, senders.username, messages.message_type, messages.message_content, messages.created_at, messages.edited_at, messages.read_at, messages.parent_message_id, messages.status, ` +
+                                    `messages_metadata.width, messages_metadata.height, messages_metadata.length, messages_metadata.source, ` +
+                                    `messages_metadata.filename, messages_metadata.size_bytes ` +
+                                  `FROM messages ` +
+                                  `JOIN users AS senders ON senders.id=messages.sender_id ` +
+                                  `LEFT JOIN messages_metadata ON messages_metadata.id=messages.message_metadata_id `
+const SELECT_ROOM_MESSAGES = SELECT_ROOM_MESSAGES_FROM +
+                             `WHERE messages.recipient_room_id=? AND ` + MESSAGES_CREATED_BETWEEN +
+                             `ORDER BY messages.id `
+const SELECT_ROOM_MESSAGES_WITH_LIMIT = SELECT_ROOM_MESSAGES +
+                                        `LIMIT ?, ?`
+const SELECT_ROOM_MESSAGES_BEFORE_ID = SELECT_ROOM_MESSAGES_FROM +
+                                       `WHERE messages.recipient_room_id=? AND ` + MESSAGES_CREATED_BETWEEN + `AND messages.id<? ` +
+                                       `ORDER BY messages.id DESC LIMIT ?`
+const SELECT_ROOM_MESSAGES_AFTER_ID = SELECT_ROOM_MESSAGES_FROM +
+                                      `WHERE messages.recipient_room_id=? AND ` + MESSAGES_CREATED_BETWEEN + `AND messages.id>? ` +
+                                      `ORDER BY messages.id LIMIT ?`
+const COUNT_ROOM_MESSAGES = "SELECT COUNT(*) FROM messages WHERE recipient_room_id=?"
+const INSERT_ROOM = "INSERT INTO rooms(name) VALUES(?)"
+const INSERT_ROOM_MEMBER = "INSERT INTO room_members(room_id, user_id) VALUES(?, ?)"
+const SELECT_ROOM = "SELECT name, created_at FROM rooms WHERE id=?"
+const SELECT_ROOM_MEMBERS = `SELECT users.username FROM room_members ` +
+                            `JOIN users ON users.id=room_members.user_id ` +
+                            `WHERE room_members.room_id=? ORDER BY users.username`
+const SELECT_ROOM_IS_MEMBER = "SELECT COUNT(*) FROM room_members WHERE room_id=? AND user_id=?"
+const SELECT_ROOM_IDS_FOR_USER = "SELECT room_id FROM room_members WHERE user_id=? ORDER BY room_id"
+const COUNT_MESSAGES_BETWEEN_USERS = `SELECT COUNT(*) FROM messages ` +
+                                     `WHERE (sender_id=? AND recipient_id=?) OR (sender_id=? AND recipient_id=?)`
+const COUNT_UNREAD_MESSAGES = "SELECT COUNT(*) FROM messages WHERE recipient_id=? AND read_at IS NULL"
+const COUNT_UNREAD_MESSAGES_FROM_SENDER = COUNT_UNREAD_MESSAGES + " AND sender_id=?"
+const COUNT_UNREAD_MESSAGES_BY_SENDER = `SELECT users.username, COUNT(*) FROM messages ` +
+                                        `JOIN users ON users.id=messages.sender_id ` +
+                                        `WHERE messages.recipient_id=? AND messages.read_at IS NULL ` +
+                                        `GROUP BY users.username`
+// Finds the latest message with each user the given user has talked to,
+// most recent first. The counterpart is whichever side of the message isn't
+// the given user. Room messages aren't part of any conversation.
+const SELECT_CONVERSATIONS = `SELECT users.username, messages.message_content, messages.message_type, messages.created_at ` +
+                             `FROM messages ` +
+                             `JOIN (SELECT MAX(id) AS id FROM messages WHERE (sender_id=? OR recipient_id=?) AND recipient_room_id IS NULL ` +
+                                   `GROUP BY IF(sender_id=?, recipient_id, sender_id)) AS latest ` +
+                               `ON latest.id=messages.id ` +
+                             `JOIN users ON users.id=IF(messages.sender_id=?, messages.recipient_id, messages.sender_id) ` +
+                             `ORDER BY messages.id DESC`
+// The default collation is case-insensitive, so LIKE matches regardless of case.
+const SEARCH_USERS_BY_PREFIX = "SELECT username FROM users WHERE username LIKE ? ORDER BY username LIMIT ?"
+// Blocking someone twice hits the primary key and changes nothing.
+const INSERT_BLOCK = "INSERT INTO blocks(blocker_id, blocked_id) VALUES(?, ?) ON DUPLICATE KEY UPDATE blocker_id=blocker_id"
+const DELETE_BLOCK = "DELETE FROM blocks WHERE blocker_id=? AND blocked_id=?"
+const SELECT_IS_BLOCKED = "SELECT COUNT(*) FROM blocks WHERE blocker_id=? AND blocked_id=?"
+const SELECT_BLOCKED_USERS = `SELECT users.username FROM blocks ` +
+                             `JOIN users ON users.id=blocks.blocked_id ` +
+                             `WHERE blocks.blocker_id=? ORDER BY users.username`
+// Finds a user's messages containing some text, newest first. Joins on users
+// to get both usernames, since the messages can be with anyone.
+const SEARCH_MESSAGES = `SELECT messages.id, senders.username, recipients.username, messages.message_type, messages.message_content, messages.created_at, messages.edited_at, messages.read_at, messages.parent_message_id, messages.status, ` +
+                          `messages_metadata.width, messages_metadata.height, messages_metadata.length, messages_metadata.source, ` +
+                          `messages_metadata.filename, messages_metadata.size_bytes ` +
+                        `FROM messages ` +
+                        `JOIN users AS senders ON senders.id=messages.sender_id ` +
+                        `JOIN users AS recipients ON recipients.id=messages.recipient_id ` +
+                        `LEFT JOIN messages_metadata ON messages_metadata.id=messages.message_metadata_id ` +
+                        `WHERE (messages.sender_id=? OR messages.recipient_id=?) AND messages.message_content LIKE ? ` +
+                        `ORDER BY messages.id DESC ` +
+                        `LIMIT ?`
 const SELECT_USER_CREDENTIALS = "SELECT hash FROM users WHERE username=?"
+const SELECT_USER_PROFILE = "SELECT id, created_at FROM users WHERE username=?"
+const UPDATE_USER_CREDENTIALS = "UPDATE users SET hash=? WHERE username=?"
+const SELECT_MESSAGE_SENDER_FOR_UPDATE = "SELECT sender_id, message_metadata_id FROM messages WHERE id=? FOR UPDATE"
+
+const SELECT_MESSAGE_ID = "SELECT id FROM messages WHERE id=?"
+const SELECT_MESSAGE_CREATED_AT = "SELECT created_at FROM messages WHERE id=?"
+// Reacting with the same emoji twice hits the unique key and changes nothing.
+const INSERT_REACTION = "INSERT INTO reactions(message_id, user_id, emoji) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE emoji=emoji"
+const DELETE_REACTION = "DELETE FROM reactions WHERE message_id=? AND user_id=? AND emoji=?"
+// Filled in with one placeholder per message id.
+const COUNT_REACTIONS_FOR_MESSAGES = "SELECT message_id, emoji, COUNT(*) FROM reactions WHERE message_id IN (%s) GROUP BY message_id, emoji"
+const SELECT_MESSAGE_TYPE_FOR_UPDATE = "SELECT sender_id, message_type FROM messages WHERE id=? FOR UPDATE"
+
+const UPDATE_MESSAGE_CONTENT = "UPDATE messages SET message_content=?, edited_at=NOW() WHERE id=?"
+
+const UPDATE_MESSAGES_READ = "UPDATE messages SET read_at=NOW(), status='read' WHERE recipient_id=? AND sender_id=? AND read_at IS NULL"
+const SELECT_MESSAGE_RECIPIENT = "SELECT recipient_id FROM messages WHERE id=?"
+const SELECT_MESSAGE_CONVERSATION = "SELECT sender_id, recipient_id, recipient_room_id FROM messages WHERE id=?"
+const UPDATE_MESSAGE_READ = "UPDATE messages SET read_at=NOW(), status='read' WHERE id=? AND read_at IS NULL"
+const UPDATE_MESSAGES_DELIVERED = "UPDATE messages SET status='delivered' WHERE recipient_id=? AND sender_id=? AND status='sent'"
+const SELECT_MESSAGE_STATUS = "SELECT status, recipient_id FROM messages WHERE id=?"
+// Only moves the status forward, in case it changed since it was checked.
+const UPDATE_MESSAGE_STATUS = "UPDATE messages SET status=? WHERE id=? AND FIELD(status, 'sent', 'delivered', 'read') < FIELD(?, 'sent', 'delivered', 'read')"
+
+const DELETE_MESSAGE = "DELETE FROM messages WHERE id=?"
+const DELETE_MESSAGES_METADATA = "DELETE FROM messages_metadata WHERE id=?"
+// Statements for deleting a user, run in this order. The metadata goes
+// first, while the messages pointing at it can still be found.
+const DELETE_USER_MESSAGES_METADATA = `DELETE FROM messages_metadata WHERE id IN ` +
+                                      `(SELECT message_metadata_id FROM messages WHERE sender_id=? OR recipient_id=?)`
+const DELETE_USER_REACTIONS = "DELETE FROM reactions WHERE user_id=?"
+const DELETE_USER_MESSAGES = "DELETE FROM messages WHERE sender_id=? OR recipient_id=?"
+const DELETE_USER_ROOM_MEMBERSHIPS = "DELETE FROM room_members WHERE user_id=?"
+const DELETE_USER_BLOCKS = "DELETE FROM blocks WHERE blocker_id=? OR blocked_id=?"
+const DELETE_USER = "DELETE FROM users WHERE id=?"
 
 
 
 // ChatSQLClient wraps a connection to the database, and provides an
 // api to the server.
-// This abstraction is in case we want to swap out a different db
-// for the project without affecting the logic in the server.
+// It implements ChatStore, so a different db can be swapped in for the
+// project without affecting the logic in the server.
 //
 // API exposed to server includes the following:
-// - NewChatSqlClient()
-// - client.CreateUser(username)
-// - client.CheckUserExists(username)
-// - client.GetUserCredentials(username)
-// - client.FetchMessages(senderName, recipientName)
-// - client.AddMessage(senderName, recipientName, messageType, messageContent)
+// - NewChatSqlClient(driverName, dataSourceName, pool, logger)
+// - client.CreateUser(ctx, username, hash)
+// - client.CheckUserExists(ctx, username)
+// - client.GetUserCredentials(ctx, username)
+// - client.UpdateUserCredentials(ctx, username, hash)
+// - client.DeleteUser(ctx, username)
+// - client.SearchUsers(ctx, prefix, limit)
+// - client.BlockUser(ctx, blockerName, blockedName)
+// - client.UnblockUser(ctx, blockerName, blockedName)
+// - client.FetchBlockedUsers(ctx, username)
+// - client.IsBlocked(ctx, blockerName, blockedName)
+// - client.FetchMessages(ctx, params)
+// - client.GetMessageCount(ctx, senderName, recipientName)
+// - client.SearchMessages(ctx, username, query, limit)
+// - client.CreateRoom(ctx, name, memberNames)
+// - client.GetRoom(ctx, roomId)
+// - client.FetchRooms(ctx, username)
+// - client.AddRoomMessage(ctx, senderName, roomId, messageType, messageContent, metadata)
+// - client.GetRoomMessageCount(ctx, roomId)
+// - client.AddMessage(ctx, senderName, recipientName, messageType, messageContent, metadata)
+// - client.AddMessages(ctx, senderName, recipientNames, messageType, messageContent, metadata)
+// - client.FetchConversations(ctx, username)
+// - client.MarkMessagesRead(ctx, recipientName, senderName)
+// - client.MarkMessageRead(ctx, messageId, readerName)
+// - client.MarkMessagesDelivered(ctx, recipientName, senderName)
+// - client.UpdateMessageStatus(ctx, messageId, status)
+// - client.CountUnread(ctx, recipientName, senderName)
+// - client.GetUnreadCounts(ctx, recipientName)
+// - client.AddReaction(ctx, messageId, username, emoji)
+// - client.RemoveReaction(ctx, messageId, username, emoji)
+// - client.EditMessage(ctx, messageId, requesterName, newContent)
+// - client.DeleteMessage(ctx, messageId, requesterName)
+// - client.InvalidateUserId(username)
+// - client.Ping(ctx)
+// - client.Close()
 //
 // ** Note that the server is responsible for handling errors propagated
 // up by the db client. **
 type ChatSQLClient struct {
   db *sql.DB
+  // Frequently used statements, prepared once by the factory.
+  insertUser *sql.Stmt
+  selectUserId *sql.Stmt
+  insertMessage *sql.Stmt
+  insertMessageWithNoMetadata *sql.Stmt
+  insertImageMetadata *sql.Stmt
+  insertVideoMetadata *sql.Stmt
+  insertFileMetadata *sql.Stmt
+  selectMessages *sql.Stmt
+  selectMessagesWithLimit *sql.Stmt
+  // Every prepared statement, so they can be closed together.
+  statements []*sql.Stmt
+  // Caches user ids by lowercased username, since a username's id never
+  // changes while the user exists. The cache is per process, so a user
+  // deleted through another server process keeps its entry here until a
+  // write using it fails, see recheckUserIds.
+  userIds map[string]int64
+  userIdsMutex sync.RWMutex
+  // See PoolConfig.
+  retryAttempts int
+  retryBackoff time.Duration
+  logger Logger
+  // Time taken by each store method, see observeQuery.
+  queryDuration *prometheus.HistogramVec
 }
 
 // Given a user, get its id.
-func (client *ChatSQLClient) getUserId(username string) (int64, error) {
-  var id int64
-  err := client.db.QueryRow(SELECT_ID_FROM_USERNAME, username).Scan(&id)
-  return id, err
+// Returns an ErrUserNotFound error if the user doesn't exist.
+// Found ids are cached. Missing users aren't, since they can be created later.
+func (client *ChatSQLClient) getUserId(ctx context.Context, username string) (int64, error) {
+  key := userIdKey(username)
+  client.userIdsMutex.RLock()
+  id, ok := client.userIds[key]
+  client.userIdsMutex.RUnlock()
+  if ok {
+    return id, nil
+  }
+  err := client.selectUserId.QueryRowContext(ctx, username).Scan(&id)
+  if err == sql.ErrNoRows {
+    return -1, userNotFound(username)
+  }
+  if err != nil {
+    return -1, err
+  }
+  client.userIdsMutex.Lock()
+  client.userIds[key] = id
+  client.userIdsMutex.Unlock()
+  return id, nil
+}
+
+// Returns the key a user's id is cached under. Usernames are compared
+// case-insensitively by the users table's collation, so "Alice" and "alice"
+// are the same user and must share an entry.
+func userIdKey(username string) string {
+  return strings.ToLower(username)
+}
+
+// Drops the cached id for a user, e.g. when the user is deleted, so the next
+// lookup goes to the db.
+func (client *ChatSQLClient) InvalidateUserId(username string) {
+  client.userIdsMutex.Lock()
+  defer client.userIdsMutex.Unlock()
+  delete(client.userIds, userIdKey(username))
+}
+
+// Returns err, or an ErrUserNotFound error if err is a foreign key failure
+// and one of the given users no longer exists. Cached ids can be stale if
+// another server process deleted the user, so they're dropped and looked up
+// again, and the next request uses the fresh ids.
+func (client *ChatSQLClient) recheckUserIds(ctx context.Context, err error, usernames ...string) error {
+  var mysqlErr *mysql.MySQLError
+  if !errors.As(err, &mysqlErr) || mysqlErr.Number != MYSQL_ERR_NO_REFERENCED_ROW {
+    return err
+  }
+  for _, username := range usernames {
+    client.InvalidateUserId(username)
+    if _, lookupErr := client.getUserId(ctx, username); lookupErr != nil {
+      return lookupErr
+    }
+  }
+  return err
+}
+
+// Deletes the user and everything tied to them in one transaction.
+// Direct messages are removed in both directions, since a conversation with
+// a deleted user can't be shown or replied to. Room messages the user sent
+// are removed too, but other members' room messages stay.
+// Returns an ErrUserNotFound error if the user doesn't exist.
+func (client *ChatSQLClient) DeleteUser(ctx context.Context, username string) error {
+  defer client.observeQuery("DeleteUser", time.Now())
+  userId, err := client.getUserId(ctx, username)
+  if err != nil {
+    return err
+  }
+  tx, err := client.db.BeginTx(ctx, nil)
+  if err != nil {
+    return err
+  }
+  statements := []struct {
+    query string
+    args []interface{}
+  }{
+    {DELETE_USER_MESSAGES_METADATA, []interface{}{userId, userId}},
+    {DELETE_USER_REACTIONS, []interface{}{userId}},
+    // Reactions to the deleted messages are removed by ON DELETE CASCADE.
+    {DELETE_USER_MESSAGES, []interface{}{userId, userId}},
+    {DELETE_USER_ROOM_MEMBERSHIPS, []interface{}{userId}},
+    {DELETE_USER_BLOCKS, []interface{}{userId, userId}},
+    {DELETE_USER, []interface{}{userId}},
+  }
+  for _, statement := range statements {
+    if _, err = tx.ExecContext(ctx, statement.query, statement.args...); err != nil {
+      tx.Rollback()
+      return err
+    }
+  }
+  if err = tx.Commit(); err != nil {
+    tx.Rollback()
+    return err
+  }
+  client.InvalidateUserId(username)
+  return nil
 }
 
-// Create a new user in the database with the given username, password hash, and salt.
-// Returns the id of the newly created user, or an error.
-func (client *ChatSQLClient) CreateUser(username string, hash []byte) (id int64, err error) {
-  res, err := client.db.Exec(INSERT_USER, username, hash)
+// Create a new user in the database with the given username and password hash.
+// Returns the id of the newly created user, or an ErrUserExists error if the
+// username is taken.
+func (client *ChatSQLClient) CreateUser(ctx context.Context, username string, hash []byte) (id int64, err error) {
+  defer client.observeQuery("CreateUser", time.Now())
+  res, err := client.insertUser.ExecContext(ctx, username, hash)
+  // The UNIQUE constraint on usernames catches concurrent signups too, so
+  // there's no need to check whether the user exists first.
+  var mysqlErr *mysql.MySQLError
+  if errors.As(err, &mysqlErr) && mysqlErr.Number == MYSQL_ERR_DUP_ENTRY {
+    return -1, userExists(username)
+  }
   if err != nil {
     return -1, err
   }
   return res.LastInsertId()
 }
 
-// Retrieves the password hash and salt for the given username.
-func (client *ChatSQLClient) GetUserCredentials(username string) (hash []byte, err error) {
-  err = client.db.QueryRow(SELECT_USER_CREDENTIALS, username).Scan(&hash)
+// Returns whether a user with the given username exists.
+func (client *ChatSQLClient) CheckUserExists(ctx context.Context, username string) (bool, error) {
+  defer client.observeQuery("CheckUserExists", time.Now())
+  _, err := client.getUserId(ctx, username)
+  if errors.Is(err, ErrUserNotFound) {
+    return false, nil
+  }
+  if err != nil {
+    return false, err
+  }
+  return true, nil
+}
+
+// Retrieves the password hash for the given username.
+// The bcrypt hash includes its salt, so this is all Authenticate needs.
+func (client *ChatSQLClient) GetUserCredentials(ctx context.Context, username string) (hash []byte, err error) {
+  defer client.observeQuery("GetUserCredentials", time.Now())
+  err = client.db.QueryRowContext(ctx, SELECT_USER_CREDENTIALS, username).Scan(&hash)
+  if err == sql.ErrNoRows {
+    return nil, userNotFound(username)
+  }
+  return
+}
+
+// Returns the user's id and when they signed up.
+// Returns an ErrUserNotFound error if the user doesn't exist.
+func (client *ChatSQLClient) GetUserProfile(ctx context.Context, username string) (*UserProfile, error) {
+  defer client.observeQuery("GetUserProfile", time.Now())
+  profile := &UserProfile{Username: username}
+  err := client.db.QueryRowContext(ctx, SELECT_USER_PROFILE, username).Scan(&profile.ID, &profile.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, userNotFound(username)
+  }
+  if err != nil {
+    return nil, err
+  }
+  return profile, nil
+}
+
+// Replaces the user's password hash. bcrypt hashes embed their salt, so
+// there's no separate salt to update.
+// Returns an ErrUserNotFound error if the user doesn't exist.
+func (client *ChatSQLClient) UpdateUserCredentials(ctx context.Context, username string, hash []byte) error {
+  defer client.observeQuery("UpdateUserCredentials", time.Now())
+  res, err := client.db.ExecContext(ctx, UPDATE_USER_CREDENTIALS, hash, username)
+  if err != nil {
+    return err
+  }
+  // Every new hash has a new salt, so an existing row always changes.
+  if n, err := res.RowsAffected(); err != nil {
+    return err
+  } else if n == 0 {
+    return userNotFound(username)
+  }
+  return nil
+}
+
+// Returns up to limit usernames starting with the given prefix, sorted.
+func (client *ChatSQLClient) SearchUsers(ctx context.Context, prefix string, limit int) (usernames []string, err error) {
+  defer client.observeQuery("SearchUsers", time.Now())
+  rows, err := client.db.QueryContext(ctx, SEARCH_USERS_BY_PREFIX, escapeLike(prefix) + "%", limit)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var username string
+    if err := rows.Scan(&username); err != nil {
+      return nil, err
+    }
+    usernames = append(usernames, username)
+  }
+  return usernames, rows.Err()
+}
+
+// Blocks blocked from sending direct messages to blocker.
+// Returns an ErrUserNotFound error if either user doesn't exist.
+func (client *ChatSQLClient) BlockUser(ctx context.Context, blockerName string, blockedName string) error {
+  defer client.observeQuery("BlockUser", time.Now())
+  blockerId, blockedId, err := client.getBlockIds(ctx, blockerName, blockedName)
+  if err != nil {
+    return err
+  }
+  _, err = client.db.ExecContext(ctx, INSERT_BLOCK, blockerId, blockedId)
+  return client.recheckUserIds(ctx, err, blockerName, blockedName)
+}
+
+// Removes the block, if there is one.
+// Returns an ErrUserNotFound error if either user doesn't exist.
+func (client *ChatSQLClient) UnblockUser(ctx context.Context, blockerName string, blockedName string) error {
+  defer client.observeQuery("UnblockUser", time.Now())
+  blockerId, blockedId, err := client.getBlockIds(ctx, blockerName, blockedName)
+  if err != nil {
+    return err
+  }
+  _, err = client.db.ExecContext(ctx, DELETE_BLOCK, blockerId, blockedId)
+  return err
+}
+
+// Gets the ids of both sides of a block.
+func (client *ChatSQLClient) getBlockIds(ctx context.Context, blockerName string, blockedName string) (blockerId int64, blockedId int64, err error) {
+  if blockerId, err = client.getUserId(ctx, blockerName); err != nil {
+    return
+  }
+  blockedId, err = client.getUserId(ctx, blockedName)
   return
 }
 
-// Adds a new message to the database. Returns the id of that message, or an error.
-func (client *ChatSQLClient) AddMessage(senderName string, recipientName string, messageType string, content string) (id int64, err_ error) {
+// Returns the usernames the user has blocked, sorted.
+// Returns an ErrUserNotFound error if the user doesn't exist.
+func (client *ChatSQLClient) FetchBlockedUsers(ctx context.Context, username string) (usernames []string, err error) {
+  defer client.observeQuery("FetchBlockedUsers", time.Now())
+  userId, err := client.getUserId(ctx, username)
+  if err != nil {
+    return nil, err
+  }
+  rows, err := client.db.QueryContext(ctx, SELECT_BLOCKED_USERS, userId)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var blocked string
+    if err := rows.Scan(&blocked); err != nil {
+      return nil, err
+    }
+    usernames = append(usernames, blocked)
+  }
+  return usernames, rows.Err()
+}
+
+// Returns whether blocker has blocked blocked.
+// Returns an ErrUserNotFound error if either user doesn't exist.
+func (client *ChatSQLClient) IsBlocked(ctx context.Context, blockerName string, blockedName string) (bool, error) {
+  defer client.observeQuery("IsBlocked", time.Now())
+  blockerId, blockedId, err := client.getBlockIds(ctx, blockerName, blockedName)
+  if err != nil {
+    return false, err
+  }
+  var count int
+  if err := client.db.QueryRowContext(ctx, SELECT_IS_BLOCKED, blockerId, blockedId).Scan(&count); err != nil {
+    return false, err
+  }
+  return count > 0, nil
+}
+
+// Returns an ErrBlocked error naming the recipient if they've blocked the
+// sender.
+func (client *ChatSQLClient) checkNotBlocked(ctx context.Context, senderId int64, recipientId int64, recipientName string) error {
+  var count int
+  if err := client.db.QueryRowContext(ctx, SELECT_IS_BLOCKED, recipientId, senderId).Scan(&count); err != nil {
+    return err
+  }
+  if count > 0 {
+    return fmt.Errorf("%w: %s", ErrBlocked, recipientName)
+  }
+  return nil
+}
+
+// Adds a new message to the database. Returns the stored message, including
+// its id and creation time, or an error.
+// Image, video and file messages must come with metadata.
+// Returns an ErrBlocked error if the recipient has blocked the sender.
+// Retried if it hits a deadlock or lock wait timeout.
+func (client *ChatSQLClient) AddMessage(ctx context.Context, senderName string, recipientName string, messageType string, content string, metadata *MessageMetadata, replyTo int64) (message *Message, err error) {
+  defer client.observeQuery("AddMessage", time.Now())
+  err = client.retry(ctx, "AddMessage", func() error {
+    message, err = client.addMessage(ctx, senderName, recipientName, messageType, content, metadata, replyTo)
+    return err
+  })
+  return message, err
+}
+
+// Makes one attempt at AddMessage.
+func (client *ChatSQLClient) addMessage(ctx context.Context, senderName string, recipientName string, messageType string, content string, metadata *MessageMetadata, replyTo int64) (*Message, error) {
   // Find the associated ids of the two users.
-  var err error
-  senderId, err := client.getUserId(senderName)
+  senderId, err := client.getUserId(ctx, senderName)
+  if err != nil {
+    return nil, err
+  }
+  recipientId, err := client.getUserId(ctx, recipientName)
+  if err != nil {
+    return nil, err
+  }
+  if err = client.checkNotBlocked(ctx, senderId, recipientId, recipientName); err != nil {
+    return nil, err
+  }
+  recipient := sql.NullInt64{Int64: recipientId, Valid: true}
+  parentId, err := client.checkReplyTo(ctx, replyTo, senderId, recipient, sql.NullInt64{})
+  if err != nil {
+    return nil, err
+  }
+  id, err := client.storeMessage(ctx, senderId, recipient, sql.NullInt64{}, parentId,
+                                 messageType, content, metadata)
   if err != nil {
-    return -1, errors.New(fmt.Sprintf("no such user %s", senderName))
+    return nil, client.recheckUserIds(ctx, err, senderName, recipientName)
+  }
+  message := &Message{
+    ID: id,
+    Sender: senderName,
+    Recipient: recipientName,
+    MessageType: messageType,
+    Content: content,
+    ReplyTo: nullInt64ToPointer(parentId),
   }
-  recipientId, err := client.getUserId(recipientName)
+  return message, client.fillStoredMessage(ctx, message, metadata)
+}
+
+// Adds a copy of the message for each recipient in one transaction, so
+// either every copy is stored or none are.
+// Returns an ErrUserNotFound error, and stores nothing, if any user is
+// missing, or an ErrBlocked error if any recipient has blocked the sender.
+func (client *ChatSQLClient) AddMessages(ctx context.Context, senderName string, recipientNames []string, messageType string, content string, metadata *MessageMetadata) ([]*Message, error) {
+  defer client.observeQuery("AddMessages", time.Now())
+  senderId, err := client.getUserId(ctx, senderName)
   if err != nil {
-    return -1, errors.New(fmt.Sprintf("no such user %s", recipientName))
+    return nil, err
   }
+  recipientIds := make([]int64, len(recipientNames))
+  for i, recipientName := range recipientNames {
+    if recipientIds[i], err = client.getUserId(ctx, recipientName); err != nil {
+      return nil, err
+    }
+    if err = client.checkNotBlocked(ctx, senderId, recipientIds[i], recipientName); err != nil {
+      return nil, err
+    }
+  }
+  tx, err := client.db.BeginTx(ctx, nil)
+  if err != nil {
+    return nil, err
+  }
+  messages := make([]*Message, len(recipientNames))
+  for i, recipientName := range recipientNames {
+    id, err := client.storeMessageTx(ctx, tx, senderId, sql.NullInt64{Int64: recipientIds[i], Valid: true},
+                                     sql.NullInt64{}, sql.NullInt64{}, messageType, content, metadata)
+    if err != nil {
+      tx.Rollback()
+      return nil, client.recheckUserIds(ctx, err, append([]string{senderName}, recipientNames...)...)
+    }
+    messages[i] = &Message{
+      ID: id,
+      Sender: senderName,
+      Recipient: recipientName,
+      MessageType: messageType,
+      Content: content,
+    }
+  }
+  if err = tx.Commit(); err != nil {
+    tx.Rollback()
+    return nil, err
+  }
+  for _, message := range messages {
+    if err = client.fillStoredMessage(ctx, message, metadata); err != nil {
+      return nil, err
+    }
+  }
+  return messages, nil
+}
+
+// Adds a new message to a room. The sender must be a member of the room.
+// Returns the stored message, or ErrRoomNotFound or ErrNotRoomMember.
+func (client *ChatSQLClient) AddRoomMessage(ctx context.Context, senderName string, roomId int64, messageType string, content string, metadata *MessageMetadata, replyTo int64) (*Message, error) {
+  defer client.observeQuery("AddRoomMessage", time.Now())
+  senderId, err := client.getUserId(ctx, senderName)
+  if err != nil {
+    return nil, err
+  }
+  if err = client.checkRoomMember(ctx, roomId, senderId); err != nil {
+    return nil, err
+  }
+  room := sql.NullInt64{Int64: roomId, Valid: true}
+  parentId, err := client.checkReplyTo(ctx, replyTo, senderId, sql.NullInt64{}, room)
+  if err != nil {
+    return nil, err
+  }
+  id, err := client.storeMessage(ctx, senderId, sql.NullInt64{}, room, parentId,
+                                 messageType, content, metadata)
+  if err != nil {
+    return nil, client.recheckUserIds(ctx, err, senderName)
+  }
+  message := &Message{
+    ID: id,
+    Sender: senderName,
+    RoomID: &roomId,
+    MessageType: messageType,
+    Content: content,
+    ReplyTo: nullInt64ToPointer(parentId),
+  }
+  return message, client.fillStoredMessage(ctx, message, metadata)
+}
+
+// Checks that a new message from senderId to either recipientId or roomId
+// can reply to the message replyTo, i.e. that it's in the same conversation
+// or room. Returns the parent id to store, which is NULL if replyTo is 0,
+// or an ErrInvalidReply error.
+func (client *ChatSQLClient) checkReplyTo(ctx context.Context, replyTo int64, senderId int64, recipientId sql.NullInt64, roomId sql.NullInt64) (sql.NullInt64, error) {
+  if replyTo == 0 {
+    return sql.NullInt64{}, nil
+  }
+  var parentSenderId int64
+  var parentRecipientId sql.NullInt64
+  var parentRoomId sql.NullInt64
+  err := client.db.QueryRowContext(ctx, SELECT_MESSAGE_CONVERSATION, replyTo).Scan(
+    &parentSenderId, &parentRecipientId, &parentRoomId)
+  if err == sql.ErrNoRows {
+    return sql.NullInt64{}, fmt.Errorf("%w, message %d not found", ErrInvalidReply, replyTo)
+  }
+  if err != nil {
+    return sql.NullInt64{}, err
+  }
+  var sameConversation bool
+  if roomId.Valid {
+    sameConversation = parentRoomId == roomId
+  } else {
+    sameConversation = parentRecipientId.Valid &&
+      ((parentSenderId == senderId && parentRecipientId.Int64 == recipientId.Int64) ||
+       (parentSenderId == recipientId.Int64 && parentRecipientId.Int64 == senderId))
+  }
+  if !sameConversation {
+    return sql.NullInt64{}, ErrInvalidReply
+  }
+  return sql.NullInt64{Int64: replyTo, Valid: true}, nil
+}
+
+// Fills in the parts of a just stored message that the db decides, i.e. its
+// creation time and status, and the stored metadata.
+func (client *ChatSQLClient) fillStoredMessage(ctx context.Context, message *Message, metadata *MessageMetadata) error {
+  if err := client.db.QueryRowContext(ctx, SELECT_MESSAGE_CREATED_AT, message.ID).Scan(&message.CreatedAt); err != nil {
+    return err
+  }
+  message.Status = MESSAGE_STATUS_SENT
+  // Only media messages store metadata. Copy it so the caller's can't
+  // change the returned message.
+  if message.MessageType != MESSAGE_TYPE_PLAINTEXT {
+    copied := *metadata
+    message.Metadata = &copied
+  }
+  return nil
+}
+
+// Inserts a message, and its metadata if it has any, for AddMessage and
+// AddRoomMessage. Exactly one of recipientId and roomId should be valid.
+// parentId is the message being replied to, if any.
+// Every message goes through storeMessageTx in its own transaction, so a
+// failure part way through never leaves orphaned metadata behind.
+// Returns the id of the new message.
+func (client *ChatSQLClient) storeMessage(ctx context.Context, senderId int64, recipientId sql.NullInt64, roomId sql.NullInt64, parentId sql.NullInt64, messageType string, content string, metadata *MessageMetadata) (int64, error) {
+  tx, err := client.db.BeginTx(ctx, nil)
+  if err != nil {
+    return -1, err
+  }
+  id, err := client.storeMessageTx(ctx, tx, senderId, recipientId, roomId, parentId, messageType, content, metadata)
+  if err != nil {
+    tx.Rollback()
+    return -1, err
+  }
+  if err = tx.Commit(); err != nil {
+    tx.Rollback()
+    return -1, err
+  }
+  return id, nil
+}
+
+// Inserts a message, and its metadata if it has any, as part of the given
+// transaction. The caller commits or rolls back.
+// Returns the id of the new message.
+func (client *ChatSQLClient) storeMessageTx(ctx context.Context, tx *sql.Tx, senderId int64, recipientId sql.NullInt64, roomId sql.NullInt64, parentId sql.NullInt64, messageType string, content string, metadata *MessageMetadata) (int64, error) {
+  var res sql.Result
+  var err error
   switch messageType {
   case MESSAGE_TYPE_PLAINTEXT:
-    // For regular messages, insert without any metadata.
-    res, err := client.db.Exec(INSERT_MESSAGE_WITH_NO_METADATA, senderId,
-                               recipientId, messageType, content)
-    if err != nil {
-      return -1, err
+    res, err = tx.StmtContext(ctx, client.insertMessageWithNoMetadata).ExecContext(ctx, senderId, recipientId,
+                                                                        roomId, parentId, messageType, content)
+  case MESSAGE_TYPE_IMAGE_LINK, MESSAGE_TYPE_VIDEO_LINK, MESSAGE_TYPE_FILE:
+    if metadata == nil {
+      return -1, errors.New(fmt.Sprintf("missing metadata for %s message", messageType))
     }
-    return res.LastInsertId()
-  case MESSAGE_TYPE_IMAGE_LINK, MESSAGE_TYPE_VIDEO_LINK:
-    // TODO: Use a prepared statement.
-    tx, err := client.db.Begin()
-    var res sql.Result
     // First insert the metadata.
-    if messageType == MESSAGE_TYPE_IMAGE_LINK {
-      res, err = tx.Exec(INSERT_MESSAGES_IMAGE_METADATA, IMAGE_WIDTH,
-                                IMAGE_HEIGHT)
-    } else {
-      res, err = tx.Exec(INSERT_MESSAGES_VIDEO_METADATA, VIDEO_LENGTH,
-                                VIDEO_SOURCE)
+    switch messageType {
+    case MESSAGE_TYPE_IMAGE_LINK:
+      res, err = tx.StmtContext(ctx, client.insertImageMetadata).ExecContext(ctx, metadata.Width,
+                                                          metadata.Height)
+    case MESSAGE_TYPE_VIDEO_LINK:
+      res, err = tx.StmtContext(ctx, client.insertVideoMetadata).ExecContext(ctx, metadata.Length,
+                                                          metadata.Source)
+    case MESSAGE_TYPE_FILE:
+      res, err = tx.StmtContext(ctx, client.insertFileMetadata).ExecContext(ctx, metadata.Filename,
+                                                         metadata.SizeBytes)
     }
     if err != nil {
-      tx.Rollback()
       return -1, err
     }
     metadataId, err := res.LastInsertId()
     if err != nil {
-      tx.Rollback()
       return -1, err
     }
     // Then insert the message.
-    res, err = tx.Exec(INSERT_MESSAGE, senderId, recipientId,
-                              messageType, content, metadataId)
-    if err != nil {
-      tx.Rollback()
-      return -1, err
-    }
-    if err = tx.Commit(); err != nil {
-      tx.Rollback()
-      return -1, err
-    }
-    return res.LastInsertId()
+    res, err = tx.StmtContext(ctx, client.insertMessage).ExecContext(ctx, senderId, recipientId,
+                                                  roomId, parentId, messageType, content, metadataId)
   default:
     return -1, errors.New(fmt.Sprintf("Unknown message type %s", messageType))
   }
+  if err != nil {
+    return -1, err
+  }
+  return res.LastInsertId()
 }
 
-// Gets messages between two users.
+// Gets messages between two users, or in a room.
 // Return an array of pointers to the Message struct.
-func (client *ChatSQLClient) FetchMessages(params *FetchMessagesParams) (messages []*Message, err error) {
+// Retried if it hits a deadlock or lock wait timeout.
+func (client *ChatSQLClient) FetchMessages(ctx context.Context, params *FetchMessagesParams) (messages []*Message, err error) {
+  defer client.observeQuery("FetchMessages", time.Now())
+  err = client.retry(ctx, "FetchMessages", func() error {
+    messages, err = client.fetchMessages(ctx, params)
+    return err
+  })
+  return messages, err
+}
+
+// Makes one attempt at FetchMessages.
+func (client *ChatSQLClient) fetchMessages(ctx context.Context, params *FetchMessagesParams) (messages []*Message, err error) {
+  if params.roomId != 0 {
+    return client.fetchRoomMessages(ctx, params)
+  }
   // Find the associated ids of the two users.
-  requestedSenderId, err := client.getUserId(params.senderName)
+  requestedSenderId, err := client.getUserId(ctx, params.senderName)
   if err != nil {
-    err = errors.New(fmt.Sprintf("no such user %s", params.senderName))
     return nil, err
   }
-  requestedRecipientId, err := client.getUserId(params.recipientName)
+  requestedRecipientId, err := client.getUserId(ctx, params.recipientName)
   if err != nil {
-    err = errors.New(fmt.Sprintf("no such user %s", params.recipientName))
     return nil, err
   }
+  // Rows only hold ids, so map them back to the usernames. Looking up both
+  // ids, rather than swapping when the sender isn't the requested one, also
+  // works when a user fetches the messages they sent to themselves.
+  usernames := map[int64]string{
+    requestedSenderId: params.senderName,
+    requestedRecipientId: params.recipientName,
+  }
   // Get all rows, limit the number of entries depending on pagination.
-  var senderId int
-  var recipientId int
+  var id int64
+  var senderId int64
+  var recipientId int64
   var messageType string
   var content string
+  var createdAt time.Time
+  var editedAt sql.NullTime
+  var readAt sql.NullTime
+  var parentId sql.NullInt64
+  var status string
   var width sql.NullInt64
   var height sql.NullInt64
   var length sql.NullInt64
   var source sql.NullString
+  var filename sql.NullString
+  var sizeBytes sql.NullInt64
   var rows *sql.Rows
-  if params.usePagination {
-    start := params.pageToLoad * params.messagesPerPage
-    end := (params.pageToLoad + 1) * params.messagesPerPage
-    log.Printf("start %d end %d", start, end)
-    rows, err = client.db.Query(SELECT_MESSAGES_BETWEEN_USERS_WITH_LIMIT, requestedSenderId,
+  since, until := createdAtBounds(params)
+  if params.beforeId != 0 {
+    rows, err = client.db.QueryContext(ctx, SELECT_MESSAGES_BEFORE_ID, requestedSenderId,
+                               requestedRecipientId, requestedRecipientId,
+                               requestedSenderId, since, until, params.beforeId, params.limit)
+  } else if params.afterId != 0 {
+    rows, err = client.db.QueryContext(ctx, SELECT_MESSAGES_AFTER_ID, requestedSenderId,
+                               requestedRecipientId, requestedRecipientId,
+                               requestedSenderId, since, until, params.afterId, params.limit)
+  } else if params.usePagination {
+    // LIMIT takes an offset and a row count, not a start and end index.
+    offset := params.pageToLoad * params.messagesPerPage
+    rows, err = client.selectMessagesWithLimit.QueryContext(ctx, requestedSenderId,
                                requestedRecipientId, requestedRecipientId,
-                               requestedSenderId, start, end)
+                               requestedSenderId, since, until, offset, params.messagesPerPage)
   } else {
-    rows, err = client.db.Query(SELECT_MESSAGES_BETWEEN_USERS, requestedSenderId,
+    rows, err = client.selectMessages.QueryContext(ctx, requestedSenderId,
                                requestedRecipientId, requestedRecipientId,
-                               requestedSenderId)
+                               requestedSenderId, since, until)
   }
   if err != nil {
-    return nil, errors.New("bad messagesPerPage or pageToLoad, no results found for desired page")
+    return nil, fmt.Errorf("couldn't query messages: %w", err)
   }
+  defer rows.Close()
   for rows.Next() {
-    if err := rows.Scan(&senderId, &recipientId, &messageType, &content,
-                        &width, &height, &length, &source); err != nil {
+    if err := rows.Scan(&id, &senderId, &recipientId, &messageType, &content, &createdAt, &editedAt, &readAt,
+                        &parentId, &status, &width, &height, &length, &source, &filename, &sizeBytes); err != nil {
       return nil, err
     }
-    sender := params.senderName
-    recipient := params.recipientName
-    if senderId != int(requestedSenderId) {
-      sender = params.recipientName
-      recipient = params.senderName
-    }
-    // If there is associated metadata, save it in the MessageMetadata struct.
-    var metadata *MessageMetadata
-    switch messageType {
-    case MESSAGE_TYPE_PLAINTEXT:
-      metadata = nil
-      break
-    case MESSAGE_TYPE_IMAGE_LINK:
-      metadata = &MessageMetadata {
-        Width: int(width.Int64),
-        Height: int(height.Int64),
-      }
-      break
-    case MESSAGE_TYPE_VIDEO_LINK:
-      metadata = &MessageMetadata {
-        Length: int(length.Int64),
-        Source: source.String,
-      }
-      break
-    default:
-      // Should never get here.
-      return nil, errors.New(fmt.Sprintf("Unknown message type %s", messageType))
+    metadata, err := client.metadataFromColumns(id, messageType, width, height, length,
+                                                source, filename, sizeBytes)
+    if err != nil {
+      return nil, err
     }
     messages = append(messages, &Message {
-      Sender: sender,
-      Recipient: recipient,
+      ID: id,
+      Sender: usernames[senderId],
+      Recipient: usernames[recipientId],
       MessageType: messageType,
       Content: content,
+      CreatedAt: createdAt,
+      Edited: editedAt.Valid,
+      EditedAt: nullTimeToPointer(editedAt),
+      ReadAt: nullTimeToPointer(readAt),
+      ReplyTo: nullInt64ToPointer(parentId),
+      Status: status,
       Metadata: metadata,
     })
   }
+  if err = rows.Err(); err != nil {
+    return nil, err
+  }
+  if params.beforeId != 0 {
+    reverseMessages(messages)
+  }
+  if err = client.attachReactions(ctx, messages); err != nil {
+    return nil, err
+  }
+  return messages, nil
+}
+
+// Returns the range of creation times to fetch messages from. Bounds that
+// aren't set, or are outside what a DATETIME column can hold, are replaced
+// with the earliest or latest DATETIME.
+func createdAtBounds(params *FetchMessagesParams) (since time.Time, until time.Time) {
+  since = MIN_DATETIME
+  if params.since.After(MIN_DATETIME) {
+    since = params.since.UTC()
+  }
+  until = MAX_DATETIME
+  if !params.until.IsZero() && params.until.Before(MAX_DATETIME) {
+    until = params.until.UTC()
+  }
+  return since, until
+}
+
+// Reverses the messages in place, e.g. to turn newest first into oldest
+// first.
+func reverseMessages(messages []*Message) {
+  for i, j := 0, len(messages) - 1; i < j; i, j = i + 1, j - 1 {
+    messages[i], messages[j] = messages[j], messages[i]
+  }
+}
+
+// Gets the messages in a room, on behalf of params.senderName who must be a
+// member of the room.
+func (client *ChatSQLClient) fetchRoomMessages(ctx context.Context, params *FetchMessagesParams) (messages []*Message, err error) {
+  requesterId, err := client.getUserId(ctx, params.senderName)
+  if err != nil {
+    return nil, err
+  }
+  if err = client.checkRoomMember(ctx, params.roomId, requesterId); err != nil {
+    return nil, err
+  }
+  var rows *sql.Rows
+  since, until := createdAtBounds(params)
+  if params.beforeId != 0 {
+    rows, err = client.db.QueryContext(ctx, SELECT_ROOM_MESSAGES_BEFORE_ID, params.roomId,
+                                       since, until, params.beforeId, params.limit)
+  } else if params.afterId != 0 {
+    rows, err = client.db.QueryContext(ctx, SELECT_ROOM_MESSAGES_AFTER_ID, params.roomId,
+                                       since, until, params.afterId, params.limit)
+  } else if params.usePagination {
+    offset := params.pageToLoad * params.messagesPerPage
+    rows, err = client.db.QueryContext(ctx, SELECT_ROOM_MESSAGES_WITH_LIMIT, params.roomId,
+                                       since, until, offset, params.messagesPerPage)
+  } else {
+    rows, err = client.db.QueryContext(ctx, SELECT_ROOM_MESSAGES, params.roomId, since, until)
+  }
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    roomId := params.roomId
+    message := &Message{RoomID: &roomId}
+    var editedAt sql.NullTime
+    var readAt sql.NullTime
+    var parentId sql.NullInt64
+    var width sql.NullInt64
+    var height sql.NullInt64
+    var length sql.NullInt64
+    var source sql.NullString
+    var filename sql.NullString
+    var sizeBytes sql.NullInt64
+    if err := rows.Scan(&message.ID, &message.Sender, &message.MessageType, &message.Content,
+                        &message.CreatedAt, &editedAt, &readAt, &parentId, &message.Status,
+                        &width, &height, &length, &source, &filename, &sizeBytes); err != nil {
+      return nil, err
+    }
+    message.Edited = editedAt.Valid
+    message.EditedAt = nullTimeToPointer(editedAt)
+    message.ReadAt = nullTimeToPointer(readAt)
+    message.ReplyTo = nullInt64ToPointer(parentId)
+    message.Metadata, err = client.metadataFromColumns(message.ID, message.MessageType, width, height,
+                                                       length, source, filename, sizeBytes)
+    if err != nil {
+      return nil, err
+    }
+    messages = append(messages, message)
+  }
+  if err = rows.Err(); err != nil {
+    return nil, err
+  }
+  if params.beforeId != 0 {
+    reverseMessages(messages)
+  }
+  if err = client.attachReactions(ctx, messages); err != nil {
+    return nil, err
+  }
   return messages, nil
 }
 
+// Creates a room with the given members. Returns the new room, or an
+// ErrUserNotFound error if a member doesn't exist.
+func (client *ChatSQLClient) CreateRoom(ctx context.Context, name string, memberNames []string) (*Room, error) {
+  defer client.observeQuery("CreateRoom", time.Now())
+  // Look the members up first, so the transaction only does inserts.
+  memberIds := make(map[int64]bool)
+  for _, memberName := range memberNames {
+    memberId, err := client.getUserId(ctx, memberName)
+    if err != nil {
+      return nil, err
+    }
+    memberIds[memberId] = true
+  }
+  tx, err := client.db.BeginTx(ctx, nil)
+  if err != nil {
+    return nil, err
+  }
+  res, err := tx.ExecContext(ctx, INSERT_ROOM, name)
+  if err != nil {
+    tx.Rollback()
+    return nil, err
+  }
+  roomId, err := res.LastInsertId()
+  if err != nil {
+    tx.Rollback()
+    return nil, err
+  }
+  for memberId := range memberIds {
+    if _, err = tx.ExecContext(ctx, INSERT_ROOM_MEMBER, roomId, memberId); err != nil {
+      tx.Rollback()
+      return nil, client.recheckUserIds(ctx, err, memberNames...)
+    }
+  }
+  if err = tx.Commit(); err != nil {
+    tx.Rollback()
+    return nil, err
+  }
+  return client.GetRoom(ctx, roomId)
+}
+
+// Returns a room and its members, sorted. Returns ErrRoomNotFound if there is
+// no such room.
+func (client *ChatSQLClient) GetRoom(ctx context.Context, roomId int64) (*Room, error) {
+  defer client.observeQuery("GetRoom", time.Now())
+  room := &Room{ID: roomId}
+  err := client.db.QueryRowContext(ctx, SELECT_ROOM, roomId).Scan(&room.Name, &room.CreatedAt)
+  if err == sql.ErrNoRows {
+    return nil, ErrRoomNotFound
+  } else if err != nil {
+    return nil, err
+  }
+  rows, err := client.db.QueryContext(ctx, SELECT_ROOM_MEMBERS, roomId)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var memberName string
+    if err := rows.Scan(&memberName); err != nil {
+      return nil, err
+    }
+    room.Members = append(room.Members, memberName)
+  }
+  return room, rows.Err()
+}
+
+// Returns the rooms a user is a member of, oldest first.
+func (client *ChatSQLClient) FetchRooms(ctx context.Context, username string) (rooms []*Room, err error) {
+  defer client.observeQuery("FetchRooms", time.Now())
+  userId, err := client.getUserId(ctx, username)
+  if err != nil {
+    return nil, err
+  }
+  rows, err := client.db.QueryContext(ctx, SELECT_ROOM_IDS_FOR_USER, userId)
+  if err != nil {
+    return nil, err
+  }
+  // Collect the ids before querying each room, so only one result set is
+  // open at a time.
+  var roomIds []int64
+  for rows.Next() {
+    var roomId int64
+    if err := rows.Scan(&roomId); err != nil {
+      rows.Close()
+      return nil, err
+    }
+    roomIds = append(roomIds, roomId)
+  }
+  rows.Close()
+  if err = rows.Err(); err != nil {
+    return nil, err
+  }
+  for _, roomId := range roomIds {
+    room, err := client.GetRoom(ctx, roomId)
+    if err != nil {
+      return nil, err
+    }
+    rooms = append(rooms, room)
+  }
+  return rooms, nil
+}
+
+// Counts the messages in a room.
+func (client *ChatSQLClient) GetRoomMessageCount(ctx context.Context, roomId int64) (count int64, err error) {
+  defer client.observeQuery("GetRoomMessageCount", time.Now())
+  err = client.db.QueryRowContext(ctx, COUNT_ROOM_MESSAGES, roomId).Scan(&count)
+  return count, err
+}
+
+// Returns ErrRoomNotFound if the room doesn't exist, or ErrNotRoomMember if
+// the user isn't a member of it.
+func (client *ChatSQLClient) checkRoomMember(ctx context.Context, roomId int64, userId int64) error {
+  var name string
+  var createdAt time.Time
+  err := client.db.QueryRowContext(ctx, SELECT_ROOM, roomId).Scan(&name, &createdAt)
+  if err == sql.ErrNoRows {
+    return ErrRoomNotFound
+  } else if err != nil {
+    return err
+  }
+  var isMember int
+  if err = client.db.QueryRowContext(ctx, SELECT_ROOM_IS_MEMBER, roomId, userId).Scan(&isMember); err != nil {
+    return err
+  }
+  if isMember == 0 {
+    return ErrNotRoomMember
+  }
+  return nil
+}
+
+// Returns up to limit messages sent or received by the user whose content
+// contains query, newest first. Room messages aren't searched.
+func (client *ChatSQLClient) SearchMessages(ctx context.Context, username string, query string, limit int) (messages []*Message, err error) {
+  defer client.observeQuery("SearchMessages", time.Now())
+  userId, err := client.getUserId(ctx, username)
+  if err != nil {
+    return nil, err
+  }
+  rows, err := client.db.QueryContext(ctx, SEARCH_MESSAGES, userId, userId,
+                                      "%" + escapeLike(query) + "%", limit)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    message := &Message{}
+    var editedAt sql.NullTime
+    var readAt sql.NullTime
+    var parentId sql.NullInt64
+    var width sql.NullInt64
+    var height sql.NullInt64
+    var length sql.NullInt64
+    var source sql.NullString
+    var filename sql.NullString
+    var sizeBytes sql.NullInt64
+    if err := rows.Scan(&message.ID, &message.Sender, &message.Recipient, &message.MessageType,
+                        &message.Content, &message.CreatedAt, &editedAt, &readAt, &parentId, &message.Status,
+                        &width, &height, &length, &source, &filename, &sizeBytes); err != nil {
+      return nil, err
+    }
+    message.Edited = editedAt.Valid
+    message.EditedAt = nullTimeToPointer(editedAt)
+    message.ReadAt = nullTimeToPointer(readAt)
+    message.ReplyTo = nullInt64ToPointer(parentId)
+    message.Metadata, err = client.metadataFromColumns(message.ID, message.MessageType, width, height,
+                                                       length, source, filename, sizeBytes)
+    if err != nil {
+      return nil, err
+    }
+    messages = append(messages, message)
+  }
+  if err = rows.Err(); err != nil {
+    return nil, err
+  }
+  if err = client.attachReactions(ctx, messages); err != nil {
+    return nil, err
+  }
+  return messages, nil
+}
+
+// Fills in the reaction counts of the given messages.
+func (client *ChatSQLClient) attachReactions(ctx context.Context, messages []*Message) error {
+  if len(messages) == 0 {
+    return nil
+  }
+  ids := make([]interface{}, len(messages))
+  messagesById := make(map[int64]*Message, len(messages))
+  for i, message := range messages {
+    ids[i] = message.ID
+    messagesById[message.ID] = message
+  }
+  placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+  rows, err := client.db.QueryContext(ctx, fmt.Sprintf(COUNT_REACTIONS_FOR_MESSAGES, placeholders), ids...)
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var messageId int64
+    var emoji string
+    var count int
+    if err := rows.Scan(&messageId, &emoji, &count); err != nil {
+      return err
+    }
+    message := messagesById[messageId]
+    if message.Reactions == nil {
+      message.Reactions = make(map[string]int)
+    }
+    message.Reactions[emoji] = count
+  }
+  return rows.Err()
+}
+
+// Counts the messages between two users, in either direction.
+func (client *ChatSQLClient) GetMessageCount(ctx context.Context, senderName string, recipientName string) (count int64, err error) {
+  defer client.observeQuery("GetMessageCount", time.Now())
+  senderId, err := client.getUserId(ctx, senderName)
+  if err != nil {
+    return 0, err
+  }
+  recipientId, err := client.getUserId(ctx, recipientName)
+  if err != nil {
+    return 0, err
+  }
+  err = client.db.QueryRowContext(ctx, COUNT_MESSAGES_BETWEEN_USERS, senderId, recipientId,
+                                  recipientId, senderId).Scan(&count)
+  return count, err
+}
+
+// Gets the conversations a user is part of, with the latest message of each.
+func (client *ChatSQLClient) FetchConversations(ctx context.Context, username string) (conversations []*Conversation, err error) {
+  defer client.observeQuery("FetchConversations", time.Now())
+  userId, err := client.getUserId(ctx, username)
+  if err != nil {
+    return nil, err
+  }
+  rows, err := client.db.QueryContext(ctx, SELECT_CONVERSATIONS, userId, userId, userId, userId)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    conversation := &Conversation{}
+    if err := rows.Scan(&conversation.Counterpart, &conversation.LastMessage,
+                        &conversation.LastMessageType, &conversation.LastMessageAt); err != nil {
+      return nil, err
+    }
+    conversations = append(conversations, conversation)
+  }
+  return conversations, rows.Err()
+}
+
+// Marks every unread message from sender to recipient as read now.
+func (client *ChatSQLClient) MarkMessagesRead(ctx context.Context, recipientName string, senderName string) error {
+  defer client.observeQuery("MarkMessagesRead", time.Now())
+  recipientId, err := client.getUserId(ctx, recipientName)
+  if err != nil {
+    return err
+  }
+  senderId, err := client.getUserId(ctx, senderName)
+  if err != nil {
+    return err
+  }
+  _, err = client.db.ExecContext(ctx, UPDATE_MESSAGES_READ, recipientId, senderId)
+  return err
+}
+
+// Marks the message as read by its recipient.
+// Returns ErrMessageNotFound if there's no such message, or
+// ErrNotMessageRecipient if the reader isn't its recipient. Room messages
+// have no single recipient, so they can't be marked read.
+func (client *ChatSQLClient) MarkMessageRead(ctx context.Context, messageId int64, readerName string) error {
+  defer client.observeQuery("MarkMessageRead", time.Now())
+  var recipientId sql.NullInt64
+  err := client.db.QueryRowContext(ctx, SELECT_MESSAGE_RECIPIENT, messageId).Scan(&recipientId)
+  if err == sql.ErrNoRows {
+    return ErrMessageNotFound
+  } else if err != nil {
+    return err
+  }
+  readerId, err := client.getUserId(ctx, readerName)
+  if err != nil && !errors.Is(err, ErrUserNotFound) {
+    return err
+  }
+  if err != nil || !recipientId.Valid || recipientId.Int64 != readerId {
+    return ErrNotMessageRecipient
+  }
+  // Already read messages keep their read_at, so this is idempotent.
+  _, err = client.db.ExecContext(ctx, UPDATE_MESSAGE_READ, messageId)
+  return err
+}
+
+// Marks every message from sender to recipient that's only been sent as
+// delivered. Read messages stay read.
+func (client *ChatSQLClient) MarkMessagesDelivered(ctx context.Context, recipientName string, senderName string) error {
+  defer client.observeQuery("MarkMessagesDelivered", time.Now())
+  recipientId, err := client.getUserId(ctx, recipientName)
+  if err != nil {
+    return err
+  }
+  senderId, err := client.getUserId(ctx, senderName)
+  if err != nil {
+    return err
+  }
+  _, err = client.db.ExecContext(ctx, UPDATE_MESSAGES_DELIVERED, recipientId, senderId)
+  return err
+}
+
+// Moves the message's status forward, e.g. from sent to delivered.
+// Moving to read also records when it was read, as MarkMessageRead does.
+// Returns ErrInvalidMessageStatus for unknown statuses, ErrMessageNotFound if
+// there's no such message, ErrNotMessageRecipient for room messages, which
+// have no single recipient, or ErrMessageStatusRegression if the message is
+// already past the status.
+func (client *ChatSQLClient) UpdateMessageStatus(ctx context.Context, messageId int64, status string) error {
+  defer client.observeQuery("UpdateMessageStatus", time.Now())
+  rank, ok := MESSAGE_STATUS_RANKS[status]
+  if !ok {
+    return fmt.Errorf("%w, got %q", ErrInvalidMessageStatus, status)
+  }
+  var current string
+  var recipientId sql.NullInt64
+  err := client.db.QueryRowContext(ctx, SELECT_MESSAGE_STATUS, messageId).Scan(&current, &recipientId)
+  if err == sql.ErrNoRows {
+    return ErrMessageNotFound
+  } else if err != nil {
+    return err
+  }
+  if !recipientId.Valid {
+    return ErrNotMessageRecipient
+  }
+  if rank < MESSAGE_STATUS_RANKS[current] {
+    return fmt.Errorf("%w, message %d is already %s", ErrMessageStatusRegression, messageId, current)
+  }
+  if status == current {
+    return nil
+  }
+  if status == MESSAGE_STATUS_READ {
+    _, err = client.db.ExecContext(ctx, UPDATE_MESSAGE_READ, messageId)
+    return err
+  }
+  _, err = client.db.ExecContext(ctx, UPDATE_MESSAGE_STATUS, status, messageId, status)
+  return err
+}
+
+// Counts the unread messages sent to a user. If senderName isn't empty,
+// only messages from that sender are counted.
+func (client *ChatSQLClient) CountUnread(ctx context.Context, recipientName string, senderName string) (count int, err error) {
+  defer client.observeQuery("CountUnread", time.Now())
+  recipientId, err := client.getUserId(ctx, recipientName)
+  if err != nil {
+    return 0, err
+  }
+  if len(senderName) == 0 {
+    err = client.db.QueryRowContext(ctx, COUNT_UNREAD_MESSAGES, recipientId).Scan(&count)
+    return count, err
+  }
+  senderId, err := client.getUserId(ctx, senderName)
+  if err != nil {
+    return 0, err
+  }
+  err = client.db.QueryRowContext(ctx, COUNT_UNREAD_MESSAGES_FROM_SENDER, recipientId, senderId).Scan(&count)
+  return count, err
+}
+
+// Counts the unread messages sent to recipient by each sender, in one query.
+func (client *ChatSQLClient) GetUnreadCounts(ctx context.Context, recipientName string) (counts map[string]int, err error) {
+  defer client.observeQuery("GetUnreadCounts", time.Now())
+  recipientId, err := client.getUserId(ctx, recipientName)
+  if err != nil {
+    return nil, err
+  }
+  rows, err := client.db.QueryContext(ctx, COUNT_UNREAD_MESSAGES_BY_SENDER, recipientId)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  counts = make(map[string]int)
+  for rows.Next() {
+    var senderName string
+    var count int
+    if err := rows.Scan(&senderName, &count); err != nil {
+      return nil, err
+    }
+    counts[senderName] = count
+  }
+  return counts, rows.Err()
+}
+
+// Adds a user's reaction to a message. Reacting twice with the same emoji
+// has no further effect.
+// Returns ErrMessageNotFound if there is no such message.
+func (client *ChatSQLClient) AddReaction(ctx context.Context, messageId int64, username string, emoji string) error {
+  defer client.observeQuery("AddReaction", time.Now())
+  userId, err := client.getReactingUserId(ctx, messageId, username)
+  if err != nil {
+    return err
+  }
+  _, err = client.db.ExecContext(ctx, INSERT_REACTION, messageId, userId, emoji)
+  return client.recheckUserIds(ctx, err, username)
+}
+
+// Removes a user's reaction from a message, if there is one.
+// Returns ErrMessageNotFound if there is no such message.
+func (client *ChatSQLClient) RemoveReaction(ctx context.Context, messageId int64, username string, emoji string) error {
+  defer client.observeQuery("RemoveReaction", time.Now())
+  userId, err := client.getReactingUserId(ctx, messageId, username)
+  if err != nil {
+    return err
+  }
+  _, err = client.db.ExecContext(ctx, DELETE_REACTION, messageId, userId, emoji)
+  return err
+}
+
+// Checks that the message exists and gets the id of the reacting user.
+func (client *ChatSQLClient) getReactingUserId(ctx context.Context, messageId int64, username string) (userId int64, err error) {
+  var found int64
+  err = client.db.QueryRowContext(ctx, SELECT_MESSAGE_ID, messageId).Scan(&found)
+  if err == sql.ErrNoRows {
+    return -1, ErrMessageNotFound
+  } else if err != nil {
+    return -1, err
+  }
+  return client.getUserId(ctx, username)
+}
+
+// Replaces the content of a plaintext message sent by the requester and
+// records when it was edited.
+// Returns ErrMessageNotFound if there is no such message,
+// ErrNotMessageSender if the requester didn't send it, or
+// ErrMessageNotEditable if it isn't a plaintext message.
+func (client *ChatSQLClient) EditMessage(ctx context.Context, messageId int64, requesterName string, newContent string) error {
+  defer client.observeQuery("EditMessage", time.Now())
+  tx, err := client.db.BeginTx(ctx, nil)
+  if err != nil {
+    return err
+  }
+  var senderId int64
+  var messageType string
+  err = tx.QueryRowContext(ctx, SELECT_MESSAGE_TYPE_FOR_UPDATE, messageId).Scan(&senderId, &messageType)
+  if err == sql.ErrNoRows {
+    tx.Rollback()
+    return ErrMessageNotFound
+  } else if err != nil {
+    tx.Rollback()
+    return err
+  }
+  requesterId, err := client.getUserId(ctx, requesterName)
+  if err != nil && !errors.Is(err, ErrUserNotFound) {
+    tx.Rollback()
+    return err
+  }
+  if err != nil || requesterId != senderId {
+    tx.Rollback()
+    return ErrNotMessageSender
+  }
+  if messageType != MESSAGE_TYPE_PLAINTEXT {
+    tx.Rollback()
+    return ErrMessageNotEditable
+  }
+  if _, err = tx.ExecContext(ctx, UPDATE_MESSAGE_CONTENT, newContent, messageId); err != nil {
+    tx.Rollback()
+    return err
+  }
+  if err = tx.Commit(); err != nil {
+    tx.Rollback()
+    return err
+  }
+  return nil
+}
+
+// Deletes a message sent by the requester, along with its metadata.
+// Returns ErrMessageNotFound if there is no such message, or
+// ErrNotMessageSender if the requester didn't send it.
+func (client *ChatSQLClient) DeleteMessage(ctx context.Context, messageId int64, requesterName string) error {
+  defer client.observeQuery("DeleteMessage", time.Now())
+  tx, err := client.db.BeginTx(ctx, nil)
+  if err != nil {
+    return err
+  }
+  // Lock the row so the metadata id can't change before we delete it.
+  var senderId int64
+  var metadataId sql.NullInt64
+  err = tx.QueryRowContext(ctx, SELECT_MESSAGE_SENDER_FOR_UPDATE, messageId).Scan(&senderId, &metadataId)
+  if err == sql.ErrNoRows {
+    tx.Rollback()
+    return ErrMessageNotFound
+  } else if err != nil {
+    tx.Rollback()
+    return err
+  }
+  requesterId, err := client.getUserId(ctx, requesterName)
+  if err != nil && !errors.Is(err, ErrUserNotFound) {
+    tx.Rollback()
+    return err
+  }
+  if err != nil || requesterId != senderId {
+    tx.Rollback()
+    return ErrNotMessageSender
+  }
+  // Delete the message first, since it references the metadata.
+  if _, err = tx.ExecContext(ctx, DELETE_MESSAGE, messageId); err != nil {
+    tx.Rollback()
+    return err
+  }
+  if metadataId.Valid {
+    if _, err = tx.ExecContext(ctx, DELETE_MESSAGES_METADATA, metadataId.Int64); err != nil {
+      tx.Rollback()
+      return err
+    }
+  }
+  if err = tx.Commit(); err != nil {
+    tx.Rollback()
+    return err
+  }
+  return nil
+}
+
+// Converts a nullable column to a pointer, which is nil for NULL.
+func nullTimeToPointer(t sql.NullTime) *time.Time {
+  if !t.Valid {
+    return nil
+  }
+  return &t.Time
+}
+
+// Converts a NULL-able integer column to a pointer, nil for NULL.
+func nullInt64ToPointer(n sql.NullInt64) *int64 {
+  if !n.Valid {
+    return nil
+  }
+  return &n.Int64
+}
+
+// Builds the metadata for a message from its joined metadata columns.
+// Returns nil for plaintext messages.
+func (client *ChatSQLClient) metadataFromColumns(id int64, messageType string, width sql.NullInt64,
+                                                height sql.NullInt64, length sql.NullInt64,
+                                                source sql.NullString, filename sql.NullString,
+                                                sizeBytes sql.NullInt64) (*MessageMetadata, error) {
+  switch messageType {
+  case MESSAGE_TYPE_PLAINTEXT:
+    return nil, nil
+  // Media messages should always have metadata, but if the row is missing
+  // it, return the message without any rather than made-up zero values.
+  case MESSAGE_TYPE_IMAGE_LINK:
+    if !width.Valid || !height.Valid {
+      client.logger.Warnf("%s message %d is missing its metadata", messageType, id)
+      return nil, nil
+    }
+    return &MessageMetadata {
+      Width: int(width.Int64),
+      Height: int(height.Int64),
+    }, nil
+  case MESSAGE_TYPE_VIDEO_LINK:
+    if !length.Valid || !source.Valid {
+      client.logger.Warnf("%s message %d is missing its metadata", messageType, id)
+      return nil, nil
+    }
+    return &MessageMetadata {
+      Length: int(length.Int64),
+      Source: source.String,
+    }, nil
+  case MESSAGE_TYPE_FILE:
+    if !filename.Valid {
+      client.logger.Warnf("%s message %d is missing its metadata", messageType, id)
+      return nil, nil
+    }
+    return &MessageMetadata {
+      Filename: filename.String,
+      SizeBytes: sizeBytes.Int64,
+    }, nil
+  default:
+    // Should never get here.
+    return nil, errors.New(fmt.Sprintf("Unknown message type %s", messageType))
+  }
+}
+
+// Escapes the LIKE wildcards (and the escape character itself) in s so it
+// is matched literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func escapeLike(s string) string {
+  return likeEscaper.Replace(s)
+}
+
+// Checks that the database is reachable.
+func (client *ChatSQLClient) Ping(ctx context.Context) error {
+  return client.db.PingContext(ctx)
+}
+
+// Prepares the frequently used statements.
+// On error, any statements already prepared are closed.
+func (client *ChatSQLClient) prepareStatements() (err error) {
+  prepare := func(query string) *sql.Stmt {
+    if err != nil {
+      return nil
+    }
+    stmt, prepareErr := client.db.Prepare(query)
+    if prepareErr != nil {
+      err = errors.New(fmt.Sprintf("couldn't prepare %q: %s", query, prepareErr.Error()))
+      return nil
+    }
+    client.statements = append(client.statements, stmt)
+    return stmt
+  }
+  client.insertUser = prepare(INSERT_USER)
+  client.selectUserId = prepare(SELECT_ID_FROM_USERNAME)
+  client.insertMessage = prepare(INSERT_MESSAGE)
+  client.insertMessageWithNoMetadata = prepare(INSERT_MESSAGE_WITH_NO_METADATA)
+  client.insertImageMetadata = prepare(INSERT_MESSAGES_IMAGE_METADATA)
+  client.insertVideoMetadata = prepare(INSERT_MESSAGES_VIDEO_METADATA)
+  client.insertFileMetadata = prepare(INSERT_MESSAGES_FILE_METADATA)
+  client.selectMessages = prepare(SELECT_MESSAGES_BETWEEN_USERS)
+  client.selectMessagesWithLimit = prepare(SELECT_MESSAGES_BETWEEN_USERS_WITH_LIMIT)
+  if err != nil {
+    client.closeStatements()
+  }
+  return err
+}
+
+// Closes every prepared statement.
+func (client *ChatSQLClient) closeStatements() {
+  for _, stmt := range client.statements {
+    if err := stmt.Close(); err != nil {
+      client.logger.Errorf("Error closing prepared statement: %s", err.Error())
+    }
+  }
+  client.statements = nil
+}
+
+// Closes the prepared statements and the connection to the database.
+func (client *ChatSQLClient) Close() error {
+  client.closeStatements()
+  return client.db.Close()
+}
+
 // Factory for creating a new client with the given connection information.
-func NewChatSqlClient(driverName string, dataSourceName string) (*ChatSQLClient, error) {
+// A nil pool means the default pool settings are used, and a nil logger
+// logs at DEFAULT_LOG_LEVEL.
+// sql.Open doesn't connect, so the db is pinged to make sure it's reachable,
+// retrying with backoff as configured by the pool.
+// The schema is then migrated to the latest version, and the frequently used
+// statements are prepared.
+func NewChatSqlClient(driverName string, dataSourceName string, pool *PoolConfig,
+                      logger Logger) (*ChatSQLClient, error) {
+  if pool == nil {
+    pool = DefaultPoolConfig()
+  }
+  if logger == nil {
+    logger = NewLogger(DEFAULT_LOG_LEVEL)
+  }
   db, err := sql.Open(driverName, dataSourceName)
   if err != nil {
     return nil, err
   }
+  db.SetMaxOpenConns(pool.MaxOpenConns)
+  db.SetMaxIdleConns(pool.MaxIdleConns)
+  db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+  if err = pingWithRetry(db, pool.PingAttempts, pool.PingBackoff, logger); err != nil {
+    db.Close()
+    return nil, err
+  }
   client := &ChatSQLClient{
     db: db,
+    userIds: make(map[string]int64),
+    retryAttempts: pool.RetryAttempts,
+    retryBackoff: pool.RetryBackoff,
+    logger: logger,
+    queryDuration: newQueryDurationMetric(),
+  }
+  // Statements can only be prepared once the tables they use exist.
+  if err = client.Migrate(context.Background()); err != nil {
+    db.Close()
+    return nil, err
+  }
+  if err = client.prepareStatements(); err != nil {
+    db.Close()
+    return nil, err
   }
   return client, nil
 }
+
+// Calls attempt until it succeeds, fails with an error that isn't transient,
+// or client.retryAttempts run out, doubling the wait between attempts.
+// attempt must be safe to repeat after a transient error, i.e. anything it
+// wrote must have been rolled back. Returns the last error.
+func (client *ChatSQLClient) retry(ctx context.Context, name string, attempt func() error) error {
+  backoff := client.retryBackoff
+  for i := 1; ; i++ {
+    err := attempt()
+    if err == nil || !isTransientError(err) || i >= client.retryAttempts {
+      return err
+    }
+    client.logger.Warnf("%s hit a transient db error (attempt %d of %d), retrying in %s: %s",
+                        name, i, client.retryAttempts, backoff, err.Error())
+    select {
+    case <-ctx.Done():
+      return err
+    case <-time.After(backoff):
+    }
+    backoff *= 2
+  }
+}
+
+// Returns whether the error is a deadlock or lock wait timeout, after which
+// MySQL has rolled back the statement or transaction, so trying again can
+// succeed. Lost connections aren't included, since a write may have gone
+// through before the connection dropped. database/sql already retries
+// queries that fail before reaching the db.
+func isTransientError(err error) bool {
+  var mysqlErr *mysql.MySQLError
+  if !errors.As(err, &mysqlErr) {
+    return false
+  }
+  return mysqlErr.Number == MYSQL_ERR_LOCK_DEADLOCK || mysqlErr.Number == MYSQL_ERR_LOCK_WAIT_TIMEOUT
+}
+
+// Pings the db until it responds or the attempts run out, doubling the wait
+// between attempts. Returns the last error if the db never responds.
+func pingWithRetry(db *sql.DB, attempts int, backoff time.Duration, logger Logger) (err error) {
+  for attempt := 1; ; attempt++ {
+    if err = db.Ping(); err == nil {
+      return nil
+    }
+    if attempt >= attempts {
+      return errors.New(fmt.Sprintf("db unreachable after %d attempts: %s", attempt, err.Error()))
+    }
+    logger.Warnf("Couldn't reach db (attempt %d of %d), retrying in %s: %s", attempt, attempts, backoff, err.Error())
+    time.Sleep(backoff)
+    backoff *= 2
+  }
+}
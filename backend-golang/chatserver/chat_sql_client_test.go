@@ -0,0 +1,616 @@
+package chatserver
+
+import (
+  "context"
+  "database/sql"
+  "errors"
+  "fmt"
+  "net"
+  "os"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/go-sql-driver/mysql"
+)
+
+// Environment variable with the DSN of a MySQL db the SQL client tests may
+// wipe, e.g. "root:testpass@tcp(localhost:3306)/chat_test?parseTime=true".
+// The tests are skipped if it isn't set.
+const ENV_TEST_DSN = "CHAT_TEST_DSN"
+
+// Tables the tests empty before each test, children first so foreign keys
+// don't get in the way.
+var TEST_TABLES = []string{"reactions", "messages", "messages_metadata", "room_members", "rooms", "blocks", "users"}
+
+// Returns a client connected to the test db, with every table emptied.
+// Skips the test if ENV_TEST_DSN isn't set.
+func newTestSQLClient(t *testing.T) *ChatSQLClient {
+  t.Helper()
+  dsn := os.Getenv(ENV_TEST_DSN)
+  if len(dsn) == 0 {
+    t.Skipf("%s isn't set", ENV_TEST_DSN)
+  }
+  pool := DefaultPoolConfig()
+  pool.PingAttempts = 1
+  client, err := NewChatSqlClient(DRIVER_NAME, dsn, pool, &recordingLogger{})
+  if err != nil {
+    t.Fatalf("NewChatSqlClient: %s", err.Error())
+  }
+  t.Cleanup(func() { client.Close() })
+  for _, table := range TEST_TABLES {
+    if _, err := client.db.Exec("DELETE FROM " + table); err != nil {
+      t.Fatalf("couldn't empty %s: %s", table, err.Error())
+    }
+  }
+  return client
+}
+
+// Returns the first column, the message id, of every row.
+func scanIds(t *testing.T, rows *sql.Rows) (ids []int64) {
+  t.Helper()
+  defer rows.Close()
+  columns, err := rows.Columns()
+  if err != nil {
+    t.Fatalf("Columns: %s", err.Error())
+  }
+  values := make([]interface{}, len(columns))
+  for i := range values {
+    values[i] = new(sql.RawBytes)
+  }
+  var id int64
+  values[0] = &id
+  for rows.Next() {
+    if err := rows.Scan(values...); err != nil {
+      t.Fatalf("Scan: %s", err.Error())
+    }
+    ids = append(ids, id)
+  }
+  if err := rows.Err(); err != nil {
+    t.Fatalf("rows: %s", err.Error())
+  }
+  return ids
+}
+
+func TestSQLPreparedStatementsMatchInlineQueries(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1", "user2")
+  metadata := map[string]*MessageMetadata{
+    MESSAGE_TYPE_PLAINTEXT: nil,
+    MESSAGE_TYPE_IMAGE_LINK: &MessageMetadata{Width: 640, Height: 480},
+    MESSAGE_TYPE_VIDEO_LINK: &MessageMetadata{Length: 30, Source: "youtube"},
+    MESSAGE_TYPE_FILE: &MessageMetadata{Filename: "notes.txt", SizeBytes: 1024},
+  }
+  contents := map[string]string{
+    MESSAGE_TYPE_PLAINTEXT: "Hi there!",
+    MESSAGE_TYPE_IMAGE_LINK: "https://example.com/cat.png",
+    MESSAGE_TYPE_VIDEO_LINK: "https://example.com/cat.mp4",
+    MESSAGE_TYPE_FILE: "https://example.com/notes.txt",
+  }
+  for messageType, content := range contents {
+    if _, err := client.AddMessage(ctx, "user1", "user2", messageType, content, metadata[messageType], 0); err != nil {
+      t.Fatalf("AddMessage %s: %s", messageType, err.Error())
+    }
+  }
+  user1, err := client.getUserId(ctx, "user1")
+  if err != nil {
+    t.Fatalf("getUserId: %s", err.Error())
+  }
+  user2, err := client.getUserId(ctx, "user2")
+  if err != nil {
+    t.Fatalf("getUserId: %s", err.Error())
+  }
+  since, until := createdAtBounds(&FetchMessagesParams{})
+  args := []interface{}{user1, user2, user2, user1, since, until}
+
+  prepared, err := client.selectMessages.QueryContext(ctx, args...)
+  if err != nil {
+    t.Fatalf("prepared query: %s", err.Error())
+  }
+  inline, err := client.db.QueryContext(ctx, SELECT_MESSAGES_BETWEEN_USERS, args...)
+  if err != nil {
+    t.Fatalf("inline query: %s", err.Error())
+  }
+  preparedIds, inlineIds := scanIds(t, prepared), scanIds(t, inline)
+  if len(preparedIds) != len(contents) || len(preparedIds) != len(inlineIds) {
+    t.Fatalf("got %d rows prepared and %d inline, want %d", len(preparedIds), len(inlineIds), len(contents))
+  }
+  for i := range preparedIds {
+    if preparedIds[i] != inlineIds[i] {
+      t.Errorf("row %d: prepared id %d, inline id %d", i, preparedIds[i], inlineIds[i])
+    }
+  }
+
+  // Each message comes back with the metadata it was stored with.
+  messages, err := client.FetchMessages(ctx, &FetchMessagesParams{senderName: "user1", recipientName: "user2"})
+  if err != nil {
+    t.Fatalf("FetchMessages: %s", err.Error())
+  }
+  for _, message := range messages {
+    want := metadata[message.MessageType]
+    if (want == nil) != (message.Metadata == nil) || (want != nil && *want != *message.Metadata) {
+      t.Errorf("%s message has metadata %+v, want %+v", message.MessageType, message.Metadata, want)
+    }
+  }
+}
+
+func TestMetadataFromColumnsWarnsWhenMissing(t *testing.T) {
+  logger := &recordingLogger{}
+  client := &ChatSQLClient{logger: logger}
+  var none sql.NullInt64
+  for _, messageType := range []string{MESSAGE_TYPE_IMAGE_LINK, MESSAGE_TYPE_VIDEO_LINK, MESSAGE_TYPE_FILE} {
+    metadata, err := client.metadataFromColumns(7, messageType, none, none, none, sql.NullString{}, sql.NullString{}, none)
+    if err != nil || metadata != nil {
+      t.Errorf("%s: got metadata %+v and error %v, want neither", messageType, metadata, err)
+    }
+    if !logger.logged(LOG_LEVEL_WARN, messageType + " message 7 is missing its metadata") {
+      t.Errorf("%s: missing metadata wasn't warned about", messageType)
+    }
+  }
+  // Plaintext messages have no metadata to miss.
+  if _, err := client.metadataFromColumns(8, MESSAGE_TYPE_PLAINTEXT, none, none, none, sql.NullString{}, sql.NullString{}, none); err != nil {
+    t.Errorf("plaintext: got error %s", err.Error())
+  }
+  if logger.logged(LOG_LEVEL_WARN, "message 8") {
+    t.Errorf("plaintext message was warned about")
+  }
+}
+
+func TestSQLFetchMessagesWithMissingMetadata(t *testing.T) {
+  client := newTestSQLClient(t)
+  logger := &recordingLogger{}
+  client.logger = logger
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1", "user2")
+  user1, err := client.getUserId(ctx, "user1")
+  if err != nil {
+    t.Fatalf("getUserId: %s", err.Error())
+  }
+  user2, err := client.getUserId(ctx, "user2")
+  if err != nil {
+    t.Fatalf("getUserId: %s", err.Error())
+  }
+  // An image message whose metadata was never inserted.
+  if _, err := client.db.Exec(INSERT_MESSAGE_WITH_NO_METADATA, user1, user2, nil, nil,
+                              MESSAGE_TYPE_IMAGE_LINK, "https://example.com/cat.png"); err != nil {
+    t.Fatalf("insert: %s", err.Error())
+  }
+  messages, err := client.FetchMessages(ctx, &FetchMessagesParams{senderName: "user1", recipientName: "user2"})
+  if err != nil {
+    t.Fatalf("FetchMessages: %s", err.Error())
+  }
+  if len(messages) != 1 || messages[0].Metadata != nil {
+    t.Fatalf("got %+v, want the one message without metadata", messages)
+  }
+  if !logger.logged(LOG_LEVEL_WARN, "is missing its metadata") {
+    t.Errorf("missing metadata wasn't warned about")
+  }
+}
+
+func TestEscapeLike(t *testing.T) {
+  for s, want := range map[string]string{
+    "hello": "hello",
+    "100%": `100\%`,
+    "snake_case": `snake\_case`,
+    `back\slash`: `back\\slash`,
+  } {
+    if got := escapeLike(s); got != want {
+      t.Errorf("escapeLike(%q) = %q, want %q", s, got, want)
+    }
+  }
+}
+
+func TestSQLSearchMessages(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1", "user2", "user3")
+  for _, message := range []struct{ sender, recipient, content string }{
+    {"user1", "user2", "100% sure"},
+    {"user1", "user2", "1000 times"},
+    {"user2", "user1", "snake_case"},
+    {"user1", "user2", "snakeXcase"},
+    {"user2", "user3", "snake_case for user3"},
+  } {
+    if _, err := client.AddMessage(ctx, message.sender, message.recipient, MESSAGE_TYPE_PLAINTEXT, message.content, nil, 0); err != nil {
+      t.Fatalf("AddMessage: %s", err.Error())
+    }
+  }
+  for query, want := range map[string]string{"0%": "100% sure", "e_c": "snake_case"} {
+    messages, err := client.SearchMessages(ctx, "user1", query, MESSAGE_SEARCH_LIMIT)
+    if err != nil {
+      t.Fatalf("SearchMessages: %s", err.Error())
+    }
+    if len(messages) != 1 || messages[0].Content != want {
+      t.Errorf("%q: got %+v, want only %q", query, messages, want)
+    }
+  }
+}
+
+func TestSQLStoreErrors(t *testing.T) {
+  testStoreErrors(t, newTestSQLClient(t))
+}
+
+func TestSQLUpdateUserCredentials(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1")
+  if err := client.UpdateUserCredentials(ctx, "user1", []byte("new hash")); err != nil {
+    t.Fatalf("UpdateUserCredentials: %s", err.Error())
+  }
+  hash, err := client.GetUserCredentials(ctx, "user1")
+  if err != nil {
+    t.Fatalf("GetUserCredentials: %s", err.Error())
+  }
+  if string(hash) != "new hash" {
+    t.Errorf("got hash %q, want the new one", hash)
+  }
+  if err := client.UpdateUserCredentials(ctx, "nobody", []byte("new hash")); !errors.Is(err, ErrUserNotFound) {
+    t.Errorf("got error %v for a missing user, want ErrUserNotFound", err)
+  }
+}
+
+func TestSQLAddMessagesIsAllOrNothing(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1", "user2", "user3")
+  if _, err := client.AddMessages(ctx, "user1", []string{"user2", "nobody", "user3"}, MESSAGE_TYPE_PLAINTEXT, "Hi all!", nil); !errors.Is(err, ErrUserNotFound) {
+    t.Fatalf("got error %v, want ErrUserNotFound", err)
+  }
+  count, err := client.GetMessageCount(ctx, "user1", "user2")
+  if err != nil {
+    t.Fatalf("GetMessageCount: %s", err.Error())
+  }
+  if count != 0 {
+    t.Errorf("user2 got %d messages from the failed batch", count)
+  }
+  messages, err := client.AddMessages(ctx, "user1", []string{"user2", "user3"}, MESSAGE_TYPE_PLAINTEXT, "Hi all!", nil)
+  if err != nil {
+    t.Fatalf("AddMessages: %s", err.Error())
+  }
+  if len(messages) != 2 || messages[0].Recipient != "user2" || messages[1].Recipient != "user3" {
+    t.Errorf("got %+v, want one message each to user2 and user3", messages)
+  }
+}
+
+func TestSQLFetchConversations(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1", "user2", "user3", "user4")
+  for _, message := range []struct{ sender, recipient, content string }{
+    {"user1", "user2", "first to user2"},
+    {"user3", "user1", "from user3"},
+    {"user2", "user1", "reply from user2"},
+    {"user3", "user4", "not for user1"},
+  } {
+    if _, err := client.AddMessage(ctx, message.sender, message.recipient, MESSAGE_TYPE_PLAINTEXT, message.content, nil, 0); err != nil {
+      t.Fatalf("AddMessage: %s", err.Error())
+    }
+  }
+  conversations, err := client.FetchConversations(ctx, "user1")
+  if err != nil {
+    t.Fatalf("FetchConversations: %s", err.Error())
+  }
+  // Most recent first, going by id since messages sent within the same
+  // second tie on time.
+  want := []Conversation{
+    {Counterpart: "user2", LastMessage: "reply from user2"},
+    {Counterpart: "user3", LastMessage: "from user3"},
+  }
+  if len(conversations) != len(want) {
+    t.Fatalf("got %d conversations, want %d", len(conversations), len(want))
+  }
+  for i, conversation := range conversations {
+    if conversation.Counterpart != want[i].Counterpart || conversation.LastMessage != want[i].LastMessage {
+      t.Errorf("conversation %d is %+v, want %s's latest, %q", i, conversation, want[i].Counterpart, want[i].LastMessage)
+    }
+  }
+}
+
+func TestSQLUnreadCounts(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1", "user2", "user3")
+  counts, err := client.GetUnreadCounts(ctx, "user1")
+  if err != nil {
+    t.Fatalf("GetUnreadCounts: %s", err.Error())
+  }
+  if len(counts) != 0 {
+    t.Errorf("got %v before any messages, want none", counts)
+  }
+  var first *Message
+  for _, sender := range []string{"user2", "user2", "user3"} {
+    message, err := client.AddMessage(ctx, sender, "user1", MESSAGE_TYPE_PLAINTEXT, "Hi there!", nil, 0)
+    if err != nil {
+      t.Fatalf("AddMessage: %s", err.Error())
+    }
+    if first == nil {
+      first = message
+    }
+  }
+  if err := client.MarkMessageRead(ctx, first.ID, "user1"); err != nil {
+    t.Fatalf("MarkMessageRead: %s", err.Error())
+  }
+  if counts, err = client.GetUnreadCounts(ctx, "user1"); err != nil {
+    t.Fatalf("GetUnreadCounts: %s", err.Error())
+  }
+  if len(counts) != 2 || counts["user2"] != 1 || counts["user3"] != 1 {
+    t.Errorf("got %v, want 1 each from user2 and user3", counts)
+  }
+}
+
+func TestSQLReplies(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1", "user2", "user3")
+  parent, err := client.AddMessage(ctx, "user1", "user2", MESSAGE_TYPE_PLAINTEXT, "I like cats", nil, 0)
+  if err != nil {
+    t.Fatalf("AddMessage: %s", err.Error())
+  }
+  reply, err := client.AddMessage(ctx, "user2", "user1", MESSAGE_TYPE_PLAINTEXT, "Me too!", nil, parent.ID)
+  if err != nil {
+    t.Fatalf("AddMessage reply: %s", err.Error())
+  }
+  if _, err := client.AddMessage(ctx, "user3", "user1", MESSAGE_TYPE_PLAINTEXT, "Me too!", nil, parent.ID); !errors.Is(err, ErrInvalidReply) {
+    t.Errorf("got error %v replying from another conversation, want ErrInvalidReply", err)
+  }
+  messages, err := client.FetchMessages(ctx, &FetchMessagesParams{senderName: "user1", recipientName: "user2"})
+  if err != nil {
+    t.Fatalf("FetchMessages: %s", err.Error())
+  }
+  if len(messages) != 2 || messages[1].ID != reply.ID || messages[1].ReplyTo == nil || *messages[1].ReplyTo != parent.ID {
+    t.Errorf("got %+v, want the parent then a reply to it", messages)
+  }
+}
+
+func TestNewChatSqlClientUnreachableDb(t *testing.T) {
+  // Nothing listens on a port that was just freed.
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Listen: %s", err.Error())
+  }
+  addr := listener.Addr().String()
+  listener.Close()
+  pool := DefaultPoolConfig()
+  pool.PingAttempts = 2
+  pool.PingBackoff = time.Millisecond
+  logger := &recordingLogger{}
+  client, err := NewChatSqlClient(DRIVER_NAME, "user:pass@tcp(" + addr + ")/chat?timeout=1s", pool, logger)
+  if err == nil {
+    client.Close()
+    t.Fatalf("got a client for an unreachable db")
+  }
+  if !strings.Contains(err.Error(), "after 2 attempts") {
+    t.Errorf("got error %q, want one saying how many attempts were made", err.Error())
+  }
+  if !logger.logged(LOG_LEVEL_WARN, "attempt 1 of 2") {
+    t.Errorf("the failed first attempt wasn't logged")
+  }
+}
+
+func TestSQLPoolSettings(t *testing.T) {
+  client := newTestSQLClient(t)
+  if got := client.db.Stats().MaxOpenConnections; got != DEFAULT_MAX_OPEN_CONNS {
+    t.Errorf("got max open connections %d, want %d", got, DEFAULT_MAX_OPEN_CONNS)
+  }
+}
+
+// Returns a client that retries up to attempts times, without a db, for
+// testing retry.
+func newRetryTestClient(attempts int) (*ChatSQLClient, *recordingLogger) {
+  logger := &recordingLogger{}
+  return &ChatSQLClient{retryAttempts: attempts, retryBackoff: time.Millisecond, logger: logger}, logger
+}
+
+func TestRetrySucceedsAfterTransientErrors(t *testing.T) {
+  client, logger := newRetryTestClient(3)
+  calls := 0
+  err := client.retry(context.Background(), "AddMessage", func() error {
+    calls++
+    if calls <= 2 {
+      return &mysql.MySQLError{Number: MYSQL_ERR_LOCK_DEADLOCK, Message: "Deadlock found"}
+    }
+    return nil
+  })
+  if err != nil || calls != 3 {
+    t.Errorf("got error %v after %d calls, want success on the third", err, calls)
+  }
+  if !logger.logged(LOG_LEVEL_WARN, "AddMessage hit a transient db error (attempt 2 of 3)") {
+    t.Errorf("retries weren't logged")
+  }
+}
+
+func TestRetryGivesUp(t *testing.T) {
+  lockTimeout := &mysql.MySQLError{Number: MYSQL_ERR_LOCK_WAIT_TIMEOUT, Message: "Lock wait timeout exceeded"}
+  tests := []struct {
+    name string
+    err error
+    calls int
+  }{
+    {"attempts run out", lockTimeout, 3},
+    {"wrapped transient error", fmt.Errorf("couldn't query messages: %w", lockTimeout), 3},
+    // Errors that would only happen again aren't retried.
+    {"validation error", userNotFound("nobody"), 1},
+    {"other mysql error", &mysql.MySQLError{Number: MYSQL_ERR_DUP_ENTRY, Message: "Duplicate entry"}, 1},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      client, _ := newRetryTestClient(3)
+      calls := 0
+      err := client.retry(context.Background(), "FetchMessages", func() error {
+        calls++
+        return test.err
+      })
+      if err != test.err || calls != test.calls {
+        t.Errorf("got error %v after %d calls, want %v after %d", err, calls, test.err, test.calls)
+      }
+    })
+  }
+}
+
+func TestRetryStopsWhenCanceled(t *testing.T) {
+  client, _ := newRetryTestClient(3)
+  client.retryBackoff = time.Hour
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  calls := 0
+  err := client.retry(ctx, "AddMessage", func() error {
+    calls++
+    return &mysql.MySQLError{Number: MYSQL_ERR_LOCK_DEADLOCK, Message: "Deadlock found"}
+  })
+  if err == nil || calls != 1 {
+    t.Errorf("got error %v after %d calls, want the first error without waiting", err, calls)
+  }
+}
+
+func TestSQLCanceledContext(t *testing.T) {
+  client := newTestSQLClient(t)
+  createStoreUsers(t, client, "user1", "user2")
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  if _, err := client.CreateUser(ctx, "user3", []byte("hash")); !errors.Is(err, context.Canceled) {
+    t.Errorf("CreateUser got error %v, want context.Canceled", err)
+  }
+  if _, err := client.AddMessage(ctx, "user1", "user2", MESSAGE_TYPE_PLAINTEXT, "Hi there!", nil, 0); !errors.Is(err, context.Canceled) {
+    t.Errorf("AddMessage got error %v, want context.Canceled", err)
+  }
+  if _, err := client.FetchMessages(ctx, &FetchMessagesParams{senderName: "user1", recipientName: "user2"}); !errors.Is(err, context.Canceled) {
+    t.Errorf("FetchMessages got error %v, want context.Canceled", err)
+  }
+  // Nothing was written.
+  if exists, err := client.CheckUserExists(context.Background(), "user3"); err != nil || exists {
+    t.Errorf("user3 exists %t (%v), want it not created", exists, err)
+  }
+}
+
+func TestSQLQueryAbortedByDeadline(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+  defer cancel()
+  start := time.Now()
+  // Stands in for an expensive query.
+  _, err := client.db.ExecContext(ctx, "SELECT SLEEP(5)")
+  if !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("got error %v, want context.DeadlineExceeded", err)
+  }
+  if elapsed := time.Since(start); elapsed > 2 * time.Second {
+    t.Errorf("query ran for %s past its deadline", elapsed)
+  }
+}
+
+func TestSQLSelfMessages(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1", "user2")
+  if _, err := client.AddMessage(ctx, "user1", "user2", MESSAGE_TYPE_PLAINTEXT, "not to self", nil, 0); err != nil {
+    t.Fatalf("AddMessage: %s", err.Error())
+  }
+  for i := 0; i < 3; i++ {
+    if _, err := client.AddMessage(ctx, "user1", "user1", MESSAGE_TYPE_PLAINTEXT, fmt.Sprintf("note %d", i), nil, 0); err != nil {
+      t.Fatalf("AddMessage: %s", err.Error())
+    }
+  }
+  messages, err := client.FetchMessages(ctx, &FetchMessagesParams{senderName: "user1", recipientName: "user1"})
+  if err != nil {
+    t.Fatalf("FetchMessages: %s", err.Error())
+  }
+  if len(messages) != 3 {
+    t.Fatalf("got %d self-messages, want 3", len(messages))
+  }
+  for i, message := range messages {
+    if message.Content != fmt.Sprintf("note %d", i) || message.Sender != "user1" || message.Recipient != "user1" {
+      t.Errorf("message %d is %+v, want note %d from user1 to user1", i, message, i)
+    }
+  }
+  if count, err := client.GetMessageCount(ctx, "user1", "user1"); err != nil || count != 3 {
+    t.Errorf("got count %d (%v), want 3", count, err)
+  }
+}
+
+// Returns how many rows the table has.
+func countRows(t *testing.T, client *ChatSQLClient, table string) (count int) {
+  t.Helper()
+  if err := client.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+    t.Fatalf("couldn't count %s: %s", table, err.Error())
+  }
+  return count
+}
+
+func TestSQLFailedMessageInsertRollsBack(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1", "user2")
+  recipientId, err := client.getUserId(ctx, "user2")
+  if err != nil {
+    t.Fatalf("getUserId: %s", err.Error())
+  }
+  recipient := sql.NullInt64{Int64: recipientId, Valid: true}
+  // The metadata goes in first, then the message fails on the sender's
+  // foreign key.
+  _, err = client.storeMessage(ctx, -1, recipient, sql.NullInt64{}, sql.NullInt64{}, MESSAGE_TYPE_IMAGE_LINK,
+                               "https://example.com/cat.png", &MessageMetadata{Width: 640, Height: 480})
+  if err == nil {
+    t.Fatalf("stored a message from a sender that doesn't exist")
+  }
+  if metadata, messages := countRows(t, client, "messages_metadata"), countRows(t, client, "messages"); metadata != 0 || messages != 0 {
+    t.Errorf("got %d metadata and %d message rows after the rollback, want none", metadata, messages)
+  }
+
+  // Plaintext messages go through the same transaction.
+  _, err = client.storeMessage(ctx, -1, recipient, sql.NullInt64{}, sql.NullInt64{}, MESSAGE_TYPE_PLAINTEXT, "Hi there!", nil)
+  if err == nil {
+    t.Fatalf("stored a message from a sender that doesn't exist")
+  }
+  if messages := countRows(t, client, "messages"); messages != 0 {
+    t.Errorf("got %d message rows after the rollback, want none", messages)
+  }
+}
+
+func TestSQLFailedBatchRollsBack(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1", "user2", "user3")
+  // Cache user3's id, then delete them behind the client's back, so the
+  // batch only fails on its last insert.
+  if _, err := client.getUserId(ctx, "user3"); err != nil {
+    t.Fatalf("getUserId: %s", err.Error())
+  }
+  if _, err := client.db.Exec("DELETE FROM users WHERE username=?", "user3"); err != nil {
+    t.Fatalf("couldn't delete user3: %s", err.Error())
+  }
+  _, err := client.AddMessages(ctx, "user1", []string{"user2", "user3"}, MESSAGE_TYPE_VIDEO_LINK,
+                               "https://example.com/cat.mp4", &MessageMetadata{Length: 30, Source: "vimeo"})
+  if !errors.Is(err, ErrUserNotFound) {
+    t.Fatalf("got error %v, want ErrUserNotFound", err)
+  }
+  if metadata, messages := countRows(t, client, "messages_metadata"), countRows(t, client, "messages"); metadata != 0 || messages != 0 {
+    t.Errorf("got %d metadata and %d message rows after the rollback, want none", metadata, messages)
+  }
+}
+
+func TestStoreMessageBeginFails(t *testing.T) {
+  // Opening doesn't connect, and once closed, every BeginTx fails.
+  db, err := sql.Open(DRIVER_NAME, "user:pass@tcp(127.0.0.1:3306)/chat")
+  if err != nil {
+    t.Fatalf("sql.Open: %s", err.Error())
+  }
+  db.Close()
+  client := &ChatSQLClient{db: db, logger: &recordingLogger{}}
+  recipient := sql.NullInt64{Int64: 2, Valid: true}
+  metadata := map[string]*MessageMetadata{
+    MESSAGE_TYPE_PLAINTEXT: nil,
+    MESSAGE_TYPE_IMAGE_LINK: &MessageMetadata{Width: 640, Height: 480},
+    MESSAGE_TYPE_VIDEO_LINK: &MessageMetadata{Length: 30, Source: "vimeo"},
+    MESSAGE_TYPE_FILE: &MessageMetadata{Filename: "notes.txt", SizeBytes: 1024},
+  }
+  for messageType, messageMetadata := range metadata {
+    t.Run(messageType, func(t *testing.T) {
+      // A panic here fails the test too.
+      id, err := client.storeMessage(context.Background(), 1, recipient, sql.NullInt64{}, sql.NullInt64{},
+                                     messageType, "https://example.com/a", messageMetadata)
+      if err == nil || id != -1 {
+        t.Errorf("got id %d and error %v, want -1 and an error", id, err)
+      }
+    })
+  }
+}
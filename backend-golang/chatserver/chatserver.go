@@ -1,35 +1,261 @@
 package chatserver
 
 import (
-  "log"
+  "context"
+  "crypto/tls"
+  "errors"
+  "fmt"
   "net/http"
+  "os"
+  "os/signal"
+  "sync"
+  "syscall"
+  "time"
+
+  auth "app/chatauth"
+  "github.com/gorilla/websocket"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// How long to wait for in-flight requests to finish when shutting down.
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
 // ChatServer maintains a db connection and any relevant state,
 // and responds to HTTP requests.
 type ChatServer struct {
-  db *ChatSQLClient
+  db ChatStore
+  mux *http.ServeMux
+  config *Config
+  // bcrypt cost used when hashing new passwords.
+  hashCost int
+  // Requirements for new passwords.
+  passwordPolicy *auth.PasswordPolicy
+  // Limits how often each user can send messages.
+  messageLimiter *rateLimiter
+  // Limits how often each client IP can create users and send messages.
+  ipLimiter *rateLimiter
+  // Upgrades connections at /ws, checking their origin.
+  upgrader *websocket.Upgrader
+  // Open WebSocket connections, keyed by userIdKey.
+  sockets map[string]map[*socketClient]bool
+  socketsMutex sync.Mutex
+  logger Logger
+  // Served at /metrics.
+  metrics *serverMetrics
 }
 
-// Startup. Should be called by main.
-func (server *ChatServer) Start() {
-  // Make db connection.
-  db, err := NewChatSqlClient(DRIVER_NAME, DATA_SOURCE_NAME)
-  if err != nil {
-    log.Fatal("unable to connect to DB: ", err)
+// Factory for creating a new server backed by the given store.
+// Handlers are registered on the server's own mux rather than the global
+// http.DefaultServeMux, so several servers can coexist in one process.
+// A nil config means the defaults are used. An invalid hash cost, password
+// policy, username lengths or max content length in the config are logged
+// and the defaults are used instead. Returns an error for a config that
+// isn't safe to run with, e.g. allowing credentials from any origin.
+// Logs at config.LogLevel, see SetLogger.
+func NewChatServer(store ChatStore, config *Config) (*ChatServer, error) {
+  if config == nil {
+    config = DefaultConfig()
+  }
+  if err := config.validate(); err != nil {
+    return nil, err
+  }
+  messageLimiter, _ := newRateLimiter(DEFAULT_MESSAGES_PER_MINUTE, DEFAULT_MESSAGE_BURST)
+  ipLimiter, _ := newRateLimiter(DEFAULT_IP_REQUESTS_PER_MINUTE, DEFAULT_IP_BURST)
+  server := &ChatServer{
+    db: store,
+    mux: http.NewServeMux(),
+    config: config,
+    hashCost: auth.DEFAULT_HASH_COST,
+    passwordPolicy: auth.DefaultPasswordPolicy(),
+    messageLimiter: messageLimiter,
+    ipLimiter: ipLimiter,
+    sockets: make(map[string]map[*socketClient]bool),
+    logger: NewLogger(config.LogLevel),
+    metrics: newServerMetrics(store),
+  }
+  server.upgrader = server.newUpgrader()
+  if err := server.SetHashCost(config.HashCost); err != nil {
+    server.logger.Warnf("Ignoring configured hash cost, using %d: %s", auth.DEFAULT_HASH_COST, err.Error())
+  }
+  if config.PasswordPolicy != nil {
+    if err := config.PasswordPolicy.Check(); err != nil {
+      server.logger.Warnf("Ignoring configured password policy, using the default: %s", err.Error())
+    } else {
+      server.passwordPolicy = config.PasswordPolicy
+    }
+  }
+  if err := config.checkUsernameLengths(); err != nil {
+    server.logger.Warnf("Ignoring configured username lengths, using %d to %d: %s",
+                        DEFAULT_USERNAME_MIN_LENGTH, DEFAULT_USERNAME_MAX_LENGTH, err.Error())
+    config.UsernameMinLength = DEFAULT_USERNAME_MIN_LENGTH
+    config.UsernameMaxLength = DEFAULT_USERNAME_MAX_LENGTH
+  }
+  if config.MaxContentLength < 1 || config.MaxContentLength > MAX_CONTENT_LENGTH_LIMIT {
+    server.logger.Warnf("Ignoring configured max content length %d, using %d", config.MaxContentLength, DEFAULT_MAX_CONTENT_LENGTH)
+    config.MaxContentLength = DEFAULT_MAX_CONTENT_LENGTH
+  }
+  if config.MaxBodyBytes < 1 {
+    server.logger.Warnf("Ignoring configured max body size %d, using %d", config.MaxBodyBytes, DEFAULT_MAX_BODY_BYTES)
+    config.MaxBodyBytes = DEFAULT_MAX_BODY_BYTES
   }
-  server.db = db
-
   // Assign handlers for requests we accept.
-  http.HandleFunc("/users", server.handleUsers)
-  http.HandleFunc("/messages", server.handleMessages)
-  http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-    w.WriteHeader(http.StatusNotFound)
+  // Creating users (bcrypt is slow on purpose), sending messages and
+  // logging in are also limited per client IP, the last so passwords can't
+  // be brute forced.
+  server.mux.Handle("/users", server.limitPostsByIP(http.HandlerFunc(server.handleUsers)))
+  server.mux.HandleFunc("/users/", server.handleUser)
+  server.mux.HandleFunc("/users/exists", server.handleUserExists)
+  server.mux.Handle("/users/password", server.limitPostsByIP(http.HandlerFunc(server.handleUserPassword)))
+  server.mux.HandleFunc("/users/block", server.handleBlocks)
+  server.mux.HandleFunc("/users/blocked", server.handleBlocked)
+  server.mux.Handle("/messages", server.limitPostsByIP(http.HandlerFunc(server.handleMessages)))
+  server.mux.HandleFunc("/messages/", server.handleMessage)
+  server.mux.HandleFunc("/messages/read", server.handleMessagesRead)
+  server.mux.HandleFunc("/messages/unread", server.handleMessagesUnread)
+  server.mux.HandleFunc("/messages/search", server.handleMessagesSearch)
+  server.mux.HandleFunc("/conversations", server.handleConversations)
+  server.mux.HandleFunc("/rooms", server.handleRooms)
+  server.mux.Handle("/login", server.limitPostsByIP(http.HandlerFunc(server.handleLogin)))
+  server.mux.HandleFunc("/ws", server.handleWebSocket)
+  server.mux.HandleFunc("/health", server.handleHealth)
+  server.mux.Handle("/metrics", promhttp.HandlerFor(server.metrics.registry, promhttp.HandlerOpts{}))
+  server.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+    errorResponse(w, http.StatusNotFound, fmt.Sprintf("no endpoint at %s", r.URL.Path), ERROR_CODE_NOT_FOUND)
   })
+  return server, nil
+}
+
+// Sets the bcrypt cost used when hashing new passwords.
+// Returns an error, and keeps the current cost, if bcrypt doesn't support it.
+func (server *ChatServer) SetHashCost(cost int) error {
+  if err := auth.ValidateHashCost(cost); err != nil {
+    return err
+  }
+  server.hashCost = cost
+  // Hash the dummy password for unknown logins now, so the first one isn't
+  // slower than a wrong password.
+  go auth.AuthenticateDummy("", cost)
+  return nil
+}
+
+// Returns the address the server listens on when started.
+func (server *ChatServer) ListenAddr() string {
+  return server.config.ListenAddr
+}
+
+// Sets how many messages each user can send per minute, and how many they
+// can send back to back. Returns an error, and keeps the current limit, if
+// either isn't positive.
+func (server *ChatServer) SetMessageRateLimit(perMinute int, burst int) error {
+  limiter, err := newRateLimiter(perMinute, burst)
+  if err != nil {
+    return err
+  }
+  server.messageLimiter = limiter
+  return nil
+}
+
+// Returns a context for the request's db queries. It's canceled when the
+// client goes away or the query timeout passes, whichever comes first.
+func (server *ChatServer) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+  return context.WithTimeout(r.Context(), server.config.QueryTimeout)
+}
 
-  // Begin serving, fail on any errors.
-  if err := http.ListenAndServe(":8000", nil); err != nil {
-    log.Fatal(err)
+// Sets how many users each client IP can create and messages it can send,
+// combined, per minute and back to back. Returns an error, and keeps the
+// current limit, if either isn't positive.
+func (server *ChatServer) SetIPRateLimit(perMinute int, burst int) error {
+  limiter, err := newRateLimiter(perMinute, burst)
+  if err != nil {
+    return err
   }
+  server.ipLimiter = limiter
+  return nil
 }
 
+// Replaces the server's logger, e.g. to send its logs somewhere other than
+// stderr.
+func (server *ChatServer) SetLogger(logger Logger) {
+  server.logger = logger
+}
+
+// Routes a request to the matching handler. This makes ChatServer an
+// http.Handler, so it can also be served by e.g. httptest.NewServer.
+// Reading more than Config.MaxBodyBytes of the body fails, so clients can't
+// exhaust the server's memory with huge bodies.
+func (server *ChatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  r.Body = http.MaxBytesReader(w, r.Body, server.config.MaxBodyBytes)
+  server.mux.ServeHTTP(w, r)
+}
+
+// Startup. Should be called by main.
+// Serves HTTPS if the config has a TLS certificate and key, otherwise HTTP.
+func (server *ChatServer) Start() {
+  // Begin serving in the background, fail on any errors.
+  httpServer := &http.Server{
+    Addr: server.config.ListenAddr,
+    Handler: server.logRequests(server.cors(server.compress(server.limitRequestTime(server)))),
+  }
+  serveErrors := make(chan error, 1)
+  if len(server.config.TLSCertFile) > 0 || len(server.config.TLSKeyFile) > 0 {
+    minVersion := server.config.TLSMinVersion
+    if minVersion == 0 {
+      minVersion = DEFAULT_TLS_MIN_VERSION
+    }
+    httpServer.TLSConfig = &tls.Config{MinVersion: minVersion}
+    server.logger.Infof("Listening on %s with TLS", httpServer.Addr)
+    go func() {
+      serveErrors <- httpServer.ListenAndServeTLS(server.config.TLSCertFile, server.config.TLSKeyFile)
+    }()
+  } else {
+    server.logger.Warnf("TLS isn't configured, so passwords are sent in the clear. " +
+                        "Only serve plain HTTP locally or behind a proxy that terminates TLS.")
+    server.logger.Infof("Listening on %s", httpServer.Addr)
+    go func() {
+      serveErrors <- httpServer.ListenAndServe()
+    }()
+  }
+
+  // Wait for a signal to stop, then let in-flight requests finish before
+  // closing the db connection.
+  stop := make(chan os.Signal, 1)
+  signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+  select {
+  case err := <-serveErrors:
+    server.logger.Errorf("Error serving: %s", err.Error())
+    os.Exit(1)
+  case sig := <-stop:
+    server.logger.Infof("Received %s, shutting down", sig)
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+  defer cancel()
+  if err := httpServer.Shutdown(ctx); err != nil {
+    server.logger.Errorf("Error shutting down server: %s", err.Error())
+  }
+  // Shutdown doesn't track hijacked connections, so close sockets ourselves.
+  server.closeSockets()
+  if err := server.db.Close(); err != nil {
+    server.logger.Errorf("Error closing db: %s", err.Error())
+  }
+  server.logger.Infof("Server stopped")
+}
+
+// Returns the HTTP status to respond with for an error from the store.
+// Anything that isn't a known client error is treated as a server fault.
+func statusForError(err error) int {
+  switch {
+  case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrMessageNotFound),
+       errors.Is(err, ErrRoomNotFound):
+    return http.StatusNotFound
+  case errors.Is(err, ErrNotMessageSender), errors.Is(err, ErrNotMessageRecipient),
+       errors.Is(err, ErrNotRoomMember), errors.Is(err, ErrBlocked):
+    return http.StatusForbidden
+  case errors.Is(err, ErrUserExists), errors.Is(err, ErrMessageStatusRegression):
+    return http.StatusConflict
+  case errors.Is(err, ErrMessageNotEditable), errors.Is(err, ErrInvalidReply),
+       errors.Is(err, ErrInvalidMessageStatus):
+    return http.StatusBadRequest
+  default:
+    return http.StatusInternalServerError
+  }
+}
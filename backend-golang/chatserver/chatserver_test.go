@@ -0,0 +1,265 @@
+package chatserver
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "testing"
+  "golang.org/x/crypto/bcrypt"
+)
+
+// Password that meets the default policy, used for every test user.
+const TEST_PASSWORD = "super-secret1"
+
+// A Logger that keeps what's logged, so tests stay quiet and can check for
+// warnings.
+type recordingLogger struct {
+  mutex sync.Mutex
+  lines []string
+}
+
+func (logger *recordingLogger) Debugf(format string, args ...interface{}) {
+  logger.record(LOG_LEVEL_DEBUG, format, args...)
+}
+
+func (logger *recordingLogger) Infof(format string, args ...interface{}) {
+  logger.record(LOG_LEVEL_INFO, format, args...)
+}
+
+func (logger *recordingLogger) Warnf(format string, args ...interface{}) {
+  logger.record(LOG_LEVEL_WARN, format, args...)
+}
+
+func (logger *recordingLogger) Errorf(format string, args ...interface{}) {
+  logger.record(LOG_LEVEL_ERROR, format, args...)
+}
+
+func (logger *recordingLogger) record(level LogLevel, format string, args ...interface{}) {
+  logger.mutex.Lock()
+  defer logger.mutex.Unlock()
+  logger.lines = append(logger.lines, logLevelNames[level] + " " + fmt.Sprintf(format, args...))
+}
+
+// Returns whether a line at the given level containing text was logged.
+func (logger *recordingLogger) logged(level LogLevel, text string) bool {
+  logger.mutex.Lock()
+  defer logger.mutex.Unlock()
+  for _, line := range logger.lines {
+    if strings.HasPrefix(line, logLevelNames[level] + " ") && strings.Contains(line, text) {
+      return true
+    }
+  }
+  return false
+}
+
+// Returned by brokenStore.
+var errBrokenStore = errors.New("the db is down")
+
+// A ChatStore whose user lookups and message inserts fail with
+// errBrokenStore, for testing how handlers report db errors. Other calls go
+// to the embedded store.
+type brokenStore struct {
+  *MemoryChatStore
+}
+
+func (store *brokenStore) CheckUserExists(ctx context.Context, username string) (bool, error) {
+  return false, errBrokenStore
+}
+
+func (store *brokenStore) GetUserCredentials(ctx context.Context, username string) ([]byte, error) {
+  return nil, errBrokenStore
+}
+
+func (store *brokenStore) AddMessage(ctx context.Context, senderName string, recipientName string, messageType string, content string, metadata *MessageMetadata, replyTo int64) (*Message, error) {
+  return nil, errBrokenStore
+}
+
+// Returns a server backed by a brokenStore.
+func newBrokenTestServer(t testing.TB) *ChatServer {
+  t.Helper()
+  return newTestServerWithStore(t, &brokenStore{NewMemoryChatStore()}, DefaultConfig())
+}
+
+// Returns a server backed by a fresh MemoryChatStore, with the cheapest
+// hash cost and rate limits high enough not to get in the way.
+func newTestServer(t testing.TB) (*ChatServer, *MemoryChatStore) {
+  t.Helper()
+  return newTestServerWithConfig(t, DefaultConfig())
+}
+
+// Like newTestServer, with the given config.
+func newTestServerWithConfig(t testing.TB, config *Config) (*ChatServer, *MemoryChatStore) {
+  t.Helper()
+  store := NewMemoryChatStore()
+  return newTestServerWithStore(t, store, config), store
+}
+
+// Like newTestServer, with the given store and config.
+func newTestServerWithStore(t testing.TB, store ChatStore, config *Config) *ChatServer {
+  t.Helper()
+  config.HashCost = bcrypt.MinCost
+  server, err := NewChatServer(store, config)
+  if err != nil {
+    t.Fatalf("NewChatServer: %s", err.Error())
+  }
+  server.SetLogger(&recordingLogger{})
+  if err := server.SetMessageRateLimit(60000, 1000); err != nil {
+    t.Fatalf("SetMessageRateLimit: %s", err.Error())
+  }
+  if err := server.SetIPRateLimit(60000, 1000); err != nil {
+    t.Fatalf("SetIPRateLimit: %s", err.Error())
+  }
+  return server
+}
+
+// Sends a request with the given body, as JSON unless the body is empty,
+// and returns the recorded response.
+func doRequest(handler http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+  return doRequestWithHeader(handler, method, target, body, nil)
+}
+
+// Like doRequest, with the given headers set on the request. A Content-Type
+// among them replaces the default.
+func doRequestWithHeader(handler http.Handler, method string, target string, body string, header http.Header) *httptest.ResponseRecorder {
+  r := httptest.NewRequest(method, target, strings.NewReader(body))
+  if len(body) > 0 {
+    r.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+  }
+  for name, values := range header {
+    r.Header[http.CanonicalHeaderKey(name)] = values
+  }
+  w := httptest.NewRecorder()
+  handler.ServeHTTP(w, r)
+  return w
+}
+
+// Fails the test unless the response has the given status, then decodes its
+// JSON body into v, if v isn't nil.
+func decodeResponse(t testing.TB, w *httptest.ResponseRecorder, status int, v interface{}) {
+  t.Helper()
+  if w.Code != status {
+    t.Fatalf("got status %d, want %d, body %s", w.Code, status, w.Body.String())
+  }
+  if v == nil {
+    return
+  }
+  if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+    t.Fatalf("couldn't decode response %q: %s", w.Body.String(), err.Error())
+  }
+}
+
+// Fails the test unless the response is a JSON error with the given status
+// and code.
+func expectError(t testing.TB, w *httptest.ResponseRecorder, status int, code string) {
+  t.Helper()
+  var body errorBody
+  decodeResponse(t, w, status, &body)
+  if body.Error.Code != code {
+    t.Fatalf("got error code %q, want %q, message %q", body.Error.Code, code, body.Error.Message)
+  }
+}
+
+// Creates a user with TEST_PASSWORD through the API.
+func createTestUser(t testing.TB, server *ChatServer, username string) {
+  t.Helper()
+  w := doRequest(server, http.MethodPost, "/users",
+                 fmt.Sprintf(`{"username":%q, "password":%q}`, username, TEST_PASSWORD))
+  decodeResponse(t, w, http.StatusOK, nil)
+}
+
+// Creates user1 and user2, the usual pair for message tests.
+func createTestUsers(t testing.TB, server *ChatServer) {
+  t.Helper()
+  createTestUser(t, server, "user1")
+  createTestUser(t, server, "user2")
+}
+
+// Creates the users straight in the store, failing the test on any error.
+func createStoreUsers(t testing.TB, store ChatStore, usernames ...string) {
+  t.Helper()
+  for _, username := range usernames {
+    if _, err := store.CreateUser(context.Background(), username, []byte("hash")); err != nil {
+      t.Fatalf("CreateUser %s: %s", username, err.Error())
+    }
+  }
+}
+
+// Returns whether the user exists, asking through the API.
+func testUserExists(t testing.TB, server *ChatServer, username string) bool {
+  t.Helper()
+  w := doRequest(server, http.MethodGet, "/users/exists?username=" + username, "")
+  var body map[string]bool
+  decodeResponse(t, w, http.StatusOK, &body)
+  return body["exists"]
+}
+
+// Sends a plaintext direct message through the API and returns it as stored.
+func sendTestMessage(t testing.TB, server *ChatServer, sender string, recipient string, content string) *Message {
+  t.Helper()
+  w := doRequest(server, http.MethodPost, "/messages",
+                 fmt.Sprintf(`{"sender":%q, "recipient":%q, "messageType":"plaintext", "content":%q}`,
+                             sender, recipient, content))
+  var message Message
+  decodeResponse(t, w, http.StatusOK, &message)
+  return &message
+}
+
+// Sends count messages from user1 to user2, with contents "message 0" and
+// so on.
+func sendTestMessages(t testing.TB, server *ChatServer, count int) {
+  t.Helper()
+  for i := 0; i < count; i++ {
+    sendTestMessage(t, server, "user1", "user2", fmt.Sprintf("message %d", i))
+  }
+}
+
+// Fetches the whole conversation between two users through the API.
+func fetchTestMessages(t testing.TB, server *ChatServer, sender string, recipient string) []*Message {
+  t.Helper()
+  w := doRequest(server, http.MethodGet, fmt.Sprintf("/messages?sender=%s&recipient=%s", sender, recipient), "")
+  var messages []*Message
+  decodeResponse(t, w, http.StatusOK, &messages)
+  return messages
+}
+
+// Both stores must keep satisfying the interface.
+var _ ChatStore = (*ChatSQLClient)(nil)
+var _ ChatStore = (*MemoryChatStore)(nil)
+
+func TestServerUsesInjectedStore(t *testing.T) {
+  server, store := newTestServer(t)
+  createStoreUsers(t, store, "user1", "user2")
+  if _, err := store.AddMessage(context.Background(), "user1", "user2", MESSAGE_TYPE_PLAINTEXT, "Hi there!", nil, 0); err != nil {
+    t.Fatalf("AddMessage: %s", err.Error())
+  }
+  messages := fetchTestMessages(t, server, "user1", "user2")
+  if len(messages) != 1 || messages[0].Content != "Hi there!" {
+    t.Fatalf("got %+v, want the message added to the store", messages)
+  }
+}
+
+func TestRoutesResolve(t *testing.T) {
+  server, _ := newTestServer(t)
+  // Each path reaches its own handler, which turns PATCH away with a 405
+  // rather than the catch-all's 404.
+  paths := []string{
+    "/users", "/users/user1", "/users/exists", "/users/password", "/users/block", "/users/blocked",
+    "/messages", "/messages/1", "/messages/1/read", "/messages/1/reactions", "/messages/read",
+    "/messages/unread", "/messages/search", "/conversations", "/rooms", "/login", "/health",
+  }
+  for _, path := range paths {
+    t.Run(path, func(t *testing.T) {
+      w := doRequest(server, http.MethodPatch, path, "")
+      expectError(t, w, http.StatusMethodNotAllowed, ERROR_CODE_METHOD_NOT_ALLOWED)
+    })
+  }
+  w := doRequest(server, http.MethodGet, "/metrics", "")
+  decodeResponse(t, w, http.StatusOK, nil)
+  w = doRequest(server, http.MethodGet, "/nowhere", "")
+  expectError(t, w, http.StatusNotFound, ERROR_CODE_NOT_FOUND)
+}
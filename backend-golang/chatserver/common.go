@@ -1,5 +1,10 @@
 package chatserver
 
+import (
+  "math"
+  "time"
+)
+
 // This file defines common structs and constants used in the chatserver package.
 // Field names must be capitalized, otherwise JSON encoder won't work.
 // However, we can provide lowercase identifiers so that clients don't need
@@ -9,39 +14,164 @@ package chatserver
 const MESSAGE_TYPE_PLAINTEXT = "plaintext"
 const MESSAGE_TYPE_IMAGE_LINK = "image_link"
 const MESSAGE_TYPE_VIDEO_LINK = "video_link"
+const MESSAGE_TYPE_FILE = "file"
+
+// Message statuses, in the order a direct message goes through them. Room
+// messages have no single recipient, so they stay sent.
+const MESSAGE_STATUS_SENT = "sent"
+const MESSAGE_STATUS_DELIVERED = "delivered"
+const MESSAGE_STATUS_READ = "read"
+
+// Position of each status in the progression. A message's status only moves
+// forward.
+var MESSAGE_STATUS_RANKS = map[string]int{
+  MESSAGE_STATUS_SENT: 0,
+  MESSAGE_STATUS_DELIVERED: 1,
+  MESSAGE_STATUS_READ: 2,
+}
 
 // Defines a message.
+// Messages are sent either to a Recipient or to a room, in which case RoomID
+// is set and Recipient is empty.
+// CreatedAt is set by the database and is encoded as RFC 3339 in JSON.
+// EditedAt is nil unless the message was edited, in which case Edited is true.
+// ReadAt is nil until the recipient reads the message.
+// Status is one of the MESSAGE_STATUS_* values.
+// Metadata is nil for plaintext messages, and for media messages whose
+// metadata is missing from the db.
+// Reactions maps each emoji to the number of users who reacted with it.
 type Message struct {
+  ID          int64            `json:"id"`
   Sender      string           `json:"sender"`
   Recipient   string           `json:"recipient"`
+  RoomID      *int64           `json:"roomId,omitempty"`
   MessageType string           `json:"messageType"`
   Content     string           `json:"content"`
+  CreatedAt   time.Time        `json:"createdAt"`
+  Edited      bool             `json:"edited"`
+  EditedAt    *time.Time       `json:"editedAt"`
+  ReadAt      *time.Time       `json:"readAt"`
+  Status      string           `json:"status"`
+  ReplyTo     *int64           `json:"replyTo"`
   Metadata    *MessageMetadata `json:"metadata"`
+  Reactions   map[string]int   `json:"reactions,omitempty"`
+}
+
+// Defines one page of messages, returned by paginated fetches.
+// HasMore is true if there are messages after this page.
+type MessagePage struct {
+  Messages []*Message `json:"messages"`
+  Total    int64      `json:"total"`
+  Page     int        `json:"page"`
+  PerPage  int        `json:"perPage"`
+  HasMore  bool       `json:"hasMore"`
 }
 
 // Defines message metadata.
+// Images use width and height, videos use length and source, and files use
+// filename and sizeBytes.
 type MessageMetadata struct {
   Width       int    `json:"width"`
   Height      int    `json:"height"`
   Length      int    `json:"length"`
   Source      string `json:"source"`
+  Filename    string `json:"filename"`
+  SizeBytes   int64  `json:"sizeBytes"`
+}
+
+// Defines the public parts of a user, never including their password hash.
+type UserProfile struct {
+  ID        int64     `json:"id"`
+  Username  string    `json:"username"`
+  CreatedAt time.Time `json:"createdAt"`
+}
+
+// Defines a room, i.e. a group chat.
+type Room struct {
+  ID        int64     `json:"id"`
+  Name      string    `json:"name"`
+  Members   []string  `json:"members"`
+  CreatedAt time.Time `json:"createdAt"`
+}
+
+// Defines a conversation with another user, summarized by its latest message.
+type Conversation struct {
+  Counterpart     string    `json:"counterpart"`
+  LastMessage     string    `json:"lastMessage"`
+  LastMessageType string    `json:"lastMessageType"`
+  LastMessageAt   time.Time `json:"lastMessageAt"`
 }
 
 // Struct for specifying a fetch messages request.
+// If roomId is set, the room's messages are fetched on behalf of senderName,
+// who must be a member, and recipientName is unused.
 type FetchMessagesParams struct {
   senderName string
   recipientName string
+  // If set, the user fetching direct messages, i.e. the sender or the
+  // recipient. Messages sent to them are marked delivered.
+  readerName string
+  roomId int64
   usePagination bool
   messagesPerPage int
   pageToLoad int
+  // If set, only the latest limit messages older than this id are fetched,
+  // still oldest first. Pagination is then ignored.
+  beforeId int64
+  // If set, only the earliest limit messages newer than this id are
+  // fetched, for clients catching up. Can't be combined with beforeId.
+  afterId int64
+  limit int
+  // If set, only messages created at or after since, and at or before
+  // until, are fetched. Can't be combined with pagination.
+  since time.Time
+  until time.Time
 }
 
 // Database information.
+// parseTime lets the driver scan DATETIME columns into time.Time.
 const DRIVER_NAME = "mysql"
-const DATA_SOURCE_NAME = "root:testpass@tcp(db:3306)/challenge"
+const DATA_SOURCE_NAME = "root:testpass@tcp(db:3306)/challenge?parseTime=true"
 
-// Hardcode message metadata for images and videos for now for simplicity.
+// Default message metadata for images and videos, used when the sender
+// doesn't provide any.
 const IMAGE_WIDTH = 100
 const IMAGE_HEIGHT = 200
 const VIDEO_LENGTH = 300
 const VIDEO_SOURCE = "YouTube"
+
+// Largest value the numeric metadata columns (SMALLINT) can hold.
+const MAX_METADATA_VALUE = 32767
+
+// Longest video source the metadata column (VARCHAR(16)) can hold.
+const MAX_VIDEO_SOURCE_LENGTH = 16
+
+// Longest filename the metadata column (VARCHAR(255)) can hold, in
+// characters.
+const MAX_FILENAME_LENGTH = 255
+
+// Maximum number of usernames returned by a user search.
+const USER_SEARCH_LIMIT = 20
+
+// Longest emoji (or emoji sequence) a reaction can hold, in bytes.
+const MAX_EMOJI_LENGTH = 32
+
+// Limits on room names and sizes.
+const MAX_ROOM_NAME_LENGTH = 64
+const MAX_ROOM_MEMBERS = 100
+
+// Maximum number of recipients for one message.
+const MAX_MESSAGE_RECIPIENTS = 50
+
+// Maximum number of messages returned by a message search.
+const MESSAGE_SEARCH_LIMIT = 50
+
+// Maximum number of messages a client can request per page.
+const MAX_MESSAGES_PER_PAGE = 100
+
+// Largest number of messages a paginated fetch can skip, i.e.
+// pageToLoad * messagesPerPage, so the offset can't overflow.
+const MAX_PAGE_OFFSET = math.MaxInt32
+
+// Number of messages fetched before a message id if the client doesn't say.
+const DEFAULT_CURSOR_LIMIT = 50
@@ -0,0 +1,139 @@
+package chatserver
+
+import (
+  "compress/gzip"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+// Responses smaller than this many bytes are sent uncompressed, since gzip
+// barely shrinks them and costs CPU on both ends.
+const GZIP_MIN_BYTES = 1024
+
+// Reuses gzip writers across responses, since each one allocates large
+// buffers.
+var gzipWriters = sync.Pool{
+  New: func() interface{} {
+    return gzip.NewWriter(nil)
+  },
+}
+
+// Middleware that gzips responses of at least GZIP_MIN_BYTES for clients
+// that accept it. Responses the handler already encoded, e.g. /metrics, are
+// passed through as is. WebSocket upgrades at /ws are passed through too,
+// since they need to hijack the connection.
+func (server *ChatServer) compress(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/ws" {
+      next.ServeHTTP(w, r)
+      return
+    }
+    // Whether the response is compressed depends on Accept-Encoding, so
+    // caches must key on it.
+    w.Header().Add("Vary", "Accept-Encoding")
+    if !acceptsGzip(r) {
+      next.ServeHTTP(w, r)
+      return
+    }
+    gzipWriter := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+    defer gzipWriter.close()
+    next.ServeHTTP(gzipWriter, r)
+  })
+}
+
+// Returns whether the request's Accept-Encoding includes gzip, e.g.
+// "gzip, deflate", and doesn't rule it out with q=0.
+func acceptsGzip(r *http.Request) bool {
+  for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+    name, params, _ := strings.Cut(encoding, ";")
+    if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+      continue
+    }
+    _, quality, found := strings.Cut(strings.ReplaceAll(params, " ", ""), "q=")
+    if !found {
+      return true
+    }
+    q, err := strconv.ParseFloat(quality, 64)
+    return err != nil || q > 0
+  }
+  return false
+}
+
+// Wraps an http.ResponseWriter to gzip the response body. The status and
+// the start of the body are held back until GZIP_MIN_BYTES have been
+// written, or the handler is done, so that small responses can still be
+// sent uncompressed.
+type gzipResponseWriter struct {
+  http.ResponseWriter
+  status int
+  // Body written so far, until started is set.
+  buffer []byte
+  // Whether the status has been sent on, after which writes go straight to
+  // gzip, or the underlying writer if gzip is nil.
+  started bool
+  gzip *gzip.Writer
+}
+
+// Holds the status back, since Content-Encoding can't be set after it.
+func (w *gzipResponseWriter) WriteHeader(status int) {
+  if !w.started {
+    w.status = status
+  }
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+  if w.started {
+    if w.gzip != nil {
+      return w.gzip.Write(p)
+    }
+    return w.ResponseWriter.Write(p)
+  }
+  w.buffer = append(w.buffer, p...)
+  if len(w.buffer) >= GZIP_MIN_BYTES {
+    if err := w.start(true); err != nil {
+      return 0, err
+    }
+  }
+  return len(p), nil
+}
+
+// Sends the status, and the buffered body, on. Only compresses if asked to
+// and the handler didn't already encode the body itself.
+func (w *gzipResponseWriter) start(compress bool) error {
+  w.started = true
+  header := w.Header()
+  if compress && len(header.Get("Content-Encoding")) == 0 {
+    // The Content-Type would otherwise be sniffed from the compressed bytes.
+    if len(header.Get("Content-Type")) == 0 {
+      header.Set("Content-Type", http.DetectContentType(w.buffer))
+    }
+    header.Set("Content-Encoding", "gzip")
+    header.Del("Content-Length")
+    w.gzip = gzipWriters.Get().(*gzip.Writer)
+    w.gzip.Reset(w.ResponseWriter)
+  }
+  w.ResponseWriter.WriteHeader(w.status)
+  buffer := w.buffer
+  w.buffer = nil
+  if len(buffer) == 0 {
+    return nil
+  }
+  _, err := w.Write(buffer)
+  return err
+}
+
+// Sends anything still held back, uncompressed since it's small, and
+// finishes the gzip stream if there is one.
+func (w *gzipResponseWriter) close() {
+  if !w.started {
+    w.start(false)
+    return
+  }
+  if w.gzip != nil {
+    w.gzip.Close()
+    gzipWriters.Put(w.gzip)
+    w.gzip = nil
+  }
+}
@@ -0,0 +1,133 @@
+package chatserver
+
+import (
+  "compress/gzip"
+  "fmt"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+// Makes a GET through the compression middleware with the given
+// Accept-Encoding and returns the response.
+func doCompressedRequest(handler http.Handler, target string, acceptEncoding string) *httptest.ResponseRecorder {
+  return doRequestWithHeader(handler, http.MethodGet, target, "", http.Header{"Accept-Encoding": {acceptEncoding}})
+}
+
+// Returns the gunzipped response body.
+func gunzipBody(t *testing.T, w *httptest.ResponseRecorder) []byte {
+  t.Helper()
+  reader, err := gzip.NewReader(w.Body)
+  if err != nil {
+    t.Fatalf("gzip.NewReader: %s", err.Error())
+  }
+  body, err := io.ReadAll(reader)
+  if err != nil {
+    t.Fatalf("reading gzipped body: %s", err.Error())
+  }
+  return body
+}
+
+func TestCompressLargeResponses(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sendTestMessages(t, server, 500)
+  plain := doCompressedRequest(server.compress(server), "/messages?sender=user1&recipient=user2", "")
+  w := doCompressedRequest(server.compress(server), "/messages?sender=user1&recipient=user2", "deflate, gzip")
+  if w.Code != http.StatusOK {
+    t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+  }
+  if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+    t.Fatalf("got Content-Encoding %q, want gzip", got)
+  }
+  if got := w.Header().Get("Content-Type"); got != "application/json" {
+    t.Errorf("got Content-Type %q, want application/json", got)
+  }
+  if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+    t.Errorf("got Vary %q, want Accept-Encoding", got)
+  }
+  if w.Body.Len() >= plain.Body.Len() {
+    t.Errorf("compressed body is %d bytes, uncompressed is %d", w.Body.Len(), plain.Body.Len())
+  }
+  if body := gunzipBody(t, w); string(body) != plain.Body.String() {
+    t.Errorf("gunzipped body doesn't match the uncompressed one")
+  }
+}
+
+func TestCompressSkipsSmallResponses(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sendTestMessages(t, server, 1)
+  w := doCompressedRequest(server.compress(server), "/messages?sender=user1&recipient=user2", "gzip")
+  if got := w.Header().Get("Content-Encoding"); len(got) > 0 {
+    t.Errorf("got Content-Encoding %q for a %d byte response, want none", got, w.Body.Len())
+  }
+  var messages []*Message
+  decodeResponse(t, w, http.StatusOK, &messages)
+  if len(messages) != 1 {
+    t.Errorf("got %d messages, want 1", len(messages))
+  }
+  // Small errors keep their status too.
+  w = doCompressedRequest(server.compress(server), "/messages?sender=user1&recipient=nobody", "gzip")
+  expectError(t, w, http.StatusNotFound, ERROR_CODE_USER_NOT_FOUND)
+}
+
+func TestCompressHonorsAcceptEncoding(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sendTestMessages(t, server, 500)
+  for _, acceptEncoding := range []string{"", "deflate", "gzip;q=0", "br, gzip; q=0"} {
+    w := doCompressedRequest(server.compress(server), "/messages?sender=user1&recipient=user2", acceptEncoding)
+    if got := w.Header().Get("Content-Encoding"); len(got) > 0 {
+      t.Errorf("Accept-Encoding %q: got Content-Encoding %q, want none", acceptEncoding, got)
+    }
+  }
+  for _, acceptEncoding := range []string{"GZIP", "gzip;q=0.5", "*, gzip"} {
+    w := doCompressedRequest(server.compress(server), "/messages?sender=user1&recipient=user2", acceptEncoding)
+    if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+      t.Errorf("Accept-Encoding %q: got Content-Encoding %q, want gzip", acceptEncoding, got)
+    }
+  }
+}
+
+func TestCompressDoesntDoubleCompressMetrics(t *testing.T) {
+  server, _ := newTestServer(t)
+  // Enough requests that /metrics is worth compressing.
+  for i := 0; i < 20; i++ {
+    doCompressedRequest(server, fmt.Sprintf("/users/exists?username=user%d", i), "")
+  }
+  w := doCompressedRequest(server.compress(server), "/metrics", "gzip")
+  if w.Code != http.StatusOK {
+    t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+  }
+  if got := w.Header().Values("Content-Encoding"); len(got) != 1 || got[0] != "gzip" {
+    t.Fatalf("got Content-Encoding %v, want gzip once", got)
+  }
+  // One gunzip gets back the text format.
+  if body := string(gunzipBody(t, w)); !strings.Contains(body, "# TYPE") {
+    t.Errorf("gunzipped body isn't metrics: %.100q", body)
+  }
+}
+
+// Reports the size of a 500 message fetch with and without gzip.
+func BenchmarkCompress(b *testing.B) {
+  server, _ := newTestServer(b)
+  createTestUsers(b, server)
+  sendTestMessages(b, server, 500)
+  handler := server.compress(server)
+  plain := doCompressedRequest(handler, "/messages?sender=user1&recipient=user2", "")
+  b.ResetTimer()
+  var compressedBytes int
+  for i := 0; i < b.N; i++ {
+    w := doCompressedRequest(handler, "/messages?sender=user1&recipient=user2", "gzip")
+    if w.Header().Get("Content-Encoding") != "gzip" {
+      b.Fatalf("response wasn't compressed")
+    }
+    compressedBytes = w.Body.Len()
+  }
+  b.ReportMetric(float64(plain.Body.Len()), "raw-bytes")
+  b.ReportMetric(float64(compressedBytes), "gzip-bytes")
+  b.ReportMetric(float64(compressedBytes) / float64(plain.Body.Len()), "ratio")
+}
@@ -0,0 +1,451 @@
+package chatserver
+
+import (
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+
+  auth "app/chatauth"
+  "github.com/go-sql-driver/mysql"
+)
+
+// Environment variables read by ConfigFromEnv.
+const ENV_LISTEN_ADDR = "CHAT_LISTEN_ADDR"
+const ENV_PORT = "CHAT_PORT"
+const ENV_TLS_CERT_FILE = "CHAT_TLS_CERT_FILE"
+const ENV_TLS_KEY_FILE = "CHAT_TLS_KEY_FILE"
+const ENV_TLS_MIN_VERSION = "CHAT_TLS_MIN_VERSION"
+const ENV_DB_DSN = "CHAT_DB_DSN"
+const ENV_DB_HOST = "CHAT_DB_HOST"
+const ENV_DB_PORT = "CHAT_DB_PORT"
+const ENV_DB_USER = "CHAT_DB_USER"
+const ENV_DB_PASSWORD = "CHAT_DB_PASSWORD"
+const ENV_DB_NAME = "CHAT_DB_NAME"
+const ENV_DB_MAX_OPEN_CONNS = "CHAT_DB_MAX_OPEN_CONNS"
+const ENV_DB_MAX_IDLE_CONNS = "CHAT_DB_MAX_IDLE_CONNS"
+const ENV_DB_CONN_MAX_LIFETIME = "CHAT_DB_CONN_MAX_LIFETIME"
+const ENV_ALLOWED_ORIGINS = "CHAT_ALLOWED_ORIGINS"
+const ENV_ALLOW_CREDENTIALS = "CHAT_CORS_CREDENTIALS"
+const ENV_TRUST_PROXY = "CHAT_TRUST_PROXY"
+const ENV_HASH_COST = "CHAT_HASH_COST"
+const ENV_MIN_PASSWORD_LENGTH = "CHAT_MIN_PASSWORD_LENGTH"
+const ENV_PASSWORD_REQUIRE_MIX = "CHAT_PASSWORD_REQUIRE_MIX"
+const ENV_USERNAME_MIN_LENGTH = "CHAT_USERNAME_MIN_LENGTH"
+const ENV_USERNAME_MAX_LENGTH = "CHAT_USERNAME_MAX_LENGTH"
+const ENV_USERNAME_ALPHANUMERIC = "CHAT_USERNAME_ALPHANUMERIC"
+const ENV_MAX_CONTENT_LENGTH = "CHAT_MAX_CONTENT_LENGTH"
+const ENV_LOG_LEVEL = "CHAT_LOG_LEVEL"
+const ENV_ALLOW_SELF_MESSAGES = "CHAT_ALLOW_SELF_MESSAGES"
+const ENV_REQUEST_TIMEOUT = "CHAT_REQUEST_TIMEOUT"
+const ENV_MAX_BODY_BYTES = "CHAT_MAX_BODY_BYTES"
+
+// Db connection settings used for any part of the DSN that isn't configured,
+// matching the db service in docker-compose.yml.
+const DEFAULT_DB_HOST = "db"
+const DEFAULT_DB_PORT = "3306"
+const DEFAULT_DB_USER = "root"
+const DEFAULT_DB_PASSWORD = "testpass"
+const DEFAULT_DB_NAME = "challenge"
+
+// Address the server listens on if none is configured.
+const DEFAULT_LISTEN_ADDR = ":8000"
+
+// Oldest TLS version accepted by default. Older versions have known
+// weaknesses.
+const DEFAULT_TLS_MIN_VERSION = tls.VersionTLS12
+
+// TLS versions ENV_TLS_MIN_VERSION can be set to.
+var TLS_VERSIONS = map[string]uint16{
+  "1.0": tls.VersionTLS10,
+  "1.1": tls.VersionTLS11,
+  "1.2": tls.VersionTLS12,
+  "1.3": tls.VersionTLS13,
+}
+
+// How long a request's db queries can take before they're canceled.
+const DEFAULT_QUERY_TIMEOUT = 5 * time.Second
+
+// How long a handler can take before the client gets a 503 instead.
+const DEFAULT_REQUEST_TIMEOUT = 10 * time.Second
+
+// Origins allowed to make cross-origin requests by default, i.e. the React
+// frontend as published by docker-compose and its dev server.
+const DEFAULT_ALLOWED_ORIGINS = "http://localhost:13000,http://localhost:3000"
+
+// Default limits on the length of new usernames.
+const DEFAULT_USERNAME_MIN_LENGTH = 1
+const DEFAULT_USERNAME_MAX_LENGTH = 10
+// Longest username the users table can hold.
+const MAX_USERNAME_LENGTH = 64
+
+// Default limit on the length of message content, in characters.
+const DEFAULT_MAX_CONTENT_LENGTH = 4096
+// Longest content the message_content column (TEXT, 65535 bytes) can hold
+// even if every character takes 4 bytes.
+const MAX_CONTENT_LENGTH_LIMIT = 16383
+
+// Default limit on the size of request bodies, in bytes. Comfortably more
+// than the longest message, with its metadata, takes as JSON.
+const DEFAULT_MAX_BODY_BYTES = 1 << 20
+
+// Default db connection pool settings.
+const DEFAULT_MAX_OPEN_CONNS = 25
+const DEFAULT_MAX_IDLE_CONNS = 5
+const DEFAULT_CONN_MAX_LIFETIME = 5 * time.Minute
+
+// By default, ping the db up to 5 times on startup, waiting 1s, 2s, 4s and
+// 8s in between. The db container is often still starting up when the
+// backend starts.
+const DEFAULT_PING_ATTEMPTS = 5
+const DEFAULT_PING_BACKOFF = time.Second
+
+// By default, retry queries that hit a deadlock or lock wait timeout up to 3
+// times in total, waiting 50ms and then 100ms in between.
+const DEFAULT_RETRY_ATTEMPTS = 3
+const DEFAULT_RETRY_BACKOFF = 50 * time.Millisecond
+
+// Config holds the settings that can change between deployments.
+type Config struct {
+  // Address for the HTTP server, e.g. ":8000" or "127.0.0.1:9000".
+  ListenAddr string
+  // Certificate and private key files to serve HTTPS with, in PEM format.
+  // Plain HTTP is served if they aren't set.
+  TLSCertFile string
+  TLSKeyFile string
+  // Oldest TLS version accepted, e.g. tls.VersionTLS12.
+  TLSMinVersion uint16
+  // MySQL data source name used to connect to the db.
+  DataSourceName string
+  // Connection pool settings for the db.
+  Pool *PoolConfig
+  // How long a request's db queries can take before they're canceled.
+  QueryTimeout time.Duration
+  // How long a request can take before it's answered with a 503. WebSocket
+  // connections aren't limited.
+  RequestTimeout time.Duration
+  // Origins browsers may make cross-origin requests from. "*" allows any.
+  AllowedOrigins []string
+  // Whether cross-origin requests from allowed origins may include
+  // credentials, i.e. cookies or an Authorization header.
+  AllowCredentials bool
+  // Whether the server is behind a proxy that appends the client's IP to
+  // X-Forwarded-For. The last address is then used for the client's IP.
+  // Otherwise clients could spoof their IP.
+  TrustProxy bool
+  // bcrypt cost used when hashing new passwords.
+  HashCost int
+  // Requirements for new passwords.
+  PasswordPolicy *auth.PasswordPolicy
+  // Length limits for new usernames, at most MAX_USERNAME_LENGTH.
+  UsernameMinLength int
+  UsernameMaxLength int
+  // Whether new usernames may only use letters, digits and underscores.
+  UsernameAlphanumeric bool
+  // Longest message content accepted, in characters, at most
+  // MAX_CONTENT_LENGTH_LIMIT.
+  MaxContentLength int
+  // Largest request body accepted, in bytes. Larger bodies get a 413.
+  MaxBodyBytes int64
+  // Whether users may send direct messages to themselves.
+  AllowSelfMessages bool
+  // Least severe messages that are logged.
+  LogLevel LogLevel
+}
+
+// PoolConfig holds the connection pool settings applied to the *sql.DB.
+// The sql package's defaults allow an unbounded number of open connections,
+// which can exhaust MySQL's connection limit under load.
+type PoolConfig struct {
+  MaxOpenConns int
+  MaxIdleConns int
+  ConnMaxLifetime time.Duration
+  // How many times to ping the db before giving up, at least 1.
+  PingAttempts int
+  // How long to wait after the first failed ping. Doubles after each attempt.
+  PingBackoff time.Duration
+  // How many times to try a query that fails with a transient error, at
+  // least 1, and how long to wait before the first retry. The wait doubles
+  // after each attempt.
+  RetryAttempts int
+  RetryBackoff time.Duration
+}
+
+// Factory for pool settings with the defaults.
+func DefaultPoolConfig() *PoolConfig {
+  return &PoolConfig{
+    MaxOpenConns: DEFAULT_MAX_OPEN_CONNS,
+    MaxIdleConns: DEFAULT_MAX_IDLE_CONNS,
+    ConnMaxLifetime: DEFAULT_CONN_MAX_LIFETIME,
+    PingAttempts: DEFAULT_PING_ATTEMPTS,
+    PingBackoff: DEFAULT_PING_BACKOFF,
+    RetryAttempts: DEFAULT_RETRY_ATTEMPTS,
+    RetryBackoff: DEFAULT_RETRY_BACKOFF,
+  }
+}
+
+// Factory for a config with the default settings.
+func DefaultConfig() *Config {
+  return &Config{
+    ListenAddr: DEFAULT_LISTEN_ADDR,
+    TLSMinVersion: DEFAULT_TLS_MIN_VERSION,
+    DataSourceName: DATA_SOURCE_NAME,
+    Pool: DefaultPoolConfig(),
+    QueryTimeout: DEFAULT_QUERY_TIMEOUT,
+    RequestTimeout: DEFAULT_REQUEST_TIMEOUT,
+    AllowedOrigins: splitList(DEFAULT_ALLOWED_ORIGINS),
+    HashCost: auth.DEFAULT_HASH_COST,
+    PasswordPolicy: auth.DefaultPasswordPolicy(),
+    UsernameMinLength: DEFAULT_USERNAME_MIN_LENGTH,
+    UsernameMaxLength: DEFAULT_USERNAME_MAX_LENGTH,
+    MaxContentLength: DEFAULT_MAX_CONTENT_LENGTH,
+    MaxBodyBytes: DEFAULT_MAX_BODY_BYTES,
+    AllowSelfMessages: true,
+    LogLevel: DEFAULT_LOG_LEVEL,
+  }
+}
+
+// Factory for a config read from the environment.
+// Any variable that isn't set falls back to the default.
+// Returns an error if a variable is set to an invalid value.
+func ConfigFromEnv() (*Config, error) {
+  config := DefaultConfig()
+  if addr := os.Getenv(ENV_LISTEN_ADDR); len(addr) > 0 {
+    config.ListenAddr = addr
+  } else if port := os.Getenv(ENV_PORT); len(port) > 0 {
+    // Shorthand for listening on every interface.
+    if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+      return nil, errors.New(fmt.Sprintf("%s should be a port number, got %q", ENV_PORT, port))
+    }
+    config.ListenAddr = ":" + port
+  }
+  config.TLSCertFile = os.Getenv(ENV_TLS_CERT_FILE)
+  config.TLSKeyFile = os.Getenv(ENV_TLS_KEY_FILE)
+  if (len(config.TLSCertFile) == 0) != (len(config.TLSKeyFile) == 0) {
+    return nil, errors.New(fmt.Sprintf("%s and %s should be set together", ENV_TLS_CERT_FILE, ENV_TLS_KEY_FILE))
+  }
+  if minVersion := os.Getenv(ENV_TLS_MIN_VERSION); len(minVersion) > 0 {
+    var ok bool
+    if config.TLSMinVersion, ok = TLS_VERSIONS[minVersion]; !ok {
+      return nil, errors.New(fmt.Sprintf("%s should be one of 1.0, 1.1, 1.2 or 1.3, got %q", ENV_TLS_MIN_VERSION, minVersion))
+    }
+  }
+  dsn, err := dataSourceNameFromEnv()
+  if err != nil {
+    return nil, err
+  }
+  config.DataSourceName = dsn
+  if err = config.Pool.readEnv(); err != nil {
+    return nil, err
+  }
+  if origins := os.Getenv(ENV_ALLOWED_ORIGINS); len(origins) > 0 {
+    config.AllowedOrigins = splitList(origins)
+  }
+  if allowCredentials := os.Getenv(ENV_ALLOW_CREDENTIALS); len(allowCredentials) > 0 {
+    var err error
+    if config.AllowCredentials, err = strconv.ParseBool(allowCredentials); err != nil {
+      return nil, errors.New(fmt.Sprintf("%s should be true or false, got %q", ENV_ALLOW_CREDENTIALS, allowCredentials))
+    }
+  }
+  if trustProxy := os.Getenv(ENV_TRUST_PROXY); len(trustProxy) > 0 {
+    var err error
+    if config.TrustProxy, err = strconv.ParseBool(trustProxy); err != nil {
+      return nil, errors.New(fmt.Sprintf("%s should be true or false, got %q", ENV_TRUST_PROXY, trustProxy))
+    }
+  }
+  if hashCost := os.Getenv(ENV_HASH_COST); len(hashCost) > 0 {
+    var err error
+    if config.HashCost, err = strconv.Atoi(hashCost); err != nil {
+      return nil, errors.New(fmt.Sprintf("%s should be a number, got %q", ENV_HASH_COST, hashCost))
+    }
+    if err = auth.ValidateHashCost(config.HashCost); err != nil {
+      return nil, errors.New(fmt.Sprintf("bad %s: %s", ENV_HASH_COST, err.Error()))
+    }
+  }
+  if minLength := os.Getenv(ENV_MIN_PASSWORD_LENGTH); len(minLength) > 0 {
+    var err error
+    if config.PasswordPolicy.MinLength, err = strconv.Atoi(minLength); err != nil {
+      return nil, errors.New(fmt.Sprintf("%s should be a number, got %q", ENV_MIN_PASSWORD_LENGTH, minLength))
+    }
+    if err = config.PasswordPolicy.Check(); err != nil {
+      return nil, errors.New(fmt.Sprintf("bad %s: %s", ENV_MIN_PASSWORD_LENGTH, err.Error()))
+    }
+  }
+  if requireMix := os.Getenv(ENV_PASSWORD_REQUIRE_MIX); len(requireMix) > 0 {
+    var err error
+    if config.PasswordPolicy.RequireMixedClasses, err = strconv.ParseBool(requireMix); err != nil {
+      return nil, errors.New(fmt.Sprintf("%s should be true or false, got %q", ENV_PASSWORD_REQUIRE_MIX, requireMix))
+    }
+  }
+  if minLength := os.Getenv(ENV_USERNAME_MIN_LENGTH); len(minLength) > 0 {
+    var err error
+    if config.UsernameMinLength, err = strconv.Atoi(minLength); err != nil {
+      return nil, errors.New(fmt.Sprintf("%s should be a number, got %q", ENV_USERNAME_MIN_LENGTH, minLength))
+    }
+  }
+  if maxLength := os.Getenv(ENV_USERNAME_MAX_LENGTH); len(maxLength) > 0 {
+    var err error
+    if config.UsernameMaxLength, err = strconv.Atoi(maxLength); err != nil {
+      return nil, errors.New(fmt.Sprintf("%s should be a number, got %q", ENV_USERNAME_MAX_LENGTH, maxLength))
+    }
+  }
+  if err := config.checkUsernameLengths(); err != nil {
+    return nil, err
+  }
+  if alphanumeric := os.Getenv(ENV_USERNAME_ALPHANUMERIC); len(alphanumeric) > 0 {
+    var err error
+    if config.UsernameAlphanumeric, err = strconv.ParseBool(alphanumeric); err != nil {
+      return nil, errors.New(fmt.Sprintf("%s should be true or false, got %q", ENV_USERNAME_ALPHANUMERIC, alphanumeric))
+    }
+  }
+  if maxContentLength := os.Getenv(ENV_MAX_CONTENT_LENGTH); len(maxContentLength) > 0 {
+    var err error
+    if config.MaxContentLength, err = strconv.Atoi(maxContentLength); err != nil {
+      return nil, errors.New(fmt.Sprintf("%s should be a number, got %q", ENV_MAX_CONTENT_LENGTH, maxContentLength))
+    }
+    if config.MaxContentLength < 1 || config.MaxContentLength > MAX_CONTENT_LENGTH_LIMIT {
+      return nil, errors.New(fmt.Sprintf("%s should be between 1 and %d, got %d",
+                                         ENV_MAX_CONTENT_LENGTH, MAX_CONTENT_LENGTH_LIMIT, config.MaxContentLength))
+    }
+  }
+  if maxBodyBytes := os.Getenv(ENV_MAX_BODY_BYTES); len(maxBodyBytes) > 0 {
+    var err error
+    if config.MaxBodyBytes, err = strconv.ParseInt(maxBodyBytes, 10, 64); err != nil || config.MaxBodyBytes < 1 {
+      return nil, errors.New(fmt.Sprintf("%s should be a positive number of bytes, got %q", ENV_MAX_BODY_BYTES, maxBodyBytes))
+    }
+  }
+  if allowSelfMessages := os.Getenv(ENV_ALLOW_SELF_MESSAGES); len(allowSelfMessages) > 0 {
+    var err error
+    if config.AllowSelfMessages, err = strconv.ParseBool(allowSelfMessages); err != nil {
+      return nil, errors.New(fmt.Sprintf("%s should be true or false, got %q", ENV_ALLOW_SELF_MESSAGES, allowSelfMessages))
+    }
+  }
+  if timeout := os.Getenv(ENV_REQUEST_TIMEOUT); len(timeout) > 0 {
+    var err error
+    if config.RequestTimeout, err = time.ParseDuration(timeout); err != nil || config.RequestTimeout <= 0 {
+      return nil, errors.New(fmt.Sprintf("%s should be a positive duration like 10s, got %q", ENV_REQUEST_TIMEOUT, timeout))
+    }
+  }
+  if logLevel := os.Getenv(ENV_LOG_LEVEL); len(logLevel) > 0 {
+    var err error
+    if config.LogLevel, err = ParseLogLevel(logLevel); err != nil {
+      return nil, errors.New(fmt.Sprintf("bad %s: %s", ENV_LOG_LEVEL, err.Error()))
+    }
+  }
+  if err = config.validate(); err != nil {
+    return nil, err
+  }
+  return config, nil
+}
+
+// Returns an error for settings that can't be fallen back from safely, so
+// the server shouldn't start with them.
+func (config *Config) validate() error {
+  // Any site could then make requests with the user's credentials.
+  if config.AllowCredentials {
+    for _, origin := range config.AllowedOrigins {
+      if origin == "*" {
+        return errors.New(fmt.Sprintf("credentials (%s) can't be allowed when any origin (%s) is",
+                                      ENV_ALLOW_CREDENTIALS, ENV_ALLOWED_ORIGINS))
+      }
+    }
+  }
+  return nil
+}
+
+// Returns an error if the username length limits don't make sense.
+func (config *Config) checkUsernameLengths() error {
+  if config.UsernameMinLength < 1 || config.UsernameMaxLength > MAX_USERNAME_LENGTH ||
+     config.UsernameMinLength > config.UsernameMaxLength {
+    return errors.New(fmt.Sprintf("username lengths should satisfy 1 <= min <= max <= %d, got %d and %d",
+                                  MAX_USERNAME_LENGTH, config.UsernameMinLength, config.UsernameMaxLength))
+  }
+  return nil
+}
+
+// Overrides the pool settings with any set in the environment.
+func (pool *PoolConfig) readEnv() error {
+  if maxOpen := os.Getenv(ENV_DB_MAX_OPEN_CONNS); len(maxOpen) > 0 {
+    var err error
+    if pool.MaxOpenConns, err = strconv.Atoi(maxOpen); err != nil || pool.MaxOpenConns < 1 {
+      return errors.New(fmt.Sprintf("%s should be a positive number, got %q", ENV_DB_MAX_OPEN_CONNS, maxOpen))
+    }
+  }
+  if maxIdle := os.Getenv(ENV_DB_MAX_IDLE_CONNS); len(maxIdle) > 0 {
+    var err error
+    if pool.MaxIdleConns, err = strconv.Atoi(maxIdle); err != nil || pool.MaxIdleConns < 0 {
+      return errors.New(fmt.Sprintf("%s should be 0 or more, got %q", ENV_DB_MAX_IDLE_CONNS, maxIdle))
+    }
+    if pool.MaxIdleConns > pool.MaxOpenConns {
+      return errors.New(fmt.Sprintf("%s should be at most %s", ENV_DB_MAX_IDLE_CONNS, ENV_DB_MAX_OPEN_CONNS))
+    }
+  } else if pool.MaxIdleConns > pool.MaxOpenConns {
+    // Keep the default from exceeding a lower max, like database/sql would.
+    pool.MaxIdleConns = pool.MaxOpenConns
+  }
+  if lifetime := os.Getenv(ENV_DB_CONN_MAX_LIFETIME); len(lifetime) > 0 {
+    var err error
+    if pool.ConnMaxLifetime, err = time.ParseDuration(lifetime); err != nil || pool.ConnMaxLifetime <= 0 {
+      return errors.New(fmt.Sprintf("%s should be a positive duration like 5m, got %q", ENV_DB_CONN_MAX_LIFETIME, lifetime))
+    }
+  }
+  return nil
+}
+
+// Returns the DSN for the db, either ENV_DB_DSN or assembled from the
+// separate host, port, user, password and database name variables. Either
+// way parseTime is turned on, since the store scans DATETIME columns into
+// time.Time.
+func dataSourceNameFromEnv() (string, error) {
+  parts := map[string]string{
+    ENV_DB_HOST: DEFAULT_DB_HOST,
+    ENV_DB_PORT: DEFAULT_DB_PORT,
+    ENV_DB_USER: DEFAULT_DB_USER,
+    ENV_DB_PASSWORD: DEFAULT_DB_PASSWORD,
+    ENV_DB_NAME: DEFAULT_DB_NAME,
+  }
+  partsSet := false
+  for name := range parts {
+    if value, ok := os.LookupEnv(name); ok {
+      parts[name] = value
+      partsSet = true
+    }
+  }
+  if dsn := os.Getenv(ENV_DB_DSN); len(dsn) > 0 {
+    if partsSet {
+      return "", errors.New(fmt.Sprintf("set either %s or the separate %s_* variables, not both", ENV_DB_DSN, "CHAT_DB"))
+    }
+    dbConfig, err := mysql.ParseDSN(dsn)
+    if err != nil {
+      return "", errors.New(fmt.Sprintf("%s isn't a valid MySQL DSN: %s", ENV_DB_DSN, err.Error()))
+    }
+    dbConfig.ParseTime = true
+    return dbConfig.FormatDSN(), nil
+  }
+  if _, err := strconv.ParseUint(parts[ENV_DB_PORT], 10, 16); err != nil {
+    return "", errors.New(fmt.Sprintf("%s should be a port number, got %q", ENV_DB_PORT, parts[ENV_DB_PORT]))
+  }
+  dbConfig := mysql.NewConfig()
+  dbConfig.Net = "tcp"
+  dbConfig.Addr = net.JoinHostPort(parts[ENV_DB_HOST], parts[ENV_DB_PORT])
+  dbConfig.User = parts[ENV_DB_USER]
+  dbConfig.Passwd = parts[ENV_DB_PASSWORD]
+  dbConfig.DBName = parts[ENV_DB_NAME]
+  // Scan DATETIME columns into time.Time.
+  dbConfig.ParseTime = true
+  return dbConfig.FormatDSN(), nil
+}
+
+// Splits a comma-separated list, ignoring spaces and empty entries.
+func splitList(list string) (items []string) {
+  for _, item := range strings.Split(list, ",") {
+    if item = strings.TrimSpace(item); len(item) > 0 {
+      items = append(items, item)
+    }
+  }
+  return items
+}
@@ -0,0 +1,191 @@
+package chatserver
+
+import (
+  "os"
+  "testing"
+  "time"
+
+  auth "app/chatauth"
+  "github.com/go-sql-driver/mysql"
+)
+
+// Every variable ConfigFromEnv reads.
+var CONFIG_ENV_VARS = []string{
+  ENV_LISTEN_ADDR, ENV_PORT, ENV_TLS_CERT_FILE, ENV_TLS_KEY_FILE, ENV_TLS_MIN_VERSION,
+  ENV_DB_DSN, ENV_DB_HOST, ENV_DB_PORT, ENV_DB_USER, ENV_DB_PASSWORD, ENV_DB_NAME,
+  ENV_DB_MAX_OPEN_CONNS, ENV_DB_MAX_IDLE_CONNS, ENV_DB_CONN_MAX_LIFETIME,
+  ENV_ALLOWED_ORIGINS, ENV_ALLOW_CREDENTIALS, ENV_TRUST_PROXY, ENV_HASH_COST,
+  ENV_MIN_PASSWORD_LENGTH, ENV_PASSWORD_REQUIRE_MIX, ENV_USERNAME_MIN_LENGTH,
+  ENV_USERNAME_MAX_LENGTH, ENV_USERNAME_ALPHANUMERIC, ENV_MAX_CONTENT_LENGTH, ENV_LOG_LEVEL,
+  ENV_ALLOW_SELF_MESSAGES, ENV_REQUEST_TIMEOUT, ENV_MAX_BODY_BYTES,
+}
+
+// Unsets every config variable for the rest of the test, then sets the
+// given ones.
+func setConfigEnv(t *testing.T, values map[string]string) {
+  t.Helper()
+  for _, name := range CONFIG_ENV_VARS {
+    // Setenv restores the original value when the test ends.
+    t.Setenv(name, "")
+    os.Unsetenv(name)
+  }
+  for name, value := range values {
+    t.Setenv(name, value)
+  }
+}
+
+// Sets the config variables like setConfigEnv and returns the config read
+// from them, failing the test on any error.
+func testConfigFromEnv(t *testing.T, values map[string]string) *Config {
+  t.Helper()
+  setConfigEnv(t, values)
+  config, err := ConfigFromEnv()
+  if err != nil {
+    t.Fatalf("%v: ConfigFromEnv: %s", values, err.Error())
+  }
+  return config
+}
+
+// Fails the test unless reading the config with the variables set returns
+// an error.
+func expectConfigError(t *testing.T, values map[string]string) {
+  t.Helper()
+  setConfigEnv(t, values)
+  if _, err := ConfigFromEnv(); err == nil {
+    t.Errorf("%v: got no error", values)
+  }
+}
+
+func TestServerHonorsListenAddr(t *testing.T) {
+  config := DefaultConfig()
+  config.ListenAddr = "127.0.0.1:18001"
+  server, _ := newTestServerWithConfig(t, config)
+  if server.ListenAddr() != "127.0.0.1:18001" {
+    t.Errorf("got listen address %q, want 127.0.0.1:18001", server.ListenAddr())
+  }
+}
+
+func TestConfigFromEnvListenAddr(t *testing.T) {
+  tests := []struct {
+    name string
+    env map[string]string
+    want string
+  }{
+    {"default", nil, DEFAULT_LISTEN_ADDR},
+    {"address", map[string]string{ENV_LISTEN_ADDR: "127.0.0.1:9000"}, "127.0.0.1:9000"},
+    {"port", map[string]string{ENV_PORT: "9000"}, ":9000"},
+    {"address wins over port", map[string]string{ENV_LISTEN_ADDR: "127.0.0.1:9000", ENV_PORT: "9001"}, "127.0.0.1:9000"},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      if config := testConfigFromEnv(t, test.env); config.ListenAddr != test.want {
+        t.Errorf("got listen address %q, want %q", config.ListenAddr, test.want)
+      }
+    })
+  }
+}
+
+func TestConfigFromEnvDataSourceName(t *testing.T) {
+  config := testConfigFromEnv(t, map[string]string{ENV_DB_DSN: "user:pass@tcp(localhost:3307)/chat?parseTime=true"})
+  if config.DataSourceName != "user:pass@tcp(localhost:3307)/chat?parseTime=true" {
+    t.Errorf("got data source name %q", config.DataSourceName)
+  }
+}
+
+func TestConfigFromEnvDataSourceNameParsesTime(t *testing.T) {
+  for _, dsn := range []string{
+    "user:pass@tcp(localhost:3307)/chat",
+    "user:pass@tcp(localhost:3307)/chat?parseTime=false&timeout=5s",
+  } {
+    config := testConfigFromEnv(t, map[string]string{ENV_DB_DSN: dsn})
+    dbConfig, err := mysql.ParseDSN(config.DataSourceName)
+    if err != nil {
+      t.Fatalf("%s: got data source name %q that doesn't parse: %s", dsn, config.DataSourceName, err.Error())
+    }
+    if !dbConfig.ParseTime || dbConfig.Addr != "localhost:3307" || dbConfig.DBName != "chat" {
+      t.Errorf("%s: got data source name %q, want the same db with parseTime", dsn, config.DataSourceName)
+    }
+  }
+  expectConfigError(t, map[string]string{ENV_DB_DSN: "not a dsn"})
+}
+
+func TestConfigFromEnvRejectsBadPort(t *testing.T) {
+  expectConfigError(t, map[string]string{ENV_PORT: "eighty"})
+}
+
+func TestConfigFromEnvAllowedOrigins(t *testing.T) {
+  config := testConfigFromEnv(t, nil)
+  if len(config.AllowedOrigins) != 2 || config.AllowedOrigins[0] != "http://localhost:13000" ||
+     config.AllowedOrigins[1] != "http://localhost:3000" {
+    t.Errorf("got default allowed origins %v", config.AllowedOrigins)
+  }
+  config = testConfigFromEnv(t, map[string]string{ENV_ALLOWED_ORIGINS: "https://a.example.com, https://b.example.com"})
+  if len(config.AllowedOrigins) != 2 || config.AllowedOrigins[0] != "https://a.example.com" ||
+     config.AllowedOrigins[1] != "https://b.example.com" {
+    t.Errorf("got allowed origins %v", config.AllowedOrigins)
+  }
+}
+
+func TestConfigRejectsCredentialsForAnyOrigin(t *testing.T) {
+  expectConfigError(t, map[string]string{ENV_ALLOWED_ORIGINS: "*", ENV_ALLOW_CREDENTIALS: "true"})
+  config := DefaultConfig()
+  config.AllowedOrigins = []string{"*"}
+  config.AllowCredentials = true
+  if _, err := NewChatServer(NewMemoryChatStore(), config); err == nil {
+    t.Errorf("NewChatServer accepted credentials from any origin")
+  }
+}
+
+func TestConfigFromEnvHashCost(t *testing.T) {
+  if config := testConfigFromEnv(t, nil); config.HashCost != auth.DEFAULT_HASH_COST {
+    t.Errorf("got default hash cost %d, want %d", config.HashCost, auth.DEFAULT_HASH_COST)
+  }
+  if config := testConfigFromEnv(t, map[string]string{ENV_HASH_COST: "4"}); config.HashCost != 4 {
+    t.Errorf("got hash cost %d, want 4", config.HashCost)
+  }
+  for _, hashCost := range []string{"3", "32", "high"} {
+    expectConfigError(t, map[string]string{ENV_HASH_COST: hashCost})
+  }
+}
+
+func TestConfigFromEnvPool(t *testing.T) {
+  config := testConfigFromEnv(t, map[string]string{
+    ENV_DB_MAX_OPEN_CONNS: "20", ENV_DB_MAX_IDLE_CONNS: "5", ENV_DB_CONN_MAX_LIFETIME: "2m",
+  })
+  if config.Pool.MaxOpenConns != 20 || config.Pool.MaxIdleConns != 5 || config.Pool.ConnMaxLifetime != 2 * time.Minute {
+    t.Errorf("got pool %+v, want 20 open, 5 idle, 2m lifetime", config.Pool)
+  }
+  // The default idle limit shrinks to fit a lower open limit.
+  if config = testConfigFromEnv(t, map[string]string{ENV_DB_MAX_OPEN_CONNS: "1"}); config.Pool.MaxIdleConns != 1 {
+    t.Errorf("got %d idle connections with 1 open, want 1", config.Pool.MaxIdleConns)
+  }
+  for _, env := range []map[string]string{
+    {ENV_DB_MAX_OPEN_CONNS: "0"},
+    {ENV_DB_MAX_IDLE_CONNS: "-1"},
+    {ENV_DB_MAX_OPEN_CONNS: "2", ENV_DB_MAX_IDLE_CONNS: "3"},
+    {ENV_DB_CONN_MAX_LIFETIME: "forever"},
+  } {
+    expectConfigError(t, env)
+  }
+}
+
+func TestConfigFromEnvRequestTimeout(t *testing.T) {
+  if config := testConfigFromEnv(t, nil); config.RequestTimeout != DEFAULT_REQUEST_TIMEOUT {
+    t.Errorf("got default request timeout %s, want %s", config.RequestTimeout, DEFAULT_REQUEST_TIMEOUT)
+  }
+  if config := testConfigFromEnv(t, map[string]string{ENV_REQUEST_TIMEOUT: "3s"}); config.RequestTimeout != 3 * time.Second {
+    t.Errorf("got request timeout %s, want 3s", config.RequestTimeout)
+  }
+  for _, timeout := range []string{"0s", "-1s", "soon"} {
+    expectConfigError(t, map[string]string{ENV_REQUEST_TIMEOUT: timeout})
+  }
+}
+
+func TestConfigFromEnvMaxBodyBytes(t *testing.T) {
+  if config := testConfigFromEnv(t, map[string]string{ENV_MAX_BODY_BYTES: "2048"}); config.MaxBodyBytes != 2048 {
+    t.Errorf("got max body bytes %d, want 2048", config.MaxBodyBytes)
+  }
+  for _, maxBodyBytes := range []string{"0", "-1", "1MB"} {
+    expectConfigError(t, map[string]string{ENV_MAX_BODY_BYTES: maxBodyBytes})
+  }
+}
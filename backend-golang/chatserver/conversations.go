@@ -0,0 +1,57 @@
+package chatserver
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+)
+
+// Request handler for /conversations.
+func (server *ChatServer) handleConversations(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodGet:
+    server.fetchConversations(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at /conversations, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only GET requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Lists everyone a user has chatted with, along with the latest message in
+// each conversation, most recently active first.
+// Expects a GET to /conversations with the following query parameters:
+// - user: username to list conversations for. username is accepted too, to
+//   match /users/exists and /messages/search.
+//
+// Sample curl request:
+// curl "localhost:18000/conversations?user=user1"
+func (server *ChatServer) fetchConversations(w http.ResponseWriter, r *http.Request) {
+  params := r.URL.Query()
+  usernames := append(params["user"], params["username"]...)
+  if len(usernames) != 1 {
+    errorResponse(w, http.StatusBadRequest, "bad GET request at /conversations, expected exactly one user", ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  username := usernames[0]
+  server.logger.Debugf("Received GET at /conversations for %s", username)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  conversations, err := server.db.FetchConversations(ctx, username)
+  if err != nil {
+    server.logger.Errorf("Error fetching conversations from db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't fetch conversations: %s", err.Error()), codeForError(err))
+    return
+  }
+  // Always respond with an array, even if there are no conversations yet.
+  if conversations == nil {
+    conversations = []*Conversation{}
+  }
+  server.logger.Debugf("Successfully fetched %d conversations for %s", len(conversations), username)
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(conversations); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
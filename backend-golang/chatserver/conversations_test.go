@@ -0,0 +1,60 @@
+package chatserver
+
+import (
+  "net/http"
+  "testing"
+)
+
+// Fetches the user's conversations.
+func fetchTestConversations(t *testing.T, server *ChatServer, username string) []*Conversation {
+  t.Helper()
+  w := doRequest(server, http.MethodGet, "/conversations?user=" + username, "")
+  var conversations []*Conversation
+  decodeResponse(t, w, http.StatusOK, &conversations)
+  return conversations
+}
+
+func TestFetchConversations(t *testing.T) {
+  server, _ := newTestServer(t)
+  for _, username := range []string{"user1", "user2", "user3", "user4", "user5"} {
+    createTestUser(t, server, username)
+  }
+  sendTestMessage(t, server, "user1", "user2", "first to user2")
+  sendTestMessage(t, server, "user3", "user1", "from user3")
+  sendTestMessage(t, server, "user2", "user1", "reply from user2")
+  // Conversations user1 isn't in don't show up.
+  sendTestMessage(t, server, "user4", "user5", "not for user1")
+  conversations := fetchTestConversations(t, server, "user1")
+  want := []Conversation{
+    {Counterpart: "user2", LastMessage: "reply from user2"},
+    {Counterpart: "user3", LastMessage: "from user3"},
+  }
+  if len(conversations) != len(want) {
+    t.Fatalf("got %d conversations, want %d: %+v", len(conversations), len(want), conversations)
+  }
+  for i, conversation := range conversations {
+    if conversation.Counterpart != want[i].Counterpart || conversation.LastMessage != want[i].LastMessage ||
+       conversation.LastMessageType != MESSAGE_TYPE_PLAINTEXT || conversation.LastMessageAt.IsZero() {
+      t.Errorf("conversation %d is %+v, want %s's latest, %q", i, conversation, want[i].Counterpart, want[i].LastMessage)
+    }
+    if i > 0 && conversation.LastMessageAt.After(conversations[i - 1].LastMessageAt) {
+      t.Errorf("conversation %d is more recent than the one before it", i)
+    }
+  }
+  // New messages move a conversation to the top.
+  sendTestMessage(t, server, "user1", "user3", "back to user3")
+  conversations = fetchTestConversations(t, server, "user1")
+  if len(conversations) != 2 || conversations[0].Counterpart != "user3" || conversations[0].LastMessage != "back to user3" {
+    t.Errorf("got %+v, want user3's conversation first", conversations)
+  }
+}
+
+func TestFetchConversationsEmpty(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUser(t, server, "user1")
+  if conversations := fetchTestConversations(t, server, "user1"); conversations == nil || len(conversations) != 0 {
+    t.Errorf("got %+v, want an empty array", conversations)
+  }
+  expectError(t, doRequest(server, http.MethodGet, "/conversations?user=nobody", ""), http.StatusNotFound, ERROR_CODE_USER_NOT_FOUND)
+  expectError(t, doRequest(server, http.MethodGet, "/conversations", ""), http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+}
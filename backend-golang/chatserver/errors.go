@@ -0,0 +1,89 @@
+package chatserver
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+)
+
+// Stable codes identifying each class of error, so clients can react to an
+// error without parsing its message.
+const ERROR_CODE_BAD_REQUEST = "bad_request"
+const ERROR_CODE_METHOD_NOT_ALLOWED = "method_not_allowed"
+const ERROR_CODE_NOT_FOUND = "not_found"
+const ERROR_CODE_ORIGIN_NOT_ALLOWED = "origin_not_allowed"
+const ERROR_CODE_UNSUPPORTED_MEDIA_TYPE = "unsupported_media_type"
+const ERROR_CODE_BODY_TOO_LARGE = "body_too_large"
+const ERROR_CODE_INVALID_CREDENTIALS = "invalid_credentials"
+const ERROR_CODE_RATE_LIMITED = "rate_limited"
+const ERROR_CODE_REQUEST_TIMEOUT = "request_timeout"
+const ERROR_CODE_USER_NOT_FOUND = "user_not_found"
+const ERROR_CODE_USER_EXISTS = "user_exists"
+const ERROR_CODE_MESSAGE_NOT_FOUND = "message_not_found"
+const ERROR_CODE_NOT_MESSAGE_SENDER = "not_message_sender"
+const ERROR_CODE_NOT_MESSAGE_RECIPIENT = "not_message_recipient"
+const ERROR_CODE_MESSAGE_NOT_EDITABLE = "message_not_editable"
+const ERROR_CODE_ROOM_NOT_FOUND = "room_not_found"
+const ERROR_CODE_NOT_ROOM_MEMBER = "not_room_member"
+const ERROR_CODE_INVALID_REPLY = "invalid_reply"
+const ERROR_CODE_INVALID_STATUS = "invalid_status"
+const ERROR_CODE_STATUS_REGRESSION = "status_regression"
+const ERROR_CODE_BLOCKED = "blocked"
+const ERROR_CODE_INTERNAL = "internal_error"
+
+// Defines the JSON body of error responses,
+// {"error": {"message": ..., "code": ...}}.
+type errorBody struct {
+  Error errorDetails `json:"error"`
+}
+
+type errorDetails struct {
+  Message string `json:"message"`
+  Code    string `json:"code"`
+}
+
+// Responds with the given status and a JSON error body.
+// Like http.Error, the handler shouldn't write anything else afterwards.
+func errorResponse(w http.ResponseWriter, status int, message string, code string) {
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("X-Content-Type-Options", "nosniff")
+  w.WriteHeader(status)
+  // The body always encodes, so this can only fail if the client has gone
+  // away, and there's no one left to tell.
+  json.NewEncoder(w).Encode(&errorBody{
+    Error: errorDetails{Message: message, Code: code},
+  })
+}
+
+// Returns the error code for an error from the store, to go with the status
+// from statusForError.
+func codeForError(err error) string {
+  switch {
+  case errors.Is(err, ErrUserNotFound):
+    return ERROR_CODE_USER_NOT_FOUND
+  case errors.Is(err, ErrUserExists):
+    return ERROR_CODE_USER_EXISTS
+  case errors.Is(err, ErrMessageNotFound):
+    return ERROR_CODE_MESSAGE_NOT_FOUND
+  case errors.Is(err, ErrNotMessageSender):
+    return ERROR_CODE_NOT_MESSAGE_SENDER
+  case errors.Is(err, ErrNotMessageRecipient):
+    return ERROR_CODE_NOT_MESSAGE_RECIPIENT
+  case errors.Is(err, ErrMessageNotEditable):
+    return ERROR_CODE_MESSAGE_NOT_EDITABLE
+  case errors.Is(err, ErrRoomNotFound):
+    return ERROR_CODE_ROOM_NOT_FOUND
+  case errors.Is(err, ErrNotRoomMember):
+    return ERROR_CODE_NOT_ROOM_MEMBER
+  case errors.Is(err, ErrInvalidReply):
+    return ERROR_CODE_INVALID_REPLY
+  case errors.Is(err, ErrInvalidMessageStatus):
+    return ERROR_CODE_INVALID_STATUS
+  case errors.Is(err, ErrMessageStatusRegression):
+    return ERROR_CODE_STATUS_REGRESSION
+  case errors.Is(err, ErrBlocked):
+    return ERROR_CODE_BLOCKED
+  default:
+    return ERROR_CODE_INTERNAL
+  }
+}
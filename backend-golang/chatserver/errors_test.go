@@ -0,0 +1,70 @@
+package chatserver
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestErrorResponseShape(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUser(t, server, "user1")
+  tests := []struct {
+    name string
+    method string
+    target string
+    body string
+    status int
+    code string
+  }{
+    {"bad JSON", http.MethodPost, "/users", `{"username":`, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST},
+    {"taken username", http.MethodPost, "/users", `{"username":"user1", "password":"` + TEST_PASSWORD + `"}`,
+     http.StatusConflict, ERROR_CODE_USER_EXISTS},
+    {"wrong password", http.MethodPost, "/login", `{"username":"user1", "password":"wrong-password1"}`,
+     http.StatusUnauthorized, ERROR_CODE_INVALID_CREDENTIALS},
+    {"missing recipient", http.MethodGet, "/messages?sender=user1&recipient=nobody", "",
+     http.StatusNotFound, ERROR_CODE_USER_NOT_FOUND},
+    {"wrong method", http.MethodPatch, "/messages", "", http.StatusMethodNotAllowed, ERROR_CODE_METHOD_NOT_ALLOWED},
+    {"no such endpoint", http.MethodGet, "/nowhere", "", http.StatusNotFound, ERROR_CODE_NOT_FOUND},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      w := doRequest(server, test.method, test.target, test.body)
+      if got := w.Header().Get("Content-Type"); got != "application/json" {
+        t.Errorf("got Content-Type %q, want application/json", got)
+      }
+      // Exactly {"error":{"message":..., "code":...}}, nothing else.
+      var body map[string]map[string]interface{}
+      decodeResponse(t, w, test.status, &body)
+      details, ok := body["error"]
+      if len(body) != 1 || !ok || len(details) != 2 {
+        t.Fatalf("got %s, want just an error with a message and code", w.Body.String())
+      }
+      if message, _ := details["message"].(string); len(message) == 0 {
+        t.Errorf("got message %v, want a non-empty string", details["message"])
+      }
+      if code, _ := details["code"].(string); code != test.code {
+        t.Errorf("got code %v, want %q", details["code"], test.code)
+      }
+    })
+  }
+}
+
+func TestErrorResponse(t *testing.T) {
+  w := httptest.NewRecorder()
+  errorResponse(w, http.StatusTeapot, "short and stout", "teapot")
+  if w.Code != http.StatusTeapot {
+    t.Errorf("got status %d, want %d", w.Code, http.StatusTeapot)
+  }
+  if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+    t.Errorf("got X-Content-Type-Options %q, want nosniff", got)
+  }
+  var body errorBody
+  if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+    t.Fatalf("couldn't decode %q: %s", w.Body.String(), err.Error())
+  }
+  if body.Error.Message != "short and stout" || body.Error.Code != "teapot" {
+    t.Errorf("got %+v", body.Error)
+  }
+}
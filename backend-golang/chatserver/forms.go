@@ -0,0 +1,123 @@
+package chatserver
+
+import (
+  "errors"
+  "fmt"
+  "mime"
+  "net/http"
+  "net/url"
+  "strconv"
+)
+
+// Content types accepted for request bodies that create users and messages.
+const CONTENT_TYPE_JSON = "application/json"
+const CONTENT_TYPE_FORM = "application/x-www-form-urlencoded"
+
+// Returned for request bodies in any other content type. Handlers respond
+// with a 415.
+var ErrUnsupportedMediaType = errors.New("body should be JSON or a url-encoded form")
+// Returned for request bodies over Config.MaxBodyBytes. Handlers respond with
+// a 413.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// Returns CONTENT_TYPE_JSON or CONTENT_TYPE_FORM for the request body,
+// ignoring parameters such as charset.
+// Bodies without a Content-Type are treated as JSON, as they were before
+// forms were accepted.
+func bodyContentType(r *http.Request) (string, error) {
+  header := r.Header.Get("Content-Type")
+  if len(header) == 0 {
+    return CONTENT_TYPE_JSON, nil
+  }
+  mediaType, _, err := mime.ParseMediaType(header)
+  if err != nil || (mediaType != CONTENT_TYPE_JSON && mediaType != CONTENT_TYPE_FORM) {
+    return "", fmt.Errorf("%w, got %q", ErrUnsupportedMediaType, header)
+  }
+  return mediaType, nil
+}
+
+// Returns the status and error code to respond with for an error parsing a
+// request body.
+func statusForBodyError(err error) (int, string) {
+  switch {
+  case errors.Is(err, ErrUnsupportedMediaType):
+    return http.StatusUnsupportedMediaType, ERROR_CODE_UNSUPPORTED_MEDIA_TYPE
+  case errors.Is(err, ErrBodyTooLarge):
+    return http.StatusRequestEntityTooLarge, ERROR_CODE_BODY_TOO_LARGE
+  default:
+    return http.StatusBadRequest, ERROR_CODE_BAD_REQUEST
+  }
+}
+
+// Returns an ErrBodyTooLarge error if reading the body failed because it was
+// over the limit, otherwise the given error.
+func bodyReadError(err error, otherwise error) error {
+  var tooLarge *http.MaxBytesError
+  if errors.As(err, &tooLarge) {
+    return fmt.Errorf("%w, the limit is %d bytes", ErrBodyTooLarge, tooLarge.Limit)
+  }
+  return otherwise
+}
+
+// Reads a form body into a sendMessageStruct. Recipients are given by
+// repeating the recipients key, and metadata by its own keys, e.g. width.
+// Metadata is left nil if none of its keys are given.
+func parseSendMessageForm(r *http.Request) (*sendMessageStruct, error) {
+  if err := r.ParseForm(); err != nil {
+    return nil, bodyReadError(err, errors.New("couldn't decode form"))
+  }
+  form := r.PostForm
+  body := &sendMessageStruct{
+    Sender: form.Get("sender"),
+    Recipient: form.Get("recipient"),
+    Recipients: form["recipients"],
+    MessageType: form.Get("messageType"),
+    Content: form.Get("content"),
+  }
+  var err error
+  if body.RoomId, err = formInt(form, "roomId"); err != nil {
+    return nil, err
+  }
+  if body.ReplyTo, err = formInt(form, "replyTo"); err != nil {
+    return nil, err
+  }
+  for _, key := range []string{"width", "height", "length", "source", "filename", "sizeBytes"} {
+    if _, ok := form[key]; ok {
+      body.Metadata = &MessageMetadata{}
+      break
+    }
+  }
+  if body.Metadata == nil {
+    return body, nil
+  }
+  body.Metadata.Source = form.Get("source")
+  body.Metadata.Filename = form.Get("filename")
+  if body.Metadata.SizeBytes, err = formInt(form, "sizeBytes"); err != nil {
+    return nil, err
+  }
+  for _, field := range []struct{key string; value *int}{
+    {"width", &body.Metadata.Width},
+    {"height", &body.Metadata.Height},
+    {"length", &body.Metadata.Length},
+  } {
+    number, err := formInt(form, field.key)
+    if err != nil {
+      return nil, err
+    }
+    *field.value = int(number)
+  }
+  return body, nil
+}
+
+// Parses an integer form value, 0 if the key is missing or empty.
+func formInt(form url.Values, key string) (int64, error) {
+  value := form.Get(key)
+  if len(value) == 0 {
+    return 0, nil
+  }
+  number, err := strconv.ParseInt(value, 10, 64)
+  if err != nil {
+    return 0, errors.New(fmt.Sprintf("%s should be an integer", key))
+  }
+  return number, nil
+}
@@ -0,0 +1,126 @@
+package chatserver
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+)
+
+// Posts the body to target in the given content type and returns the
+// response.
+func doBodyRequest(handler http.Handler, target string, contentType string, body string) *httptest.ResponseRecorder {
+  return doRequestWithHeader(handler, http.MethodPost, target, body, http.Header{"Content-Type": {contentType}})
+}
+
+func TestCreateUserContentTypes(t *testing.T) {
+  tests := []struct {
+    name string
+    contentType string
+    body string
+  }{
+    {"json", CONTENT_TYPE_JSON, `{"username":"user1", "password":"` + TEST_PASSWORD + `"}`},
+    {"json with charset", CONTENT_TYPE_JSON + "; charset=utf-8", `{"username":"user1", "password":"` + TEST_PASSWORD + `"}`},
+    {"form", CONTENT_TYPE_FORM, url.Values{"username": {"user1"}, "password": {TEST_PASSWORD}}.Encode()},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      server, _ := newTestServer(t)
+      decodeResponse(t, doBodyRequest(server, "/users", test.contentType, test.body), http.StatusOK, nil)
+      // The password made it through intact.
+      decodeResponse(t, loginTestUser(server, TEST_PASSWORD), http.StatusOK, nil)
+    })
+  }
+}
+
+func TestSendMessageContentTypes(t *testing.T) {
+  tests := []struct {
+    name string
+    contentType string
+    body string
+  }{
+    {"json", CONTENT_TYPE_JSON, `{"sender":"user1", "recipient":"user2", "messageType":"plaintext", "content":"Hi & bye"}`},
+    {"form", CONTENT_TYPE_FORM, url.Values{
+      "sender": {"user1"}, "recipient": {"user2"}, "messageType": {"plaintext"}, "content": {"Hi & bye"},
+    }.Encode()},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      server, _ := newTestServer(t)
+      createTestUsers(t, server)
+      var message Message
+      decodeResponse(t, doBodyRequest(server, "/messages", test.contentType, test.body), http.StatusOK, &message)
+      if message.Sender != "user1" || message.Recipient != "user2" || message.Content != "Hi & bye" {
+        t.Errorf("got %+v, want user1's message to user2", message)
+      }
+    })
+  }
+}
+
+func TestSendImageForm(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  body := url.Values{
+    "sender": {"user1"}, "recipient": {"user2"}, "messageType": {MESSAGE_TYPE_IMAGE_LINK},
+    "content": {"https://example.com/cat.png"}, "width": {"640"}, "height": {"480"},
+  }.Encode()
+  var message Message
+  decodeResponse(t, doBodyRequest(server, "/messages", CONTENT_TYPE_FORM, body), http.StatusOK, &message)
+  if message.Metadata == nil || message.Metadata.Width != 640 || message.Metadata.Height != 480 {
+    t.Errorf("got metadata %+v, want 640x480", message.Metadata)
+  }
+  w := doBodyRequest(server, "/messages", CONTENT_TYPE_FORM, body + "&replyTo=first")
+  expectError(t, w, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+}
+
+func TestUnsupportedContentTypes(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  for _, contentType := range []string{"text/plain", "multipart/form-data; boundary=x", "application/xml", "not a type"} {
+    for _, target := range []string{"/users", "/messages"} {
+      w := doBodyRequest(server, target, contentType, "username=user3")
+      if w.Code != http.StatusUnsupportedMediaType {
+        t.Errorf("%s %s: got status %d, want %d", target, contentType, w.Code, http.StatusUnsupportedMediaType)
+        continue
+      }
+      expectError(t, w, http.StatusUnsupportedMediaType, ERROR_CODE_UNSUPPORTED_MEDIA_TYPE)
+    }
+  }
+  if testUserExists(t, server, "user3") {
+    t.Errorf("user was created from an unsupported body")
+  }
+}
+
+func TestOversizedBodies(t *testing.T) {
+  config := DefaultConfig()
+  config.MaxBodyBytes = 1024
+  server, _ := newTestServerWithConfig(t, config)
+  createTestUsers(t, server)
+  content := strings.Repeat("a", 2048)
+  tests := []struct {
+    name string
+    target string
+    contentType string
+    body string
+  }{
+    {"user json", "/users", CONTENT_TYPE_JSON, `{"username":"user3", "password":"` + content + `"}`},
+    {"user form", "/users", CONTENT_TYPE_FORM, url.Values{"username": {"user3"}, "password": {content}}.Encode()},
+    {"message json", "/messages", CONTENT_TYPE_JSON,
+     `{"sender":"user1", "recipient":"user2", "messageType":"plaintext", "content":"` + content + `"}`},
+    {"message form", "/messages", CONTENT_TYPE_FORM, url.Values{
+      "sender": {"user1"}, "recipient": {"user2"}, "messageType": {"plaintext"}, "content": {content},
+    }.Encode()},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      w := doBodyRequest(server, test.target, test.contentType, test.body)
+      expectError(t, w, http.StatusRequestEntityTooLarge, ERROR_CODE_BODY_TOO_LARGE)
+    })
+  }
+  if messages := fetchTestMessages(t, server, "user1", "user2"); len(messages) != 0 {
+    t.Errorf("got %d messages, want the oversized ones dropped", len(messages))
+  }
+  // Bodies under the limit still go through.
+  sendTestMessage(t, server, "user1", "user2", strings.Repeat("a", 512))
+}
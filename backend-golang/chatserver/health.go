@@ -0,0 +1,48 @@
+package chatserver
+
+import (
+  "context"
+  "encoding/json"
+  "net/http"
+  "time"
+)
+
+// How long the health check waits for the db to respond.
+const HEALTH_CHECK_TIMEOUT = 2 * time.Second
+
+// Request handler for /health.
+func (server *ChatServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodGet:
+    server.checkHealth(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at /health, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only GET requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Reports whether the server can reach the db, for liveness probes.
+// Responds with 200 {"status":"ok"}, or 503 {"status":"unavailable"} if the
+// db doesn't respond in time.
+//
+// Sample curl request:
+// curl "localhost:18000/health"
+func (server *ChatServer) checkHealth(w http.ResponseWriter, r *http.Request) {
+  ctx, cancel := context.WithTimeout(r.Context(), HEALTH_CHECK_TIMEOUT)
+  defer cancel()
+  status := "ok"
+  statusCode := http.StatusOK
+  if err := server.db.Ping(ctx); err != nil {
+    server.logger.Errorf("Health check failed, couldn't reach db: %s", err.Error())
+    status = "unavailable"
+    statusCode = http.StatusServiceUnavailable
+  }
+  w.WriteHeader(statusCode)
+  if err := json.NewEncoder(w).Encode(map[string]string{
+    "status": status,
+  }); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+  }
+}
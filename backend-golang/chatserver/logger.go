@@ -0,0 +1,94 @@
+package chatserver
+
+import (
+  "errors"
+  "fmt"
+  "log"
+  "os"
+  "strings"
+)
+
+// Log levels, from most to least verbose. A logger drops messages below its
+// level.
+type LogLevel int
+
+const (
+  LOG_LEVEL_DEBUG LogLevel = iota
+  LOG_LEVEL_INFO
+  LOG_LEVEL_WARN
+  LOG_LEVEL_ERROR
+)
+
+// Per-request details, e.g. pagination offsets, are logged at debug level,
+// so they're left out by default.
+const DEFAULT_LOG_LEVEL = LOG_LEVEL_INFO
+
+// Names of the levels, as used in log lines and ENV_LOG_LEVEL.
+var logLevelNames = map[LogLevel]string{
+  LOG_LEVEL_DEBUG: "debug",
+  LOG_LEVEL_INFO: "info",
+  LOG_LEVEL_WARN: "warn",
+  LOG_LEVEL_ERROR: "error",
+}
+
+// Logger is the leveled logging API the server and SQL client use.
+// Arguments are handled as in fmt.Printf.
+type Logger interface {
+  Debugf(format string, args ...interface{})
+  Infof(format string, args ...interface{})
+  Warnf(format string, args ...interface{})
+  Errorf(format string, args ...interface{})
+}
+
+// A Logger that writes to stderr with the standard log package, prefixing
+// each line with its level.
+type stdLogger struct {
+  level LogLevel
+  logger *log.Logger
+}
+
+// Factory for the default Logger, which drops messages below level.
+func NewLogger(level LogLevel) Logger {
+  return &stdLogger{
+    level: level,
+    logger: log.New(os.Stderr, "", log.LstdFlags),
+  }
+}
+
+func (logger *stdLogger) Debugf(format string, args ...interface{}) {
+  logger.logf(LOG_LEVEL_DEBUG, format, args...)
+}
+
+func (logger *stdLogger) Infof(format string, args ...interface{}) {
+  logger.logf(LOG_LEVEL_INFO, format, args...)
+}
+
+func (logger *stdLogger) Warnf(format string, args ...interface{}) {
+  logger.logf(LOG_LEVEL_WARN, format, args...)
+}
+
+func (logger *stdLogger) Errorf(format string, args ...interface{}) {
+  logger.logf(LOG_LEVEL_ERROR, format, args...)
+}
+
+// Writes the message if its level is at least the logger's.
+func (logger *stdLogger) logf(level LogLevel, format string, args ...interface{}) {
+  if level < logger.level {
+    return
+  }
+  logger.logger.Print(strings.ToUpper(logLevelNames[level]), " ", fmt.Sprintf(format, args...))
+}
+
+// Parses a level name such as "debug", case-insensitively.
+func ParseLogLevel(name string) (LogLevel, error) {
+  for level, levelName := range logLevelNames {
+    if strings.EqualFold(name, levelName) {
+      return level, nil
+    }
+  }
+  return DEFAULT_LOG_LEVEL, errors.New(fmt.Sprintf("unknown log level %q, expected debug, info, warn or error", name))
+}
+
+func (level LogLevel) String() string {
+  return logLevelNames[level]
+}
@@ -0,0 +1,102 @@
+package chatserver
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+
+  auth "app/chatauth"
+)
+
+// Struct for decoding JSON body for POST requests at /login.
+type loginStruct struct {
+  Username string
+  Password string
+}
+
+// Request handler for /login.
+func (server *ChatServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodPost:
+    server.login(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at /login, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only POST requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Logs a user in and returns a session token.
+// Expects a POST with the following parameters in the body:
+// - username
+// - password
+//
+// Unknown usernames and wrong passwords get the same 401, after about the
+// same amount of time. Attempts are rate limited per client IP.
+//
+// Note on salts: bcrypt generates a random salt when hashing and stores it
+// as part of the hash itself, so the hash returned by GetUserCredentials is
+// all Authenticate needs. There is no separate salt to look up.
+//
+// Sample curl request:
+// curl -d '{"username":"user1", "password":"super-secret"}' -H "Content-Type: application/json" -X POST localhost:18000/login
+func (server *ChatServer) login(w http.ResponseWriter, r *http.Request) {
+  username, password, err := server.parseLogin(r)
+  if err != nil {
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf("Error: %s", err.Error()), code)
+    return
+  }
+  server.logger.Debugf("Received POST at /login for user %s", username)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  hash, err := server.db.GetUserCredentials(ctx, username)
+  if errors.Is(err, ErrUserNotFound) {
+    server.logger.Warnf("Failed login for unknown user %s", username)
+    // Take as long as checking a wrong password would, so the response
+    // doesn't reveal whether the username exists.
+    auth.AuthenticateDummy(password, server.hashCost)
+    errorResponse(w, http.StatusUnauthorized, "invalid username or password", ERROR_CODE_INVALID_CREDENTIALS)
+    return
+  }
+  if err != nil {
+    // Anything else is the db failing, not bad credentials.
+    server.logger.Errorf("Error getting credentials for user %s, %s", username, err.Error())
+    errorResponse(w, statusForError(err), "couldn't check credentials, database error", codeForError(err))
+    return
+  }
+  token, err := auth.Authenticate(password, hash)
+  if err != nil {
+    server.logger.Warnf("Failed login for user %s", username)
+    errorResponse(w, http.StatusUnauthorized, "invalid username or password", ERROR_CODE_INVALID_CREDENTIALS)
+    return
+  }
+  // Success.
+  server.logger.Infof("User %s logged in successfully", username)
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(map[string]string{
+    "token": base64.URLEncoding.EncodeToString(token),
+  }); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Parse POST request for /login.
+// Returns parsed values or error.
+func (server *ChatServer) parseLogin(r *http.Request) (username string, password string, err error) {
+  var body loginStruct
+  decoder := json.NewDecoder(r.Body)
+  if err = decoder.Decode(&body); err != nil {
+    err = bodyReadError(err, errors.New("bad POST request, could not parse"))
+    return
+  }
+  if len(body.Username) < 1 || len(body.Password) < 1 {
+    err = errors.New("username and password are required")
+    return
+  }
+  return body.Username, body.Password, nil
+}
@@ -0,0 +1,904 @@
+package chatserver
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// MemoryChatStore is a ChatStore that keeps everything in memory.
+// It behaves like ChatSQLClient (same errors, same pagination) but needs no
+// database, which makes it handy for tests and local development.
+// Nothing is persisted across restarts. Operations never block on I/O, so
+// contexts are accepted but ignored.
+// Unlike MySQL, usernames are matched case-sensitively, except by
+// SearchUsers, so "Alice" and "alice" are two different users here.
+type MemoryChatStore struct {
+  mutex sync.Mutex
+  users map[string]*memoryUser
+  messages []*Message
+  // Users who reacted to each message, by message id and then emoji.
+  reactions map[int64]map[string]map[string]bool
+  rooms map[int64]*memoryRoom
+  // Users each user has blocked, by blocker.
+  blocks map[string]map[string]bool
+  nextUserId int64
+  nextMessageId int64
+  nextRoomId int64
+}
+
+// A user as stored by MemoryChatStore.
+type memoryUser struct {
+  id int64
+  hash []byte
+  createdAt time.Time
+}
+
+// A room as stored by MemoryChatStore.
+type memoryRoom struct {
+  name string
+  members map[string]bool
+  createdAt time.Time
+}
+
+// Factory for creating a new, empty in-memory store.
+func NewMemoryChatStore() *MemoryChatStore {
+  return &MemoryChatStore{
+    users: make(map[string]*memoryUser),
+    reactions: make(map[int64]map[string]map[string]bool),
+    rooms: make(map[int64]*memoryRoom),
+    blocks: make(map[string]map[string]bool),
+    nextUserId: 1,
+    nextMessageId: 1,
+    nextRoomId: 1,
+  }
+}
+
+// Creates a new user. Returns the id of the newly created user, or an error
+// if the username is taken.
+func (store *MemoryChatStore) CreateUser(ctx context.Context, username string, hash []byte) (id int64, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[username]; ok {
+    return -1, userExists(username)
+  }
+  id = store.nextUserId
+  store.nextUserId++
+  store.users[username] = &memoryUser{
+    id: id,
+    hash: hash,
+    createdAt: time.Now().UTC().Truncate(time.Second),
+  }
+  return id, nil
+}
+
+// Returns the user's id and when they signed up.
+func (store *MemoryChatStore) GetUserProfile(ctx context.Context, username string) (*UserProfile, error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  user, ok := store.users[username]
+  if !ok {
+    return nil, userNotFound(username)
+  }
+  return &UserProfile{ID: user.id, Username: username, CreatedAt: user.createdAt}, nil
+}
+
+// Returns whether a user with the given username exists.
+func (store *MemoryChatStore) CheckUserExists(ctx context.Context, username string) (bool, error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  _, ok := store.users[username]
+  return ok, nil
+}
+
+// Retrieves the password hash for the given username.
+func (store *MemoryChatStore) GetUserCredentials(ctx context.Context, username string) (hash []byte, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  user, ok := store.users[username]
+  if !ok {
+    return nil, userNotFound(username)
+  }
+  return user.hash, nil
+}
+
+// Replaces the password hash stored for the given user.
+func (store *MemoryChatStore) UpdateUserCredentials(ctx context.Context, username string, hash []byte) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  user, ok := store.users[username]
+  if !ok {
+    return userNotFound(username)
+  }
+  user.hash = hash
+  return nil
+}
+
+// Deletes the user with their direct messages, the room messages they sent,
+// their reactions, room memberships and blocks.
+func (store *MemoryChatStore) DeleteUser(ctx context.Context, username string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[username]; !ok {
+    return userNotFound(username)
+  }
+  // Same as ChatSQLClient, drop direct messages in both directions but only
+  // the room messages the user sent.
+  kept := store.messages[:0]
+  deletedIds := make(map[int64]bool)
+  for _, message := range store.messages {
+    if message.Sender == username || (message.RoomID == nil && message.Recipient == username) {
+      delete(store.reactions, message.ID)
+      deletedIds[message.ID] = true
+      continue
+    }
+    kept = append(kept, message)
+  }
+  store.messages = kept
+  store.orphanReplies(deletedIds)
+  for messageId, byEmoji := range store.reactions {
+    for emoji, users := range byEmoji {
+      delete(users, username)
+      if len(users) == 0 {
+        delete(byEmoji, emoji)
+      }
+    }
+    if len(byEmoji) == 0 {
+      delete(store.reactions, messageId)
+    }
+  }
+  for _, room := range store.rooms {
+    delete(room.members, username)
+  }
+  delete(store.blocks, username)
+  for _, blocked := range store.blocks {
+    delete(blocked, username)
+  }
+  delete(store.users, username)
+  return nil
+}
+
+// Returns up to limit usernames starting with prefix, case-insensitively,
+// in alphabetical order.
+func (store *MemoryChatStore) SearchUsers(ctx context.Context, prefix string, limit int) (usernames []string, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  prefix = strings.ToLower(prefix)
+  for username := range store.users {
+    if strings.HasPrefix(strings.ToLower(username), prefix) {
+      usernames = append(usernames, username)
+    }
+  }
+  sort.Strings(usernames)
+  if len(usernames) > limit {
+    usernames = usernames[:limit]
+  }
+  return usernames, nil
+}
+
+// Blocks blocked from sending direct messages to blocker.
+func (store *MemoryChatStore) BlockUser(ctx context.Context, blockerName string, blockedName string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if err := store.checkUsersExist(blockerName, blockedName); err != nil {
+    return err
+  }
+  if store.blocks[blockerName] == nil {
+    store.blocks[blockerName] = make(map[string]bool)
+  }
+  store.blocks[blockerName][blockedName] = true
+  return nil
+}
+
+// Removes the block, if there is one.
+func (store *MemoryChatStore) UnblockUser(ctx context.Context, blockerName string, blockedName string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if err := store.checkUsersExist(blockerName, blockedName); err != nil {
+    return err
+  }
+  delete(store.blocks[blockerName], blockedName)
+  return nil
+}
+
+// Returns the usernames the user has blocked, sorted.
+func (store *MemoryChatStore) FetchBlockedUsers(ctx context.Context, username string) (usernames []string, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[username]; !ok {
+    return nil, userNotFound(username)
+  }
+  for blocked := range store.blocks[username] {
+    usernames = append(usernames, blocked)
+  }
+  sort.Strings(usernames)
+  return usernames, nil
+}
+
+// Returns whether blocker has blocked blocked.
+func (store *MemoryChatStore) IsBlocked(ctx context.Context, blockerName string, blockedName string) (bool, error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if err := store.checkUsersExist(blockerName, blockedName); err != nil {
+    return false, err
+  }
+  return store.blocks[blockerName][blockedName], nil
+}
+
+// Returns an ErrUserNotFound error for the first of the users that doesn't
+// exist. Must be called with the mutex held.
+func (store *MemoryChatStore) checkUsersExist(usernames ...string) error {
+  for _, username := range usernames {
+    if _, ok := store.users[username]; !ok {
+      return userNotFound(username)
+    }
+  }
+  return nil
+}
+
+// Returns an ErrBlocked error naming the recipient if they've blocked the
+// sender. Must be called with the mutex held.
+func (store *MemoryChatStore) checkNotBlocked(senderName string, recipientName string) error {
+  if store.blocks[recipientName][senderName] {
+    return fmt.Errorf("%w: %s", ErrBlocked, recipientName)
+  }
+  return nil
+}
+
+// Adds a new message. Returns the stored message, or an error.
+// Image, video and file messages must come with metadata.
+func (store *MemoryChatStore) AddMessage(ctx context.Context, senderName string, recipientName string, messageType string, content string, metadata *MessageMetadata, replyTo int64) (*Message, error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[senderName]; !ok {
+    return nil, userNotFound(senderName)
+  }
+  if _, ok := store.users[recipientName]; !ok {
+    return nil, userNotFound(recipientName)
+  }
+  if err := store.checkNotBlocked(senderName, recipientName); err != nil {
+    return nil, err
+  }
+  parentId, err := store.checkReplyTo(replyTo, func(parent *Message) bool {
+    return parent.RoomID == nil && isBetween(parent, senderName, recipientName)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return store.storeMessage(senderName, recipientName, nil, parentId, messageType, content, metadata)
+}
+
+// Adds a copy of the message for each recipient. Nothing is stored if any
+// user is missing or any recipient has blocked the sender.
+func (store *MemoryChatStore) AddMessages(ctx context.Context, senderName string, recipientNames []string, messageType string, content string, metadata *MessageMetadata) ([]*Message, error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  // Check everything up front, so that nothing is stored if anything is
+  // wrong.
+  if _, ok := store.users[senderName]; !ok {
+    return nil, userNotFound(senderName)
+  }
+  for _, recipientName := range recipientNames {
+    if _, ok := store.users[recipientName]; !ok {
+      return nil, userNotFound(recipientName)
+    }
+    if err := store.checkNotBlocked(senderName, recipientName); err != nil {
+      return nil, err
+    }
+  }
+  if err := checkMessageType(messageType, metadata); err != nil {
+    return nil, err
+  }
+  messages := make([]*Message, len(recipientNames))
+  for i, recipientName := range recipientNames {
+    message, err := store.storeMessage(senderName, recipientName, nil, nil, messageType, content, metadata)
+    if err != nil {
+      return nil, err
+    }
+    messages[i] = message
+  }
+  return messages, nil
+}
+
+// Adds a new message to a room. The sender must be a member of the room.
+// Returns the stored message, or ErrRoomNotFound or ErrNotRoomMember.
+func (store *MemoryChatStore) AddRoomMessage(ctx context.Context, senderName string, roomId int64, messageType string, content string, metadata *MessageMetadata, replyTo int64) (*Message, error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[senderName]; !ok {
+    return nil, userNotFound(senderName)
+  }
+  if err := store.checkRoomMember(roomId, senderName); err != nil {
+    return nil, err
+  }
+  parentId, err := store.checkReplyTo(replyTo, func(parent *Message) bool {
+    return parent.RoomID != nil && *parent.RoomID == roomId
+  })
+  if err != nil {
+    return nil, err
+  }
+  return store.storeMessage(senderName, "", &roomId, parentId, messageType, content, metadata)
+}
+
+// Checks that the message replyTo exists and is in the same conversation,
+// according to sameConversation. Returns the parent id to store, nil if
+// replyTo is 0, or an ErrInvalidReply error.
+// Must be called with the mutex held.
+func (store *MemoryChatStore) checkReplyTo(replyTo int64, sameConversation func(parent *Message) bool) (*int64, error) {
+  if replyTo == 0 {
+    return nil, nil
+  }
+  for _, message := range store.messages {
+    if message.ID != replyTo {
+      continue
+    }
+    if !sameConversation(message) {
+      return nil, ErrInvalidReply
+    }
+    return &replyTo, nil
+  }
+  return nil, fmt.Errorf("%w, message %d not found", ErrInvalidReply, replyTo)
+}
+
+// Clears the parent of any replies to the given messages, like the
+// ON DELETE SET NULL on messages.parent_message_id.
+// Must be called with the mutex held.
+func (store *MemoryChatStore) orphanReplies(deletedIds map[int64]bool) {
+  for _, message := range store.messages {
+    if message.ReplyTo != nil && deletedIds[*message.ReplyTo] {
+      message.ReplyTo = nil
+    }
+  }
+}
+
+// Stores a message to either a recipient or a room, for AddMessage and
+// AddRoomMessage. Must be called with the mutex held.
+func (store *MemoryChatStore) storeMessage(senderName string, recipientName string, roomId *int64, parentId *int64, messageType string, content string, metadata *MessageMetadata) (*Message, error) {
+  if err := checkMessageType(messageType, metadata); err != nil {
+    return nil, err
+  }
+  if messageType == MESSAGE_TYPE_PLAINTEXT {
+    metadata = nil
+  } else {
+    // Copy so the caller can't modify the stored metadata.
+    copied := *metadata
+    metadata = &copied
+  }
+  id := store.nextMessageId
+  store.nextMessageId++
+  message := &Message {
+    ID: id,
+    Sender: senderName,
+    Recipient: recipientName,
+    RoomID: roomId,
+    MessageType: messageType,
+    Content: content,
+    CreatedAt: time.Now().UTC().Truncate(time.Second),
+    ReplyTo: parentId,
+    Status: MESSAGE_STATUS_SENT,
+    Metadata: metadata,
+  }
+  store.messages = append(store.messages, message)
+  return store.copyMessage(message), nil
+}
+
+// Returns an error if the message type is unknown, or is missing the
+// metadata it needs.
+func checkMessageType(messageType string, metadata *MessageMetadata) error {
+  switch messageType {
+  case MESSAGE_TYPE_PLAINTEXT:
+    return nil
+  case MESSAGE_TYPE_IMAGE_LINK, MESSAGE_TYPE_VIDEO_LINK, MESSAGE_TYPE_FILE:
+    if metadata == nil {
+      return errors.New(fmt.Sprintf("missing metadata for %s message", messageType))
+    }
+    return nil
+  default:
+    return errors.New(fmt.Sprintf("Unknown message type %s", messageType))
+  }
+}
+
+// Gets messages between two users, oldest first.
+func (store *MemoryChatStore) FetchMessages(ctx context.Context, params *FetchMessagesParams) (messages []*Message, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[params.senderName]; !ok {
+    return nil, userNotFound(params.senderName)
+  }
+  // Room messages are only visible to members.
+  inConversation := func(message *Message) bool {
+    return message.RoomID != nil && *message.RoomID == params.roomId
+  }
+  if params.roomId != 0 {
+    if err := store.checkRoomMember(params.roomId, params.senderName); err != nil {
+      return nil, err
+    }
+  } else {
+    if _, ok := store.users[params.recipientName]; !ok {
+      return nil, userNotFound(params.recipientName)
+    }
+    inConversation = func(message *Message) bool {
+      return isBetween(message, params.senderName, params.recipientName)
+    }
+  }
+  for _, message := range store.messages {
+    if inConversation(message) && (params.beforeId == 0 || message.ID < params.beforeId) &&
+       message.ID > params.afterId &&
+       (params.since.IsZero() || !message.CreatedAt.Before(params.since)) &&
+       (params.until.IsZero() || !message.CreatedAt.After(params.until)) {
+      messages = append(messages, store.copyMessage(message))
+    }
+  }
+  if params.beforeId != 0 {
+    if len(messages) > params.limit {
+      messages = messages[len(messages) - params.limit:]
+    }
+    return messages, nil
+  }
+  if params.afterId != 0 {
+    if len(messages) > params.limit {
+      messages = messages[:params.limit]
+    }
+    return messages, nil
+  }
+  if params.usePagination {
+    start := params.pageToLoad * params.messagesPerPage
+    end := start + params.messagesPerPage
+    if start >= len(messages) {
+      return nil, nil
+    }
+    if end > len(messages) {
+      end = len(messages)
+    }
+    messages = messages[start:end]
+  }
+  return messages, nil
+}
+
+// Returns up to limit messages sent or received by the user whose content
+// contains query, case-insensitively, newest first. Room messages aren't
+// searched.
+func (store *MemoryChatStore) SearchMessages(ctx context.Context, username string, query string, limit int) (messages []*Message, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[username]; !ok {
+    return nil, userNotFound(username)
+  }
+  query = strings.ToLower(query)
+  for i := len(store.messages) - 1; i >= 0 && len(messages) < limit; i-- {
+    message := store.messages[i]
+    if message.RoomID != nil || (message.Sender != username && message.Recipient != username) {
+      continue
+    }
+    if strings.Contains(strings.ToLower(message.Content), query) {
+      messages = append(messages, store.copyMessage(message))
+    }
+  }
+  return messages, nil
+}
+
+// Creates a room with the given members. Returns the new room, or an
+// ErrUserNotFound error if a member doesn't exist.
+func (store *MemoryChatStore) CreateRoom(ctx context.Context, name string, memberNames []string) (*Room, error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  members := make(map[string]bool)
+  for _, memberName := range memberNames {
+    if _, ok := store.users[memberName]; !ok {
+      return nil, userNotFound(memberName)
+    }
+    members[memberName] = true
+  }
+  roomId := store.nextRoomId
+  store.nextRoomId++
+  store.rooms[roomId] = &memoryRoom{
+    name: name,
+    members: members,
+    createdAt: time.Now().UTC().Truncate(time.Second),
+  }
+  return store.copyRoom(roomId), nil
+}
+
+// Returns a room and its members, sorted. Returns ErrRoomNotFound if there is
+// no such room.
+func (store *MemoryChatStore) GetRoom(ctx context.Context, roomId int64) (*Room, error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.rooms[roomId]; !ok {
+    return nil, ErrRoomNotFound
+  }
+  return store.copyRoom(roomId), nil
+}
+
+// Returns the rooms a user is a member of, oldest first.
+func (store *MemoryChatStore) FetchRooms(ctx context.Context, username string) (rooms []*Room, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[username]; !ok {
+    return nil, userNotFound(username)
+  }
+  for roomId := int64(1); roomId < store.nextRoomId; roomId++ {
+    if room, ok := store.rooms[roomId]; ok && room.members[username] {
+      rooms = append(rooms, store.copyRoom(roomId))
+    }
+  }
+  return rooms, nil
+}
+
+// Counts the messages in a room.
+func (store *MemoryChatStore) GetRoomMessageCount(ctx context.Context, roomId int64) (count int64, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  for _, message := range store.messages {
+    if message.RoomID != nil && *message.RoomID == roomId {
+      count++
+    }
+  }
+  return count, nil
+}
+
+// Returns ErrRoomNotFound if the room doesn't exist, or ErrNotRoomMember if
+// the user isn't a member of it. Must be called with the mutex held.
+func (store *MemoryChatStore) checkRoomMember(roomId int64, username string) error {
+  room, ok := store.rooms[roomId]
+  if !ok {
+    return ErrRoomNotFound
+  }
+  if !room.members[username] {
+    return ErrNotRoomMember
+  }
+  return nil
+}
+
+// Returns the room with the given id as a Room, with sorted members.
+// Must be called with the mutex held.
+func (store *MemoryChatStore) copyRoom(roomId int64) *Room {
+  room := store.rooms[roomId]
+  copied := &Room{
+    ID: roomId,
+    Name: room.name,
+    CreatedAt: room.createdAt,
+  }
+  for memberName := range room.members {
+    copied.Members = append(copied.Members, memberName)
+  }
+  sort.Strings(copied.Members)
+  return copied
+}
+
+// Counts the messages between two users, in either direction.
+func (store *MemoryChatStore) GetMessageCount(ctx context.Context, senderName string, recipientName string) (count int64, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[senderName]; !ok {
+    return 0, userNotFound(senderName)
+  }
+  if _, ok := store.users[recipientName]; !ok {
+    return 0, userNotFound(recipientName)
+  }
+  for _, message := range store.messages {
+    if isBetween(message, senderName, recipientName) {
+      count++
+    }
+  }
+  return count, nil
+}
+
+// Gets the conversations a user is part of, with the latest message of each.
+func (store *MemoryChatStore) FetchConversations(ctx context.Context, username string) (conversations []*Conversation, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[username]; !ok {
+    return nil, userNotFound(username)
+  }
+  // Walk backwards so the first message seen for a counterpart is the latest.
+  seen := make(map[string]bool)
+  for i := len(store.messages) - 1; i >= 0; i-- {
+    message := store.messages[i]
+    if message.RoomID != nil {
+      continue
+    }
+    var counterpart string
+    if message.Sender == username {
+      counterpart = message.Recipient
+    } else if message.Recipient == username {
+      counterpart = message.Sender
+    } else {
+      continue
+    }
+    if seen[counterpart] {
+      continue
+    }
+    seen[counterpart] = true
+    conversations = append(conversations, &Conversation{
+      Counterpart: counterpart,
+      LastMessage: message.Content,
+      LastMessageType: message.MessageType,
+      LastMessageAt: message.CreatedAt,
+    })
+  }
+  return conversations, nil
+}
+
+// Marks every unread message from sender to recipient as read now.
+func (store *MemoryChatStore) MarkMessagesRead(ctx context.Context, recipientName string, senderName string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[recipientName]; !ok {
+    return userNotFound(recipientName)
+  }
+  if _, ok := store.users[senderName]; !ok {
+    return userNotFound(senderName)
+  }
+  now := time.Now().UTC().Truncate(time.Second)
+  for _, message := range store.messages {
+    if message.Recipient == recipientName && message.Sender == senderName && message.ReadAt == nil {
+      readAt := now
+      message.ReadAt = &readAt
+      message.Status = MESSAGE_STATUS_READ
+    }
+  }
+  return nil
+}
+
+// Marks a direct message read by its recipient, keeping the original time
+// if it was already read.
+func (store *MemoryChatStore) MarkMessageRead(ctx context.Context, messageId int64, readerName string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  for _, message := range store.messages {
+    if message.ID != messageId {
+      continue
+    }
+    if message.RoomID != nil || message.Recipient != readerName {
+      return ErrNotMessageRecipient
+    }
+    if message.ReadAt == nil {
+      readAt := time.Now().UTC().Truncate(time.Second)
+      message.ReadAt = &readAt
+      message.Status = MESSAGE_STATUS_READ
+    }
+    return nil
+  }
+  return ErrMessageNotFound
+}
+
+// Marks every sent, but not yet delivered, message from sender to recipient
+// as delivered.
+func (store *MemoryChatStore) MarkMessagesDelivered(ctx context.Context, recipientName string, senderName string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[recipientName]; !ok {
+    return userNotFound(recipientName)
+  }
+  if _, ok := store.users[senderName]; !ok {
+    return userNotFound(senderName)
+  }
+  for _, message := range store.messages {
+    if message.RoomID == nil && message.Recipient == recipientName && message.Sender == senderName &&
+       message.Status == MESSAGE_STATUS_SENT {
+      message.Status = MESSAGE_STATUS_DELIVERED
+    }
+  }
+  return nil
+}
+
+// Moves a direct message forward to the given status. Returns an
+// ErrMessageStatusRegression error if it's already further along.
+func (store *MemoryChatStore) UpdateMessageStatus(ctx context.Context, messageId int64, status string) error {
+  rank, ok := MESSAGE_STATUS_RANKS[status]
+  if !ok {
+    return fmt.Errorf("%w, got %q", ErrInvalidMessageStatus, status)
+  }
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  for _, message := range store.messages {
+    if message.ID != messageId {
+      continue
+    }
+    if message.RoomID != nil {
+      return ErrNotMessageRecipient
+    }
+    if rank < MESSAGE_STATUS_RANKS[message.Status] {
+      return fmt.Errorf("%w, message %d is already %s", ErrMessageStatusRegression, messageId, message.Status)
+    }
+    message.Status = status
+    if status == MESSAGE_STATUS_READ && message.ReadAt == nil {
+      readAt := time.Now().UTC().Truncate(time.Second)
+      message.ReadAt = &readAt
+    }
+    return nil
+  }
+  return ErrMessageNotFound
+}
+
+// Counts the unread messages sent to a user. If senderName isn't empty,
+// only messages from that sender are counted.
+func (store *MemoryChatStore) CountUnread(ctx context.Context, recipientName string, senderName string) (count int, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[recipientName]; !ok {
+    return 0, userNotFound(recipientName)
+  }
+  if _, ok := store.users[senderName]; !ok && len(senderName) > 0 {
+    return 0, userNotFound(senderName)
+  }
+  for _, message := range store.messages {
+    if message.Recipient == recipientName && message.ReadAt == nil &&
+       (len(senderName) == 0 || message.Sender == senderName) {
+      count++
+    }
+  }
+  return count, nil
+}
+
+// Counts the unread messages sent to a user, by sender.
+func (store *MemoryChatStore) GetUnreadCounts(ctx context.Context, recipientName string) (counts map[string]int, err error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if _, ok := store.users[recipientName]; !ok {
+    return nil, userNotFound(recipientName)
+  }
+  counts = make(map[string]int)
+  for _, message := range store.messages {
+    if message.Recipient == recipientName && message.ReadAt == nil {
+      counts[message.Sender]++
+    }
+  }
+  return counts, nil
+}
+
+// Adds a user's reaction to a message. Reacting twice with the same emoji
+// has no further effect.
+func (store *MemoryChatStore) AddReaction(ctx context.Context, messageId int64, username string, emoji string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if err := store.checkReaction(messageId, username); err != nil {
+    return err
+  }
+  emojis, ok := store.reactions[messageId]
+  if !ok {
+    emojis = make(map[string]map[string]bool)
+    store.reactions[messageId] = emojis
+  }
+  if emojis[emoji] == nil {
+    emojis[emoji] = make(map[string]bool)
+  }
+  emojis[emoji][username] = true
+  return nil
+}
+
+// Removes a user's reaction from a message, if there is one.
+func (store *MemoryChatStore) RemoveReaction(ctx context.Context, messageId int64, username string, emoji string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  if err := store.checkReaction(messageId, username); err != nil {
+    return err
+  }
+  if users, ok := store.reactions[messageId][emoji]; ok {
+    delete(users, username)
+    if len(users) == 0 {
+      delete(store.reactions[messageId], emoji)
+    }
+  }
+  return nil
+}
+
+// Checks that the message and the reacting user exist.
+// Must be called with the mutex held.
+func (store *MemoryChatStore) checkReaction(messageId int64, username string) error {
+  found := false
+  for _, message := range store.messages {
+    if message.ID == messageId {
+      found = true
+      break
+    }
+  }
+  if !found {
+    return ErrMessageNotFound
+  }
+  if _, ok := store.users[username]; !ok {
+    return userNotFound(username)
+  }
+  return nil
+}
+
+// Replaces the content of a plaintext message sent by the requester and
+// records when it was edited.
+func (store *MemoryChatStore) EditMessage(ctx context.Context, messageId int64, requesterName string, newContent string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  for _, message := range store.messages {
+    if message.ID != messageId {
+      continue
+    }
+    if message.Sender != requesterName {
+      return ErrNotMessageSender
+    }
+    if message.MessageType != MESSAGE_TYPE_PLAINTEXT {
+      return ErrMessageNotEditable
+    }
+    message.Content = newContent
+    editedAt := time.Now().UTC().Truncate(time.Second)
+    message.Edited = true
+    message.EditedAt = &editedAt
+    return nil
+  }
+  return ErrMessageNotFound
+}
+
+// Deletes a message sent by the requester.
+// Returns ErrMessageNotFound if there is no such message, or
+// ErrNotMessageSender if the requester didn't send it.
+func (store *MemoryChatStore) DeleteMessage(ctx context.Context, messageId int64, requesterName string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  for i, message := range store.messages {
+    if message.ID != messageId {
+      continue
+    }
+    if message.Sender != requesterName {
+      return ErrNotMessageSender
+    }
+    store.messages = append(store.messages[:i], store.messages[i+1:]...)
+    delete(store.reactions, messageId)
+    store.orphanReplies(map[int64]bool{messageId: true})
+    return nil
+  }
+  return ErrMessageNotFound
+}
+
+// An in-memory store is always reachable.
+func (store *MemoryChatStore) Ping(ctx context.Context) error {
+  return nil
+}
+
+// Nothing to release for an in-memory store.
+func (store *MemoryChatStore) Close() error {
+  return nil
+}
+
+// Returns whether the message was sent between the two users, in either
+// direction.
+func isBetween(message *Message, username1 string, username2 string) bool {
+  return (message.Sender == username1 && message.Recipient == username2) ||
+         (message.Sender == username2 && message.Recipient == username1)
+}
+
+// Returns a copy of the message, with its reaction counts, that callers
+// can't use to modify the store. Must be called with the mutex held.
+func (store *MemoryChatStore) copyMessage(message *Message) *Message {
+  copied := *message
+  if message.RoomID != nil {
+    roomId := *message.RoomID
+    copied.RoomID = &roomId
+  }
+  if message.Metadata != nil {
+    metadata := *message.Metadata
+    copied.Metadata = &metadata
+  }
+  if message.EditedAt != nil {
+    editedAt := *message.EditedAt
+    copied.EditedAt = &editedAt
+  }
+  if message.ReadAt != nil {
+    readAt := *message.ReadAt
+    copied.ReadAt = &readAt
+  }
+  if message.ReplyTo != nil {
+    replyTo := *message.ReplyTo
+    copied.ReplyTo = &replyTo
+  }
+  copied.Reactions = nil
+  for emoji, users := range store.reactions[message.ID] {
+    if copied.Reactions == nil {
+      copied.Reactions = make(map[string]int)
+    }
+    copied.Reactions[emoji] = len(users)
+  }
+  return &copied
+}
@@ -1,21 +1,115 @@
 package chatserver
 
 import (
+  "context"
   "encoding/json"
   "errors"
   "fmt"
-  "log"
   "net/http"
   "net/url"
   "strconv"
+  "strings"
+  "time"
+  "unicode/utf8"
 )
 
-// Struct for decoding JSON body for POST requests at /messages.
+// Path suffix for marking a single message read, /messages/{id}/read.
+const READ_PATH_SUFFIX = "/read"
+
+// Struct for decoding JSON body for POST requests at /messages/{id}/read.
+type markMessageReadStruct struct {
+  Reader string
+}
+
+// Struct for decoding JSON body for PUT requests at /messages/read.
+type markReadStruct struct {
+  Reader      string
+  Counterpart string
+}
+
+// Struct for decoding JSON body for PUT requests at /messages/{id}.
+type editMessageStruct struct {
+  Editor  string
+  Content string
+}
+
+// Struct for decoding JSON or form body for POST requests at /messages.
 type sendMessageStruct struct {
   Sender      string
   Recipient   string
+  Recipients  []string
+  RoomId      int64
+  ReplyTo     int64
   MessageType string
   Content     string
+  Metadata    *MessageMetadata
+}
+
+// Request handler for /messages/read.
+func (server *ChatServer) handleMessagesRead(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodPut:
+    server.markMessagesRead(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at /messages/read, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only PUT requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Request handler for /messages/search.
+func (server *ChatServer) handleMessagesSearch(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodGet:
+    server.searchMessages(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at /messages/search, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only GET requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Request handler for /messages/unread.
+func (server *ChatServer) handleMessagesUnread(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodGet:
+    server.countUnread(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at /messages/unread, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only GET requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Request handler for /messages/{id}.
+func (server *ChatServer) handleMessage(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  if strings.HasSuffix(r.URL.Path, REACTIONS_PATH_SUFFIX) {
+    server.handleReactions(w, r)
+    return
+  }
+  if strings.HasSuffix(r.URL.Path, READ_PATH_SUFFIX) {
+    if r.Method != http.MethodPost {
+      server.logger.Warnf("Unknown request received at %s, %+v", r.URL.Path, r)
+      errorResponse(w, http.StatusMethodNotAllowed, "only POST requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+      return
+    }
+    server.markMessageRead(w, r)
+    return
+  }
+  switch r.Method {
+  case http.MethodPut:
+    server.editMessage(w, r)
+  case http.MethodDelete:
+    server.deleteMessage(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at %s, %+v", r.URL.Path, r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only PUT and DELETE requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
 }
 
 // Request handler for /messages.
@@ -28,133 +122,412 @@ func (server *ChatServer) handleMessages(w http.ResponseWriter, r *http.Request)
     server.sendMessage(w, r)
   default:
     // Unhandled request, respond with StatusMethodNotAllowed (405).
-    log.Printf("Unknown request received at /messages, %+v", r)
-    http.Error(w, "only GET and POST requests are accepted", http.StatusMethodNotAllowed)
+    server.logger.Warnf("Unknown request received at /messages, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only GET and POST requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
   }
 }
 
 // Adds a message to the database.
 // Expects a POST to /messages with the following parameters in the body:
 // - sender: sender username
-// - recipient: recipient username
-// - messageType: one of "plaintext", "image_link", "video_link"
+// - recipient: recipient username, or
+// - recipients: array of recipient usernames, each gets a copy, or
+// - roomId: id of the room to send to, the sender must be a member
+// - messageType: one of "plaintext", "image_link", "video_link", "file"
 // - content: the text of the message
+// - [metadata]: optional {width, height} for images or {length, source} for
+//   videos, defaults are used if omitted. If given, every field is required.
+//   Required {filename, sizeBytes} for files.
+// - [replyTo]: optional id of the message this replies to, which must be in
+//   the same conversation or room. Not allowed with recipients.
+// The body can be JSON or a url-encoded form. In a form, recipients is
+// repeated once per username and the metadata fields are top-level keys,
+// e.g. width. Other content types get a 415, and bodies over
+// Config.MaxBodyBytes a 413.
+// Responds with the stored message, as returned when fetching messages, or an
+// array of them when sending to recipients.
 //
-// Note that we allow users to send messages to themselves.
+// Users can send messages to themselves unless the config's
+// AllowSelfMessages is false, in which case they get a 400.
+// Each sender is rate limited, see SetMessageRateLimit. Senders over the
+// limit get a 429 with a Retry-After header.
 //
 // Sample curl request:
 // curl -d '{"sender":"user2", "recipient":"user1", "messageType":"plaintext", "content":"Hi there!"}' -H "Content-Type: application/json" -X POST localhost:18000/messages
+// curl -d "sender=user2&recipient=user1&messageType=plaintext&content=Hi+there!" -X POST localhost:18000/messages
 func (server *ChatServer) sendMessage(w http.ResponseWriter, r *http.Request) {
   // Parse request.
-  senderName, recipientName, messageType, content, err := server.parseSendMessage(r)
+  body, err := server.parseSendMessage(r)
   if err != nil {
-    http.Error(w,fmt.Sprintf(
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf(
       "bad POST request at /messages, couldn't parse, error: %s",
       err.Error()),
-    http.StatusBadRequest)
+    code)
+    return
+  }
+
+  to := body.Recipient
+  if body.RoomId != 0 {
+    to = fmt.Sprintf("room %d", body.RoomId)
+  } else if body.Recipients != nil {
+    to = strings.Join(body.Recipients, ", ")
+  }
+  server.logger.Debugf("Received POST at /messages for sender %s and recipient %s", body.Sender, to)
+  // Keyed like user ids, so changing the case of the username doesn't get
+  // a fresh bucket.
+  if ok, retryAfter := server.messageLimiter.allow(userIdKey(body.Sender)); !ok {
+    server.logger.Warnf("Rate limiting messages from %s", body.Sender)
+    tooManyRequests(w, "too many messages, try again later", retryAfter)
+    return
+  }
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  if body.Recipients != nil {
+    server.sendMessages(ctx, w, body)
+    return
+  }
+  var message *Message
+  if body.RoomId != 0 {
+    message, err = server.db.AddRoomMessage(ctx, body.Sender, body.RoomId, body.MessageType, body.Content, body.Metadata, body.ReplyTo)
+  } else {
+    message, err = server.db.AddMessage(ctx, body.Sender, body.Recipient, body.MessageType, body.Content, body.Metadata, body.ReplyTo)
+  }
+  if err != nil {
+    server.logger.Errorf("Error adding message to db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't send message: %s", err.Error()), codeForError(err))
     return
   }
+  // Success.
+  server.logger.Debugf("Successfully stored message from %s to %s", body.Sender, to)
+  server.metrics.messagesSent.WithLabelValues(message.MessageType).Inc()
+  // Neither the push nor the response modify the message, so they can share it.
+  go server.notifyRecipient(message)
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(message); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
 
-  log.Printf("Received POST at /messages for sender %s and recipient %s", senderName, recipientName)
-  id, err := server.db.AddMessage(senderName, recipientName, messageType, content)
+// Sends a message to each of body.Recipients, for sendMessage.
+// Either every recipient gets the message or none do. Responds with an array
+// of the stored messages, one per recipient in the order given.
+func (server *ChatServer) sendMessages(ctx context.Context, w http.ResponseWriter, body *sendMessageStruct) {
+  messages, err := server.db.AddMessages(ctx, body.Sender, body.Recipients, body.MessageType, body.Content, body.Metadata)
   if err != nil {
-    log.Printf("Error adding message to db: %s", err.Error())
-    http.Error(w, fmt.Sprintf("Couldn't send message: %s", err.Error()), http.StatusInternalServerError)
+    server.logger.Errorf("Error adding messages to db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't send message: %s", err.Error()), codeForError(err))
     return
   }
   // Success.
-  log.Printf("Successfully stored message from %s to %s", senderName, recipientName)
+  server.logger.Debugf("Successfully stored %d messages from %s", len(messages), body.Sender)
+  server.metrics.messagesSent.WithLabelValues(body.MessageType).Add(float64(len(messages)))
+  for _, message := range messages {
+    go server.notifyRecipient(message)
+  }
   w.WriteHeader(http.StatusOK)
-  if err := json.NewEncoder(w).Encode(map[string]string{
-    "sender": senderName,
-    "recipient": recipientName,
-    "message_id": strconv.FormatInt(id, 10),
-  }); err != nil {
-    log.Printf("Error formatting http response, %s", err.Error())
-    http.Error(w, "error generating response", http.StatusInternalServerError)
+  if err := json.NewEncoder(w).Encode(messages); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
   }
 }
 
+// Returns an error if message content is empty or longer than the
+// configured limit.
+func (server *ChatServer) validateContent(content string) error {
+  if len(content) <= 0 {
+    return errors.New("rejecting empty message")
+  }
+  if utf8.RuneCountInString(content) > server.config.MaxContentLength {
+    return errors.New(fmt.Sprintf("message content should be at most %d characters", server.config.MaxContentLength))
+  }
+  return nil
+}
+
+// Returns an error if the content of a link message isn't a valid http or
+// https URL. Other schemes (e.g. javascript:) can't be rendered safely.
+func validateLink(content string) error {
+  link, err := url.ParseRequestURI(content)
+  if err != nil {
+    return errors.New("link messages should hold a valid URL")
+  }
+  if link.Scheme != "http" && link.Scheme != "https" {
+    return errors.New("link messages should hold an http or https URL")
+  }
+  if len(link.Host) == 0 {
+    return errors.New("link messages should hold a URL with a host")
+  }
+  return nil
+}
+
 // Parse POST request for /messages.
-// Returns parsed values or error.
-func (server *ChatServer) parseSendMessage(r *http.Request) (senderName string, recipientName string, messageType string, content string, err error) {
+// Returns parsed values or error. Only the metadata fields that apply to the
+// message type are kept.
+func (server *ChatServer) parseSendMessage(r *http.Request) (*sendMessageStruct, error) {
+  contentType, err := bodyContentType(r)
+  if err != nil {
+    return nil, err
+  }
   var body sendMessageStruct
-  decoder := json.NewDecoder(r.Body)
-  if err := decoder.Decode(&body); err != nil {
-    return "", "", "", "", errors.New("couldn't decode JSON")
-  }
-  senderName = body.Sender
-  recipientName = body.Recipient
-  messageType = body.MessageType
-  content = body.Content
-  // Ignore empty messages.
-  if len(content) <= 0 {
-    return "", "", "", "", errors.New(fmt.Sprintf("rejecting empty message"))
+  if contentType == CONTENT_TYPE_FORM {
+    form, err := parseSendMessageForm(r)
+    if err != nil {
+      return nil, err
+    }
+    body = *form
+  } else if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+    return nil, bodyReadError(err, errors.New("couldn't decode JSON"))
+  }
+  // Messages go to either a user, several users or a room.
+  targets := 0
+  for _, given := range []bool{len(body.Recipient) > 0, body.Recipients != nil, body.RoomId != 0} {
+    if given {
+      targets++
+    }
   }
-  if messageType != MESSAGE_TYPE_PLAINTEXT && messageType != MESSAGE_TYPE_IMAGE_LINK &&
-     messageType != MESSAGE_TYPE_VIDEO_LINK {
-      return "", "", "", "", errors.New(fmt.Sprintf("invalid messageType %s", messageType))
+  if targets != 1 {
+    return nil, errors.New("expected exactly one of recipient, recipients and roomId")
+  }
+  // Usernames are case insensitive, so "Alice" and "alice" are the same user.
+  if !server.config.AllowSelfMessages && userIdKey(body.Recipient) == userIdKey(body.Sender) {
+    return nil, errors.New("can't send messages to yourself")
+  }
+  if body.Recipients != nil {
+    if len(body.Recipients) < 1 || len(body.Recipients) > MAX_MESSAGE_RECIPIENTS {
+      return nil, errors.New(fmt.Sprintf("recipients should have between 1 and %d usernames", MAX_MESSAGE_RECIPIENTS))
+    }
+    seen := make(map[string]bool)
+    for _, recipient := range body.Recipients {
+      if len(recipient) < 1 || seen[userIdKey(recipient)] {
+        return nil, errors.New("recipients should be distinct, non-empty usernames")
+      }
+      if !server.config.AllowSelfMessages && userIdKey(recipient) == userIdKey(body.Sender) {
+        return nil, errors.New("can't send messages to yourself")
+      }
+      seen[userIdKey(recipient)] = true
+    }
+  }
+  // A reply belongs to one conversation, so it can't go to several users.
+  if body.ReplyTo < 0 || (body.ReplyTo != 0 && body.Recipients != nil) {
+    return nil, errors.New("replyTo should be a message id, and can't be combined with recipients")
+  }
+  if err := server.validateContent(body.Content); err != nil {
+    return nil, err
+  }
+  // Only keep the metadata fields that apply to the message type, falling
+  // back to the defaults for clients that don't send any.
+  switch body.MessageType {
+  case MESSAGE_TYPE_PLAINTEXT:
+    body.Metadata = nil
+  case MESSAGE_TYPE_IMAGE_LINK:
+    if err := validateLink(body.Content); err != nil {
+      return nil, err
+    }
+    if body.Metadata == nil {
+      body.Metadata = &MessageMetadata{Width: IMAGE_WIDTH, Height: IMAGE_HEIGHT}
+      break
+    }
+    if body.Metadata.Width <= 0 || body.Metadata.Height <= 0 ||
+       body.Metadata.Width > MAX_METADATA_VALUE || body.Metadata.Height > MAX_METADATA_VALUE {
+      return nil, errors.New(fmt.Sprintf(
+        "image width and height should be between 1 and %d", MAX_METADATA_VALUE))
+    }
+    body.Metadata = &MessageMetadata{Width: body.Metadata.Width, Height: body.Metadata.Height}
+  case MESSAGE_TYPE_VIDEO_LINK:
+    if err := validateLink(body.Content); err != nil {
+      return nil, err
+    }
+    if body.Metadata == nil {
+      body.Metadata = &MessageMetadata{Length: VIDEO_LENGTH, Source: VIDEO_SOURCE}
+      break
+    }
+    if body.Metadata.Length <= 0 || body.Metadata.Length > MAX_METADATA_VALUE {
+      return nil, errors.New(fmt.Sprintf(
+        "video length should be between 1 and %d", MAX_METADATA_VALUE))
+    }
+    if len(body.Metadata.Source) == 0 || len(body.Metadata.Source) > MAX_VIDEO_SOURCE_LENGTH {
+      return nil, errors.New(fmt.Sprintf(
+        "video source should be between 1 and %d characters", MAX_VIDEO_SOURCE_LENGTH))
+    }
+    body.Metadata = &MessageMetadata{Length: body.Metadata.Length, Source: body.Metadata.Source}
+  case MESSAGE_TYPE_FILE:
+    // There's no sensible default filename, so file messages must say.
+    if body.Metadata == nil || len(body.Metadata.Filename) == 0 {
+      return nil, errors.New("file messages require a filename")
+    }
+    if utf8.RuneCountInString(body.Metadata.Filename) > MAX_FILENAME_LENGTH {
+      return nil, errors.New(fmt.Sprintf(
+        "filename should be at most %d characters", MAX_FILENAME_LENGTH))
+    }
+    if body.Metadata.SizeBytes < 0 {
+      return nil, errors.New("file size can't be negative")
+    }
+    body.Metadata = &MessageMetadata{Filename: body.Metadata.Filename, SizeBytes: body.Metadata.SizeBytes}
+  default:
+    return nil, errors.New(fmt.Sprintf("invalid messageType %s", body.MessageType))
   }
-  return senderName, recipientName, messageType, content, nil
+  return &body, nil
 }
 
 
 
 
-// Fetches messages between two users.
+// Fetches messages between two users, or in a room.
 // Expects a GET to /messages with the following query parameters:
 // - sender: sender username
 // - recipient: recipient username
-// - [messagesPerPage]: optional number of messages per page
-// - [pageToLoad]: optional page number to show (0 indexed)
+// - [reader]: optional username of whichever of the two is fetching. Messages
+//   sent to them that were only sent are marked delivered.
+// Or, for a room:
+// - roomId: id of the room
+// - user: username of a member of the room
+// - [messagesPerPage]: optional number of messages per page, at most
+//   MAX_MESSAGES_PER_PAGE
+// - [pageToLoad]: optional page number to show (0 indexed), such that
+//   pageToLoad * messagesPerPage is at most MAX_PAGE_OFFSET
+// - [beforeId]: optional message id, only the messages just before it are
+//   returned. Can't be combined with messagesPerPage and pageToLoad.
+// - [afterId]: optional message id, only the messages just after it are
+//   returned, for catching up on new messages. Can't be combined with
+//   beforeId, messagesPerPage or pageToLoad.
+// - [limit]: optional number of messages to return with beforeId or afterId,
+//   at most MAX_MESSAGES_PER_PAGE, DEFAULT_CURSOR_LIMIT by default
+// - [since], [until]: optional RFC3339 times, only messages created within
+//   them (inclusive) are returned. Either can be omitted. Can't be combined
+//   with messagesPerPage and pageToLoad.
 //
 // Note that the order of the sender and recipient does not matter, they are
 // simply better names than "username1" and "username 2"
 //
+// Without pagination, or with beforeId or afterId, responds with an array of
+// messages, oldest first. With pagination, responds with
+// {"messages": [...], "total": N, "page": P, "perPage": K, "hasMore": B}
+// where total counts all messages between the two users, or in the room, and
+// hasMore says whether there are pages after this one.
+//
 // Sample curl request:
 // curl "localhost:18000/messages?sender=user1&recipient=user2&messagesPerPage=2&pageToLoad=1"
 func (server *ChatServer) fetchMessages(w http.ResponseWriter, r *http.Request) {
   fetchMessagesParams, err := server.parseFetchMessages(r)
   if (err != nil) {
-    http.Error(w, fmt.Sprintf("bad GET request at /messages, could not parse, %s", err.Error()), http.StatusBadRequest)
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad GET request at /messages, could not parse, %s", err.Error()), ERROR_CODE_BAD_REQUEST)
     return
   }
-  log.Printf("Received GET at /messages for %s and %s", fetchMessagesParams.senderName,
-                                                        fetchMessagesParams.recipientName)
+  server.logger.Debugf("Received GET at /messages for %s and %s", fetchMessagesParams.senderName,
+                       fetchMessagesParams.recipientName)
   // Get messages.
-  messages, err := server.db.FetchMessages(fetchMessagesParams)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  messages, err := server.db.FetchMessages(ctx, fetchMessagesParams)
   if err != nil {
-    log.Printf("Error fetching messages from db: %s", err.Error())
-    http.Error(w, fmt.Sprintf("Couldn't fetch messages: %s", err.Error()), http.StatusInternalServerError)
+    server.logger.Errorf("Error fetching messages from db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't fetch messages: %s", err.Error()), codeForError(err))
     return
   }
+  if len(fetchMessagesParams.readerName) > 0 {
+    if err = server.markDelivered(ctx, fetchMessagesParams, messages); err != nil {
+      server.logger.Errorf("Error marking messages delivered in db: %s", err.Error())
+      errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't fetch messages: %s", err.Error()), codeForError(err))
+      return
+    }
+  }
+  // Paginated fetches also report the total, so clients know how many
+  // pages there are. Unpaginated fetches keep returning a bare array.
+  var response interface{} = messages
+  if fetchMessagesParams.usePagination {
+    var total int64
+    if fetchMessagesParams.roomId != 0 {
+      total, err = server.db.GetRoomMessageCount(ctx, fetchMessagesParams.roomId)
+    } else {
+      total, err = server.db.GetMessageCount(ctx, fetchMessagesParams.senderName,
+                                             fetchMessagesParams.recipientName)
+    }
+    if err != nil {
+      server.logger.Errorf("Error counting messages in db: %s", err.Error())
+      errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't fetch messages: %s", err.Error()), codeForError(err))
+      return
+    }
+    if messages == nil {
+      messages = []*Message{}
+    }
+    response = &MessagePage{
+      Messages: messages,
+      Total: total,
+      Page: fetchMessagesParams.pageToLoad,
+      PerPage: fetchMessagesParams.messagesPerPage,
+      HasMore: int64(fetchMessagesParams.pageToLoad + 1) * int64(fetchMessagesParams.messagesPerPage) < total,
+    }
+  }
   // Try to send response.
-  log.Printf("Successfully fetched messages between %s and %s",
-             fetchMessagesParams.senderName, fetchMessagesParams.recipientName)
+  server.logger.Debugf("Successfully fetched messages between %s and %s",
+                       fetchMessagesParams.senderName, fetchMessagesParams.recipientName)
   w.WriteHeader(http.StatusOK)
-  if err := json.NewEncoder(w).Encode(messages); err != nil {
-    log.Printf("Error formatting http response, %s", err.Error())
-    http.Error(w, "error generating response", http.StatusInternalServerError)
+  if err := json.NewEncoder(w).Encode(response); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Marks the messages sent to the reader as delivered, for fetchMessages,
+// including the fetched ones so the response matches the db.
+func (server *ChatServer) markDelivered(ctx context.Context, params *FetchMessagesParams, messages []*Message) error {
+  counterpart := params.senderName
+  if counterpart == params.readerName {
+    counterpart = params.recipientName
+  }
+  if err := server.db.MarkMessagesDelivered(ctx, params.readerName, counterpart); err != nil {
+    return err
+  }
+  for _, message := range messages {
+    if message.Recipient == params.readerName && message.Status == MESSAGE_STATUS_SENT {
+      message.Status = MESSAGE_STATUS_DELIVERED
+    }
   }
+  return nil
 }
 
 // Parse GET request for /messages.
 // Returns parsed values or error.
 func (server *ChatServer) parseFetchMessages(r *http.Request) (fetchMessagesParams *FetchMessagesParams, err error) {
   fetchMessagesParams = &FetchMessagesParams{}
-  // Parse request.
-  u, err := url.Parse(r.URL.String())
+  // Parse request. ParseQuery decodes the escaped values, so usernames with
+  // characters like & or = still work as long as the client escapes them.
+  params, err := url.ParseQuery(r.URL.RawQuery)
   if err != nil {
-    err = errors.New("Couldn't parse GET at /messages")
+    err = errors.New("Couldn't parse GET at /messages, query string is malformed")
     return
   }
-  params := u.Query()
-  if len(params["sender"]) != 1 || len(params["recipient"]) != 1 {
-    err = errors.New("Couldn't parse GET at /messages")
-    return
+  if _, haveRoomId := params["roomId"]; haveRoomId {
+    // Room messages are fetched on behalf of a member of the room.
+    if len(params["roomId"]) != 1 || len(params["user"]) != 1 || len(params.Get("user")) == 0 {
+      err = errors.New("Expect roomId and user to both have 1 value")
+      return
+    }
+    fetchMessagesParams.roomId, err = strconv.ParseInt(params.Get("roomId"), 10, 64)
+    if err != nil || fetchMessagesParams.roomId < 1 {
+      err = errors.New("Error parsing roomId")
+      return
+    }
+    fetchMessagesParams.senderName = params.Get("user")
+  } else {
+    if len(params["sender"]) != 1 || len(params["recipient"]) != 1 ||
+       len(params.Get("sender")) == 0 || len(params.Get("recipient")) == 0 {
+      err = errors.New("Expect sender and recipient to both have 1 non-empty value")
+      return
+    }
+    fetchMessagesParams.senderName = params.Get("sender")
+    fetchMessagesParams.recipientName = params.Get("recipient")
+    if _, haveReader := params["reader"]; haveReader {
+      reader := params.Get("reader")
+      if len(params["reader"]) != 1 ||
+         (reader != fetchMessagesParams.senderName && reader != fetchMessagesParams.recipientName) {
+        err = errors.New("Expect reader to be either the sender or the recipient")
+        return
+      }
+      fetchMessagesParams.readerName = reader
+    }
   }
-  fetchMessagesParams.senderName = params.Get("sender")
-  fetchMessagesParams.recipientName = params.Get("recipient")
   // Check that messagesPerPage and pageToLoad either both have 1 value or
   // both have 0 values provided, and that they are parsable as integers.
   _, haveMessagesPerPage := params["messagesPerPage"]
@@ -178,6 +551,368 @@ func (server *ChatServer) parseFetchMessages(r *http.Request) (fetchMessagesPara
       err = errors.New("Error parsing pageToLoad")
       return
     }
+    if fetchMessagesParams.messagesPerPage < 1 || fetchMessagesParams.messagesPerPage > MAX_MESSAGES_PER_PAGE {
+      err = errors.New(fmt.Sprintf("messagesPerPage should be between 1 and %d", MAX_MESSAGES_PER_PAGE))
+      return
+    }
+    if fetchMessagesParams.pageToLoad < 0 ||
+       fetchMessagesParams.pageToLoad > MAX_PAGE_OFFSET / fetchMessagesParams.messagesPerPage {
+      err = errors.New(fmt.Sprintf("pageToLoad should be between 0 and %d for %d messagesPerPage",
+                                   MAX_PAGE_OFFSET / fetchMessagesParams.messagesPerPage,
+                                   fetchMessagesParams.messagesPerPage))
+      return
+    }
+  }
+  // Cursor pagination: the limit messages just before beforeId, or just
+  // after afterId.
+  _, haveBeforeId := params["beforeId"]
+  _, haveAfterId := params["afterId"]
+  if haveBeforeId || haveAfterId {
+    if haveMessagesPerPage || (haveBeforeId && haveAfterId) || len(params["beforeId"]) > 1 ||
+       len(params["afterId"]) > 1 || len(params["limit"]) > 1 {
+      err = errors.New("Expect one beforeId or afterId, at most one limit, and no messagesPerPage or pageToLoad")
+      return
+    }
+    if haveBeforeId {
+      fetchMessagesParams.beforeId, err = strconv.ParseInt(params.Get("beforeId"), 10, 64)
+      if err != nil || fetchMessagesParams.beforeId < 1 {
+        err = errors.New("Error parsing beforeId")
+        return
+      }
+    } else {
+      fetchMessagesParams.afterId, err = strconv.ParseInt(params.Get("afterId"), 10, 64)
+      if err != nil || fetchMessagesParams.afterId < 1 {
+        err = errors.New("Error parsing afterId")
+        return
+      }
+    }
+    fetchMessagesParams.limit = DEFAULT_CURSOR_LIMIT
+    if _, haveLimit := params["limit"]; haveLimit {
+      fetchMessagesParams.limit, err = strconv.Atoi(params.Get("limit"))
+      if err != nil || fetchMessagesParams.limit < 1 || fetchMessagesParams.limit > MAX_MESSAGES_PER_PAGE {
+        err = errors.New(fmt.Sprintf("limit should be between 1 and %d", MAX_MESSAGES_PER_PAGE))
+        return
+      }
+    }
+  }
+  // Time range. Paginated fetches report the conversation's total, which
+  // wouldn't match a filtered page.
+  _, haveSince := params["since"]
+  _, haveUntil := params["until"]
+  if (haveSince || haveUntil) && haveMessagesPerPage {
+    err = errors.New("Expect no messagesPerPage or pageToLoad with since or until")
+    return
+  }
+  if fetchMessagesParams.since, err = parseTimeParam(params, "since"); err != nil {
+    return
+  }
+  if fetchMessagesParams.until, err = parseTimeParam(params, "until"); err != nil {
+    return
+  }
+  if !fetchMessagesParams.since.IsZero() && !fetchMessagesParams.until.IsZero() &&
+     fetchMessagesParams.until.Before(fetchMessagesParams.since) {
+    err = errors.New("until should not be before since")
+    return
   }
   return
 }
+
+// Parses an optional RFC3339 query parameter. Returns the zero time if it's
+// missing.
+func parseTimeParam(params url.Values, name string) (time.Time, error) {
+  if _, ok := params[name]; !ok {
+    return time.Time{}, nil
+  }
+  if len(params[name]) > 1 {
+    return time.Time{}, errors.New(fmt.Sprintf("Expect %s to have at most 1 value", name))
+  }
+  parsed, err := time.Parse(time.RFC3339, params.Get(name))
+  if err != nil {
+    return time.Time{}, errors.New(fmt.Sprintf("Error parsing %s, expected an RFC3339 time like 2006-01-02T15:04:05Z", name))
+  }
+  return parsed, nil
+}
+
+// Edits the content of a plaintext message.
+// Expects a PUT to /messages/{id} with the following parameters in the body:
+// - editor: username of the requester, who must be the message's sender
+// - content: the new text of the message
+//
+// Image and video messages can't be edited. Edited messages are returned
+// with "edited": true and the time of the latest edit in "editedAt".
+//
+// Sample curl request:
+// curl -d '{"editor":"user2", "content":"Hi there, fixed!"}' -H "Content-Type: application/json" -X PUT localhost:18000/messages/1
+func (server *ChatServer) editMessage(w http.ResponseWriter, r *http.Request) {
+  messageId, err := parseMessageId(r, "")
+  if err != nil {
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad PUT request at %s, %s", r.URL.Path, err.Error()), ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  var body editMessageStruct
+  if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+    err = bodyReadError(err, errors.New("couldn't decode JSON"))
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf("bad PUT request at %s, %s", r.URL.Path, err.Error()), code)
+    return
+  }
+  if len(body.Editor) < 1 {
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad PUT request at %s, editor is required", r.URL.Path), ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  // Same rules as sending.
+  if err := server.validateContent(body.Content); err != nil {
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad PUT request at %s, %s", r.URL.Path, err.Error()), ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  server.logger.Debugf("Received PUT at /messages for message %d from %s", messageId, body.Editor)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  if err := server.db.EditMessage(ctx, messageId, body.Editor, body.Content); err != nil {
+    server.logger.Errorf("Error editing message in db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't edit message: %s", err.Error()), codeForError(err))
+    return
+  }
+  // Success.
+  server.logger.Debugf("Successfully edited message %d", messageId)
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(map[string]string{
+    "message_id": strconv.FormatInt(messageId, 10),
+  }); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Deletes a message.
+// Expects a DELETE to /messages/{id} with the following query parameters:
+// - sender: username of the requester, who must be the message's sender
+//
+// Any metadata stored for the message is deleted along with it.
+//
+// Sample curl request:
+// curl -X DELETE "localhost:18000/messages/1?sender=user1"
+func (server *ChatServer) deleteMessage(w http.ResponseWriter, r *http.Request) {
+  messageId, err := parseMessageId(r, "")
+  if err != nil {
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad DELETE request at %s, %s", r.URL.Path, err.Error()), ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  senderName := r.URL.Query().Get("sender")
+  if len(senderName) < 1 {
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad DELETE request at %s, sender is required", r.URL.Path), ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  server.logger.Debugf("Received DELETE at /messages for message %d from %s", messageId, senderName)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  if err := server.db.DeleteMessage(ctx, messageId, senderName); err != nil {
+    server.logger.Errorf("Error deleting message from db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't delete message: %s", err.Error()), codeForError(err))
+    return
+  }
+  // Success.
+  server.logger.Debugf("Successfully deleted message %d", messageId)
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(map[string]string{
+    "message_id": strconv.FormatInt(messageId, 10),
+  }); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Parse the message id out of a /messages/{id} path, or a longer path such
+// as /messages/{id}/reactions if the suffix is given.
+func parseMessageId(r *http.Request, suffix string) (int64, error) {
+  path := strings.TrimSuffix(r.URL.Path, suffix)
+  id, err := strconv.ParseInt(strings.TrimPrefix(path, "/messages/"), 10, 64)
+  if err != nil {
+    return 0, errors.New("couldn't parse message id")
+  }
+  return id, nil
+}
+
+// Marks the messages a user has received from another user as read.
+// Expects a PUT to /messages/read with the following parameters in the body:
+// - reader: username of the recipient who read the messages
+// - counterpart: username of the sender of the messages
+//
+// Fetched messages report when they were read in readAt.
+//
+// Sample curl request:
+// curl -d '{"reader":"user1", "counterpart":"user2"}' -H "Content-Type: application/json" -X PUT localhost:18000/messages/read
+func (server *ChatServer) markMessagesRead(w http.ResponseWriter, r *http.Request) {
+  var body markReadStruct
+  if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+    err = bodyReadError(err, errors.New("couldn't decode JSON"))
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf("bad PUT request at /messages/read, %s", err.Error()), code)
+    return
+  }
+  if len(body.Reader) < 1 || len(body.Counterpart) < 1 {
+    errorResponse(w, http.StatusBadRequest, "bad PUT request at /messages/read, reader and counterpart are required", ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  server.logger.Debugf("Received PUT at /messages/read for %s reading %s", body.Reader, body.Counterpart)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  if err := server.db.MarkMessagesRead(ctx, body.Reader, body.Counterpart); err != nil {
+    server.logger.Errorf("Error marking messages read in db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't mark messages read: %s", err.Error()), codeForError(err))
+    return
+  }
+  // Success.
+  server.logger.Debugf("Successfully marked messages from %s to %s read", body.Counterpart, body.Reader)
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(map[string]string{
+    "reader": body.Reader,
+    "counterpart": body.Counterpart,
+  }); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Marks a single message as read by its recipient.
+// Expects a POST to /messages/{id}/read with the following parameters in the
+// body:
+// - reader: username of the message's recipient
+// Only the recipient can mark a message read, and doing it again keeps the
+// original time. The sender sees the time in the message's readAt.
+//
+// Sample curl request:
+// curl -d '{"reader":"user1"}' -H "Content-Type: application/json" -X POST localhost:18000/messages/1/read
+func (server *ChatServer) markMessageRead(w http.ResponseWriter, r *http.Request) {
+  messageId, err := parseMessageId(r, READ_PATH_SUFFIX)
+  if err != nil {
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad POST request at %s, %s", r.URL.Path, err.Error()), ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  var body markMessageReadStruct
+  if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+    err = bodyReadError(err, errors.New("couldn't decode JSON"))
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf("bad POST request at %s, %s", r.URL.Path, err.Error()), code)
+    return
+  }
+  if len(body.Reader) < 1 {
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad POST request at %s, reader is required", r.URL.Path), ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  server.logger.Debugf("Received POST at %s for %s", r.URL.Path, body.Reader)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  if err := server.db.MarkMessageRead(ctx, messageId, body.Reader); err != nil {
+    server.logger.Errorf("Error marking message %d read in db: %s", messageId, err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't mark message read: %s", err.Error()), codeForError(err))
+    return
+  }
+  // Success.
+  server.logger.Debugf("Successfully marked message %d read", messageId)
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(map[string]interface{}{
+    "id": messageId,
+    "reader": body.Reader,
+  }); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Counts a user's unread messages, e.g. for notification badges.
+// Expects a GET to /messages/unread with the following query parameters:
+// - user: username of the recipient, username is accepted too
+// - [from]: optional, only count messages from this sender
+//
+// Responds with {"count": N}. Without from, the response also breaks the
+// count down by sender, {"count": N, "bySender": {"user2": 3, ...}}.
+//
+// Sample curl request:
+// curl "localhost:18000/messages/unread?user=user1&from=user2"
+func (server *ChatServer) countUnread(w http.ResponseWriter, r *http.Request) {
+  params := r.URL.Query()
+  usernames := append(params["user"], params["username"]...)
+  if len(usernames) != 1 || len(params["from"]) > 1 {
+    errorResponse(w, http.StatusBadRequest, "bad GET request at /messages/unread, expected exactly one user and at most one from", ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  username := usernames[0]
+  senderName := params.Get("from")
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  response := map[string]interface{}{}
+  if len(senderName) > 0 {
+    count, err := server.db.CountUnread(ctx, username, senderName)
+    if err != nil {
+      server.logger.Errorf("Error counting unread messages in db: %s", err.Error())
+      errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't count unread messages: %s", err.Error()), codeForError(err))
+      return
+    }
+    response["count"] = count
+  } else {
+    counts, err := server.db.GetUnreadCounts(ctx, username)
+    if err != nil {
+      server.logger.Errorf("Error counting unread messages in db: %s", err.Error())
+      errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't count unread messages: %s", err.Error()), codeForError(err))
+      return
+    }
+    total := 0
+    for _, count := range counts {
+      total += count
+    }
+    response["count"] = total
+    response["bySender"] = counts
+  }
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(response); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Searches a user's messages, in every conversation, for some text.
+// Expects a GET to /messages/search with the following query parameters:
+// - username: user whose messages to search
+// - q: text to look for, matched anywhere in the message content
+// - [limit]: optional, at most MESSAGE_SEARCH_LIMIT (the default)
+// Matches are returned newest first.
+//
+// Sample curl request:
+// curl "localhost:18000/messages/search?username=user1&q=hello"
+func (server *ChatServer) searchMessages(w http.ResponseWriter, r *http.Request) {
+  params := r.URL.Query()
+  if len(params["username"]) != 1 || len(params.Get("q")) < 1 {
+    errorResponse(w, http.StatusBadRequest, "bad GET request at /messages/search, expected a username and a non-empty q", ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  username := params.Get("username")
+  query := params.Get("q")
+  limit := MESSAGE_SEARCH_LIMIT
+  if len(params["limit"]) > 0 {
+    var err error
+    limit, err = strconv.Atoi(params.Get("limit"))
+    if err != nil || limit < 1 || limit > MESSAGE_SEARCH_LIMIT {
+      errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad GET request at /messages/search, limit should be between 1 and %d", MESSAGE_SEARCH_LIMIT), ERROR_CODE_BAD_REQUEST)
+      return
+    }
+  }
+  server.logger.Debugf("Received GET at /messages/search for %s", username)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  messages, err := server.db.SearchMessages(ctx, username, query, limit)
+  if err != nil {
+    server.logger.Errorf("Error searching messages in db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't search messages: %s", err.Error()), codeForError(err))
+    return
+  }
+  // Always respond with an array, even if nothing matched.
+  if messages == nil {
+    messages = []*Message{}
+  }
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(messages); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
@@ -0,0 +1,786 @@
+package chatserver
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+  "time"
+)
+
+// Sends an image message from user1 to user2 and returns it as stored.
+func sendTestImage(t *testing.T, server *ChatServer) *Message {
+  t.Helper()
+  w := doRequest(server, http.MethodPost, "/messages",
+                 `{"sender":"user1", "recipient":"user2", "messageType":"image_link", ` +
+                 `"content":"https://example.com/cat.png", "metadata":{"width":640, "height":480}}`)
+  var message Message
+  decodeResponse(t, w, http.StatusOK, &message)
+  return &message
+}
+
+func TestEditMessage(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sent := sendTestMessage(t, server, "user1", "user2", "Hi tehre!")
+  if sent.Edited || sent.EditedAt != nil {
+    t.Fatalf("new message is already edited: %+v", sent)
+  }
+  w := doRequest(server, http.MethodPut, fmt.Sprintf("/messages/%d", sent.ID),
+                 `{"editor":"user1", "content":"Hi there!"}`)
+  decodeResponse(t, w, http.StatusOK, nil)
+  messages := fetchTestMessages(t, server, "user1", "user2")
+  if len(messages) != 1 {
+    t.Fatalf("got %d messages, want 1", len(messages))
+  }
+  if messages[0].Content != "Hi there!" || !messages[0].Edited || messages[0].EditedAt == nil {
+    t.Errorf("got %+v, want the edited content marked as edited", messages[0])
+  }
+}
+
+func TestEditMessageRejections(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sent := sendTestMessage(t, server, "user1", "user2", "Hi there!")
+  image := sendTestImage(t, server)
+  tests := []struct {
+    name string
+    id int64
+    body string
+    status int
+    code string
+  }{
+    {"not the sender", sent.ID, `{"editor":"user2", "content":"Hijacked"}`, http.StatusForbidden, ERROR_CODE_NOT_MESSAGE_SENDER},
+    {"image message", image.ID, `{"editor":"user1", "content":"https://example.com/dog.png"}`, http.StatusBadRequest, ERROR_CODE_MESSAGE_NOT_EDITABLE},
+    {"no such message", image.ID + 1, `{"editor":"user1", "content":"Hi there!"}`, http.StatusNotFound, ERROR_CODE_MESSAGE_NOT_FOUND},
+    {"missing editor", sent.ID, `{"content":"Hi there!"}`, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST},
+    {"empty content", sent.ID, `{"editor":"user1", "content":""}`, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST},
+    {"bad JSON", sent.ID, `{"editor":`, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      w := doRequest(server, http.MethodPut, fmt.Sprintf("/messages/%d", test.id), test.body)
+      expectError(t, w, test.status, test.code)
+    })
+  }
+  // Nothing was changed.
+  for _, message := range fetchTestMessages(t, server, "user1", "user2") {
+    if message.Edited {
+      t.Errorf("message %d was edited: %+v", message.ID, message)
+    }
+  }
+}
+
+func TestFetchMessagesTimestampsAscending(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  before := time.Now().UTC().Truncate(time.Second)
+  for i := 0; i < 5; i++ {
+    sendTestMessage(t, server, "user1", "user2", fmt.Sprintf("message %d", i))
+  }
+  after := time.Now().UTC()
+  w := doRequest(server, http.MethodGet, "/messages?sender=user1&recipient=user2", "")
+  var raw []map[string]interface{}
+  decodeResponse(t, w, http.StatusOK, &raw)
+  if len(raw) != 5 {
+    t.Fatalf("got %d messages, want 5", len(raw))
+  }
+  var previous time.Time
+  for i, message := range raw {
+    text, _ := message["createdAt"].(string)
+    createdAt, err := time.Parse(time.RFC3339, text)
+    if err != nil {
+      t.Fatalf("message %d: createdAt %q isn't RFC 3339", i, text)
+    }
+    if createdAt.Before(before) || createdAt.After(after) {
+      t.Errorf("message %d: createdAt %s isn't between %s and %s", i, createdAt, before, after)
+    }
+    if createdAt.Before(previous) {
+      t.Errorf("message %d: createdAt %s is before the previous message's %s", i, createdAt, previous)
+    }
+    previous = createdAt
+  }
+}
+
+func TestFetchMessagesIdsIncrease(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sent := make(map[int64]string)
+  for i := 0; i < 5; i++ {
+    // Alternate directions, since both belong to the conversation.
+    sender, recipient := "user1", "user2"
+    if i % 2 == 1 {
+      sender, recipient = recipient, sender
+    }
+    message := sendTestMessage(t, server, sender, recipient, fmt.Sprintf("message %d", i))
+    sent[message.ID] = message.Content
+  }
+  // Image messages are joined with their metadata, whose id mustn't replace
+  // the message's.
+  image := sendTestImage(t, server)
+  sent[image.ID] = image.Content
+  messages := fetchTestMessages(t, server, "user1", "user2")
+  if len(messages) != len(sent) {
+    t.Fatalf("got %d messages, want %d", len(messages), len(sent))
+  }
+  for i, message := range messages {
+    if sent[message.ID] != message.Content {
+      t.Errorf("message %d has content %q, but was sent with %q", message.ID, message.Content, sent[message.ID])
+    }
+    if i > 0 && message.ID <= messages[i - 1].ID {
+      t.Errorf("message ids %d and %d aren't increasing", messages[i - 1].ID, message.ID)
+    }
+  }
+}
+
+// Fetches one page of the conversation between user1 and user2.
+func fetchTestPage(t *testing.T, server *ChatServer, perPage int, page int) *MessagePage {
+  t.Helper()
+  w := doRequest(server, http.MethodGet, fmt.Sprintf(
+    "/messages?sender=user1&recipient=user2&messagesPerPage=%d&pageToLoad=%d", perPage, page), "")
+  var messagePage MessagePage
+  decodeResponse(t, w, http.StatusOK, &messagePage)
+  return &messagePage
+}
+
+func TestFetchMessagesFullPages(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sendTestMessages(t, server, 10)
+  for page := 0; page < 5; page++ {
+    messagePage := fetchTestPage(t, server, 2, page)
+    if len(messagePage.Messages) != 2 {
+      t.Fatalf("page %d has %d messages, want 2", page, len(messagePage.Messages))
+    }
+    for i, message := range messagePage.Messages {
+      if want := fmt.Sprintf("message %d", page * 2 + i); message.Content != want {
+        t.Errorf("page %d message %d is %q, want %q", page, i, message.Content, want)
+      }
+    }
+  }
+}
+
+func TestFetchMessagesRejectsBadPages(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  tests := []struct {
+    name string
+    query string
+  }{
+    {"negative messagesPerPage", "messagesPerPage=-5&pageToLoad=0"},
+    {"zero messagesPerPage", "messagesPerPage=0&pageToLoad=0"},
+    {"messagesPerPage over the max", fmt.Sprintf("messagesPerPage=%d&pageToLoad=0", MAX_MESSAGES_PER_PAGE + 1)},
+    {"negative pageToLoad", "messagesPerPage=10&pageToLoad=-1"},
+    {"non-numeric messagesPerPage", "messagesPerPage=ten&pageToLoad=0"},
+    {"non-numeric pageToLoad", "messagesPerPage=10&pageToLoad=first"},
+    {"messagesPerPage alone", "messagesPerPage=10"},
+    {"pageToLoad alone", "pageToLoad=0"},
+    {"repeated pageToLoad", "messagesPerPage=10&pageToLoad=0&pageToLoad=1"},
+    {"overflowing offset", fmt.Sprintf("messagesPerPage=%d&pageToLoad=%d", MAX_MESSAGES_PER_PAGE, MAX_PAGE_OFFSET)},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      w := doRequest(server, http.MethodGet, "/messages?sender=user1&recipient=user2&" + test.query, "")
+      expectError(t, w, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+    })
+  }
+}
+
+func TestFetchMessagesPageTotal(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  createTestUser(t, server, "user3")
+  sendTestMessages(t, server, 7)
+  sendTestMessage(t, server, "user2", "user1", "reply")
+  // Other conversations don't count towards the total.
+  sendTestMessage(t, server, "user1", "user3", "elsewhere")
+  messagePage := fetchTestPage(t, server, 5, 0)
+  if messagePage.Total != 8 || messagePage.Page != 0 || messagePage.PerPage != 5 || !messagePage.HasMore {
+    t.Errorf("got total %d, page %d, perPage %d, hasMore %t, want 8, 0, 5, true",
+             messagePage.Total, messagePage.Page, messagePage.PerPage, messagePage.HasMore)
+  }
+  messagePage = fetchTestPage(t, server, 5, 1)
+  if messagePage.Total != 8 || messagePage.HasMore {
+    t.Errorf("got total %d, hasMore %t on the last page, want 8, false", messagePage.Total, messagePage.HasMore)
+  }
+}
+
+func TestFetchMessagesPageBoundaries(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sendTestMessages(t, server, 10)
+  // The last page is partial, and pages past the end are empty.
+  for page, want := range [][]int{{0, 1, 2}, {3, 4, 5}, {6, 7, 8}, {9}, {}} {
+    messagePage := fetchTestPage(t, server, 3, page)
+    if len(messagePage.Messages) != len(want) {
+      t.Errorf("page %d has %d messages, want %d", page, len(messagePage.Messages), len(want))
+      continue
+    }
+    for i, message := range messagePage.Messages {
+      if content := fmt.Sprintf("message %d", want[i]); message.Content != content {
+        t.Errorf("page %d message %d is %q, want %q", page, i, message.Content, content)
+      }
+    }
+  }
+}
+
+func TestMediaMetadataRoundTrips(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  tests := []struct {
+    messageType string
+    content string
+    metadata string
+    want MessageMetadata
+  }{
+    {MESSAGE_TYPE_IMAGE_LINK, "https://example.com/cat.png", `{"width":640, "height":480}`,
+     MessageMetadata{Width: 640, Height: 480}},
+    {MESSAGE_TYPE_VIDEO_LINK, "https://example.com/cat.mp4", `{"length":30, "source":"vimeo"}`,
+     MessageMetadata{Length: 30, Source: "vimeo"}},
+    {MESSAGE_TYPE_FILE, "https://example.com/notes.txt", `{"filename":"notes.txt", "sizeBytes":1024}`,
+     MessageMetadata{Filename: "notes.txt", SizeBytes: 1024}},
+    // Filenames are limited in characters, not bytes.
+    {MESSAGE_TYPE_FILE, "https://example.com/long.txt",
+     fmt.Sprintf(`{"filename":%q}`, strings.Repeat("é", MAX_FILENAME_LENGTH - 4) + ".txt"),
+     MessageMetadata{Filename: strings.Repeat("é", MAX_FILENAME_LENGTH - 4) + ".txt"}},
+    // Fields that don't apply to the message type are dropped.
+    {MESSAGE_TYPE_IMAGE_LINK, "https://example.com/dog.png", `{"width":10, "height":20, "length":30}`,
+     MessageMetadata{Width: 10, Height: 20}},
+  }
+  for _, test := range tests {
+    w := doRequest(server, http.MethodPost, "/messages", fmt.Sprintf(
+      `{"sender":"user1", "recipient":"user2", "messageType":%q, "content":%q, "metadata":%s}`,
+      test.messageType, test.content, test.metadata))
+    decodeResponse(t, w, http.StatusOK, nil)
+  }
+  messages := fetchTestMessages(t, server, "user1", "user2")
+  if len(messages) != len(tests) {
+    t.Fatalf("got %d messages, want %d", len(messages), len(tests))
+  }
+  for i, message := range messages {
+    if message.MessageType != tests[i].messageType || message.Metadata == nil || *message.Metadata != tests[i].want {
+      t.Errorf("message %d is a %s with metadata %+v, want a %s with %+v",
+               i, message.MessageType, message.Metadata, tests[i].messageType, tests[i].want)
+    }
+  }
+}
+
+func TestMediaMetadataRejections(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  tests := []struct {
+    name string
+    messageType string
+    metadata string
+  }{
+    {"image without height", MESSAGE_TYPE_IMAGE_LINK, `{"width":640}`},
+    {"image with negative width", MESSAGE_TYPE_IMAGE_LINK, `{"width":-1, "height":480}`},
+    {"image too wide", MESSAGE_TYPE_IMAGE_LINK, fmt.Sprintf(`{"width":%d, "height":480}`, MAX_METADATA_VALUE + 1)},
+    {"video without source", MESSAGE_TYPE_VIDEO_LINK, `{"length":30}`},
+    {"video without length", MESSAGE_TYPE_VIDEO_LINK, `{"source":"vimeo"}`},
+    {"file without metadata", MESSAGE_TYPE_FILE, `null`},
+    {"file without filename", MESSAGE_TYPE_FILE, `{"sizeBytes":1024}`},
+    {"filename too long", MESSAGE_TYPE_FILE,
+     fmt.Sprintf(`{"filename":%q, "sizeBytes":1024}`, strings.Repeat("a", MAX_FILENAME_LENGTH - 3) + ".txt")},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      w := doRequest(server, http.MethodPost, "/messages", fmt.Sprintf(
+        `{"sender":"user1", "recipient":"user2", "messageType":%q, "content":"https://example.com/a", "metadata":%s}`,
+        test.messageType, test.metadata))
+      expectError(t, w, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+    })
+  }
+  if messages := fetchTestMessages(t, server, "user1", "user2"); len(messages) != 0 {
+    t.Errorf("got %d messages stored, want none", len(messages))
+  }
+}
+
+// A ChatStore whose message queries hang until their context is done, like
+// a stuck db. It records the context's error.
+type stuckStore struct {
+  *MemoryChatStore
+  errs chan error
+}
+
+func (store *stuckStore) FetchMessages(ctx context.Context, params *FetchMessagesParams) ([]*Message, error) {
+  <-ctx.Done()
+  store.errs <- ctx.Err()
+  return nil, ctx.Err()
+}
+
+func TestFetchMessagesTimesOut(t *testing.T) {
+  config := DefaultConfig()
+  config.QueryTimeout = 50 * time.Millisecond
+  store := &stuckStore{NewMemoryChatStore(), make(chan error, 1)}
+  server := newTestServerWithStore(t, store, config)
+  createTestUsers(t, server)
+  start := time.Now()
+  w := doRequest(server, http.MethodGet, "/messages?sender=user1&recipient=user2", "")
+  expectError(t, w, http.StatusInternalServerError, ERROR_CODE_INTERNAL)
+  if elapsed := time.Since(start); elapsed > time.Second {
+    t.Errorf("request took %s with a %s query timeout", elapsed, config.QueryTimeout)
+  }
+  if err := <-store.errs; err != context.DeadlineExceeded {
+    t.Errorf("query context ended with %v, want the deadline", err)
+  }
+}
+
+func TestFetchMessagesCanceledWithRequest(t *testing.T) {
+  store := &stuckStore{NewMemoryChatStore(), make(chan error, 1)}
+  server := newTestServerWithStore(t, store, DefaultConfig())
+  createTestUsers(t, server)
+  // The client going away cancels the query well before the timeout.
+  ctx, cancel := context.WithCancel(context.Background())
+  r := httptest.NewRequest(http.MethodGet, "/messages?sender=user1&recipient=user2", nil).WithContext(ctx)
+  done := make(chan struct{})
+  go func() {
+    server.ServeHTTP(httptest.NewRecorder(), r)
+    close(done)
+  }()
+  cancel()
+  select {
+  case err := <-store.errs:
+    if err != context.Canceled {
+      t.Errorf("query context ended with %v, want it canceled", err)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("query wasn't canceled with the request")
+  }
+  <-done
+}
+
+// Searches user1's messages for q.
+func searchTestMessages(t *testing.T, server *ChatServer, q string) []*Message {
+  t.Helper()
+  w := doRequest(server, http.MethodGet, "/messages/search?username=user1&q=" + url.QueryEscape(q), "")
+  var messages []*Message
+  decodeResponse(t, w, http.StatusOK, &messages)
+  return messages
+}
+
+func TestSearchMessages(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  createTestUser(t, server, "user3")
+  sendTestMessage(t, server, "user1", "user2", "hello there")
+  sendTestMessage(t, server, "user3", "user1", "Hello from user3")
+  sendTestMessage(t, server, "user2", "user3", "hello, not for user1")
+  sendTestMessage(t, server, "user2", "user1", "goodbye")
+  // Only user1's own conversations match, newest first.
+  messages := searchTestMessages(t, server, "hello")
+  if len(messages) != 2 || messages[0].Content != "Hello from user3" || messages[1].Content != "hello there" {
+    t.Errorf("got %+v, want user1's two hellos, newest first", messages)
+  }
+  if messages := searchTestMessages(t, server, "nothing like it"); messages == nil || len(messages) != 0 {
+    t.Errorf("got %+v, want an empty array", messages)
+  }
+}
+
+func TestSearchMessagesSpecialCharacters(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sendTestMessage(t, server, "user1", "user2", "100% sure")
+  sendTestMessage(t, server, "user1", "user2", "1000 times")
+  sendTestMessage(t, server, "user1", "user2", "snake_case")
+  sendTestMessage(t, server, "user1", "user2", "snakeXcase")
+  sendTestMessage(t, server, "user1", "user2", `back\slash`)
+  // Wildcards are matched literally.
+  for q, want := range map[string]string{"0%": "100% sure", "e_c": "snake_case", `\s`: `back\slash`} {
+    messages := searchTestMessages(t, server, q)
+    if len(messages) != 1 || messages[0].Content != want {
+      t.Errorf("%q: got %+v, want only %q", q, messages, want)
+    }
+  }
+}
+
+func TestSearchMessagesRejections(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  tests := []struct {
+    name string
+    query string
+    status int
+    code string
+  }{
+    {"missing username", "q=hello", http.StatusBadRequest, ERROR_CODE_BAD_REQUEST},
+    {"missing q", "username=user1", http.StatusBadRequest, ERROR_CODE_BAD_REQUEST},
+    {"zero limit", "username=user1&q=hello&limit=0", http.StatusBadRequest, ERROR_CODE_BAD_REQUEST},
+    {"limit over the max", fmt.Sprintf("username=user1&q=hello&limit=%d", MESSAGE_SEARCH_LIMIT + 1), http.StatusBadRequest, ERROR_CODE_BAD_REQUEST},
+    {"no such user", "username=nobody&q=hello", http.StatusNotFound, ERROR_CODE_USER_NOT_FOUND},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      w := doRequest(server, http.MethodGet, "/messages/search?" + test.query, "")
+      expectError(t, w, test.status, test.code)
+    })
+  }
+}
+
+func TestSendMessageToMissingRecipient(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUser(t, server, "user1")
+  w := doRequest(server, http.MethodPost, "/messages",
+                 `{"sender":"user1", "recipient":"nobody", "messageType":"plaintext", "content":"Hi there!"}`)
+  expectError(t, w, http.StatusNotFound, ERROR_CODE_USER_NOT_FOUND)
+  // Nor can missing users send messages.
+  w = doRequest(server, http.MethodPost, "/messages",
+                `{"sender":"nobody", "recipient":"user1", "messageType":"plaintext", "content":"Hi there!"}`)
+  expectError(t, w, http.StatusNotFound, ERROR_CODE_USER_NOT_FOUND)
+}
+
+func TestSendMessageReportsDbErrors(t *testing.T) {
+  server := newBrokenTestServer(t)
+  createTestUsers(t, server)
+  w := doRequest(server, http.MethodPost, "/messages",
+                 `{"sender":"user1", "recipient":"user2", "messageType":"plaintext", "content":"Hi there!"}`)
+  expectError(t, w, http.StatusInternalServerError, ERROR_CODE_INTERNAL)
+}
+
+func TestSendMessageToRecipients(t *testing.T) {
+  server, _ := newTestServer(t)
+  for _, username := range []string{"user1", "user2", "user3", "user4"} {
+    createTestUser(t, server, username)
+  }
+  w := doRequest(server, http.MethodPost, "/messages",
+                 `{"sender":"user1", "recipients":["user2", "user3", "user4"], "messageType":"plaintext", "content":"Hi all!"}`)
+  var sent []*Message
+  decodeResponse(t, w, http.StatusOK, &sent)
+  recipients := []string{"user2", "user3", "user4"}
+  if len(sent) != len(recipients) {
+    t.Fatalf("got %d messages, want %d", len(sent), len(recipients))
+  }
+  // One message per recipient, in the order given, each with its own id.
+  ids := make(map[int64]bool)
+  for i, recipient := range recipients {
+    if sent[i].Recipient != recipient || sent[i].Content != "Hi all!" || ids[sent[i].ID] {
+      t.Errorf("message %d is %+v, want a new message to %s", i, sent[i], recipient)
+    }
+    ids[sent[i].ID] = true
+    messages := fetchTestMessages(t, server, "user1", recipient)
+    if len(messages) != 1 || messages[0].ID != sent[i].ID {
+      t.Errorf("%s got %+v, want just message %d", recipient, messages, sent[i].ID)
+    }
+  }
+}
+
+func TestSendMessageToRecipientsIsAllOrNothing(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  createTestUser(t, server, "user3")
+  w := doRequest(server, http.MethodPost, "/messages",
+                 `{"sender":"user1", "recipients":["user2", "nobody", "user3"], "messageType":"plaintext", "content":"Hi all!"}`)
+  expectError(t, w, http.StatusNotFound, ERROR_CODE_USER_NOT_FOUND)
+  for _, recipient := range []string{"user2", "user3"} {
+    if messages := fetchTestMessages(t, server, "user1", recipient); len(messages) != 0 {
+      t.Errorf("%s got %d messages from the failed batch", recipient, len(messages))
+    }
+  }
+}
+
+func TestSendMessageToRecipientsRejections(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  recipients := make([]string, MAX_MESSAGE_RECIPIENTS + 1)
+  for i := range recipients {
+    recipients[i] = fmt.Sprintf("%q", fmt.Sprintf("user%d", i))
+  }
+  for name, targets := range map[string]string{
+    "no recipients": `"recipients":[]`,
+    "too many recipients": `"recipients":[` + strings.Join(recipients, ",") + `]`,
+    "repeated recipient": `"recipients":["user2", "user2"]`,
+    "repeated recipient in another case": `"recipients":["user2", "USER2"]`,
+    "empty recipient": `"recipients":["user2", ""]`,
+    "recipient and recipients": `"recipient":"user2", "recipients":["user2"]`,
+  } {
+    t.Run(name, func(t *testing.T) {
+      w := doRequest(server, http.MethodPost, "/messages",
+                     `{"sender":"user1", ` + targets + `, "messageType":"plaintext", "content":"Hi all!"}`)
+      expectError(t, w, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+    })
+  }
+}
+
+// Marks the message read by reader and returns the response.
+func markTestMessageRead(server *ChatServer, messageId int64, reader string) *httptest.ResponseRecorder {
+  return doRequest(server, http.MethodPost, fmt.Sprintf("/messages/%d/read", messageId), fmt.Sprintf(`{"reader":%q}`, reader))
+}
+
+func TestMarkMessageRead(t *testing.T) {
+  server, store := newTestServer(t)
+  createTestUsers(t, server)
+  sent := sendTestMessage(t, server, "user1", "user2", "Hi there!")
+  if sent.ReadAt != nil {
+    t.Fatalf("new message is already read: %+v", sent)
+  }
+  before := time.Now().UTC().Truncate(time.Second)
+  decodeResponse(t, markTestMessageRead(server, sent.ID, "user2"), http.StatusOK, nil)
+  // The sender sees when it was read.
+  messages := fetchTestMessages(t, server, "user1", "user2")
+  if len(messages) != 1 || messages[0].ReadAt == nil || messages[0].ReadAt.Before(before) ||
+     messages[0].Status != MESSAGE_STATUS_READ {
+    t.Fatalf("got %+v, want the message read since %s", messages, before)
+  }
+
+  // Marking it again keeps the original time. Move it back first, so a new
+  // time would be noticed.
+  readAt := messages[0].ReadAt.Add(-time.Hour)
+  store.mutex.Lock()
+  store.messages[0].ReadAt = &readAt
+  store.mutex.Unlock()
+  decodeResponse(t, markTestMessageRead(server, sent.ID, "user2"), http.StatusOK, nil)
+  messages = fetchTestMessages(t, server, "user1", "user2")
+  if messages[0].ReadAt == nil || !messages[0].ReadAt.Equal(readAt) {
+    t.Errorf("got readAt %v after marking twice, want the original %s", messages[0].ReadAt, readAt)
+  }
+}
+
+func TestMarkMessageReadRejections(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sent := sendTestMessage(t, server, "user1", "user2", "Hi there!")
+  // Only the recipient can mark it read.
+  expectError(t, markTestMessageRead(server, sent.ID, "user1"), http.StatusForbidden, ERROR_CODE_NOT_MESSAGE_RECIPIENT)
+  expectError(t, markTestMessageRead(server, sent.ID + 1, "user2"), http.StatusNotFound, ERROR_CODE_MESSAGE_NOT_FOUND)
+  w := doRequest(server, http.MethodPost, fmt.Sprintf("/messages/%d/read", sent.ID), `{}`)
+  expectError(t, w, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+  if messages := fetchTestMessages(t, server, "user1", "user2"); messages[0].ReadAt != nil {
+    t.Errorf("message was marked read: %+v", messages[0])
+  }
+}
+
+// Counts user1's unread messages, optionally only from one sender.
+func countTestUnread(t *testing.T, server *ChatServer, from string) (count int, bySender map[string]int) {
+  t.Helper()
+  target := "/messages/unread?user=user1"
+  if len(from) > 0 {
+    target += "&from=" + from
+  }
+  var body struct {
+    Count int `json:"count"`
+    BySender map[string]int `json:"bySender"`
+  }
+  decodeResponse(t, doRequest(server, http.MethodGet, target, ""), http.StatusOK, &body)
+  return body.Count, body.BySender
+}
+
+func TestUnreadCounts(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  createTestUser(t, server, "user3")
+  if count, bySender := countTestUnread(t, server, ""); count != 0 || len(bySender) != 0 {
+    t.Errorf("got %d unread %v before any messages, want none", count, bySender)
+  }
+  first := sendTestMessage(t, server, "user2", "user1", "one")
+  sendTestMessage(t, server, "user2", "user1", "two")
+  sendTestMessage(t, server, "user3", "user1", "three")
+  // Messages user1 sent aren't theirs to read.
+  sendTestMessage(t, server, "user1", "user2", "four")
+  count, bySender := countTestUnread(t, server, "")
+  if count != 3 || len(bySender) != 2 || bySender["user2"] != 2 || bySender["user3"] != 1 {
+    t.Errorf("got %d unread %v, want 3 split 2 from user2 and 1 from user3", count, bySender)
+  }
+  if count, _ := countTestUnread(t, server, "user2"); count != 2 {
+    t.Errorf("got %d unread from user2, want 2", count)
+  }
+
+  decodeResponse(t, markTestMessageRead(server, first.ID, "user1"), http.StatusOK, nil)
+  if count, _ := countTestUnread(t, server, "user2"); count != 1 {
+    t.Errorf("got %d unread from user2 after reading one, want 1", count)
+  }
+  w := doRequest(server, http.MethodPut, "/messages/read", `{"reader":"user1", "counterpart":"user2"}`)
+  decodeResponse(t, w, http.StatusOK, nil)
+  // Senders with nothing unread drop out.
+  count, bySender = countTestUnread(t, server, "")
+  if count != 1 || len(bySender) != 1 || bySender["user3"] != 1 {
+    t.Errorf("got %d unread %v after reading user2's, want just 1 from user3", count, bySender)
+  }
+}
+
+// Sends a plaintext reply and returns the response.
+func sendTestReply(server *ChatServer, sender string, recipient string, replyTo int64) *httptest.ResponseRecorder {
+  return doRequest(server, http.MethodPost, "/messages", fmt.Sprintf(
+    `{"sender":%q, "recipient":%q, "messageType":"plaintext", "content":"Me too!", "replyTo":%d}`,
+    sender, recipient, replyTo))
+}
+
+func TestSendReply(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  parent := sendTestMessage(t, server, "user1", "user2", "I like cats")
+  var reply Message
+  decodeResponse(t, sendTestReply(server, "user2", "user1", parent.ID), http.StatusOK, &reply)
+  if reply.ReplyTo == nil || *reply.ReplyTo != parent.ID {
+    t.Errorf("got replyTo %v, want %d", reply.ReplyTo, parent.ID)
+  }
+  // Fetching stays flat and in order, with the parent referenced.
+  messages := fetchTestMessages(t, server, "user1", "user2")
+  if len(messages) != 2 || messages[0].ID != parent.ID || messages[1].ID != reply.ID {
+    t.Fatalf("got %+v, want the parent then the reply", messages)
+  }
+  if messages[0].ReplyTo != nil {
+    t.Errorf("parent has replyTo %d, want none", *messages[0].ReplyTo)
+  }
+  if messages[1].ReplyTo == nil || *messages[1].ReplyTo != parent.ID {
+    t.Errorf("fetched reply has replyTo %v, want %d", messages[1].ReplyTo, parent.ID)
+  }
+}
+
+func TestSendReplyRejections(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  createTestUser(t, server, "user3")
+  parent := sendTestMessage(t, server, "user1", "user2", "I like cats")
+  // Parents that don't exist, or are in another conversation, are rejected.
+  expectError(t, sendTestReply(server, "user2", "user1", parent.ID + 100), http.StatusBadRequest, ERROR_CODE_INVALID_REPLY)
+  expectError(t, sendTestReply(server, "user3", "user1", parent.ID), http.StatusBadRequest, ERROR_CODE_INVALID_REPLY)
+  expectError(t, sendTestReply(server, "user2", "user1", -1), http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+  if messages := fetchTestMessages(t, server, "user1", "user2"); len(messages) != 1 {
+    t.Errorf("got %d messages, want just the parent", len(messages))
+  }
+}
+
+// Fetches the conversation between user1 and user2 with extra query
+// parameters.
+func fetchTestMessagesWith(t *testing.T, server *ChatServer, query string) []*Message {
+  t.Helper()
+  w := doRequest(server, http.MethodGet, "/messages?sender=user1&recipient=user2&" + query, "")
+  var messages []*Message
+  decodeResponse(t, w, http.StatusOK, &messages)
+  return messages
+}
+
+func TestFetchMessagesAfterId(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sendTestMessages(t, server, 5)
+  all := fetchTestMessages(t, server, "user1", "user2")
+  // Only newer messages, oldest first.
+  messages := fetchTestMessagesWith(t, server, fmt.Sprintf("afterId=%d", all[1].ID))
+  if len(messages) != 3 {
+    t.Fatalf("got %d messages after %d, want 3", len(messages), all[1].ID)
+  }
+  for i, message := range messages {
+    if message.ID != all[i + 2].ID {
+      t.Errorf("message %d has id %d, want %d", i, message.ID, all[i + 2].ID)
+    }
+  }
+  // The limit keeps the oldest of the newer messages, so clients can keep
+  // catching up from the last one they got.
+  messages = fetchTestMessagesWith(t, server, fmt.Sprintf("afterId=%d&limit=2", all[1].ID))
+  if len(messages) != 2 || messages[0].ID != all[2].ID || messages[1].ID != all[3].ID {
+    t.Errorf("got %+v, want messages %d and %d", messages, all[2].ID, all[3].ID)
+  }
+  if messages := fetchTestMessagesWith(t, server, fmt.Sprintf("afterId=%d", all[4].ID)); len(messages) != 0 {
+    t.Errorf("got %d messages after the latest, want none", len(messages))
+  }
+}
+
+func TestFetchMessagesAfterIdRejections(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  for _, query := range []string{
+    "afterId=0", "afterId=-1", "afterId=first", "afterId=1&afterId=2",
+    "afterId=1&beforeId=5", "afterId=1&messagesPerPage=10&pageToLoad=0",
+    fmt.Sprintf("afterId=1&limit=%d", MAX_MESSAGES_PER_PAGE + 1),
+  } {
+    w := doRequest(server, http.MethodGet, "/messages?sender=user1&recipient=user2&" + query, "")
+    if w.Code != http.StatusBadRequest {
+      t.Errorf("%s: got status %d, want %d", query, w.Code, http.StatusBadRequest)
+    }
+  }
+}
+
+func TestFetchMessagesTimeRange(t *testing.T) {
+  server, store := newTestServer(t)
+  createTestUsers(t, server)
+  sendTestMessages(t, server, 3)
+  // Spread the messages an hour apart.
+  start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+  store.mutex.Lock()
+  for i, message := range store.messages {
+    message.CreatedAt = start.Add(time.Duration(i) * time.Hour)
+  }
+  store.mutex.Unlock()
+  at := func(hours int) string {
+    return url.QueryEscape(start.Add(time.Duration(hours) * time.Hour).Format(time.RFC3339))
+  }
+  tests := []struct {
+    name string
+    query string
+    want []string
+  }{
+    {"both bounds", "since=" + at(1) + "&until=" + at(1), []string{"message 1"}},
+    {"since only", "since=" + at(1), []string{"message 1", "message 2"}},
+    {"until only", "until=" + at(1), []string{"message 0", "message 1"}},
+    {"between messages", "since=" + url.QueryEscape(start.Add(30 * time.Minute).Format(time.RFC3339)), []string{"message 1", "message 2"}},
+    {"nothing in range", "since=" + at(3), []string{}},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      messages := fetchTestMessagesWith(t, server, test.query)
+      if len(messages) != len(test.want) {
+        t.Fatalf("got %d messages, want %d", len(messages), len(test.want))
+      }
+      for i, message := range messages {
+        if message.Content != test.want[i] {
+          t.Errorf("message %d is %q, want %q", i, message.Content, test.want[i])
+        }
+      }
+    })
+  }
+}
+
+func TestFetchMessagesTimeRangeRejections(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  for _, query := range []string{
+    "since=yesterday", "until=2024-03-01", "since=2024-03-01T12:00:00Z&since=2024-03-01T13:00:00Z",
+    "since=2024-03-01T13:00:00Z&until=2024-03-01T12:00:00Z",
+    "since=2024-03-01T12:00:00Z&messagesPerPage=10&pageToLoad=0",
+  } {
+    w := doRequest(server, http.MethodGet, "/messages?sender=user1&recipient=user2&" + query, "")
+    if w.Code != http.StatusBadRequest {
+      t.Errorf("%s: got status %d, want %d", query, w.Code, http.StatusBadRequest)
+    }
+  }
+}
+
+func TestSelfMessages(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  sendTestMessage(t, server, "user1", "user2", "not to self")
+  for i := 0; i < 3; i++ {
+    sendTestMessage(t, server, "user1", "user1", fmt.Sprintf("note %d", i))
+  }
+  // Each message comes back exactly once, from and to user1.
+  messages := fetchTestMessages(t, server, "user1", "user1")
+  if len(messages) != 3 {
+    t.Fatalf("got %d self-messages, want 3", len(messages))
+  }
+  for i, message := range messages {
+    if message.Content != fmt.Sprintf("note %d", i) || message.Sender != "user1" || message.Recipient != "user1" {
+      t.Errorf("message %d is %+v, want note %d from user1 to user1", i, message, i)
+    }
+  }
+}
+
+func TestSelfMessagesDisallowed(t *testing.T) {
+  config := DefaultConfig()
+  config.AllowSelfMessages = false
+  server, _ := newTestServerWithConfig(t, config)
+  createTestUser(t, server, "user1")
+  // Usernames are case insensitive, so other casings are still yourself.
+  for _, targets := range []string{
+    `"recipient":"user1"`,
+    `"recipient":"User1"`,
+    `"recipients":["USER1"]`,
+  } {
+    w := doRequest(server, http.MethodPost, "/messages",
+                   `{"sender":"user1", ` + targets + `, "messageType":"plaintext", "content":"note"}`)
+    expectError(t, w, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+  }
+}
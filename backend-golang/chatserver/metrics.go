@@ -0,0 +1,80 @@
+package chatserver
+
+import (
+  "time"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Prefix of every metric's name.
+const METRICS_NAMESPACE = "chat"
+
+// Prometheus metrics recorded by the server, served at /metrics.
+// Each server has its own registry, so several servers can coexist in one
+// process.
+type serverMetrics struct {
+  registry *prometheus.Registry
+  // Requests by handler pattern, e.g. "/messages", and status code.
+  requests *prometheus.CounterVec
+  // Stored messages by message type. A message sent to several recipients
+  // counts once per recipient.
+  messagesSent *prometheus.CounterVec
+  usersCreated prometheus.Counter
+}
+
+// Factory for the server's metrics. The store's metrics are registered too
+// if it has any, see ChatSQLClient.Collect.
+func newServerMetrics(store ChatStore) *serverMetrics {
+  metrics := &serverMetrics{
+    registry: prometheus.NewRegistry(),
+    requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+      Namespace: METRICS_NAMESPACE,
+      Name: "http_requests_total",
+      Help: "HTTP requests handled, by handler and status code.",
+    }, []string{"handler", "code"}),
+    messagesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+      Namespace: METRICS_NAMESPACE,
+      Name: "messages_sent_total",
+      Help: "Messages stored, by message type.",
+    }, []string{"type"}),
+    usersCreated: prometheus.NewCounter(prometheus.CounterOpts{
+      Namespace: METRICS_NAMESPACE,
+      Name: "users_created_total",
+      Help: "Users created.",
+    }),
+  }
+  metrics.registry.MustRegister(metrics.requests, metrics.messagesSent, metrics.usersCreated,
+                                collectors.NewGoCollector(),
+                                collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+  if collector, ok := store.(prometheus.Collector); ok {
+    metrics.registry.MustRegister(collector)
+  }
+  return metrics
+}
+
+// Factory for the histogram of db call durations, by ChatSQLClient method.
+func newQueryDurationMetric() *prometheus.HistogramVec {
+  return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Namespace: METRICS_NAMESPACE,
+    Name: "db_query_duration_seconds",
+    Help: "Time taken by db calls, by store method, including retries.",
+    Buckets: prometheus.DefBuckets,
+  }, []string{"method"})
+}
+
+// Records how long the named store method took since start. Meant to be
+// deferred at the top of the method.
+func (client *ChatSQLClient) observeQuery(method string, start time.Time) {
+  client.queryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// Describe and Collect make ChatSQLClient a prometheus.Collector, so the
+// server registers its metrics alongside its own.
+func (client *ChatSQLClient) Describe(descs chan<- *prometheus.Desc) {
+  client.queryDuration.Describe(descs)
+}
+
+func (client *ChatSQLClient) Collect(metrics chan<- prometheus.Metric) {
+  client.queryDuration.Collect(metrics)
+}
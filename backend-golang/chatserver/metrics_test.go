@@ -0,0 +1,84 @@
+package chatserver
+
+import (
+  "bufio"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+)
+
+// Scrapes the server's /metrics and returns each sample's value by its name
+// and labels, as written in the text format, e.g.
+// `chat_users_created_total` or `chat_messages_sent_total{type="plaintext"}`.
+func scrapeMetrics(t *testing.T, handler http.Handler) map[string]float64 {
+  t.Helper()
+  w := doRequest(handler, http.MethodGet, "/metrics", "")
+  if w.Code != http.StatusOK {
+    t.Fatalf("got status %d from /metrics", w.Code)
+  }
+  samples := make(map[string]float64)
+  scanner := bufio.NewScanner(w.Body)
+  for scanner.Scan() {
+    line := scanner.Text()
+    if strings.HasPrefix(line, "#") {
+      continue
+    }
+    separator := strings.LastIndex(line, " ")
+    if separator < 0 {
+      continue
+    }
+    value, err := strconv.ParseFloat(line[separator + 1:], 64)
+    if err != nil {
+      t.Fatalf("couldn't parse sample %q", line)
+    }
+    samples[line[:separator]] = value
+  }
+  return samples
+}
+
+func TestMetricsCountRequests(t *testing.T) {
+  server, _ := newTestServer(t)
+  // Requests are counted by the middleware Start adds.
+  handler := server.logRequests(server)
+  before := scrapeMetrics(t, handler)
+  for _, username := range []string{"user1", "user2"} {
+    w := doRequest(handler, http.MethodPost, "/users", fmt.Sprintf(`{"username":%q, "password":%q}`, username, TEST_PASSWORD))
+    decodeResponse(t, w, http.StatusOK, nil)
+  }
+  for i := 0; i < 3; i++ {
+    sendTestMessage(t, server, "user1", "user2", "Hi there!")
+  }
+  sendTestImage(t, server)
+  doRequest(handler, http.MethodGet, "/messages?sender=user1&recipient=nobody", "")
+  doRequest(handler, http.MethodGet, "/messages?sender=user1&recipient=user2", "")
+  after := scrapeMetrics(t, handler)
+  for sample, want := range map[string]float64{
+    `chat_users_created_total`: 2,
+    `chat_messages_sent_total{type="plaintext"}`: 3,
+    `chat_messages_sent_total{type="image_link"}`: 1,
+    `chat_http_requests_total{code="404",handler="/messages"}`: 1,
+    `chat_http_requests_total{code="200",handler="/messages"}`: 1,
+    `chat_http_requests_total{code="200",handler="/users"}`: 2,
+  } {
+    if got := after[sample] - before[sample]; got != want {
+      t.Errorf("%s went up by %v, want %v", sample, got, want)
+    }
+  }
+}
+
+func TestMetricsIncludeStoreQueries(t *testing.T) {
+  client := &ChatSQLClient{queryDuration: newQueryDurationMetric()}
+  client.observeQuery("AddMessage", time.Now().Add(-time.Millisecond))
+  client.observeQuery("AddMessage", time.Now())
+  server := newTestServerWithStore(t, client, DefaultConfig())
+  samples := scrapeMetrics(t, server)
+  if got := samples[`chat_db_query_duration_seconds_count{method="AddMessage"}`]; got != 2 {
+    t.Errorf("got %v AddMessage queries, want 2", got)
+  }
+  if got := samples[`chat_db_query_duration_seconds_sum{method="AddMessage"}`]; got < 0.001 {
+    t.Errorf("got %vs spent in AddMessage, want at least a millisecond", got)
+  }
+}
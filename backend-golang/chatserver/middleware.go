@@ -0,0 +1,170 @@
+package chatserver
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "net"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Wraps an http.ResponseWriter to remember the status code of the response.
+type statusRecorder struct {
+  http.ResponseWriter
+  status int
+}
+
+// Records the status before passing it on.
+func (recorder *statusRecorder) WriteHeader(status int) {
+  recorder.status = status
+  recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Lets WebSocket upgrades take over the connection through the recorder.
+func (recorder *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  hijacker, ok := recorder.ResponseWriter.(http.Hijacker)
+  if !ok {
+    return nil, nil, errors.New("response writer doesn't support hijacking")
+  }
+  recorder.status = http.StatusSwitchingProtocols
+  return hijacker.Hijack()
+}
+
+// Middleware that logs the method, path, status and duration of every
+// request, and counts it by handler and status.
+func (server *ChatServer) logRequests(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    start := time.Now()
+    // Handlers that never call WriteHeader respond with 200.
+    recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+    next.ServeHTTP(recorder, r)
+    server.logger.Infof("%s %s %d %s", r.Method, r.URL.Path, recorder.status, time.Since(start))
+    // Label by the matched pattern rather than the path, since paths like
+    // /messages/{id} would give every message its own series.
+    _, pattern := server.mux.Handler(r)
+    server.metrics.requests.WithLabelValues(pattern, strconv.Itoa(recorder.status)).Inc()
+  })
+}
+
+// Message of the response to requests that time out.
+const REQUEST_TIMEOUT_MESSAGE = "request timeout"
+
+// Middleware that answers with a 503 if the handler takes longer than the
+// config's RequestTimeout. The request's context is canceled at the same
+// time, so its db queries give up too. WebSocket connections at /ws are
+// long-lived, and need to hijack the connection, so they're passed through.
+func (server *ChatServer) limitRequestTime(next http.Handler) http.Handler {
+  if server.config.RequestTimeout <= 0 {
+    return next
+  }
+  body, _ := json.Marshal(&errorBody{
+    Error: errorDetails{Message: REQUEST_TIMEOUT_MESSAGE, Code: ERROR_CODE_REQUEST_TIMEOUT},
+  })
+  timeoutHandler := http.TimeoutHandler(next, server.config.RequestTimeout, string(body))
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/ws" {
+      next.ServeHTTP(w, r)
+      return
+    }
+    timeoutHandler.ServeHTTP(&timeoutResponseWriter{ResponseWriter: w}, r)
+  })
+}
+
+// Wraps the http.ResponseWriter given to http.TimeoutHandler, which doesn't
+// set a Content-Type on its timeout response.
+type timeoutResponseWriter struct {
+  http.ResponseWriter
+}
+
+// Marks a 503 without a Content-Type, i.e. the timeout response, as JSON.
+func (w *timeoutResponseWriter) WriteHeader(status int) {
+  if status == http.StatusServiceUnavailable && len(w.Header().Get("Content-Type")) == 0 {
+    w.Header().Set("Content-Type", "application/json")
+  }
+  w.ResponseWriter.WriteHeader(status)
+}
+
+// Methods and headers cross-origin requests may use.
+const CORS_ALLOWED_METHODS = "GET, POST, PUT, DELETE, OPTIONS"
+const CORS_ALLOWED_HEADERS = "Content-Type, Authorization"
+
+// Middleware that adds CORS headers for requests from allowed origins, so
+// the React frontend can call the API from a different origin.
+// Preflight (OPTIONS) requests are answered here with a 204, or a 403 if
+// the origin isn't allowed. If the config allows credentials, browsers are
+// told they may send them too.
+func (server *ChatServer) cors(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    origin := r.Header.Get("Origin")
+    allowed := len(origin) > 0 && server.originAllowed(origin)
+    if allowed {
+      w.Header().Set("Access-Control-Allow-Origin", origin)
+      w.Header().Set("Access-Control-Allow-Methods", CORS_ALLOWED_METHODS)
+      w.Header().Set("Access-Control-Allow-Headers", CORS_ALLOWED_HEADERS)
+      if server.config.AllowCredentials {
+        w.Header().Set("Access-Control-Allow-Credentials", "true")
+      }
+    }
+    // The response depends on the Origin, so caches must key on it.
+    w.Header().Add("Vary", "Origin")
+    if r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+      if !allowed {
+        errorResponse(w, http.StatusForbidden, "origin not allowed", ERROR_CODE_ORIGIN_NOT_ALLOWED)
+        return
+      }
+      w.WriteHeader(http.StatusNoContent)
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+// Returns whether the origin is in the configured allowlist.
+func (server *ChatServer) originAllowed(origin string) bool {
+  for _, allowed := range server.config.AllowedOrigins {
+    if allowed == "*" || allowed == origin {
+      return true
+    }
+  }
+  return false
+}
+
+// Middleware that rate limits POST requests by client IP. Clients over the
+// limit get a 429 with a Retry-After header. Other methods pass through.
+func (server *ChatServer) limitPostsByIP(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+      next.ServeHTTP(w, r)
+      return
+    }
+    ip := server.clientIP(r)
+    if ok, retryAfter := server.ipLimiter.allow(ip); !ok {
+      server.logger.Warnf("Rate limiting %s %s from %s", r.Method, r.URL.Path, ip)
+      tooManyRequests(w, "too many requests, try again later", retryAfter)
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+// Returns the IP of the client making the request. Behind a trusted proxy,
+// that's the last address in X-Forwarded-For, which the proxy appended.
+// Earlier addresses come from the client, which can set them to anything.
+func (server *ChatServer) clientIP(r *http.Request) string {
+  if server.config.TrustProxy {
+    if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+      addresses := strings.Split(forwarded[len(forwarded)-1], ",")
+      if last := strings.TrimSpace(addresses[len(addresses)-1]); len(last) > 0 {
+        return last
+      }
+    }
+  }
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    return r.RemoteAddr
+  }
+  return host
+}
@@ -0,0 +1,113 @@
+package chatserver
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+// Sends a request from origin through the CORS middleware. Preflights ask
+// whether a POST is allowed.
+func doCORSRequest(server *ChatServer, method string, origin string) *httptest.ResponseRecorder {
+  header := http.Header{"Origin": {origin}}
+  if method == http.MethodOptions {
+    header.Set("Access-Control-Request-Method", http.MethodPost)
+  }
+  return doRequestWithHeader(server.cors(server), method, "/users/exists?username=user1", "", header)
+}
+
+func TestCORSPreflight(t *testing.T) {
+  server, _ := newTestServer(t)
+  w := doCORSRequest(server, http.MethodOptions, "http://localhost:3000")
+  if w.Code != http.StatusNoContent {
+    t.Fatalf("got status %d, want %d", w.Code, http.StatusNoContent)
+  }
+  for header, want := range map[string]string{
+    "Access-Control-Allow-Origin": "http://localhost:3000",
+    "Access-Control-Allow-Methods": CORS_ALLOWED_METHODS,
+    "Access-Control-Allow-Headers": CORS_ALLOWED_HEADERS,
+    "Vary": "Origin",
+  } {
+    if got := w.Header().Get(header); got != want {
+      t.Errorf("got %s %q, want %q", header, got, want)
+    }
+  }
+  // Credentials weren't allowed in the config.
+  if got := w.Header().Get("Access-Control-Allow-Credentials"); len(got) > 0 {
+    t.Errorf("got Access-Control-Allow-Credentials %q, want none", got)
+  }
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+  server, _ := newTestServer(t)
+  w := doCORSRequest(server, http.MethodOptions, "http://evil.example.com")
+  expectError(t, w, http.StatusForbidden, ERROR_CODE_ORIGIN_NOT_ALLOWED)
+  if got := w.Header().Get("Access-Control-Allow-Origin"); len(got) > 0 {
+    t.Errorf("got Access-Control-Allow-Origin %q on a preflight from a disallowed origin", got)
+  }
+  // Other requests are still served, but browsers won't let the page read
+  // the response.
+  w = doCORSRequest(server, http.MethodGet, "http://evil.example.com")
+  if w.Code != http.StatusOK {
+    t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+  }
+  if got := w.Header().Get("Access-Control-Allow-Origin"); len(got) > 0 {
+    t.Errorf("got Access-Control-Allow-Origin %q for a disallowed origin", got)
+  }
+}
+
+func TestCORSAllowedOriginRequest(t *testing.T) {
+  config := DefaultConfig()
+  config.AllowedOrigins = []string{"https://chat.example.com"}
+  config.AllowCredentials = true
+  server, _ := newTestServerWithConfig(t, config)
+  w := doCORSRequest(server, http.MethodGet, "https://chat.example.com")
+  if w.Code != http.StatusOK {
+    t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+  }
+  if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://chat.example.com" {
+    t.Errorf("got Access-Control-Allow-Origin %q, want the request's origin", got)
+  }
+  if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+    t.Errorf("got Access-Control-Allow-Credentials %q, want true", got)
+  }
+  // The default localhost origins are no longer allowed.
+  w = doCORSRequest(server, http.MethodOptions, "http://localhost:3000")
+  expectError(t, w, http.StatusForbidden, ERROR_CODE_ORIGIN_NOT_ALLOWED)
+}
+
+func TestRequestTimeout(t *testing.T) {
+  config := DefaultConfig()
+  config.RequestTimeout = 50 * time.Millisecond
+  store := &stuckStore{NewMemoryChatStore(), make(chan error, 1)}
+  server := newTestServerWithStore(t, store, config)
+  createTestUsers(t, server)
+  start := time.Now()
+  w := doRequest(server.limitRequestTime(server), http.MethodGet, "/messages?sender=user1&recipient=user2", "")
+  expectError(t, w, http.StatusServiceUnavailable, ERROR_CODE_REQUEST_TIMEOUT)
+  if got := w.Header().Get("Content-Type"); got != "application/json" {
+    t.Errorf("got Content-Type %q, want application/json", got)
+  }
+  if elapsed := time.Since(start); elapsed > time.Second {
+    t.Errorf("request took %s with a %s timeout", elapsed, config.RequestTimeout)
+  }
+  // The slow query was canceled along with the request.
+  if err := <-store.errs; err != context.Canceled && err != context.DeadlineExceeded {
+    t.Errorf("query context ended with %v, want it canceled", err)
+  }
+}
+
+func TestRequestTimeoutLeavesFastRequests(t *testing.T) {
+  config := DefaultConfig()
+  config.RequestTimeout = time.Second
+  server, _ := newTestServerWithConfig(t, config)
+  createTestUsers(t, server)
+  w := doRequest(server.limitRequestTime(server), http.MethodGet, "/users/exists?username=user1", "")
+  var body map[string]bool
+  decodeResponse(t, w, http.StatusOK, &body)
+  if !body["exists"] {
+    t.Errorf("got %v, want user1 to exist", body)
+  }
+}
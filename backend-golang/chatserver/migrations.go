@@ -0,0 +1,274 @@
+package chatserver
+
+import (
+  "context"
+  "database/sql"
+  "embed"
+  "errors"
+  "fmt"
+  "path"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// Schema migrations, applied in order of the number their filename starts
+// with, e.g. 0002_add_profiles.sql. Each file holds one or more statements
+// separated by semicolons at the end of a line. Lines starting with # are
+// comments.
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Upgrades the tables created by the original db/sql/init.sql to match
+// migration INIT_SCHEMA_VERSION.
+//go:embed migrations/baseline/upgrade.sql
+var baselineUpgrade string
+
+// Records which migrations have been applied to the db.
+const CREATE_SCHEMA_MIGRATIONS = `CREATE TABLE IF NOT EXISTS schema_migrations(` +
+                                   `version INT NOT NULL, ` +
+                                   `applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP, ` +
+                                   `PRIMARY KEY (version))`
+const SELECT_APPLIED_MIGRATIONS = "SELECT version FROM schema_migrations"
+const INSERT_APPLIED_MIGRATION = "INSERT INTO schema_migrations(version) VALUES(?)"
+
+// Named lock held while migrating, so that servers starting at the same time
+// don't apply the same migration twice.
+const MIGRATIONS_LOCK_NAME = "chat_schema_migrations"
+const MIGRATIONS_LOCK_TIMEOUT_SECONDS = 60
+const GET_MIGRATIONS_LOCK = "SELECT GET_LOCK(?, ?)"
+const RELEASE_MIGRATIONS_LOCK = "SELECT RELEASE_LOCK(?)"
+
+// Before the server managed the schema, MySQL created the tables from
+// db/sql/init.sql when it first created its volume. The last version of
+// init.sql matches 0001_init.sql, so dbs it created start at migration 1.
+// Dbs created by the original init.sql, version 0, are upgraded to it first.
+const INIT_SCHEMA_VERSION = 1
+const BASELINE_SCHEMA_VERSION = 0
+const COUNT_USERS_TABLE = `SELECT COUNT(*) FROM information_schema.tables ` +
+                          `WHERE table_schema=DATABASE() AND table_name='users'`
+// parent_message_id was the last column added to init.sql, so dbs without it
+// were created by an older version.
+const COUNT_INIT_SCHEMA_LATEST_COLUMN = `SELECT COUNT(*) FROM information_schema.columns ` +
+                                        `WHERE table_schema=DATABASE() AND table_name='messages' ` +
+                                        `AND column_name='parent_message_id'`
+const SELECT_MESSAGES_COLUMNS = `SELECT column_name FROM information_schema.columns ` +
+                                `WHERE table_schema=DATABASE() AND table_name='messages'`
+// The columns of messages in the original init.sql.
+var BASELINE_MESSAGES_COLUMNS = []string{
+  "id", "sender_id", "recipient_id", "message_type", "message_content", "message_metadata_id",
+}
+
+// One schema migration.
+type migration struct {
+  version int
+  name string
+  statements []string
+}
+
+// Creates or upgrades the db's tables by applying any embedded migrations
+// that haven't been applied yet.
+// MySQL commits each schema change as it goes, so a migration that fails
+// part way through has to be cleaned up by hand before retrying.
+func (client *ChatSQLClient) Migrate(ctx context.Context) error {
+  migrations, err := loadMigrations()
+  if err != nil {
+    return err
+  }
+  // GET_LOCK belongs to the connection, so do everything on one.
+  conn, err := client.db.Conn(ctx)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  var locked sql.NullInt64
+  err = conn.QueryRowContext(ctx, GET_MIGRATIONS_LOCK, MIGRATIONS_LOCK_NAME,
+                             MIGRATIONS_LOCK_TIMEOUT_SECONDS).Scan(&locked)
+  if err != nil {
+    return err
+  }
+  if locked.Int64 != 1 {
+    return errors.New("timed out waiting for another server to finish migrating the db")
+  }
+  defer conn.ExecContext(context.Background(), RELEASE_MIGRATIONS_LOCK, MIGRATIONS_LOCK_NAME)
+  if _, err = conn.ExecContext(ctx, CREATE_SCHEMA_MIGRATIONS); err != nil {
+    return err
+  }
+  applied, err := appliedMigrations(ctx, conn)
+  if err != nil {
+    return err
+  }
+  if len(applied) == 0 {
+    if err = client.adoptInitSchema(ctx, conn, applied); err != nil {
+      return err
+    }
+  }
+  for _, m := range migrations {
+    if applied[m.version] {
+      continue
+    }
+    client.logger.Infof("Applying db migration %s", m.name)
+    for _, statement := range m.statements {
+      if _, err = conn.ExecContext(ctx, statement); err != nil {
+        return errors.New(fmt.Sprintf("migration %s failed: %s", m.name, err.Error()))
+      }
+    }
+    if _, err = conn.ExecContext(ctx, INSERT_APPLIED_MIGRATION, m.version); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Records migration INIT_SCHEMA_VERSION as applied if the db's tables were
+// created by db/sql/init.sql, so that later migrations upgrade them instead
+// of 0001_init.sql failing on tables that already exist. Tables created by
+// the original init.sql are upgraded to match 0001_init.sql first.
+// Returns an error if they were created by any other version, which has to
+// be brought up to date by hand.
+func (client *ChatSQLClient) adoptInitSchema(ctx context.Context, conn *sql.Conn, applied map[int]bool) error {
+  var tables, columns int
+  if err := conn.QueryRowContext(ctx, COUNT_USERS_TABLE).Scan(&tables); err != nil {
+    return err
+  }
+  if tables == 0 {
+    return nil
+  }
+  if err := conn.QueryRowContext(ctx, COUNT_INIT_SCHEMA_LATEST_COLUMN).Scan(&columns); err != nil {
+    return err
+  }
+  if columns == 0 {
+    baseline, err := isBaselineSchema(ctx, conn)
+    if err != nil {
+      return err
+    }
+    if !baseline {
+      return errors.New("the db's tables were created by an old db/sql/init.sql, " +
+                        "update them to match migrations/0001_init.sql before starting the server")
+    }
+    client.logger.Infof("Found tables created by the original db/sql/init.sql, upgrading them from version %d",
+                        BASELINE_SCHEMA_VERSION)
+    for _, statement := range splitStatements(baselineUpgrade) {
+      if _, err = conn.ExecContext(ctx, statement); err != nil {
+        return errors.New(fmt.Sprintf("upgrading the original init.sql tables failed: %s", err.Error()))
+      }
+    }
+  }
+  client.logger.Infof("Found tables created by db/sql/init.sql, recording migration %d as applied", INIT_SCHEMA_VERSION)
+  if _, err := conn.ExecContext(ctx, INSERT_APPLIED_MIGRATION, INIT_SCHEMA_VERSION); err != nil {
+    return err
+  }
+  applied[INIT_SCHEMA_VERSION] = true
+  return nil
+}
+
+// Returns whether the messages table has exactly the columns the original
+// init.sql gave it.
+func isBaselineSchema(ctx context.Context, conn *sql.Conn) (bool, error) {
+  rows, err := conn.QueryContext(ctx, SELECT_MESSAGES_COLUMNS)
+  if err != nil {
+    return false, err
+  }
+  defer rows.Close()
+  columns := make(map[string]bool)
+  for rows.Next() {
+    var column string
+    if err := rows.Scan(&column); err != nil {
+      return false, err
+    }
+    columns[strings.ToLower(column)] = true
+  }
+  if err := rows.Err(); err != nil {
+    return false, err
+  }
+  if len(columns) != len(BASELINE_MESSAGES_COLUMNS) {
+    return false, nil
+  }
+  for _, column := range BASELINE_MESSAGES_COLUMNS {
+    if !columns[column] {
+      return false, nil
+    }
+  }
+  return true, nil
+}
+
+// Returns the versions of the migrations already applied.
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+  rows, err := conn.QueryContext(ctx, SELECT_APPLIED_MIGRATIONS)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  applied := make(map[int]bool)
+  for rows.Next() {
+    var version int
+    if err := rows.Scan(&version); err != nil {
+      return nil, err
+    }
+    applied[version] = true
+  }
+  return applied, rows.Err()
+}
+
+// Reads the embedded migrations, sorted by version.
+func loadMigrations() ([]*migration, error) {
+  names, err := migrationFiles.ReadDir("migrations")
+  if err != nil {
+    return nil, err
+  }
+  var migrations []*migration
+  versions := make(map[int]string)
+  for _, entry := range names {
+    name := entry.Name()
+    prefix, _, found := strings.Cut(name, "_")
+    version, err := strconv.Atoi(prefix)
+    if !found || err != nil || version < 1 {
+      return nil, errors.New(fmt.Sprintf("migration %s should be named like 0001_description.sql", name))
+    }
+    if other, ok := versions[version]; ok {
+      return nil, errors.New(fmt.Sprintf("migrations %s and %s have the same version", other, name))
+    }
+    versions[version] = name
+    contents, err := migrationFiles.ReadFile(path.Join("migrations", name))
+    if err != nil {
+      return nil, err
+    }
+    migrations = append(migrations, &migration{
+      version: version,
+      name: name,
+      statements: splitStatements(string(contents)),
+    })
+  }
+  sort.Slice(migrations, func(i, j int) bool {
+    return migrations[i].version < migrations[j].version
+  })
+  return migrations, nil
+}
+
+// Splits a migration into statements, since the driver runs one at a time.
+// Drops comment lines, and statements that are empty without them.
+func splitStatements(contents string) (statements []string) {
+  var current []string
+  for _, line := range strings.Split(contents, "\n") {
+    trimmed := strings.TrimSpace(line)
+    if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+      continue
+    }
+    if strings.HasSuffix(trimmed, ";") {
+      if rest := strings.TrimSpace(strings.TrimSuffix(trimmed, ";")); len(rest) > 0 {
+        current = append(current, rest)
+      }
+      if len(current) > 0 {
+        statements = append(statements, strings.Join(current, "\n"))
+      }
+      current = nil
+      continue
+    }
+    current = append(current, trimmed)
+  }
+  // Allow the last statement to leave out its semicolon.
+  if len(current) > 0 {
+    statements = append(statements, strings.Join(current, "\n"))
+  }
+  return statements
+}
@@ -0,0 +1,102 @@
+# Initial schema. Later changes go in new, higher numbered files, never in
+# this one, since it has already run on existing dbs.
+#
+# There are 6 tables to keep track of the data for this chat app.
+# - users
+# - rooms
+# - room_members
+# - messages
+# - messages_metadata
+# - reactions
+# Each is defined and described below.
+
+# Stores users and their hashed passwords.
+# The bcrypt hash already contains the salt used to generate it, so there is
+# no separate salt column.
+# Usernames are limited to 64 chars, the server may enforce a lower limit.
+CREATE TABLE users(
+  id INT NOT NULL AUTO_INCREMENT,
+  username VARCHAR(64) NOT NULL UNIQUE,
+  hash BINARY(60) NOT NULL,
+  PRIMARY KEY (id)
+);
+# Create index for username since that will be the most used query.
+CREATE INDEX user_idx on users(username);
+
+# Stores rooms for group chats.
+CREATE TABLE rooms(
+  id INT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(64) NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (id)
+);
+
+# Stores which users are members of which rooms.
+CREATE TABLE room_members(
+  room_id INT NOT NULL,
+  user_id INT NOT NULL,
+  PRIMARY KEY (room_id, user_id),
+  FOREIGN KEY (room_id) REFERENCES rooms(id),
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
+# Create index for user since rooms are listed per user.
+CREATE INDEX room_member_user_idx on room_members(user_id);
+
+# Stores all messages.
+# Store user ids not usernames because we may want to allow changes to usernames.
+# Each message goes to either a user (recipient_id) or a room
+# (recipient_room_id), the other is NULL.
+CREATE TABLE messages(
+  id INT NOT NULL AUTO_INCREMENT,
+  sender_id INT NOT NULL,
+  recipient_id INT NULL,
+  recipient_room_id INT NULL,
+  message_type ENUM('plaintext', 'image_link', 'video_link', 'file') NOT NULL,
+  message_content TEXT NOT NULL,
+  message_metadata_id INT,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  edited_at DATETIME NULL,
+  read_at DATETIME NULL,
+  # The message this one replies to, if any. Replies outlive their parent.
+  parent_message_id INT NULL,
+  PRIMARY KEY (id),
+  FOREIGN KEY (sender_id) REFERENCES users(id),
+  FOREIGN KEY (recipient_id) REFERENCES users(id),
+  FOREIGN KEY (recipient_room_id) REFERENCES rooms(id),
+  FOREIGN KEY (parent_message_id) REFERENCES messages(id) ON DELETE SET NULL
+);
+# Create index for sender and recipient to improve performance of recovering
+# message history between two people.
+CREATE INDEX sender_recipient_idx on messages(sender_id, recipient_id);
+# Create index for room to improve performance of recovering a room's history.
+CREATE INDEX recipient_room_idx on messages(recipient_room_id);
+
+# Stores optional metadata for messages, so that not every row in the messages
+# table needs to have these fields available.
+# Messages that are image links need a width and height.
+# Messages that are video links need a length and source.
+# Messages that are files need a filename and size in bytes.
+CREATE TABLE messages_metadata (
+  id INT NOT NULL AUTO_INCREMENT,
+  width SMALLINT,
+  height SMALLINT,
+  length SMALLINT,
+  source VARCHAR(16),
+  filename VARCHAR(255),
+  size_bytes BIGINT,
+  PRIMARY KEY (id)
+);
+
+# Stores emoji reactions to messages.
+# Each user can react to a message with each emoji at most once.
+# Reactions are deleted along with their message.
+CREATE TABLE reactions (
+  id INT NOT NULL AUTO_INCREMENT,
+  message_id INT NOT NULL,
+  user_id INT NOT NULL,
+  emoji VARCHAR(32) CHARACTER SET utf8mb4 NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY message_user_emoji_idx (message_id, user_id, emoji),
+  FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
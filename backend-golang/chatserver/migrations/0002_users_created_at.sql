@@ -0,0 +1,3 @@
+# Records when each user signed up, for profiles. Users created before this
+# migration get the time it ran.
+ALTER TABLE users ADD COLUMN created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP;
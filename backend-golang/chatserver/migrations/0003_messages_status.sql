@@ -0,0 +1,5 @@
+# Tracks whether each direct message has only been sent, has been delivered
+# to one of the recipient's devices, or has been read. Messages read before
+# this migration start out read.
+ALTER TABLE messages ADD COLUMN status ENUM('sent', 'delivered', 'read') NOT NULL DEFAULT 'sent';
+UPDATE messages SET status='read' WHERE read_at IS NOT NULL;
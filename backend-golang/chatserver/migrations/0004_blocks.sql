@@ -0,0 +1,10 @@
+# Records which users have blocked which. A blocked user can't send direct
+# messages to whoever blocked them, but messages already sent stay.
+CREATE TABLE blocks(
+  blocker_id INT NOT NULL,
+  blocked_id INT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (blocker_id, blocked_id),
+  FOREIGN KEY (blocker_id) REFERENCES users(id),
+  FOREIGN KEY (blocked_id) REFERENCES users(id)
+);
@@ -0,0 +1,49 @@
+# Upgrades the tables created by the original db/sql/init.sql, version 0, to
+# match 0001_init.sql. Run instead of 0001_init.sql on those dbs.
+# Existing messages get the time this runs as their created_at, since when
+# they were sent was never recorded.
+
+ALTER TABLE users MODIFY username VARCHAR(64) NOT NULL;
+
+CREATE TABLE rooms(
+  id INT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(64) NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (id)
+);
+
+CREATE TABLE room_members(
+  room_id INT NOT NULL,
+  user_id INT NOT NULL,
+  PRIMARY KEY (room_id, user_id),
+  FOREIGN KEY (room_id) REFERENCES rooms(id),
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX room_member_user_idx on room_members(user_id);
+
+ALTER TABLE messages
+  MODIFY recipient_id INT NULL,
+  ADD COLUMN recipient_room_id INT NULL AFTER recipient_id,
+  MODIFY message_type ENUM('plaintext', 'image_link', 'video_link', 'file') NOT NULL,
+  ADD COLUMN created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  ADD COLUMN edited_at DATETIME NULL,
+  ADD COLUMN read_at DATETIME NULL,
+  ADD COLUMN parent_message_id INT NULL,
+  ADD FOREIGN KEY (recipient_room_id) REFERENCES rooms(id),
+  ADD FOREIGN KEY (parent_message_id) REFERENCES messages(id) ON DELETE SET NULL;
+CREATE INDEX recipient_room_idx on messages(recipient_room_id);
+
+ALTER TABLE messages_metadata
+  ADD COLUMN filename VARCHAR(255),
+  ADD COLUMN size_bytes BIGINT;
+
+CREATE TABLE reactions (
+  id INT NOT NULL AUTO_INCREMENT,
+  message_id INT NOT NULL,
+  user_id INT NOT NULL,
+  emoji VARCHAR(32) CHARACTER SET utf8mb4 NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY message_user_emoji_idx (message_id, user_id, emoji),
+  FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
@@ -0,0 +1,168 @@
+package chatserver
+
+import (
+  "context"
+  "strings"
+  "testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+  migrations, err := loadMigrations()
+  if err != nil {
+    t.Fatalf("loadMigrations: %s", err.Error())
+  }
+  if len(migrations) == 0 {
+    t.Fatalf("no migrations were embedded")
+  }
+  // Versions start at INIT_SCHEMA_VERSION and leave no gaps.
+  for i, m := range migrations {
+    if m.version != INIT_SCHEMA_VERSION + i {
+      t.Errorf("migration %s has version %d, want %d", m.name, m.version, INIT_SCHEMA_VERSION + i)
+    }
+    if len(m.statements) == 0 {
+      t.Errorf("migration %s has no statements", m.name)
+    }
+  }
+}
+
+func TestSplitStatements(t *testing.T) {
+  statements := splitStatements(`# Comment lines are dropped.
+CREATE TABLE a(
+  id INT
+);
+
+# So are statements with nothing but comments.
+;
+ALTER TABLE a ADD COLUMN b INT;
+ALTER TABLE a ADD COLUMN c INT`)
+  want := []string{"CREATE TABLE a(\nid INT\n)", "ALTER TABLE a ADD COLUMN b INT", "ALTER TABLE a ADD COLUMN c INT"}
+  if len(statements) != len(want) {
+    t.Fatalf("got %d statements %q, want %d", len(statements), statements, len(want))
+  }
+  for i := range want {
+    if statements[i] != want[i] {
+      t.Errorf("statement %d is %q, want %q", i, statements[i], want[i])
+    }
+  }
+}
+
+func TestSQLMigrateIsIdempotent(t *testing.T) {
+  // NewChatSqlClient has already migrated once.
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  createStoreUsers(t, client, "user1")
+  for i := 0; i < 2; i++ {
+    if err := client.Migrate(ctx); err != nil {
+      t.Fatalf("Migrate %d: %s", i + 1, err.Error())
+    }
+  }
+  migrations, err := loadMigrations()
+  if err != nil {
+    t.Fatalf("loadMigrations: %s", err.Error())
+  }
+  var applied int
+  if err := client.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+    t.Fatalf("couldn't count applied migrations: %s", err.Error())
+  }
+  if applied != len(migrations) {
+    t.Errorf("got %d applied migrations, want each of the %d once", applied, len(migrations))
+  }
+  // Existing data survives.
+  if exists, err := client.CheckUserExists(ctx, "user1"); err != nil || !exists {
+    t.Errorf("user1 is gone after migrating again (%v)", err)
+  }
+}
+
+// The tables the original db/sql/init.sql created, version 0 of the schema.
+const BASELINE_SCHEMA = `
+CREATE TABLE users(
+  id INT NOT NULL AUTO_INCREMENT,
+  username VARCHAR(10) NOT NULL UNIQUE,
+  hash BINARY(60) NOT NULL,
+  PRIMARY KEY (id)
+);
+CREATE INDEX user_idx on users(username);
+CREATE TABLE messages(
+  id INT NOT NULL AUTO_INCREMENT,
+  sender_id INT NOT NULL,
+  recipient_id INT NOT NULL,
+  message_type ENUM('plaintext', 'image_link', 'video_link') NOT NULL,
+  message_content TEXT NOT NULL,
+  message_metadata_id INT,
+  PRIMARY KEY (id),
+  FOREIGN KEY (sender_id) REFERENCES users(id),
+  FOREIGN KEY (recipient_id) REFERENCES users(id)
+);
+CREATE INDEX sender_recipient_idx on messages(sender_id, recipient_id);
+CREATE TABLE messages_metadata (
+  id INT NOT NULL AUTO_INCREMENT,
+  width SMALLINT,
+  height SMALLINT,
+  length SMALLINT,
+  source VARCHAR(16),
+  PRIMARY KEY (id)
+);
+INSERT INTO users(username, hash) VALUES('user1', 'hash'), ('user2', 'hash');
+INSERT INTO messages_metadata(width, height) VALUES(640, 480);
+INSERT INTO messages(sender_id, recipient_id, message_type, message_content, message_metadata_id)
+  SELECT u1.id, u2.id, 'image_link', 'https://example.com/cat.png', (SELECT MAX(id) FROM messages_metadata)
+  FROM users u1, users u2 WHERE u1.username='user1' AND u2.username='user2';
+`
+
+func TestBaselineUpgradeStatements(t *testing.T) {
+  statements := splitStatements(baselineUpgrade)
+  if len(statements) == 0 {
+    t.Fatalf("the baseline upgrade has no statements")
+  }
+  for _, statement := range statements {
+    if strings.Contains(statement, "#") {
+      t.Errorf("statement still has a comment: %q", statement)
+    }
+  }
+}
+
+func TestSQLMigrateUpgradesBaselineSchema(t *testing.T) {
+  client := newTestSQLClient(t)
+  ctx := context.Background()
+  // Start over from the tables the original init.sql created.
+  for _, table := range append([]string{"schema_migrations"}, TEST_TABLES...) {
+    if _, err := client.db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+      t.Fatalf("couldn't drop %s: %s", table, err.Error())
+    }
+  }
+  for _, statement := range splitStatements(BASELINE_SCHEMA) {
+    if _, err := client.db.Exec(statement); err != nil {
+      t.Fatalf("couldn't create the baseline schema: %s", err.Error())
+    }
+  }
+  if err := client.Migrate(ctx); err != nil {
+    t.Fatalf("Migrate: %s", err.Error())
+  }
+  migrations, err := loadMigrations()
+  if err != nil {
+    t.Fatalf("loadMigrations: %s", err.Error())
+  }
+  if applied := countRows(t, client, "schema_migrations"); applied != len(migrations) {
+    t.Errorf("got %d applied migrations, want %d", applied, len(migrations))
+  }
+  // The old message survives with its metadata.
+  messages, err := client.FetchMessages(ctx, &FetchMessagesParams{senderName: "user1", recipientName: "user2"})
+  if err != nil {
+    t.Fatalf("FetchMessages: %s", err.Error())
+  }
+  if len(messages) != 1 || messages[0].Metadata == nil || messages[0].Metadata.Width != 640 {
+    t.Errorf("got %+v, want the image sent before upgrading", messages)
+  }
+  // Everything added since the original schema works.
+  createStoreUsers(t, client, "a-much-longer-username")
+  if _, err := client.AddMessage(ctx, "user1", "user2", MESSAGE_TYPE_FILE, "https://example.com/a.pdf",
+                                 &MessageMetadata{Filename: "a.pdf", SizeBytes: 1 << 33}, messages[0].ID); err != nil {
+    t.Errorf("AddMessage: %s", err.Error())
+  }
+  if _, err := client.CreateRoom(ctx, "room", []string{"user1", "user2"}); err != nil {
+    t.Errorf("CreateRoom: %s", err.Error())
+  }
+  if err := client.Migrate(ctx); err != nil {
+    t.Errorf("Migrate again: %s", err.Error())
+  }
+}
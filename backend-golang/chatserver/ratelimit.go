@@ -0,0 +1,106 @@
+package chatserver
+
+import (
+  "errors"
+  "fmt"
+  "math"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// Default limit on messages sent per user.
+const DEFAULT_MESSAGES_PER_MINUTE = 60
+const DEFAULT_MESSAGE_BURST = 10
+
+// Default limit on user creation and message sending per client IP.
+const DEFAULT_IP_REQUESTS_PER_MINUTE = 120
+const DEFAULT_IP_BURST = 20
+
+// How often the rate limiter drops buckets for keys that have gone idle.
+const RATE_LIMIT_CLEANUP_INTERVAL = 5 * time.Minute
+
+// A token bucket. Tokens refill continuously up to the limiter's burst.
+type tokenBucket struct {
+  tokens float64
+  updatedAt time.Time
+}
+
+// rateLimiter limits how often each key (e.g. a username) can do something,
+// using one token bucket per key.
+type rateLimiter struct {
+  mutex sync.Mutex
+  buckets map[string]*tokenBucket
+  // Tokens added per second.
+  rate float64
+  // Bucket capacity, i.e. how many actions can happen back to back.
+  burst float64
+  lastCleanup time.Time
+}
+
+// Factory for a limiter allowing perMinute actions per key, in bursts of up
+// to burst.
+func newRateLimiter(perMinute int, burst int) (*rateLimiter, error) {
+  if perMinute < 1 || burst < 1 {
+    return nil, errors.New(fmt.Sprintf("rate limit must be positive, got %d per minute with burst %d", perMinute, burst))
+  }
+  return &rateLimiter{
+    buckets: make(map[string]*tokenBucket),
+    rate: float64(perMinute) / 60,
+    burst: float64(burst),
+    lastCleanup: time.Now(),
+  }, nil
+}
+
+// Takes a token for key if one is available.
+// Otherwise returns false and how long until the next token is available.
+func (limiter *rateLimiter) allow(key string) (bool, time.Duration) {
+  limiter.mutex.Lock()
+  defer limiter.mutex.Unlock()
+  now := time.Now()
+  if now.Sub(limiter.lastCleanup) > RATE_LIMIT_CLEANUP_INTERVAL {
+    limiter.cleanup(now)
+  }
+  bucket, ok := limiter.buckets[key]
+  if !ok {
+    bucket = &tokenBucket{tokens: limiter.burst, updatedAt: now}
+    limiter.buckets[key] = bucket
+  }
+  bucket.tokens = limiter.refill(bucket, now)
+  bucket.updatedAt = now
+  if bucket.tokens < 1 {
+    wait := time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+    return false, wait
+  }
+  bucket.tokens--
+  return true, 0
+}
+
+// Returns how many tokens the bucket holds at the given time.
+func (limiter *rateLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+  tokens := bucket.tokens + now.Sub(bucket.updatedAt).Seconds() * limiter.rate
+  if tokens > limiter.burst {
+    tokens = limiter.burst
+  }
+  return tokens
+}
+
+// Drops buckets that have refilled completely, since they behave the same as
+// a new bucket. Keeps the map from growing with every key ever seen.
+// Must be called with the mutex held.
+func (limiter *rateLimiter) cleanup(now time.Time) {
+  for key, bucket := range limiter.buckets {
+    if limiter.refill(bucket, now) >= limiter.burst {
+      delete(limiter.buckets, key)
+    }
+  }
+  limiter.lastCleanup = now
+}
+
+// Responds with a 429, telling the client how many seconds to wait before
+// retrying in the Retry-After header.
+func tooManyRequests(w http.ResponseWriter, message string, retryAfter time.Duration) {
+  w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+  errorResponse(w, http.StatusTooManyRequests, message, ERROR_CODE_RATE_LIMITED)
+}
@@ -0,0 +1,166 @@
+package chatserver
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+// Moves every bucket's last update back by d, as if d had passed.
+func rewindRateLimiter(limiter *rateLimiter, d time.Duration) {
+  limiter.mutex.Lock()
+  defer limiter.mutex.Unlock()
+  for _, bucket := range limiter.buckets {
+    bucket.updatedAt = bucket.updatedAt.Add(-d)
+  }
+}
+
+func TestRateLimiterBlocksAfterBurst(t *testing.T) {
+  limiter, err := newRateLimiter(60, 3)
+  if err != nil {
+    t.Fatalf("newRateLimiter: %s", err.Error())
+  }
+  for i := 0; i < 3; i++ {
+    if ok, _ := limiter.allow("user1"); !ok {
+      t.Fatalf("action %d was blocked within the burst", i)
+    }
+  }
+  ok, wait := limiter.allow("user1")
+  if ok {
+    t.Fatalf("action after the burst was allowed")
+  }
+  // One token a second.
+  if wait <= 0 || wait > time.Second {
+    t.Errorf("got wait %s, want up to a second", wait)
+  }
+  // Each key has its own bucket.
+  if ok, _ := limiter.allow("user2"); !ok {
+    t.Errorf("another key was blocked")
+  }
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+  limiter, err := newRateLimiter(60, 3)
+  if err != nil {
+    t.Fatalf("newRateLimiter: %s", err.Error())
+  }
+  for i := 0; i < 3; i++ {
+    limiter.allow("user1")
+  }
+  rewindRateLimiter(limiter, 2 * time.Second)
+  for i := 0; i < 2; i++ {
+    if ok, _ := limiter.allow("user1"); !ok {
+      t.Fatalf("action %d was blocked after 2 tokens refilled", i)
+    }
+  }
+  if ok, _ := limiter.allow("user1"); ok {
+    t.Fatalf("action was allowed after the refilled tokens ran out")
+  }
+  // Buckets don't fill past the burst, however long they sit.
+  rewindRateLimiter(limiter, time.Hour)
+  for i := 0; i < 3; i++ {
+    if ok, _ := limiter.allow("user1"); !ok {
+      t.Fatalf("action %d was blocked after a full refill", i)
+    }
+  }
+  if ok, _ := limiter.allow("user1"); ok {
+    t.Errorf("bucket refilled past the burst")
+  }
+}
+
+func TestNewRateLimiterRejectsNonPositive(t *testing.T) {
+  for _, limit := range [][2]int{{0, 1}, {1, 0}, {-1, 5}} {
+    if _, err := newRateLimiter(limit[0], limit[1]); err == nil {
+      t.Errorf("got no error for %d per minute with burst %d", limit[0], limit[1])
+    }
+  }
+}
+
+// Creates a user from the given client address and returns the response.
+func createUserFrom(server *ChatServer, remoteAddr string, forwardedFor string, username string) *httptest.ResponseRecorder {
+  r := httptest.NewRequest(http.MethodPost, "/users",
+                           strings.NewReader(fmt.Sprintf(`{"username":%q, "password":%q}`, username, TEST_PASSWORD)))
+  r.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+  r.RemoteAddr = remoteAddr
+  if len(forwardedFor) > 0 {
+    r.Header.Set("X-Forwarded-For", forwardedFor)
+  }
+  w := httptest.NewRecorder()
+  server.ServeHTTP(w, r)
+  return w
+}
+
+func TestLimitPostsByIP(t *testing.T) {
+  server, _ := newTestServer(t)
+  if err := server.SetIPRateLimit(60, 2); err != nil {
+    t.Fatalf("SetIPRateLimit: %s", err.Error())
+  }
+  for i := 0; i < 2; i++ {
+    w := createUserFrom(server, "192.0.2.1:1234", "", fmt.Sprintf("user%d", i))
+    decodeResponse(t, w, http.StatusOK, nil)
+  }
+  w := createUserFrom(server, "192.0.2.1:5678", "", "user2")
+  expectError(t, w, http.StatusTooManyRequests, ERROR_CODE_RATE_LIMITED)
+  if got := w.Header().Get("Retry-After"); got != "1" {
+    t.Errorf("got Retry-After %q, want 1", got)
+  }
+  // Other IPs, and other methods, aren't affected.
+  w = createUserFrom(server, "192.0.2.2:1234", "", "user2")
+  decodeResponse(t, w, http.StatusOK, nil)
+  w = doRequest(server, http.MethodGet, "/users/exists?username=user0", "")
+  decodeResponse(t, w, http.StatusOK, nil)
+  // X-Forwarded-For is ignored unless the proxy is trusted.
+  w = createUserFrom(server, "192.0.2.1:1234", "198.51.100.1", "user3")
+  expectError(t, w, http.StatusTooManyRequests, ERROR_CODE_RATE_LIMITED)
+}
+
+func TestLimitPostsByForwardedIP(t *testing.T) {
+  config := DefaultConfig()
+  config.TrustProxy = true
+  server, _ := newTestServerWithConfig(t, config)
+  if err := server.SetIPRateLimit(60, 1); err != nil {
+    t.Fatalf("SetIPRateLimit: %s", err.Error())
+  }
+  // Every request comes through the proxy, so clients are told apart by the
+  // address it appended.
+  w := createUserFrom(server, "10.0.0.1:1234", "198.51.100.1", "user1")
+  decodeResponse(t, w, http.StatusOK, nil)
+  w = createUserFrom(server, "10.0.0.1:1234", "198.51.100.2", "user2")
+  decodeResponse(t, w, http.StatusOK, nil)
+  // Addresses the client added itself don't dodge the limit.
+  w = createUserFrom(server, "10.0.0.1:1234", "203.0.113.9, 198.51.100.1", "user3")
+  expectError(t, w, http.StatusTooManyRequests, ERROR_CODE_RATE_LIMITED)
+}
+
+func TestLimitLoginsByIP(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUser(t, server, "user1")
+  if err := server.SetIPRateLimit(60, 3); err != nil {
+    t.Fatalf("SetIPRateLimit: %s", err.Error())
+  }
+  for i := 0; i < 3; i++ {
+    expectError(t, loginTestUser(server, fmt.Sprintf("guess-%d", i)), http.StatusUnauthorized, ERROR_CODE_INVALID_CREDENTIALS)
+  }
+  // Even the right password is turned away once the guesses run out.
+  expectError(t, loginTestUser(server, TEST_PASSWORD), http.StatusTooManyRequests, ERROR_CODE_RATE_LIMITED)
+}
+
+func TestMessageRateLimitIgnoresUsernameCase(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  if err := server.SetMessageRateLimit(60, 2); err != nil {
+    t.Fatalf("SetMessageRateLimit: %s", err.Error())
+  }
+  sendTestMessages(t, server, 2)
+  // Changing the case of the sender is still the same sender.
+  for _, sender := range []string{"user1", "User1", "USER1"} {
+    w := doRequest(server, http.MethodPost, "/messages",
+                   fmt.Sprintf(`{"sender":%q, "recipient":"user2", "messageType":"plaintext", "content":"Hi"}`, sender))
+    expectError(t, w, http.StatusTooManyRequests, ERROR_CODE_RATE_LIMITED)
+  }
+  // Other senders have their own bucket.
+  sendTestMessage(t, server, "user2", "user1", "Hi")
+}
@@ -0,0 +1,123 @@
+package chatserver
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+)
+
+// Path suffix for reactions to a message, i.e. /messages/{id}/reactions.
+const REACTIONS_PATH_SUFFIX = "/reactions"
+
+// Struct for decoding JSON body for POST requests at /messages/{id}/reactions.
+type reactionStruct struct {
+  User        string
+  Emoji       string
+}
+
+// Request handler for /messages/{id}/reactions.
+func (server *ChatServer) handleReactions(w http.ResponseWriter, r *http.Request) {
+  switch r.Method {
+  case http.MethodPost:
+    server.addReaction(w, r)
+  case http.MethodDelete:
+    server.removeReaction(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at %s, %+v", r.URL.Path, r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only POST and DELETE requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Reacts to a message with an emoji.
+// Expects a POST to /messages/{id}/reactions with the following parameters
+// in the body:
+// - user: username of the user reacting
+// - emoji: the emoji to react with
+// Reacting twice with the same emoji doesn't count twice.
+//
+// Sample curl request:
+// curl -d '{"user":"user1", "emoji":"👍"}' -H "Content-Type: application/json" -X POST localhost:18000/messages/1/reactions
+func (server *ChatServer) addReaction(w http.ResponseWriter, r *http.Request) {
+  messageId, err := parseMessageId(r, REACTIONS_PATH_SUFFIX)
+  if err != nil {
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad POST request at %s, %s", r.URL.Path, err.Error()), ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  var body reactionStruct
+  if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+    err = bodyReadError(err, errors.New("couldn't decode JSON"))
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf("bad POST request at %s, %s", r.URL.Path, err.Error()), code)
+    return
+  }
+  if err := validateReaction(body.User, body.Emoji); err != nil {
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad POST request at %s, %s", r.URL.Path, err.Error()), ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  server.logger.Debugf("Received POST at /messages for a reaction to message %d from %s", messageId, body.User)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  if err := server.db.AddReaction(ctx, messageId, body.User, body.Emoji); err != nil {
+    server.logger.Errorf("Error adding reaction to db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't add reaction: %s", err.Error()), codeForError(err))
+    return
+  }
+  server.writeReactionResponse(w, messageId)
+}
+
+// Removes a reaction from a message.
+// Expects a DELETE to /messages/{id}/reactions with the following query
+// parameters:
+// - user: username of the user who reacted
+// - emoji: the emoji to remove
+//
+// Sample curl request:
+// curl -X DELETE "localhost:18000/messages/1/reactions?user=user1&emoji=%F0%9F%91%8D"
+func (server *ChatServer) removeReaction(w http.ResponseWriter, r *http.Request) {
+  messageId, err := parseMessageId(r, REACTIONS_PATH_SUFFIX)
+  if err != nil {
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad DELETE request at %s, %s", r.URL.Path, err.Error()), ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  params := r.URL.Query()
+  username := params.Get("user")
+  emoji := params.Get("emoji")
+  if err := validateReaction(username, emoji); err != nil {
+    errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad DELETE request at %s, %s", r.URL.Path, err.Error()), ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  server.logger.Debugf("Received DELETE at /messages for a reaction to message %d from %s", messageId, username)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  if err := server.db.RemoveReaction(ctx, messageId, username, emoji); err != nil {
+    server.logger.Errorf("Error removing reaction from db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't remove reaction: %s", err.Error()), codeForError(err))
+    return
+  }
+  server.writeReactionResponse(w, messageId)
+}
+
+// Checks that a reaction names a user and a reasonably sized emoji.
+func validateReaction(username string, emoji string) error {
+  if len(username) < 1 {
+    return errors.New("user is required")
+  }
+  if len(emoji) < 1 || len(emoji) > MAX_EMOJI_LENGTH {
+    return errors.New(fmt.Sprintf("emoji should be between 1 and %d bytes", MAX_EMOJI_LENGTH))
+  }
+  return nil
+}
+
+// Responds to a successful reaction change with the message id.
+func (server *ChatServer) writeReactionResponse(w http.ResponseWriter, messageId int64) {
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(map[string]string{
+    "message_id": strconv.FormatInt(messageId, 10),
+  }); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
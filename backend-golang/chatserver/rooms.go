@@ -0,0 +1,107 @@
+package chatserver
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+)
+
+type createRoomStruct struct {
+  Name    string
+  Members []string
+}
+
+// Request handler for /rooms.
+func (server *ChatServer) handleRooms(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodPost:
+    server.createRoom(w, r)
+  case http.MethodGet:
+    server.fetchRooms(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at /rooms, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only POST and GET requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Creates a room for a group chat.
+// Expects a POST to /rooms with a JSON body containing the room's name and
+// its members' usernames.
+//
+// Sample curl request:
+// curl -d '{"name":"friends", "members":["user1", "user2", "user3"]}' -H "Content-Type: application/json" -X POST localhost:18000/rooms
+func (server *ChatServer) createRoom(w http.ResponseWriter, r *http.Request) {
+  body, err := parseCreateRoom(r)
+  if err != nil {
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf("bad POST request at /rooms, couldn't parse, error: %s", err.Error()), code)
+    return
+  }
+  server.logger.Debugf("Received POST at /rooms for %s with %d members", body.Name, len(body.Members))
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  room, err := server.db.CreateRoom(ctx, body.Name, body.Members)
+  if err != nil {
+    server.logger.Errorf("Error creating room in db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't create room: %s", err.Error()), codeForError(err))
+    return
+  }
+  server.logger.Debugf("Successfully created room %d", room.ID)
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(room); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Parse POST request for /rooms.
+func parseCreateRoom(r *http.Request) (*createRoomStruct, error) {
+  var body createRoomStruct
+  if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+    return nil, bodyReadError(err, errors.New("couldn't decode JSON"))
+  }
+  if len(body.Name) == 0 || len(body.Name) > MAX_ROOM_NAME_LENGTH {
+    return nil, errors.New(fmt.Sprintf("room name should be between 1 and %d characters", MAX_ROOM_NAME_LENGTH))
+  }
+  if len(body.Members) == 0 || len(body.Members) > MAX_ROOM_MEMBERS {
+    return nil, errors.New(fmt.Sprintf("rooms should have between 1 and %d members", MAX_ROOM_MEMBERS))
+  }
+  return &body, nil
+}
+
+// Lists the rooms a user is a member of.
+// Expects a GET to /rooms with the following query parameters:
+// - user: username to list rooms for
+//
+// Sample curl request:
+// curl "localhost:18000/rooms?user=user1"
+func (server *ChatServer) fetchRooms(w http.ResponseWriter, r *http.Request) {
+  params := r.URL.Query()
+  if len(params["user"]) != 1 {
+    errorResponse(w, http.StatusBadRequest, "bad GET request at /rooms, expected exactly one user", ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  username := params.Get("user")
+  server.logger.Debugf("Received GET at /rooms for %s", username)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  rooms, err := server.db.FetchRooms(ctx, username)
+  if err != nil {
+    server.logger.Errorf("Error fetching rooms from db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't fetch rooms: %s", err.Error()), codeForError(err))
+    return
+  }
+  // Always respond with an array, even if the user isn't in any rooms.
+  if rooms == nil {
+    rooms = []*Room{}
+  }
+  server.logger.Debugf("Successfully fetched %d rooms for %s", len(rooms), username)
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(rooms); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
@@ -0,0 +1,88 @@
+package chatserver
+
+import (
+  "fmt"
+  "net/http"
+  "testing"
+)
+
+// Creates a room named friends with user1, user2 and user3, and returns it.
+func createTestRoom(t *testing.T, server *ChatServer) *Room {
+  t.Helper()
+  w := doRequest(server, http.MethodPost, "/rooms", `{"name":"friends", "members":["user1", "user2", "user3"]}`)
+  var room Room
+  decodeResponse(t, w, http.StatusOK, &room)
+  return &room
+}
+
+func TestCreateRoom(t *testing.T) {
+  server, _ := newTestServer(t)
+  for _, username := range []string{"user1", "user2", "user3", "user4"} {
+    createTestUser(t, server, username)
+  }
+  room := createTestRoom(t, server)
+  if room.ID == 0 || room.Name != "friends" || len(room.Members) != 3 {
+    t.Errorf("got room %+v, want friends with 3 members", room)
+  }
+  for username, want := range map[string]int{"user1": 1, "user4": 0} {
+    w := doRequest(server, http.MethodGet, "/rooms?user=" + username, "")
+    var rooms []*Room
+    decodeResponse(t, w, http.StatusOK, &rooms)
+    if len(rooms) != want || (want > 0 && rooms[0].ID != room.ID) {
+      t.Errorf("%s is in rooms %+v, want %d", username, rooms, want)
+    }
+  }
+}
+
+func TestCreateRoomRejections(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUsers(t, server)
+  tests := []struct {
+    name string
+    body string
+    status int
+    code string
+  }{
+    {"missing member", `{"name":"friends", "members":["user1", "nobody"]}`, http.StatusNotFound, ERROR_CODE_USER_NOT_FOUND},
+    {"no members", `{"name":"friends", "members":[]}`, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST},
+    {"no name", `{"members":["user1", "user2"]}`, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      expectError(t, doRequest(server, http.MethodPost, "/rooms", test.body), test.status, test.code)
+    })
+  }
+}
+
+func TestRoomMessagesMembersOnly(t *testing.T) {
+  server, _ := newTestServer(t)
+  for _, username := range []string{"user1", "user2", "user3", "user4"} {
+    createTestUser(t, server, username)
+  }
+  room := createTestRoom(t, server)
+  w := doRequest(server, http.MethodPost, "/messages", fmt.Sprintf(
+    `{"sender":"user1", "roomId":%d, "messageType":"plaintext", "content":"Hi all!"}`, room.ID))
+  var sent Message
+  decodeResponse(t, w, http.StatusOK, &sent)
+  // Every member sees the message.
+  for _, member := range room.Members {
+    w := doRequest(server, http.MethodGet, fmt.Sprintf("/messages?roomId=%d&user=%s", room.ID, member), "")
+    var messages []*Message
+    decodeResponse(t, w, http.StatusOK, &messages)
+    if len(messages) != 1 || messages[0].ID != sent.ID {
+      t.Errorf("%s got %+v, want just message %d", member, messages, sent.ID)
+    }
+  }
+  // Non-members can neither read nor post.
+  w = doRequest(server, http.MethodGet, fmt.Sprintf("/messages?roomId=%d&user=user4", room.ID), "")
+  expectError(t, w, http.StatusForbidden, ERROR_CODE_NOT_ROOM_MEMBER)
+  w = doRequest(server, http.MethodPost, "/messages", fmt.Sprintf(
+    `{"sender":"user4", "roomId":%d, "messageType":"plaintext", "content":"Let me in"}`, room.ID))
+  expectError(t, w, http.StatusForbidden, ERROR_CODE_NOT_ROOM_MEMBER)
+  w = doRequest(server, http.MethodGet, fmt.Sprintf("/messages?roomId=%d&user=user1", room.ID + 1), "")
+  expectError(t, w, http.StatusNotFound, ERROR_CODE_ROOM_NOT_FOUND)
+  // Room messages don't show up in direct conversations.
+  if messages := fetchTestMessages(t, server, "user1", "user2"); len(messages) != 0 {
+    t.Errorf("got %d room messages in a direct conversation", len(messages))
+  }
+}
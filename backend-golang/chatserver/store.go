@@ -0,0 +1,126 @@
+package chatserver
+
+import (
+  "context"
+  "errors"
+  "fmt"
+)
+
+// Errors returned by ChatStore implementations that the server maps to
+// specific HTTP statuses.
+var ErrUserNotFound = errors.New("no such user")
+var ErrUserExists = errors.New("username already taken")
+var ErrMessageNotFound = errors.New("message not found")
+var ErrNotMessageSender = errors.New("only the sender can modify this message")
+var ErrNotMessageRecipient = errors.New("only the recipient can mark this message read")
+var ErrMessageNotEditable = errors.New("only plaintext messages can be edited")
+var ErrRoomNotFound = errors.New("room not found")
+var ErrNotRoomMember = errors.New("only room members can do this")
+var ErrInvalidReply = errors.New("replyTo should be a message in the same conversation")
+var ErrInvalidMessageStatus = errors.New("status should be sent, delivered or read")
+var ErrMessageStatusRegression = errors.New("message status can't move backwards")
+var ErrBlocked = errors.New("the recipient has blocked the sender")
+
+// Returns an error wrapping ErrUserNotFound that names the missing user.
+func userNotFound(username string) error {
+  return fmt.Errorf("%w %s", ErrUserNotFound, username)
+}
+
+// Returns an error wrapping ErrUserExists that names the taken username.
+func userExists(username string) error {
+  return fmt.Errorf("%w: %s", ErrUserExists, username)
+}
+
+// ChatStore is the storage API the server depends on.
+// ChatSQLClient is the MySQL implementation; any other backend only needs
+// to satisfy this interface to be swapped in via NewChatServer.
+// Methods give up once their ctx is canceled or times out.
+type ChatStore interface {
+  // Creates a user with the given password hash, returns the new user's id.
+  // Returns an ErrUserExists error if the username is taken.
+  CreateUser(ctx context.Context, username string, hash []byte) (id int64, err error)
+  // Returns whether the user exists.
+  CheckUserExists(ctx context.Context, username string) (bool, error)
+  // Returns the password hash stored for the given user.
+  // Returns an ErrUserNotFound error if the user doesn't exist.
+  GetUserCredentials(ctx context.Context, username string) (hash []byte, err error)
+  // Returns the user's public profile.
+  // Returns an ErrUserNotFound error if the user doesn't exist.
+  GetUserProfile(ctx context.Context, username string) (*UserProfile, error)
+  // Replaces the password hash stored for the given user.
+  UpdateUserCredentials(ctx context.Context, username string, hash []byte) error
+  // Deletes the user along with every message they sent or received, their
+  // reactions, their room memberships and their blocks either way.
+  DeleteUser(ctx context.Context, username string) error
+  // Returns up to limit usernames starting with prefix, case-insensitively,
+  // in alphabetical order.
+  SearchUsers(ctx context.Context, prefix string, limit int) (usernames []string, err error)
+  // Stops blocked from sending direct messages to blocker. Blocking someone
+  // twice has no further effect.
+  BlockUser(ctx context.Context, blockerName string, blockedName string) error
+  // Lets blocked message blocker again, if they were blocked.
+  UnblockUser(ctx context.Context, blockerName string, blockedName string) error
+  // Returns the usernames the user has blocked, in alphabetical order.
+  FetchBlockedUsers(ctx context.Context, username string) (usernames []string, err error)
+  // Returns whether blocker has blocked blocked.
+  IsBlocked(ctx context.Context, blockerName string, blockedName string) (bool, error)
+  // Stores a message and its metadata, returns the stored message.
+  // If replyTo isn't 0 the message replies to that message, which must be
+  // between the same two users, otherwise returns an ErrInvalidReply error.
+  // Returns an ErrBlocked error if the recipient has blocked the sender.
+  AddMessage(ctx context.Context, senderName string, recipientName string, messageType string, content string, metadata *MessageMetadata, replyTo int64) (*Message, error)
+  // Stores the same message once per recipient, all or nothing. Returns the
+  // stored messages in the order of recipientNames. Stores nothing, and
+  // returns an ErrBlocked error, if any recipient has blocked the sender.
+  AddMessages(ctx context.Context, senderName string, recipientNames []string, messageType string, content string, metadata *MessageMetadata) ([]*Message, error)
+  // Returns the messages between two users, or in a room, oldest first.
+  FetchMessages(ctx context.Context, params *FetchMessagesParams) (messages []*Message, err error)
+  // Creates a room with the given members, returns the new room.
+  CreateRoom(ctx context.Context, name string, memberNames []string) (*Room, error)
+  // Returns a room and its members.
+  GetRoom(ctx context.Context, roomId int64) (*Room, error)
+  // Returns the rooms a user is a member of.
+  FetchRooms(ctx context.Context, username string) (rooms []*Room, err error)
+  // Stores a message to a room the sender is a member of, returns the stored
+  // message. As with AddMessage, replyTo must be 0 or a message in the room.
+  AddRoomMessage(ctx context.Context, senderName string, roomId int64, messageType string, content string, metadata *MessageMetadata, replyTo int64) (*Message, error)
+  // Returns the number of messages in a room.
+  GetRoomMessageCount(ctx context.Context, roomId int64) (count int64, err error)
+  // Returns up to limit of the user's messages containing query, newest first.
+  SearchMessages(ctx context.Context, username string, query string, limit int) (messages []*Message, err error)
+  // Returns the number of messages between two users.
+  GetMessageCount(ctx context.Context, senderName string, recipientName string) (count int64, err error)
+  // Returns a user's conversations, most recently active first.
+  FetchConversations(ctx context.Context, username string) (conversations []*Conversation, err error)
+  // Marks all unread messages from sender to recipient as read.
+  MarkMessagesRead(ctx context.Context, recipientName string, senderName string) error
+  // Marks a single message as read if the reader is its recipient. Marking
+  // a message that's already read keeps the original time.
+  MarkMessageRead(ctx context.Context, messageId int64, readerName string) error
+  // Marks every message from sender to recipient that's only been sent as
+  // delivered.
+  MarkMessagesDelivered(ctx context.Context, recipientName string, senderName string) error
+  // Moves a message's status forward. Setting the status it already has
+  // changes nothing. Returns an ErrInvalidMessageStatus error for unknown
+  // statuses, or ErrMessageStatusRegression if the message is already past
+  // the status.
+  UpdateMessageStatus(ctx context.Context, messageId int64, status string) error
+  // Counts unread messages sent to recipient, optionally only from sender.
+  CountUnread(ctx context.Context, recipientName string, senderName string) (count int, err error)
+  // Counts unread messages sent to recipient, by sender. Senders with no
+  // unread messages are left out.
+  GetUnreadCounts(ctx context.Context, recipientName string) (counts map[string]int, err error)
+  // Replaces a plaintext message's content if the requester is its sender.
+  EditMessage(ctx context.Context, messageId int64, requesterName string, newContent string) error
+  // Adds a user's reaction to a message. Reacting twice with the same emoji
+  // has no further effect.
+  AddReaction(ctx context.Context, messageId int64, username string, emoji string) error
+  // Removes a user's reaction from a message, if there is one.
+  RemoveReaction(ctx context.Context, messageId int64, username string, emoji string) error
+  // Deletes a message and its metadata if the requester is its sender.
+  DeleteMessage(ctx context.Context, messageId int64, requesterName string) error
+  // Checks that the store is reachable.
+  Ping(ctx context.Context) error
+  // Releases any resources held by the store.
+  Close() error
+}
@@ -0,0 +1,93 @@
+package chatserver
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+  "testing"
+)
+
+// Checks that the store's errors match the sentinel errors with errors.Is.
+// Run against each ChatStore implementation.
+func testStoreErrors(t *testing.T, store ChatStore) {
+  ctx := context.Background()
+  createStoreUsers(t, store, "user1", "user2")
+  message, err := store.AddMessage(ctx, "user1", "user2", MESSAGE_TYPE_PLAINTEXT, "Hi there!", nil, 0)
+  if err != nil {
+    t.Fatalf("AddMessage: %s", err.Error())
+  }
+  image, err := store.AddMessage(ctx, "user1", "user2", MESSAGE_TYPE_IMAGE_LINK, "https://example.com/cat.png",
+                                 &MessageMetadata{Width: 640, Height: 480}, 0)
+  if err != nil {
+    t.Fatalf("AddMessage: %s", err.Error())
+  }
+  missingId := image.ID + 1000
+  tests := []struct {
+    name string
+    call func() error
+    want error
+  }{
+    {"CreateUser taken", func() error {
+      _, err := store.CreateUser(ctx, "user1", []byte("hash"))
+      return err
+    }, ErrUserExists},
+    {"GetUserCredentials missing user", func() error {
+      _, err := store.GetUserCredentials(ctx, "nobody")
+      return err
+    }, ErrUserNotFound},
+    {"AddMessage missing recipient", func() error {
+      _, err := store.AddMessage(ctx, "user1", "nobody", MESSAGE_TYPE_PLAINTEXT, "Hi there!", nil, 0)
+      return err
+    }, ErrUserNotFound},
+    {"AddMessage missing sender", func() error {
+      _, err := store.AddMessage(ctx, "nobody", "user1", MESSAGE_TYPE_PLAINTEXT, "Hi there!", nil, 0)
+      return err
+    }, ErrUserNotFound},
+    {"FetchMessages missing user", func() error {
+      _, err := store.FetchMessages(ctx, &FetchMessagesParams{senderName: "user1", recipientName: "nobody"})
+      return err
+    }, ErrUserNotFound},
+    {"EditMessage missing message", func() error {
+      return store.EditMessage(ctx, missingId, "user1", "Hi!")
+    }, ErrMessageNotFound},
+    {"EditMessage not the sender", func() error {
+      return store.EditMessage(ctx, message.ID, "user2", "Hi!")
+    }, ErrNotMessageSender},
+    {"EditMessage image", func() error {
+      return store.EditMessage(ctx, image.ID, "user1", "https://example.com/dog.png")
+    }, ErrMessageNotEditable},
+    {"DeleteMessage missing message", func() error {
+      return store.DeleteMessage(ctx, missingId, "user1")
+    }, ErrMessageNotFound},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      if err := test.call(); !errors.Is(err, test.want) {
+        t.Errorf("got error %v, want one matching %q", err, test.want)
+      }
+    })
+  }
+}
+
+func TestMemoryStoreErrors(t *testing.T) {
+  testStoreErrors(t, NewMemoryChatStore())
+}
+
+func TestStatusForError(t *testing.T) {
+  tests := []struct {
+    err error
+    status int
+    code string
+  }{
+    {userNotFound("user1"), http.StatusNotFound, ERROR_CODE_USER_NOT_FOUND},
+    {userExists("user1"), http.StatusConflict, ERROR_CODE_USER_EXISTS},
+    {fmt.Errorf("%w 7", ErrMessageNotFound), http.StatusNotFound, ERROR_CODE_MESSAGE_NOT_FOUND},
+    {errors.New("the db is down"), http.StatusInternalServerError, ERROR_CODE_INTERNAL},
+  }
+  for _, test := range tests {
+    if status, code := statusForError(test.err), codeForError(test.err); status != test.status || code != test.code {
+      t.Errorf("%q: got %d %q, want %d %q", test.err, status, code, test.status, test.code)
+    }
+  }
+}
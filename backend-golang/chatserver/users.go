@@ -4,14 +4,22 @@ import (
   "encoding/json"
   "errors"
   "fmt"
-  "log"
   "net/http"
   "strconv"
+  "strings"
 
   auth "app/chatauth"
 )
 
-// Struct for decoding JSON body for POST requests at /users.
+// Symbols usernames may contain besides letters and digits, the unreserved
+// URL characters.
+const URL_SAFE_USERNAME_SYMBOLS = "_-.~"
+
+// Usernames that can't be signed up for, since /users/{username} would
+// clash with other endpoints.
+var RESERVED_USERNAMES = []string{"exists", "password", "block", "blocked"}
+
+// Struct for decoding JSON or form body for POST requests at /users.
 type createUserStruct struct {
   Username string
   Password string
@@ -21,52 +29,114 @@ type createUserStruct struct {
 func (server *ChatServer) handleUsers(w http.ResponseWriter, r *http.Request) {
   w.Header().Add("Content-Type", "application/json")
   switch r.Method {
+  case http.MethodGet:
+    server.searchUsers(w, r)
   case http.MethodPost:
     server.createUser(w, r)
+  case http.MethodDelete:
+    server.deleteUser(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at /users, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only GET, POST and DELETE requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Request handler for /users/{username}.
+func (server *ChatServer) handleUser(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodGet:
+    server.getUserProfile(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at %s, %+v", r.URL.Path, r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only GET requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Struct for decoding JSON body for POST requests at /users/password.
+type changePasswordStruct struct {
+  Username    string
+  OldPassword string
+  NewPassword string
+}
+
+// Request handler for /users/exists.
+func (server *ChatServer) handleUserExists(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodGet:
+    server.checkUserExists(w, r)
+  default:
+    // Unhandled request, respond with StatusMethodNotAllowed (405).
+    server.logger.Warnf("Unknown request received at /users/exists, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only GET requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
+  }
+}
+
+// Request handler for /users/password.
+func (server *ChatServer) handleUserPassword(w http.ResponseWriter, r *http.Request) {
+  w.Header().Add("Content-Type", "application/json")
+  switch r.Method {
+  case http.MethodPost:
+    server.changePassword(w, r)
   default:
     // Unhandled request, respond with StatusMethodNotAllowed (405).
-    log.Printf("Unknown request received at /users, %+v", r)
-    http.Error(w, "only POST requests are accepted", http.StatusMethodNotAllowed)
+    server.logger.Warnf("Unknown request received at /users/password, %+v", r)
+    errorResponse(w, http.StatusMethodNotAllowed, "only POST requests are accepted", ERROR_CODE_METHOD_NOT_ALLOWED)
   }
 }
 
 // Creates a new user.
 // Expects a POST with the following parameters in the body:
-// - username : maximum 10 characters
-// - password : maximum 72 characters (due to bcrypt limitation)
-// Expects data in JSON, because it's easier to send JSON than url-encoded
-// key value pairs in React, and our frontend is in React.
+// - username : between Config.UsernameMinLength and UsernameMaxLength
+//   characters, 1 to 10 by default
+// - password : must meet the password policy, see auth.PasswordPolicy, and
+//   at most 72 characters (due to bcrypt limitation)
+// Accepts JSON, which is easiest to send from our React frontend, or a
+// url-encoded form, for curl and HTML forms. Other content types get a 415,
+// and bodies over Config.MaxBodyBytes a 413.
 //
-// Sample curl request:
+// Sample curl requests:
 // curl -d '{"username":"user1", "password":"super-secret"}' -H "Content-Type: application/json" -X POST localhost:18000/users
+// curl -d "username=user1&password=super-secret" -X POST localhost:18000/users
 func (server *ChatServer) createUser(w http.ResponseWriter, r *http.Request) {
   username, password, err := server.parseCreateUser(r)
   if err != nil {
-    http.Error(w, fmt.Sprintf("Error: %s", err.Error()), http.StatusBadRequest)
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf("Error: %s", err.Error()), code)
     return
   }
   // Hash password and create a new user.
-  hash, err := auth.HashPasswordWithSalt(password)
+  hash, err := auth.HashPasswordWithSalt(password, server.hashCost)
   if err != nil {
-    log.Printf("Error hashing password, %s", err.Error())
-    http.Error(w, "hashing error", http.StatusInternalServerError)
+    server.logger.Errorf("Error hashing password, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "hashing error", ERROR_CODE_INTERNAL)
     return
   }
-  id, err := server.db.CreateUser(username, hash)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  id, err := server.db.CreateUser(ctx, username, hash)
   if err != nil {
-    log.Printf("Error creating a user, %s", err.Error())
-    http.Error(w, fmt.Sprintf("couldn't create user, database error: %s", err.Error()), http.StatusInternalServerError)
+    server.logger.Errorf("Error creating a user, %s", err.Error())
+    if errors.Is(err, ErrUserExists) {
+      errorResponse(w, http.StatusConflict, "username already taken", ERROR_CODE_USER_EXISTS)
+      return
+    }
+    errorResponse(w, statusForError(err), "couldn't create user, database error", codeForError(err))
     return
   }
   // Success!
-  log.Printf("User %s created successfully, id %d", username, id)
+  server.logger.Infof("User %s created successfully, id %d", username, id)
+  server.metrics.usersCreated.Inc()
   w.WriteHeader(http.StatusOK)
   if err := json.NewEncoder(w).Encode(map[string]string{
     "username": username,
     "id": strconv.FormatInt(id, 10),
   }); err != nil {
-    log.Printf("Error formatting http response, %s", err.Error())
-    http.Error(w, "error generating response", http.StatusInternalServerError)
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
   }
 }
 
@@ -74,19 +144,295 @@ func (server *ChatServer) createUser(w http.ResponseWriter, r *http.Request) {
 // Returns parsed values or error.
 func (server *ChatServer) parseCreateUser(r *http.Request) (username string, password string, err error) {
   // Parse request.
-  var body createUserStruct
-  decoder := json.NewDecoder(r.Body)
-  if err = decoder.Decode(&body); err != nil {
-    err = errors.New("bad POST request, could not parse")
+  contentType, err := bodyContentType(r)
+  if err != nil {
+    return
+  }
+  if contentType == CONTENT_TYPE_FORM {
+    if err = r.ParseForm(); err != nil {
+      err = bodyReadError(err, errors.New("bad POST request, could not parse"))
+      return
+    }
+    username = r.PostForm.Get("username")
+    password = r.PostForm.Get("password")
+  } else {
+    var body createUserStruct
+    decoder := json.NewDecoder(r.Body)
+    if err = decoder.Decode(&body); err != nil {
+      err = bodyReadError(err, errors.New("bad POST request, could not parse"))
+      return
+    }
+    username = body.Username
+    password = body.Password
+  }
+  server.logger.Debugf("Received POST at /users for user %s", username)
+  // Check username and strength of password.
+  if err = server.validateUsername(username); err != nil {
     return
   }
-  username = body.Username
-  password = body.Password
-  log.Printf("Received POST at /users for user %s", username)
-  // Check lengths of username and password.
-  if len(username) < 1 || len(password) < 1 || len(username) > 10 || len(password) > 72 {
-    err = errors.New("username should be between 1 and 10 characters, password should be between 1 and 72 characters")
+  if err = server.passwordPolicy.Validate(password); err != nil {
     return
   }
   return username, password, nil
 }
+
+// Lists usernames, for example to populate a user picker.
+// Expects a GET to /users with the following query parameters:
+// - [prefix]: optional, only return usernames starting with this
+//   (case-insensitive)
+// - [limit]: optional maximum number of results, at most USER_SEARCH_LIMIT
+//
+// Results are sorted alphabetically. Only usernames are returned.
+//
+// Sample curl request:
+// curl "localhost:18000/users?prefix=us&limit=5"
+func (server *ChatServer) searchUsers(w http.ResponseWriter, r *http.Request) {
+  params := r.URL.Query()
+  prefix := params.Get("prefix")
+  limit := USER_SEARCH_LIMIT
+  if len(params["limit"]) > 0 {
+    var err error
+    limit, err = strconv.Atoi(params.Get("limit"))
+    if err != nil || limit < 1 || limit > USER_SEARCH_LIMIT {
+      errorResponse(w, http.StatusBadRequest, fmt.Sprintf("bad GET request at /users, limit should be between 1 and %d", USER_SEARCH_LIMIT), ERROR_CODE_BAD_REQUEST)
+      return
+    }
+  }
+  server.logger.Debugf("Received GET at /users for prefix %q", prefix)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  usernames, err := server.db.SearchUsers(ctx, prefix, limit)
+  if err != nil {
+    server.logger.Errorf("Error searching users in db: %s", err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't search users: %s", err.Error()), codeForError(err))
+    return
+  }
+  // Always respond with an array, even if nothing matched.
+  if usernames == nil {
+    usernames = []string{}
+  }
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(usernames); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Checks whether a username is taken, e.g. so a registration form can warn
+// before submitting.
+// Expects a GET to /users/exists with the following query parameters:
+// - username
+//
+// Sample curl request:
+// curl "localhost:18000/users/exists?username=user1"
+func (server *ChatServer) checkUserExists(w http.ResponseWriter, r *http.Request) {
+  params := r.URL.Query()
+  if len(params["username"]) != 1 {
+    errorResponse(w, http.StatusBadRequest, "bad GET request at /users/exists, expected exactly one username", ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  username := params.Get("username")
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  exists, err := server.db.CheckUserExists(ctx, username)
+  if err != nil {
+    server.logger.Errorf("Error checking if user %s exists, %s", username, err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't check user: %s", err.Error()), codeForError(err))
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(map[string]bool{
+    "exists": exists,
+  }); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Gets a user's public profile, their id, username and when they signed up.
+// Expects a GET to /users/{username}. Responds with a 404 if there is no
+// such user.
+//
+// Sample curl request:
+// curl "localhost:18000/users/user1"
+func (server *ChatServer) getUserProfile(w http.ResponseWriter, r *http.Request) {
+  username := strings.TrimPrefix(r.URL.Path, "/users/")
+  if len(username) == 0 || strings.Contains(username, "/") {
+    errorResponse(w, http.StatusNotFound, fmt.Sprintf("no such user at %s", r.URL.Path), ERROR_CODE_USER_NOT_FOUND)
+    return
+  }
+  server.logger.Debugf("Received GET at /users/ for %s", username)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  profile, err := server.db.GetUserProfile(ctx, username)
+  if err != nil {
+    server.logger.Errorf("Error getting profile for %s, %s", username, err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("Couldn't get user: %s", err.Error()), codeForError(err))
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(profile); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Changes a user's password.
+// Expects a POST with the following parameters in the body:
+// - username
+// - oldPassword: the user's current password
+// - newPassword: must meet the password policy, like at signup
+// Responds with a 401 if the username or old password is wrong.
+//
+// Sample curl request:
+// curl -d '{"username":"user1", "oldPassword":"super-secret", "newPassword":"even-more-secret"}' -H "Content-Type: application/json" -X POST localhost:18000/users/password
+func (server *ChatServer) changePassword(w http.ResponseWriter, r *http.Request) {
+  body, err := server.parseChangePassword(r)
+  if err != nil {
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf("Error: %s", err.Error()), code)
+    return
+  }
+  server.logger.Debugf("Received POST at /users/password for user %s", body.Username)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  hash, err := server.db.GetUserCredentials(ctx, body.Username)
+  if errors.Is(err, ErrUserNotFound) {
+    server.logger.Warnf("Failed password change for unknown user %s", body.Username)
+    // Same as login, don't reveal whether the username exists.
+    auth.AuthenticateDummy(body.OldPassword, server.hashCost)
+    errorResponse(w, http.StatusUnauthorized, "invalid username or password", ERROR_CODE_INVALID_CREDENTIALS)
+    return
+  }
+  if err != nil {
+    server.logger.Errorf("Error getting credentials for user %s, %s", body.Username, err.Error())
+    errorResponse(w, statusForError(err), "couldn't check credentials, database error", codeForError(err))
+    return
+  }
+  if _, err := auth.Authenticate(body.OldPassword, hash); err != nil {
+    server.logger.Warnf("Failed password change for user %s", body.Username)
+    errorResponse(w, http.StatusUnauthorized, "invalid username or password", ERROR_CODE_INVALID_CREDENTIALS)
+    return
+  }
+  newHash, err := auth.HashPasswordWithSalt(body.NewPassword, server.hashCost)
+  if err != nil {
+    server.logger.Errorf("Error hashing password, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "hashing error", ERROR_CODE_INTERNAL)
+    return
+  }
+  if err := server.db.UpdateUserCredentials(ctx, body.Username, newHash); err != nil {
+    server.logger.Errorf("Error updating credentials for user %s, %s", body.Username, err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("couldn't change password: %s", err.Error()), codeForError(err))
+    return
+  }
+  // Success.
+  server.logger.Infof("User %s changed their password", body.Username)
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(map[string]string{
+    "username": body.Username,
+  }); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Parse POST request for /users/password.
+// Returns parsed values or error.
+func (server *ChatServer) parseChangePassword(r *http.Request) (*changePasswordStruct, error) {
+  var body changePasswordStruct
+  decoder := json.NewDecoder(r.Body)
+  if err := decoder.Decode(&body); err != nil {
+    return nil, bodyReadError(err, errors.New("bad POST request, could not parse"))
+  }
+  if len(body.Username) < 1 || len(body.OldPassword) < 1 {
+    return nil, errors.New("username and oldPassword are required")
+  }
+  if err := server.passwordPolicy.Validate(body.NewPassword); err != nil {
+    return nil, err
+  }
+  return &body, nil
+}
+
+// Deletes a user's account, for data deletion requests.
+// Expects a DELETE with the following parameters in the body:
+// - username
+// - password
+// Every message the user sent or received is deleted too, see
+// ChatStore.DeleteUser. Responds with a 401 if the username or password is
+// wrong.
+//
+// Sample curl request:
+// curl -d '{"username":"user1", "password":"super-secret"}' -H "Content-Type: application/json" -X DELETE localhost:18000/users
+func (server *ChatServer) deleteUser(w http.ResponseWriter, r *http.Request) {
+  // Same body as logging in.
+  username, password, err := server.parseLogin(r)
+  if err != nil {
+    status, code := statusForBodyError(err)
+    errorResponse(w, status, fmt.Sprintf("Error: %s", err.Error()), code)
+    return
+  }
+  server.logger.Debugf("Received DELETE at /users for user %s", username)
+  ctx, cancel := server.queryContext(r)
+  defer cancel()
+  hash, err := server.db.GetUserCredentials(ctx, username)
+  if errors.Is(err, ErrUserNotFound) {
+    server.logger.Warnf("Failed account deletion for unknown user %s", username)
+    // Same as login, don't reveal whether the username exists.
+    auth.AuthenticateDummy(password, server.hashCost)
+    errorResponse(w, http.StatusUnauthorized, "invalid username or password", ERROR_CODE_INVALID_CREDENTIALS)
+    return
+  }
+  if err != nil {
+    server.logger.Errorf("Error getting credentials for user %s, %s", username, err.Error())
+    errorResponse(w, statusForError(err), "couldn't check credentials, database error", codeForError(err))
+    return
+  }
+  if _, err := auth.Authenticate(password, hash); err != nil {
+    server.logger.Warnf("Failed account deletion for user %s", username)
+    errorResponse(w, http.StatusUnauthorized, "invalid username or password", ERROR_CODE_INVALID_CREDENTIALS)
+    return
+  }
+  if err := server.db.DeleteUser(ctx, username); err != nil {
+    server.logger.Errorf("Error deleting user %s, %s", username, err.Error())
+    errorResponse(w, statusForError(err), fmt.Sprintf("couldn't delete user: %s", err.Error()), codeForError(err))
+    return
+  }
+  // Success.
+  server.logger.Infof("User %s deleted", username)
+  w.WriteHeader(http.StatusOK)
+  if err := json.NewEncoder(w).Encode(map[string]string{
+    "username": username,
+  }); err != nil {
+    server.logger.Errorf("Error formatting http response, %s", err.Error())
+    errorResponse(w, http.StatusInternalServerError, "error generating response", ERROR_CODE_INTERNAL)
+  }
+}
+
+// Returns an error saying why the username can't be used for a new user.
+func (server *ChatServer) validateUsername(username string) error {
+  if len(username) < server.config.UsernameMinLength || len(username) > server.config.UsernameMaxLength {
+    return errors.New(fmt.Sprintf("username should be between %d and %d characters",
+                                  server.config.UsernameMinLength, server.config.UsernameMaxLength))
+  }
+  for _, c := range username {
+    alphanumeric := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_'
+    if server.config.UsernameAlphanumeric && !alphanumeric {
+      return errors.New("username may only contain letters, digits and underscores")
+    }
+    // Usernames go in query strings (e.g. GET /messages), so only allow
+    // characters that never need escaping there.
+    if !alphanumeric && !strings.ContainsRune(URL_SAFE_USERNAME_SYMBOLS, c) {
+      return errors.New(fmt.Sprintf("username may only contain letters, digits and any of %s", URL_SAFE_USERNAME_SYMBOLS))
+    }
+  }
+  // "." and ".." mean something else as path segments, e.g. in profile URLs.
+  if len(strings.Trim(username, ".")) == 0 {
+    return errors.New("username can't be only dots")
+  }
+  for _, reserved := range RESERVED_USERNAMES {
+    if strings.EqualFold(username, reserved) {
+      return errors.New(fmt.Sprintf("username %s is reserved", username))
+    }
+  }
+  return nil
+}
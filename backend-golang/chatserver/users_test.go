@@ -0,0 +1,223 @@
+package chatserver
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+
+  auth "app/chatauth"
+  "golang.org/x/crypto/bcrypt"
+)
+
+func TestCreatedUserCredentialsAuthenticate(t *testing.T) {
+  server, store := newTestServer(t)
+  createTestUser(t, server, "user1")
+  hash, err := store.GetUserCredentials(context.Background(), "user1")
+  if err != nil {
+    t.Fatalf("GetUserCredentials: %s", err.Error())
+  }
+  // The stored hash carries its own salt, so it's all Authenticate needs.
+  if _, err := auth.Authenticate(TEST_PASSWORD, hash); err != nil {
+    t.Errorf("stored hash doesn't authenticate the password: %s", err.Error())
+  }
+  if _, err := auth.Authenticate("wrong-password1", hash); err == nil {
+    t.Errorf("stored hash authenticates the wrong password")
+  }
+  w := doRequest(server, http.MethodPost, "/login", `{"username":"user1", "password":"` + TEST_PASSWORD + `"}`)
+  var body map[string]string
+  decodeResponse(t, w, http.StatusOK, &body)
+  if len(body["token"]) == 0 {
+    t.Errorf("login response has no token: %v", body)
+  }
+}
+
+func TestCheckUserExists(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUser(t, server, "user1")
+  for username, want := range map[string]bool{"user1": true, "user2": false} {
+    w := doRequest(server, http.MethodGet, "/users/exists?username=" + username, "")
+    var body map[string]bool
+    decodeResponse(t, w, http.StatusOK, &body)
+    if body["exists"] != want {
+      t.Errorf("%s: got exists %t, want %t", username, body["exists"], want)
+    }
+  }
+  w := doRequest(server, http.MethodGet, "/users/exists", "")
+  expectError(t, w, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+}
+
+func TestCheckUserExistsReportsDbErrors(t *testing.T) {
+  server := newBrokenTestServer(t)
+  // A db error mustn't look like a user that doesn't exist.
+  w := doRequest(server, http.MethodGet, "/users/exists?username=user1", "")
+  expectError(t, w, http.StatusInternalServerError, ERROR_CODE_INTERNAL)
+}
+
+func TestLoginReportsDbErrors(t *testing.T) {
+  server := newBrokenTestServer(t)
+  // An outage mustn't look like bad credentials.
+  expectError(t, loginTestUser(server, TEST_PASSWORD), http.StatusInternalServerError, ERROR_CODE_INTERNAL)
+  // Unknown users still get the usual 401.
+  server, _ = newTestServer(t)
+  expectError(t, loginTestUser(server, TEST_PASSWORD), http.StatusUnauthorized, ERROR_CODE_INVALID_CREDENTIALS)
+}
+
+func TestSetHashCost(t *testing.T) {
+  server, store := newTestServer(t)
+  if err := server.SetHashCost(bcrypt.MinCost + 1); err != nil {
+    t.Fatalf("SetHashCost: %s", err.Error())
+  }
+  for _, cost := range []int{bcrypt.MinCost - 1, bcrypt.MaxCost + 1} {
+    if err := server.SetHashCost(cost); err == nil {
+      t.Errorf("cost %d: got no error", cost)
+    }
+  }
+  // Rejected costs leave the last good one in place.
+  createTestUser(t, server, "user1")
+  hash, err := store.GetUserCredentials(context.Background(), "user1")
+  if err != nil {
+    t.Fatalf("GetUserCredentials: %s", err.Error())
+  }
+  if cost, err := bcrypt.Cost(hash); err != nil || cost != bcrypt.MinCost + 1 {
+    t.Errorf("user was hashed with cost %d (%v), want %d", cost, err, bcrypt.MinCost + 1)
+  }
+  w := doRequest(server, http.MethodPost, "/login", `{"username":"user1", "password":"` + TEST_PASSWORD + `"}`)
+  decodeResponse(t, w, http.StatusOK, nil)
+}
+
+// Asks to change user1's password and returns the response.
+func changeTestPassword(server *ChatServer, oldPassword string, newPassword string) *httptest.ResponseRecorder {
+  return doRequest(server, http.MethodPost, "/users/password", fmt.Sprintf(
+    `{"username":"user1", "oldPassword":%q, "newPassword":%q}`, oldPassword, newPassword))
+}
+
+// Logs user1 in with the password and returns the response.
+func loginTestUser(server *ChatServer, password string) *httptest.ResponseRecorder {
+  return doRequest(server, http.MethodPost, "/login", fmt.Sprintf(`{"username":"user1", "password":%q}`, password))
+}
+
+func TestChangePassword(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUser(t, server, "user1")
+  w := changeTestPassword(server, TEST_PASSWORD, "even-more-secret2")
+  var body map[string]string
+  decodeResponse(t, w, http.StatusOK, &body)
+  if body["username"] != "user1" {
+    t.Errorf("got %v, want the username", body)
+  }
+  // Only the new password works from now on.
+  decodeResponse(t, loginTestUser(server, "even-more-secret2"), http.StatusOK, nil)
+  expectError(t, loginTestUser(server, TEST_PASSWORD), http.StatusUnauthorized, ERROR_CODE_INVALID_CREDENTIALS)
+}
+
+func TestChangePasswordWrongOldPassword(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUser(t, server, "user1")
+  w := changeTestPassword(server, "wrong-password1", "even-more-secret2")
+  expectError(t, w, http.StatusUnauthorized, ERROR_CODE_INVALID_CREDENTIALS)
+  // A user that doesn't exist gets the same response.
+  w = doRequest(server, http.MethodPost, "/users/password",
+                `{"username":"nobody", "oldPassword":"wrong-password1", "newPassword":"even-more-secret2"}`)
+  expectError(t, w, http.StatusUnauthorized, ERROR_CODE_INVALID_CREDENTIALS)
+  // The password is unchanged.
+  decodeResponse(t, loginTestUser(server, TEST_PASSWORD), http.StatusOK, nil)
+}
+
+func TestCredentialChecksReportDbErrors(t *testing.T) {
+  server := newBrokenTestServer(t)
+  expectError(t, changeTestPassword(server, TEST_PASSWORD, "even-more-secret2"), http.StatusInternalServerError, ERROR_CODE_INTERNAL)
+  w := doRequest(server, http.MethodDelete, "/users", `{"username":"user1", "password":"` + TEST_PASSWORD + `"}`)
+  expectError(t, w, http.StatusInternalServerError, ERROR_CODE_INTERNAL)
+}
+
+func TestDeleteUserWrongCredentials(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUser(t, server, "user1")
+  for _, body := range []string{
+    `{"username":"user1", "password":"wrong-password1"}`,
+    `{"username":"nobody", "password":"` + TEST_PASSWORD + `"}`,
+  } {
+    w := doRequest(server, http.MethodDelete, "/users", body)
+    expectError(t, w, http.StatusUnauthorized, ERROR_CODE_INVALID_CREDENTIALS)
+  }
+  w := doRequest(server, http.MethodDelete, "/users", `{"username":"user1", "password":"` + TEST_PASSWORD + `"}`)
+  decodeResponse(t, w, http.StatusOK, nil)
+  expectError(t, loginTestUser(server, TEST_PASSWORD), http.StatusUnauthorized, ERROR_CODE_INVALID_CREDENTIALS)
+}
+
+func TestChangePasswordRejectsBadNewPasswords(t *testing.T) {
+  server, _ := newTestServer(t)
+  createTestUser(t, server, "user1")
+  for name, newPassword := range map[string]string{
+    "too short": "short1",
+    "too long": strings.Repeat("a1", 37),
+  } {
+    t.Run(name, func(t *testing.T) {
+      expectError(t, changeTestPassword(server, TEST_PASSWORD, newPassword), http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+    })
+  }
+  decodeResponse(t, loginTestUser(server, TEST_PASSWORD), http.StatusOK, nil)
+}
+
+func TestCreateUserRejectsWeakPasswords(t *testing.T) {
+  server, _ := newTestServer(t)
+  for password, reason := range map[string]string{
+    "abc1": "at least 8 characters",
+    "1234567890": "mix at least two",
+  } {
+    w := doRequest(server, http.MethodPost, "/users", fmt.Sprintf(`{"username":"user1", "password":%q}`, password))
+    var body errorBody
+    decodeResponse(t, w, http.StatusBadRequest, &body)
+    // Clients are told what's wrong with it.
+    if !strings.Contains(body.Error.Message, reason) {
+      t.Errorf("%q: got message %q, want one saying %q", password, body.Error.Message, reason)
+    }
+  }
+  if testUserExists(t, server, "user1") {
+    t.Errorf("user was created with a weak password")
+  }
+}
+
+func TestCreateUserRejectsUnsafeUsernames(t *testing.T) {
+  server, _ := newTestServer(t)
+  for _, username := range []string{"a&b", "a=b", "a b", "a+b", "a%20b", "a/b", "a?b", "a#b", "..", "exists", "Password"} {
+    w := doRequest(server, http.MethodPost, "/users", fmt.Sprintf(`{"username":%q, "password":%q}`, username, TEST_PASSWORD))
+    if w.Code != http.StatusBadRequest {
+      t.Errorf("%q: got status %d, want %d", username, w.Code, http.StatusBadRequest)
+    }
+  }
+}
+
+func TestFetchMessagesWithAdversarialUsernames(t *testing.T) {
+  server, store := newTestServer(t)
+  // Usernames with every symbol that's allowed go in queries unescaped.
+  createTestUser(t, server, "a.b-c~d_e")
+  createTestUser(t, server, "user1")
+  sendTestMessage(t, server, "a.b-c~d_e", "user1", "Hi there!")
+  if messages := fetchTestMessages(t, server, "a.b-c~d_e", "user1"); len(messages) != 1 {
+    t.Errorf("got %d messages with a.b-c~d_e, want 1", len(messages))
+  }
+  // Users from before usernames were checked can still be fetched, as long
+  // as the client escapes them.
+  ctx := context.Background()
+  createStoreUsers(t, store, "a&b=c", "x y+z")
+  if _, err := store.AddMessage(ctx, "a&b=c", "x y+z", MESSAGE_TYPE_PLAINTEXT, "Hi there!", nil, 0); err != nil {
+    t.Fatalf("AddMessage: %s", err.Error())
+  }
+  w := doRequest(server, http.MethodGet, "/messages?sender=" + url.QueryEscape("a&b=c") +
+                 "&recipient=" + url.QueryEscape("x y+z"), "")
+  var messages []*Message
+  decodeResponse(t, w, http.StatusOK, &messages)
+  if len(messages) != 1 || messages[0].Sender != "a&b=c" || messages[0].Recipient != "x y+z" {
+    t.Errorf("got %+v, want the one message between a&b=c and x y+z", messages)
+  }
+  // Unescaped, the & cuts the sender short at "a", who doesn't exist.
+  w = doRequest(server, http.MethodGet, "/messages?sender=a&b=c&recipient=user1", "")
+  expectError(t, w, http.StatusNotFound, ERROR_CODE_USER_NOT_FOUND)
+  w = doRequest(server, http.MethodGet, "/messages?sender=a%zz&recipient=user1", "")
+  expectError(t, w, http.StatusBadRequest, ERROR_CODE_BAD_REQUEST)
+}
@@ -0,0 +1,272 @@
+package chatserver
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "sync"
+  "time"
+
+  "github.com/gorilla/websocket"
+)
+
+// Event types pushed to clients over WebSockets.
+const SOCKET_EVENT_MESSAGE = "message"
+const SOCKET_EVENT_TYPING = "typing"
+
+// Typing indicators from a connection to the same user are relayed at most
+// this often, so rapid keystrokes don't flood the recipient.
+const TYPING_DEBOUNCE = 2 * time.Second
+
+// How long a write to a socket may take before the client is considered gone.
+const SOCKET_WRITE_TIMEOUT = 10 * time.Second
+// Largest frame we accept from a client.
+const SOCKET_MAX_READ_BYTES = 4096
+
+// Returns an upgrader for HTTP connections at /ws. Browsers must connect
+// from one of the allowed origins, the same as for the rest of the API.
+// Clients that send no Origin, i.e. anything but a browser, are let through.
+func (server *ChatServer) newUpgrader() *websocket.Upgrader {
+  return &websocket.Upgrader{
+    ReadBufferSize: 1024,
+    WriteBufferSize: 1024,
+    CheckOrigin: func(r *http.Request) bool {
+      origin := r.Header.Get("Origin")
+      return len(origin) == 0 || server.originAllowed(origin)
+    },
+    // Failed upgrades get the same JSON errors as other endpoints.
+    Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+      code := ERROR_CODE_BAD_REQUEST
+      switch status {
+      case http.StatusMethodNotAllowed:
+        code = ERROR_CODE_METHOD_NOT_ALLOWED
+      case http.StatusForbidden:
+        code = ERROR_CODE_ORIGIN_NOT_ALLOWED
+      }
+      errorResponse(w, status, fmt.Sprintf("bad request at /ws, %s", reason.Error()), code)
+    },
+  }
+}
+
+// Defines an event pushed to a client over its WebSocket.
+type socketEvent struct {
+  Type    string   `json:"type"`
+  Message *Message `json:"message,omitempty"`
+  // Who is typing, for typing events.
+  From    string   `json:"from,omitempty"`
+}
+
+// Defines an event sent by a client over its WebSocket.
+type clientEvent struct {
+  Type string `json:"type"`
+  // Who the client is typing to, for typing events.
+  To   string `json:"to"`
+}
+
+// A single WebSocket connection for a user.
+// gorilla/websocket allows only one concurrent writer per connection, so
+// writes are serialized with a mutex.
+type socketClient struct {
+  conn *websocket.Conn
+  writeMutex sync.Mutex
+  // When a typing event was last relayed to each recipient. Only touched by
+  // the connection's read loop.
+  lastTyping map[string]time.Time
+}
+
+// Writes the event to the client as JSON.
+func (client *socketClient) send(event *socketEvent) error {
+  client.writeMutex.Lock()
+  defer client.writeMutex.Unlock()
+  client.conn.SetWriteDeadline(time.Now().Add(SOCKET_WRITE_TIMEOUT))
+  return client.conn.WriteJSON(event)
+}
+
+// Request handler for /ws.
+// Expects a GET with the following query parameters:
+// - username: user to receive new messages for
+//
+// Once connected, the client receives {"type":"message","message":{...}}
+// whenever a message is sent to the user. A user may have several
+// connections open at once (e.g. multiple tabs), and each receives the push.
+//
+// The client can send {"type":"typing","to":"user2"} while the user types,
+// which is relayed to user2's connections as {"type":"typing","from":...}.
+// Typing events aren't stored, and are dropped if user2 isn't connected.
+func (server *ChatServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+  username := r.URL.Query().Get("username")
+  if len(username) < 1 {
+    errorResponse(w, http.StatusBadRequest, "bad request at /ws, username is required", ERROR_CODE_BAD_REQUEST)
+    return
+  }
+  ctx, cancel := server.queryContext(r)
+  _, err := server.db.GetUserCredentials(ctx, username)
+  cancel()
+  if err != nil {
+    errorResponse(w, statusForError(err), fmt.Sprintf("bad request at /ws, %s", err.Error()), codeForError(err))
+    return
+  }
+  conn, err := server.upgrader.Upgrade(w, r, nil)
+  if err != nil {
+    // Upgrade already responded to the client.
+    server.logger.Errorf("Error upgrading connection for %s: %s", username, err.Error())
+    return
+  }
+  client := &socketClient{conn: conn, lastTyping: make(map[string]time.Time)}
+  server.addSocket(username, client)
+  server.logger.Infof("WebSocket connected for %s", username)
+
+  // Read until the client goes away, then clean up.
+  conn.SetReadLimit(SOCKET_MAX_READ_BYTES)
+  for {
+    _, data, err := conn.ReadMessage()
+    if err != nil {
+      break
+    }
+    server.handleClientEvent(username, client, data)
+  }
+  server.removeSocket(username, client)
+  conn.Close()
+  server.logger.Infof("WebSocket disconnected for %s", username)
+}
+
+// Handles an event sent by the user over one of their connections.
+// Malformed and unknown events are ignored.
+func (server *ChatServer) handleClientEvent(username string, client *socketClient, data []byte) {
+  var event clientEvent
+  if err := json.Unmarshal(data, &event); err != nil {
+    server.logger.Warnf("Ignoring malformed WebSocket event from %s", username)
+    return
+  }
+  switch event.Type {
+  case SOCKET_EVENT_TYPING:
+    if len(event.To) < 1 || userIdKey(event.To) == userIdKey(username) {
+      return
+    }
+    now := time.Now()
+    if now.Sub(client.lastTyping[userIdKey(event.To)]) < TYPING_DEBOUNCE {
+      return
+    }
+    client.lastTyping[userIdKey(event.To)] = now
+    // Typing events follow the same rule as direct messages, but are dropped
+    // silently so the sender can't tell they've been blocked. Events to users
+    // that don't exist are dropped too.
+    ctx, cancel := context.WithTimeout(context.Background(), server.config.QueryTimeout)
+    defer cancel()
+    blocked, err := server.db.IsBlocked(ctx, event.To, username)
+    if err != nil {
+      if !errors.Is(err, ErrUserNotFound) {
+        server.logger.Errorf("Error checking whether %s blocked %s: %s", event.To, username, err.Error())
+      }
+      return
+    }
+    if blocked {
+      return
+    }
+    server.pushEvent(event.To, &socketEvent{Type: SOCKET_EVENT_TYPING, From: username})
+  default:
+    server.logger.Warnf("Ignoring unknown WebSocket event %q from %s", event.Type, username)
+  }
+}
+
+// Registers a connection for the user. Connections are keyed like user ids,
+// since usernames are case insensitive.
+func (server *ChatServer) addSocket(username string, client *socketClient) {
+  server.socketsMutex.Lock()
+  defer server.socketsMutex.Unlock()
+  key := userIdKey(username)
+  if server.sockets[key] == nil {
+    server.sockets[key] = make(map[*socketClient]bool)
+  }
+  server.sockets[key][client] = true
+}
+
+// Unregisters a connection for the user.
+func (server *ChatServer) removeSocket(username string, client *socketClient) {
+  server.socketsMutex.Lock()
+  defer server.socketsMutex.Unlock()
+  key := userIdKey(username)
+  delete(server.sockets[key], client)
+  if len(server.sockets[key]) == 0 {
+    delete(server.sockets, key)
+  }
+}
+
+// Returns the user's current connections, however the username is cased.
+func (server *ChatServer) socketsFor(username string) []*socketClient {
+  server.socketsMutex.Lock()
+  defer server.socketsMutex.Unlock()
+  key := userIdKey(username)
+  clients := make([]*socketClient, 0, len(server.sockets[key]))
+  for client := range server.sockets[key] {
+    clients = append(clients, client)
+  }
+  return clients
+}
+
+// Closes every open connection. Their read loops then unregister them.
+func (server *ChatServer) closeSockets() {
+  server.socketsMutex.Lock()
+  defer server.socketsMutex.Unlock()
+  for _, clients := range server.sockets {
+    for client := range clients {
+      client.conn.Close()
+    }
+  }
+}
+
+// Pushes a newly stored message to all of the recipient's connections, or
+// for room messages, to every other member of the room.
+// Does nothing for recipients that aren't connected. Direct messages that
+// reach the recipient are marked delivered.
+func (server *ChatServer) notifyRecipient(message *Message) {
+  recipients := []string{message.Recipient}
+  if message.RoomID != nil {
+    // This runs after the response is sent, so there's no request to cancel
+    // the lookup with.
+    ctx, cancel := context.WithTimeout(context.Background(), server.config.QueryTimeout)
+    defer cancel()
+    room, err := server.db.GetRoom(ctx, *message.RoomID)
+    if err != nil {
+      server.logger.Errorf("Error looking up members of room %d: %s", *message.RoomID, err.Error())
+      return
+    }
+    recipients = nil
+    for _, member := range room.Members {
+      if userIdKey(member) != userIdKey(message.Sender) {
+        recipients = append(recipients, member)
+      }
+    }
+  }
+  delivered := 0
+  for _, recipient := range recipients {
+    delivered += server.pushEvent(recipient, &socketEvent{Type: SOCKET_EVENT_MESSAGE, Message: message})
+  }
+  // A direct message pushed to any of the recipient's connections has
+  // reached one of their devices.
+  if message.RoomID == nil && delivered > 0 {
+    ctx, cancel := context.WithTimeout(context.Background(), server.config.QueryTimeout)
+    defer cancel()
+    if err := server.db.UpdateMessageStatus(ctx, message.ID, MESSAGE_STATUS_DELIVERED); err != nil &&
+       !errors.Is(err, ErrMessageStatusRegression) {
+      server.logger.Errorf("Error marking message %d delivered: %s", message.ID, err.Error())
+    }
+  }
+}
+
+// Pushes the event to all of the user's connections, returning how many it
+// reached. Does nothing if the user isn't connected.
+func (server *ChatServer) pushEvent(username string, event *socketEvent) (sent int) {
+  for _, client := range server.socketsFor(username) {
+    if err := client.send(event); err != nil {
+      // The read loop notices the broken connection and unregisters it.
+      server.logger.Errorf("Error pushing %s event to %s: %s", event.Type, username, err.Error())
+      client.conn.Close()
+      continue
+    }
+    sent++
+  }
+  return sent
+}
@@ -0,0 +1,213 @@
+package chatserver
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/gorilla/websocket"
+)
+
+// How long tests wait for an event that should arrive.
+const TEST_SOCKET_TIMEOUT = 2 * time.Second
+// How long tests wait to be sure an event doesn't arrive.
+const TEST_SOCKET_QUIET = 200 * time.Millisecond
+
+// Serves the server over a real connection until the test ends, since
+// WebSockets can't be recorded.
+func newTestHTTPServer(t *testing.T, server *ChatServer) *httptest.Server {
+  t.Helper()
+  httpServer := httptest.NewServer(server)
+  t.Cleanup(httpServer.Close)
+  return httpServer
+}
+
+// Returns the URL to open a WebSocket for the user at.
+func testSocketURL(httpServer *httptest.Server, username string) string {
+  return "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws?username=" + username
+}
+
+// Opens a WebSocket for the user and waits until the server has registered
+// it, so nothing pushed afterwards is missed.
+func dialTestSocket(t *testing.T, server *ChatServer, httpServer *httptest.Server, username string) *websocket.Conn {
+  t.Helper()
+  url := testSocketURL(httpServer, username)
+  conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+  if err != nil {
+    t.Fatalf("Dial %s: %s", url, err.Error())
+  }
+  t.Cleanup(func() { conn.Close() })
+  deadline := time.Now().Add(TEST_SOCKET_TIMEOUT)
+  for len(server.socketsFor(username)) == 0 {
+    if time.Now().After(deadline) {
+      t.Fatalf("socket for %s was never registered", username)
+    }
+    time.Sleep(time.Millisecond)
+  }
+  return conn
+}
+
+// Reads the next event from the socket, failing the test if none arrives.
+func readTestEvent(t *testing.T, conn *websocket.Conn) *socketEvent {
+  t.Helper()
+  conn.SetReadDeadline(time.Now().Add(TEST_SOCKET_TIMEOUT))
+  var event socketEvent
+  if err := conn.ReadJSON(&event); err != nil {
+    t.Fatalf("no event received: %s", err.Error())
+  }
+  return &event
+}
+
+// Fails the test if an event arrives on the socket. The connection can't be
+// read from afterwards.
+func expectNoEvent(t *testing.T, conn *websocket.Conn) {
+  t.Helper()
+  conn.SetReadDeadline(time.Now().Add(TEST_SOCKET_QUIET))
+  var event socketEvent
+  if err := conn.ReadJSON(&event); err == nil {
+    t.Fatalf("got unexpected event %+v", event)
+  }
+}
+
+func TestWebSocketPushesMessagesToRecipient(t *testing.T) {
+  server, _ := newTestServer(t)
+  httpServer := newTestHTTPServer(t, server)
+  createTestUser(t, server, "user1")
+  createTestUser(t, server, "user2")
+  recipientConn := dialTestSocket(t, server, httpServer, "user1")
+  senderConn := dialTestSocket(t, server, httpServer, "user2")
+
+  sent := sendTestMessage(t, server, "user2", "user1", "Hi there!")
+  event := readTestEvent(t, recipientConn)
+  if event.Type != SOCKET_EVENT_MESSAGE || event.Message == nil {
+    t.Fatalf("got %+v, want a message event", event)
+  }
+  if event.Message.ID != sent.ID || event.Message.Content != "Hi there!" || event.Message.Sender != "user2" {
+    t.Errorf("got message %+v, want %+v", event.Message, sent)
+  }
+  // The sender isn't the recipient, so their socket gets nothing.
+  expectNoEvent(t, senderConn)
+}
+
+func TestWebSocketUnregistersClosedConnections(t *testing.T) {
+  server, _ := newTestServer(t)
+  httpServer := newTestHTTPServer(t, server)
+  createTestUser(t, server, "user1")
+  conn := dialTestSocket(t, server, httpServer, "user1")
+  conn.Close()
+  deadline := time.Now().Add(TEST_SOCKET_TIMEOUT)
+  for len(server.socketsFor("user1")) > 0 {
+    if time.Now().After(deadline) {
+      t.Fatalf("closed socket is still registered")
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+func TestWebSocketRejectsUnknownUsers(t *testing.T) {
+  server, _ := newTestServer(t)
+  httpServer := newTestHTTPServer(t, server)
+  url := testSocketURL(httpServer, "nobody")
+  _, response, err := websocket.DefaultDialer.Dial(url, nil)
+  if err == nil {
+    t.Fatalf("Dial succeeded for a user that doesn't exist")
+  }
+  if response == nil || response.StatusCode != http.StatusNotFound {
+    t.Errorf("got response %+v, want a 404", response)
+  }
+}
+
+func TestWebSocketRelaysTypingEvents(t *testing.T) {
+  server, _ := newTestServer(t)
+  httpServer := newTestHTTPServer(t, server)
+  createTestUsers(t, server)
+  recipientConn := dialTestSocket(t, server, httpServer, "user1")
+  senderConn := dialTestSocket(t, server, httpServer, "user2")
+
+  if err := senderConn.WriteJSON(&clientEvent{Type: SOCKET_EVENT_TYPING, To: "user1"}); err != nil {
+    t.Fatalf("WriteJSON: %s", err.Error())
+  }
+  event := readTestEvent(t, recipientConn)
+  if event.Type != SOCKET_EVENT_TYPING || event.From != "user2" || event.Message != nil {
+    t.Errorf("got %+v, want a typing event from user2", event)
+  }
+  // Another event right away is debounced.
+  if err := senderConn.WriteJSON(&clientEvent{Type: SOCKET_EVENT_TYPING, To: "user1"}); err != nil {
+    t.Fatalf("WriteJSON: %s", err.Error())
+  }
+  expectNoEvent(t, recipientConn)
+  // Typing events aren't stored.
+  if messages := fetchTestMessages(t, server, "user1", "user2"); len(messages) != 0 {
+    t.Errorf("got %d stored messages, want none", len(messages))
+  }
+}
+
+func TestWebSocketDropsTypingEvents(t *testing.T) {
+  server, _ := newTestServer(t)
+  httpServer := newTestHTTPServer(t, server)
+  createTestUsers(t, server)
+  createTestUser(t, server, "user3")
+  w := doRequest(server, http.MethodPost, "/users/block", `{"blocker":"user1", "blocked":"user2"}`)
+  decodeResponse(t, w, http.StatusOK, nil)
+  recipientConn := dialTestSocket(t, server, httpServer, "user1")
+  senderConn := dialTestSocket(t, server, httpServer, "user2")
+  // Blocked senders, recipients that aren't connected or don't exist, and
+  // yourself all get dropped without a word.
+  for _, to := range []string{"user1", "user3", "nobody", "user2"} {
+    if err := senderConn.WriteJSON(&clientEvent{Type: SOCKET_EVENT_TYPING, To: to}); err != nil {
+      t.Fatalf("WriteJSON: %s", err.Error())
+    }
+  }
+  expectNoEvent(t, recipientConn)
+  expectNoEvent(t, senderConn)
+}
+
+func TestWebSocketChecksOrigin(t *testing.T) {
+  server, _ := newTestServer(t)
+  httpServer := newTestHTTPServer(t, server)
+  createTestUser(t, server, "user1")
+  url := testSocketURL(httpServer, "user1")
+  // The frontend is on another port, but it's in the allowlist.
+  conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://localhost:13000"}})
+  if err != nil {
+    t.Fatalf("Dial from an allowed origin: %s", err.Error())
+  }
+  conn.Close()
+  _, response, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.com"}})
+  if err == nil {
+    t.Fatalf("Dial succeeded from an origin that isn't allowed")
+  }
+  if response == nil || response.StatusCode != http.StatusForbidden {
+    t.Errorf("got response %+v, want a 403", response)
+  }
+}
+
+func TestSocketsAreKeyedCaseInsensitively(t *testing.T) {
+  server, _ := newTestServer(t)
+  client := &socketClient{}
+  server.addSocket("Alice", client)
+  for _, username := range []string{"Alice", "alice", "ALICE"} {
+    if clients := server.socketsFor(username); len(clients) != 1 || clients[0] != client {
+      t.Errorf("%s: got %d sockets, want Alice's one", username, len(clients))
+    }
+  }
+  server.removeSocket("aLiCe", client)
+  if clients := server.socketsFor("Alice"); len(clients) != 0 {
+    t.Errorf("got %d sockets after removing Alice's, want none", len(clients))
+  }
+}
+
+func TestSQLWebSocketUsernamesAreCaseInsensitive(t *testing.T) {
+  // The memory store's usernames are case sensitive, the db's aren't.
+  server := newTestServerWithStore(t, newTestSQLClient(t), DefaultConfig())
+  httpServer := newTestHTTPServer(t, server)
+  createTestUsers(t, server)
+  conn := dialTestSocket(t, server, httpServer, "USER1")
+  sent := sendTestMessage(t, server, "user2", "user1", "Hi there!")
+  event := readTestEvent(t, conn)
+  if event.Type != SOCKET_EVENT_MESSAGE || event.Message == nil || event.Message.ID != sent.ID {
+    t.Errorf("got %+v, want the message sent to user1", event)
+  }
+}
@@ -1,9 +1,30 @@
 package main
 
-import "app/chatserver"
+import (
+	"os"
 
-// Entry point for our backend. Simply starts up the server.
+	"app/chatserver"
+)
+
+// Entry point for our backend. Connects to the db and starts up the server.
+// Settings are read from the environment, see chatserver.ConfigFromEnv.
 func main() {
-	server := new(chatserver.ChatServer)
+	config, err := chatserver.ConfigFromEnv()
+	if err != nil {
+		chatserver.NewLogger(chatserver.DEFAULT_LOG_LEVEL).Errorf("invalid config: %s", err.Error())
+		os.Exit(1)
+	}
+	logger := chatserver.NewLogger(config.LogLevel)
+	db, err := chatserver.NewChatSqlClient(chatserver.DRIVER_NAME, config.DataSourceName, config.Pool, logger)
+	if err != nil {
+		logger.Errorf("unable to connect to DB: %s", err.Error())
+		os.Exit(1)
+	}
+	server, err := chatserver.NewChatServer(db, config)
+	if err != nil {
+		logger.Errorf("invalid config: %s", err.Error())
+		os.Exit(1)
+	}
+	server.SetLogger(logger)
 	server.Start()
 }